@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var (
+	adminPluginsMux sync.Mutex
+	adminPlugins    []*NvidiaDevicePlugin
+)
+
+// adminToken is the bearer token of --admin-token-file, the POST requests of the admin API
+// are refused without it
+var adminToken string
+
+// readAdminToken reads the bearer token of the admin API from the file
+func readAdminToken(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	adminToken = strings.TrimSpace(string(data))
+	if adminToken == "" {
+		return fmt.Errorf("%s is empty", path)
+	}
+	return nil
+}
+
+// adminPost guards a request of the admin API changing the state of the plugin: only POST is
+// allowed, with the bearer token of --admin-token-file. The admin API shares --metrics-address
+// with the metrics, which anyone reaching the node can scrape.
+func adminPost(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if adminToken == "" {
+			http.Error(w, "the admin API is disabled, set --admin-token-file", http.StatusForbidden)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nvidia-device-plugin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// setAdminPlugins sets the plugins the admin API operates on
+func setAdminPlugins(plugins []*NvidiaDevicePlugin) {
+	adminPluginsMux.Lock()
+	defer adminPluginsMux.Unlock()
+	adminPlugins = plugins
+}
+
+func getAdminPlugins() []*NvidiaDevicePlugin {
+	adminPluginsMux.Lock()
+	defer adminPluginsMux.Unlock()
+	return adminPlugins
+}
+
+// registerAdminHandlers adds the admin API to httpMux
+func registerAdminHandlers() {
+	httpMux.HandleFunc("/admin/healthy", adminPost(serveForceHealthy))
+	httpMux.HandleFunc("/admin/history", serveUsageHistory)
+	if enableFaultInjectionFlag {
+		httpMux.HandleFunc("/admin/faults", serveFaults)
+	}
+	if deviceConfigFileFlag {
+		httpMux.HandleFunc("/admin/device-configs", serveDeviceConfigs)
+	}
+}
+
+// probeDevice checks that NVML can reach a device and query its status
+func probeDevice(uuid string) error {
+	gpu, _, _, err := nvml.ParseMigDeviceUUID(uuid)
+	if err != nil {
+		gpu = uuid
+	}
+	d, err := nvml.NewDeviceLiteByUUID(gpu)
+	if err != nil {
+		return err
+	}
+	_, err = d.Status()
+	return err
+}
+
+// reinstate marks the device healthy again; it returns false if the plugin does not serve it
+func (m *NvidiaDevicePlugin) reinstate(uuid string) bool {
+	for _, d := range m.cachedDevices {
+		if d.ID != uuid {
+			continue
+		}
+		select {
+		case m.health <- &DeviceHealth{Device: d, Health: pluginapi.Healthy, Reason: "reinstated by admin"}:
+		case <-time.After(5 * time.Second):
+			log.Printf("Error: timed out reinstating %s for '%s'", uuid, m.resourceName)
+		}
+		return true
+	}
+	return false
+}
+
+// serveForceHealthy handles POST /admin/healthy?uuid=<uuid>, re-probing the
+// device and reinstating its vDevices if the probe passes
+func serveForceHealthy(w http.ResponseWriter, r *http.Request) {
+	uuid := r.URL.Query().Get("uuid")
+	if uuid == "" {
+		http.Error(w, "missing uuid", http.StatusBadRequest)
+		return
+	}
+	if err := probeDevice(uuid); err != nil {
+		http.Error(w, fmt.Sprintf("probe of %s failed: %v", uuid, err), http.StatusConflict)
+		return
+	}
+	found := false
+	for _, p := range getAdminPlugins() {
+		if p.reinstate(uuid) {
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("unknown device: %s", uuid), http.StatusNotFound)
+		return
+	}
+	log.Printf("Device %s reinstated by admin request", uuid)
+	fmt.Fprintf(w, "%s reinstated\n", uuid)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// allocateCacheTTL is how long a response is returned again for the same devices. The kubelet
+// retries a failed or timed out Allocate within its pod admission, well within this time.
+const allocateCacheTTL = time.Minute
+
+// cachedAllocation is a response, the pod it was computed for, empty if unknown, and the time it was computed
+type cachedAllocation struct {
+	response *pluginapi.AllocateResponse
+	pod      types.UID
+	at       time.Time
+}
+
+// allocateCache remembers the recent responses of Allocate by pod and requested devices, so that
+// a request retried by the kubelet gets the same vDevices instead of acquiring others. Requests of
+// unknown pods are cached by their devices alone: a retried request is one whose response did not
+// reach the kubelet, so its devices are not in the kubelet checkpoint yet. Once they are there
+// under another pod, the entry belonged to an admitted pod and a new pod getting the same devices
+// must not get the shared cache and limits of the previous one.
+type allocateCache struct {
+	mux     sync.Mutex
+	entries map[string]cachedAllocation
+}
+
+// allocateKey identifies a request by the sorted device IDs of each of its containers
+func allocateKey(reqs *pluginapi.AllocateRequest) string {
+	var containers []string
+	for _, req := range reqs.ContainerRequests {
+		ids := append([]string(nil), req.DevicesIDs...)
+		sort.Strings(ids)
+		containers = append(containers, strings.Join(ids, annSep))
+	}
+	return strings.Join(containers, ";")
+}
+
+// podAllocateKey identifies a request of a pod, or of an unknown pod if empty
+func podAllocateKey(reqs *pluginapi.AllocateRequest, pod types.UID) string {
+	return string(pod) + "/" + allocateKey(reqs)
+}
+
+// get returns the response computed recently for the same request of the pod, or nil. The
+// entry is dropped if the kubelet checkpoint, read by checkpoint, assigns one of its devices to
+// another pod.
+func (c *allocateCache) get(reqs *pluginapi.AllocateRequest, pod types.UID, checkpoint func() (map[string]deviceAssignment, error)) *pluginapi.AllocateResponse {
+	key := podAllocateKey(reqs, pod)
+	c.mux.Lock()
+	entry, ok := c.entries[key]
+	c.mux.Unlock()
+	if !ok || time.Since(entry.at) > allocateCacheTTL {
+		return nil
+	}
+	assignments, err := checkpoint()
+	if err != nil {
+		log.Printf("Warning: not reusing the previous response of Allocate for %s: %v", allocateKey(reqs), err)
+		return nil
+	}
+	for _, req := range reqs.ContainerRequests {
+		for _, id := range req.DevicesIDs {
+			if a, ok := assignments[id]; ok && types.UID(a.podUID) != entry.pod {
+				c.mux.Lock()
+				delete(c.entries, key)
+				c.mux.Unlock()
+				return nil
+			}
+		}
+	}
+	return entry.response
+}
+
+// put remembers the response of a request of the pod, dropping the expired ones
+func (c *allocateCache) put(reqs *pluginapi.AllocateRequest, pod types.UID, response *pluginapi.AllocateResponse) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedAllocation)
+	}
+	for k, entry := range c.entries {
+		if time.Since(entry.at) > allocateCacheTTL {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[podAllocateKey(reqs, pod)] = cachedAllocation{response: response, pod: pod, at: time.Now()}
+}
+
+// reset forgets the responses, whose vDevices are unknown to a new vDevice controller
+func (c *allocateCache) reset() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries = nil
+}
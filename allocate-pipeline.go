@@ -0,0 +1,473 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Names of the built-in allocation stages, in the order they run
+const (
+	stageIdentifyPod    = "identify-pod"
+	stageSelectVDevices = "select-vdevices"
+	stageComputeLimits  = "compute-limits"
+	stageInject         = "inject"
+	stageWebhook        = "webhook"
+	stageRecord         = "record"
+)
+
+// allocateRequest is the state shared by the containers of an Allocate call
+type allocateRequest struct {
+	ctx      context.Context
+	plugin   *NvidiaDevicePlugin
+	requests []*pluginapi.ContainerAllocateRequest
+	pod      v1.Pod
+	// podResolved is set when Allocate looked the pod up before running the stages
+	podResolved bool
+	quota       *namespaceQuota
+	selector    *gpuSelector
+	// granted are the annMemoryGranted entries of the containers allocated so far
+	granted []string
+	// addnum is the number of containers without the resource skipped so far
+	addnum int
+	// using are the vDevices allocated to each container so far
+	using [][]string
+	// replay are the vDevices to allocate to each container instead of selecting them, set
+	// when replaying a golden file
+	replay [][]string
+	// dryRun is set by the startup self-test: stages must not change any state nor reach
+	// the kubelet, the API server or external services
+	dryRun bool
+}
+
+// containerAllocation is the state of the allocation of one container, passed through the stages
+type containerAllocation struct {
+	*allocateRequest
+	index     int
+	request   *pluginapi.ContainerAllocateRequest
+	container string
+	// deviceIDs are the vDevices actually allocated, which may differ from the requested ones
+	deviceIDs    []string
+	vdevices     []*VDevice
+	uuids        []string
+	memoryLimits []uint64
+	response     *pluginapi.ContainerAllocateResponse
+}
+
+// first returns true for the first container of the Allocate call
+func (a *containerAllocation) first() bool {
+	return a.index == 0
+}
+
+// last returns true for the last container of the Allocate call
+func (a *containerAllocation) last() bool {
+	return a.index == len(a.requests)-1
+}
+
+// allocateStage is a step of the allocation of a container. Stages run in order for each
+// container; an error aborts the whole Allocate call.
+type allocateStage struct {
+	name string
+	run  func(a *containerAllocation) error
+}
+
+var allocateStages = []allocateStage{
+	{stageIdentifyPod, identifyPodStage},
+	{stageSelectVDevices, selectVDevicesStage},
+	{stageComputeLimits, computeLimitsStage},
+	{stageInject, injectStage},
+	{stageWebhook, webhookStage},
+	{stageRecord, recordStage},
+}
+
+// registerAllocateStage adds a stage running right after the stage named after, or last if
+// after is empty. Call it from an init function to extend Allocate without patching server.go.
+func registerAllocateStage(name string, after string, run func(a *containerAllocation) error) {
+	stage := allocateStage{name: name, run: run}
+	if after == "" {
+		allocateStages = append(allocateStages, stage)
+		return
+	}
+	for i, s := range allocateStages {
+		if s.name == after {
+			allocateStages = append(allocateStages[:i+1], append([]allocateStage{stage}, allocateStages[i+1:]...)...)
+			return
+		}
+	}
+	log.Panicf("Fatal: no allocate stage %q to register %q after", after, name)
+}
+
+// runAllocateStages allocates the containers of the request through the registered stages, pod
+// is the pod already looked up by the caller or nil
+func (m *NvidiaDevicePlugin) runAllocateStages(ctx context.Context, reqs *pluginapi.AllocateRequest, pod *v1.Pod) (*pluginapi.AllocateResponse, error) {
+	r := &allocateRequest{
+		ctx:      ctx,
+		plugin:   m,
+		requests: reqs.ContainerRequests,
+	}
+	if pod != nil {
+		r.pod, r.podResolved = *pod, true
+	}
+	response, err := r.allocate()
+	if err == nil {
+		recordGolden(r, response)
+	}
+	return response, err
+}
+
+// allocate runs the stages for each container of the request
+func (r *allocateRequest) allocate() (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+	var uuids []string
+	for i, req := range r.requests {
+		a := &containerAllocation{
+			allocateRequest: r,
+			index:           i,
+			request:         req,
+			deviceIDs:       req.DevicesIDs,
+			response:        &pluginapi.ContainerAllocateResponse{Envs: make(map[string]string)},
+		}
+		for _, s := range allocateStages {
+			if err := s.run(a); err != nil {
+				return nil, err
+			}
+		}
+		r.using = append(r.using, a.deviceIDs)
+		uuids = append(uuids, a.uuids...)
+		responses.ContainerResponses = append(responses.ContainerResponses, a.response)
+	}
+	// Clocks and power limits are only applied once no stage can fail the call anymore
+	if gpuTuner != nil && len(r.pod.UID) > 0 && !r.dryRun {
+		if err := gpuTuner.apply(&r.pod, uuids); err != nil {
+			return nil, err
+		}
+	}
+	return &responses, nil
+}
+
+// resolvePod returns the pending pod being allocated, or an empty pod if it cannot be found
+func resolvePod(ctx context.Context, resourceName string, reqs *pluginapi.AllocateRequest) (v1.Pod, error) {
+	pod, err := findPendingPod(ctx, resourceName, reqs)
+	if err != nil {
+		// A namespace budget cannot be enforced without the pod, anything else falls back to the defaults
+		if namespaceQuotaFlag {
+			return pod, fmt.Errorf("failed to find the pod being allocated: %v", err)
+		}
+		log.Printf("Warning: failed to find the pod being allocated, using the defaults: %v", err)
+		return v1.Pod{}, nil
+	}
+	return pod, nil
+}
+
+// identifyPodStage resolves the pod being allocated and the name of the container
+func identifyPodStage(a *containerAllocation) error {
+	if a.first() {
+		if podLookupEnabled() && !a.dryRun && !a.podResolved {
+			var err error
+			if a.pod, err = resolvePod(a.ctx, a.plugin.resourceName, &pluginapi.AllocateRequest{ContainerRequests: a.requests}); err != nil {
+				return err
+			}
+		}
+		var err error
+		a.quota, err = newNamespaceQuota(a.ctx, &a.pod)
+		if err != nil {
+			return err
+		}
+		a.selector, err = newGPUSelector(&a.pod)
+		if err != nil {
+			return err
+		}
+	}
+	if len(a.pod.UID) > 0 {
+		for {
+			if a.index+a.addnum >= len(a.pod.Spec.Containers) {
+				return fmt.Errorf("pod %s has fewer containers requesting %s than the allocation", a.pod.Name, a.plugin.resourceName)
+			}
+			ctrs := a.pod.Spec.Containers[a.index+a.addnum]
+			_, ok := ctrs.Resources.Limits[v1.ResourceName(a.plugin.resourceName)]
+			if !ok {
+				a.addnum++
+				continue
+			} else {
+				a.container = ctrs.Name
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// selectVDevicesStage picks the vDevices of the container and charges them to the namespace quota
+func selectVDevicesStage(a *containerAllocation) error {
+	m := a.plugin
+	req := a.request
+	vdevices := m.getVDevices()
+	if a.replay != nil {
+		a.deviceIDs = a.replay[a.index]
+	} else if m.vDeviceController != nil {
+		// fix kubelet shutdown after Allocate
+		if !a.dryRun {
+			m.vDeviceController.releaseByRequest(req.DevicesIDs)
+		}
+
+		availableIds := a.selector.filterVDeviceIDs(vdevices, m.vDeviceController.available())
+		if len(availableIds) < len(req.DevicesIDs) {
+			if a.selector != nil {
+				return fmt.Errorf("no enough devices matching the GPU model selector of pod %s", a.pod.Name)
+			}
+			return fmt.Errorf("no enough devices")
+		}
+		availableIds = reservations.filterForPod(a, availableIds, len(req.DevicesIDs))
+		if len(availableIds) < len(req.DevicesIDs) {
+			return fmt.Errorf("no enough devices outside of the GPU reservations for pod %s", a.pod.Name)
+		}
+		availableIds, err := exclusive.filterForPod(a, availableIds)
+		if err != nil {
+			return err
+		}
+		if len(availableIds) < len(req.DevicesIDs) {
+			return fmt.Errorf("no enough devices on GPUs not held exclusively for pod %s", a.pod.Name)
+		}
+		availableIds = memoryPressureMonitor.filterVDeviceIDs(vdevices, availableIds)
+		if len(availableIds) < len(req.DevicesIDs) {
+			return fmt.Errorf("no enough devices on GPUs without memory pressure for pod %s", a.pod.Name)
+		}
+		availableIds = constraints.apply(a, availableIds, len(req.DevicesIDs))
+		if len(availableIds) < len(req.DevicesIDs) {
+			return fmt.Errorf("no enough devices satisfying the allocation constraints for pod %s", a.pod.Name)
+		}
+		if podRequestsRDMA(&a.pod) {
+			availableIds = preferRDMALocal(vdevices, availableIds, len(req.DevicesIDs))
+		}
+		var ids []string
+		if !a.dryRun {
+			ids = externalAllocation(a, availableIds, len(req.DevicesIDs))
+		}
+		if ids != nil {
+			a.deviceIDs = ids
+		} else {
+			preferReq := pluginapi.PreferredAllocationRequest{}
+			preferReq.ContainerRequests = make([]*pluginapi.ContainerPreferredAllocationRequest, 1)
+			preferReq.ContainerRequests[0] = &pluginapi.ContainerPreferredAllocationRequest{
+				AllocationSize:     int32(len(a.deviceIDs)),
+				AvailableDeviceIDs: availableIds,
+			}
+			preferResp, err := m.GetPreferredAllocation(a.ctx, &preferReq)
+			if err != nil {
+				return err
+			}
+			if int32(len(preferResp.ContainerResponses[0].DeviceIDs)) == preferReq.ContainerRequests[0].AllocationSize {
+				a.deviceIDs = preferResp.ContainerResponses[0].DeviceIDs
+			} else {
+				a.deviceIDs = availableIds[0:len(req.DevicesIDs)]
+				log.Printf("Warn: get preferred failed")
+				if !a.dryRun {
+					countVDevices(m.resourceName, func(c *vdeviceCounts) { c.preferredFallbacks++ })
+				}
+			}
+		}
+		if !a.dryRun {
+			m.vDeviceController.acquire(req.DevicesIDs, a.deviceIDs)
+		}
+	}
+
+	var err error
+	a.vdevices, err = VDevicesByIDs(vdevices, a.deviceIDs)
+	if err != nil {
+		return err
+	}
+	if err := a.selector.check(a.vdevices); err != nil {
+		return err
+	}
+	if err := a.quota.charge(&a.pod, a.vdevices); err != nil {
+		return err
+	}
+	a.uuids = UniqueDeviceIDs(a.vdevices)
+	return nil
+}
+
+// computeLimitsStage sets the memory and SM limits enforced by libvgpu
+func computeLimitsStage(a *containerAllocation) error {
+	envs := a.response.Envs
+	envs["CUDA_DEVICE_SM_LIMIT"] = strconv.Itoa(int(100 * deviceCoresScalingFlag / float64(maxSplit(a.vdevices))))
+	var err error
+	a.memoryLimits, err = applyPodLimits(&a.pod, envs, a.vdevices)
+	if err != nil {
+		return err
+	}
+	oversubscribe, err := podOversubscribes(&a.pod)
+	if err != nil {
+		return err
+	}
+	if oversubscribe {
+		for k, v := range oversubscriptionEnvs() {
+			envs[k] = v
+		}
+	}
+	return nil
+}
+
+// maxSplit returns the largest split count of the GPUs of vdevices, which sets the SM limit of
+// a container spanning GPUs split in different ways
+func maxSplit(vdevices []*VDevice) uint {
+	split := uint(1)
+	for _, vd := range vdevices {
+		if vd.split > split {
+			split = vd.split
+		}
+	}
+	return split
+}
+
+// injectStage adds the devices, environment and mounts the container needs to use its vDevices
+func injectStage(a *containerAllocation) error {
+	if podUsesVMRuntime(&a.pod) {
+		return injectVMStage(a)
+	}
+	if podUsesGVisor(&a.pod) {
+		return injectGVisorStage(a)
+	}
+	m := a.plugin
+	response := a.response
+	deviceIDs := m.deviceIDsFromUUIDs(a.uuids)
+
+	if deviceListStrategyFlag == DeviceListStrategyEnvvar {
+		for k, v := range m.apiEnvs(m.deviceListEnvvar, deviceIDs) {
+			response.Envs[k] = v
+		}
+	}
+	if deviceListStrategyFlag == DeviceListStrategyVolumeMounts {
+		for k, v := range m.apiEnvs(m.deviceListEnvvar, []string{deviceListAsVolumeMountsContainerPathRoot}) {
+			response.Envs[k] = v
+		}
+		response.Mounts = m.apiMounts(deviceIDs)
+	}
+	if deviceListStrategyFlag == DeviceListStrategyCDIAnnotations {
+		response.Annotations = m.apiCDIAnnotations(a.uuids)
+	}
+	if passDeviceSpecsFlag {
+		response.Devices = m.apiDeviceSpecs(nvidiaDriverRootFlag, a.uuids)
+	} else if passMigCapsFlag {
+		specs, err := migCapDeviceSpecs(nvidiaDriverRootFlag, a.uuids)
+		if err != nil {
+			return err
+		}
+		response.Devices = specs
+	}
+
+	var mapEnvs []string
+	for i, vd := range a.vdevices {
+		mapEnvs = append(mapEnvs, fmt.Sprintf("%v:%v", i, vd.dev.ID))
+	}
+	response.Envs["NVIDIA_DEVICE_MAP"] = strings.Join(mapEnvs, " ")
+
+	numaNode := gpuNUMANode(a.vdevices)
+	if sharedCacheEnabled() || numaSharedCacheDirFlag != "" || readOnlyRootfsFlag {
+		if err := sharedCacheQuota.admit(); err != nil {
+			return err
+		}
+		timestr := a.pod.Name + "_" + a.container
+		hostDir := filepath.Join(sharedCacheDir(numaNode), timestr)
+		if vgpuMonitor != nil && !a.dryRun {
+			// The monitor names the directory and finds its pod later, no pod lookup is needed
+			var err error
+			hostDir, err = vgpuMonitor.createCacheDir(a.ctx, a, numaNode)
+			if err != nil {
+				return err
+			}
+			timestr = filepath.Base(hostDir)
+		} else if !a.dryRun {
+			os.MkdirAll(hostDir, os.ModePerm)
+		}
+		containerDir := "/" + timestr
+		if readOnlyRootfsFlag {
+			// A fixed path that hardened images and security policies can rely on
+			containerDir = writableContainerDir
+		}
+		response.Mounts = append(response.Mounts,
+			&pluginapi.Mount{ContainerPath: containerDir,
+				HostPath: hostDir, ReadOnly: false})
+		response.Envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"] = fmt.Sprintf(containerDir+"/%v.cache", uuid.NewString())
+	} else {
+		response.Envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"] = fmt.Sprintf("/tmp/%v.cache", uuid.NewString())
+	}
+	if numaSharedCacheDirFlag != "" && numaNode >= 0 {
+		response.Envs["VGPU_SHARED_CACHE_NUMA_NODE"] = strconv.FormatInt(numaNode, 10)
+	}
+	if gpuTuner != nil && len(a.pod.UID) > 0 && !a.dryRun {
+		if err := checkWholeGPUs(a); err != nil {
+			return err
+		}
+	}
+	if mpsManager != nil && !a.dryRun {
+		mpsEnvs, mpsMounts, err := mpsManager.allocate(a.uuids)
+		if err != nil {
+			return err
+		}
+		for k, v := range mpsEnvs {
+			response.Envs[k] = v
+		}
+		response.Mounts = append(response.Mounts, mpsMounts...)
+	}
+
+	response.Mounts = append(response.Mounts,
+		&pluginapi.Mount{ContainerPath: "/usr/local/vgpu/libvgpu.so",
+			HostPath: "/usr/local/vgpu/libvgpu.so", ReadOnly: true},
+		&pluginapi.Mount{ContainerPath: "/usr/local/vgpu/pciinfo.vgpu",
+			HostPath: os.Getenv("PCIBUSFILE"), ReadOnly: true},
+	)
+	if readOnlyRootfsFlag {
+		response.Envs["LD_PRELOAD"] = "/usr/local/vgpu/libvgpu.so"
+	} else {
+		response.Mounts = append(response.Mounts,
+			&pluginapi.Mount{ContainerPath: "/etc/ld.so.preload",
+				HostPath: "/usr/local/vgpu/ld.so.preload", ReadOnly: true})
+	}
+	response.Mounts = append(response.Mounts, enforcementMounts()...)
+	return nil
+}
+
+// recordStage records the allocation in the vDevice controller, the audit log, the events and
+// finally in the pod annotations
+func recordStage(a *containerAllocation) error {
+	if a.dryRun {
+		return nil
+	}
+	m := a.plugin
+	req := a.request
+	if m.vDeviceController != nil {
+		if a.response.Annotations == nil {
+			a.response.Annotations = make(map[string]string)
+		}
+		a.response.Annotations[annRequest] = strings.Join(req.DevicesIDs, annSep)
+		a.response.Annotations[annUsing] = strings.Join(a.deviceIDs, annSep)
+		m.vDeviceController.acquire(req.DevicesIDs, a.deviceIDs)
+	}
+	if a.container != "" {
+		a.granted = append(a.granted, formatGranted(a.container, a.memoryLimits))
+	}
+
+	auditAllocation(m.resourceName, &a.pod, a.container, req.DevicesIDs, a.deviceIDs, a.uuids, a.response)
+	allocationTracer.traceAllocation(a)
+	if decisions.enabled() {
+		decisions.write(allocateDecision(a))
+	}
+	recordEvent(eventAllocate, m.resourceName, a.deviceIDs, "pod %s/%s requested %v", a.pod.Namespace, a.pod.Name, req.DevicesIDs)
+	if verboseFlag > 5 {
+		log.Printf("Debug: allocate request %v, response %v\n",
+			req.DevicesIDs, a.deviceIDs)
+	}
+
+	if a.last() && defaultDeviceMemoryFlag != "" {
+		recordGrantedMemory(&a.pod, a.granted)
+	}
+	return nil
+}
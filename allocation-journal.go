@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// allocationJournalVersion is the version of the format of the allocation journal
+const allocationJournalVersion = 1
+
+// allocationJournal is the content of --allocation-journal-file: the vDevices the controllers of
+// the plugin-managed mode hold, so that a restarted plugin knows them before the kubelet
+// checkpoint is read. Plugins running before the journal existed kept that state only in the
+// vgpu-request and vgpu-using annotations of the checkpoint, see migrate.
+type allocationJournal struct {
+	Version int `json:"version"`
+	// Resources are the vDevices in use by resource name of their controller
+	Resources map[string]map[string]journalEntry `json:"resources"`
+
+	mux  sync.Mutex
+	path string
+}
+
+// journalEntry is a vDevice in use
+type journalEntry struct {
+	// Request is the device ID of the kubelet the vDevice was allocated for
+	Request string    `json:"request"`
+	Since   time.Time `json:"since"`
+}
+
+// journal is non-nil in the plugin-managed allocation mode when --allocation-journal-file is set
+var journal *allocationJournal
+
+// openAllocationJournal reads the journal of the file, an empty journal if it does not exist
+func openAllocationJournal(path string) (*allocationJournal, error) {
+	j := &allocationJournal{path: path, Resources: make(map[string]map[string]journalEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("invalid allocation journal %s: %v", path, err)
+	}
+	if j.Version > allocationJournalVersion {
+		return nil, fmt.Errorf("allocation journal %s has version %d, newer than %d", path, j.Version, allocationJournalVersion)
+	}
+	if j.Resources == nil {
+		j.Resources = make(map[string]map[string]journalEntry)
+	}
+	return j, nil
+}
+
+// removeAllocationJournal drops the journal of a node leaving the plugin-managed mode, which
+// would otherwise hold stale vDevices if the mode is enabled again
+func removeAllocationJournal(path string) {
+	if err := os.Remove(path); err == nil {
+		log.Printf("Removed the allocation journal %s, the allocation mode is %s", path, allocationModeFlag)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove the allocation journal %s: %v", path, err)
+	}
+}
+
+// entries returns the vDevices in use of the resource, false if the journal has none recorded
+func (j *allocationJournal) entries(resourceName string) (map[string]journalEntry, bool) {
+	if j == nil {
+		return nil, false
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	entries, ok := j.Resources[resourceName]
+	return entries, ok
+}
+
+// record replaces the vDevices in use of the resource and writes the journal
+func (j *allocationJournal) record(resourceName string, entries map[string]journalEntry) {
+	if j == nil {
+		return
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.Version = allocationJournalVersion
+	j.Resources[resourceName] = entries
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(j.path, data)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write the allocation journal %s: %v", j.path, err)
+	}
+}
+
+// journalEntries returns the vDevices in use of the controller. The caller holds m.mux.
+func (m *VDeviceController) journalEntries() map[string]journalEntry {
+	entries := make(map[string]journalEntry)
+	for id, owner := range m.idMap {
+		if owner != "" {
+			entries[id] = journalEntry{Request: owner, Since: m.acquiredAt[id]}
+		}
+	}
+	return entries
+}
+
+// persist writes the vDevices in use to the journal once the controller is initialized. The
+// caller holds m.mux.
+func (m *VDeviceController) persist() {
+	if m.journaled {
+		journal.record(m.resourceName, m.journalEntries())
+	}
+}
+
+// restore acquires the vDevices of the journal, or migrates the state of a plugin that ran
+// without the journal from the kubelet checkpoint. The checkpoint sync of the next Allocate and
+// the reconciliation release what belongs to pods that ended meanwhile.
+func (m *VDeviceController) restore() {
+	if journal == nil {
+		return
+	}
+	if entries, ok := journal.entries(m.resourceName); ok {
+		m.mux.Lock()
+		for id, e := range entries {
+			if _, known := m.idMap[id]; !known {
+				log.Printf("Warning: dropping vDevice %s of the allocation journal, unknown to %s", id, m.resourceName)
+				continue
+			}
+			m.idMap[id] = e.Request
+			m.acquiredAt[id] = e.Since
+		}
+		m.journaled = true
+		m.persist()
+		m.mux.Unlock()
+		log.Printf("Restored %d vDevices in use of %s from the allocation journal", len(entries), m.resourceName)
+		return
+	}
+	log.Printf("Migrating the vDevices in use of %s from the kubelet checkpoint to the allocation journal", m.resourceName)
+	if err := m.updateFromCheckpoint(context.Background()); err != nil {
+		log.Printf("Warning: migration of %s postponed to the next start: %v", m.resourceName, err)
+		return
+	}
+	m.mux.Lock()
+	m.journaled = true
+	m.persist()
+	m.mux.Unlock()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Allocation modes set with --allocation-mode, deciding who picks the vDevices of a container
+const (
+	// allocationModeKubeletPreferred advertises GetPreferredAllocation, the kubelet asks the
+	// plugin which vDevices to allocate
+	allocationModeKubeletPreferred = "kubelet-preferred"
+	// allocationModePluginManaged is for kubelets without preferred allocation: the plugin
+	// ignores the vDevices picked by the kubelet and allocates its own through the vDevice
+	// controller, which keeps them in the allocation journal
+	allocationModePluginManaged = "plugin-managed"
+	// allocationModeNone allocates the vDevices picked by the kubelet
+	allocationModeNone = "none"
+)
+
+// deprecatedAllocationModes maps the former names of the allocation modes to the current ones
+var deprecatedAllocationModes = map[string]string{
+	"preferred": allocationModeKubeletPreferred,
+	"legacy":    allocationModePluginManaged,
+}
+
+// validateAllocationMode checks --allocation-mode against the options it interacts with. The
+// deprecated --enable-legacy-preferred selects the plugin-managed mode when --allocation-mode is
+// not set.
+func validateAllocationMode(allocationModeSet bool) error {
+	mode := allocationModeFlag
+	if current, ok := deprecatedAllocationModes[mode]; ok {
+		mode = current
+	}
+	switch mode {
+	case allocationModeKubeletPreferred, allocationModePluginManaged, allocationModeNone:
+	default:
+		return fmt.Errorf("invalid --allocation-mode option: %v, expected '%s', '%s' or '%s'",
+			mode, allocationModeKubeletPreferred, allocationModePluginManaged, allocationModeNone)
+	}
+	if enableLegacyPreferredFlag {
+		if allocationModeSet && mode != allocationModePluginManaged {
+			return fmt.Errorf("invalid --enable-legacy-preferred option: it selects the plugin-managed allocation mode, which conflicts with --allocation-mode=%s", mode)
+		}
+		mode = allocationModePluginManaged
+	}
+	if mode == allocationModePluginManaged && migStrategyFlag == MigStrategySingle {
+		return fmt.Errorf("invalid --allocation-mode option: %s, the MIG devices of --mig-strategy=%s have no vDevices for the plugin to pick",
+			mode, MigStrategySingle)
+	}
+	return nil
+}
+
+// resolveAllocationMode replaces a deprecated --allocation-mode by its current name, and by the
+// plugin-managed mode with --enable-legacy-preferred
+func resolveAllocationMode() {
+	if mode, ok := deprecatedAllocationModes[allocationModeFlag]; ok {
+		log.Printf("Warning: --allocation-mode=%s is deprecated, use --allocation-mode=%s", allocationModeFlag, mode)
+		allocationModeFlag = mode
+	}
+	if enableLegacyPreferredFlag {
+		allocationModeFlag = allocationModePluginManaged
+	}
+}
+
+// allocationMode returns the allocation mode of the plugin. The MIG devices of the mixed strategy
+// have a preferred allocation of their own but no vDevices for the plugin-managed mode, the other
+// resources without an allocation policy have no preferred allocation in any mode.
+func (m *NvidiaDevicePlugin) allocationMode() string {
+	if m.migStrategy == MigStrategyMixed {
+		if allocationModeFlag == allocationModeNone {
+			return allocationModeNone
+		}
+		return allocationModeKubeletPreferred
+	}
+	if m.allocatePolicy == nil {
+		return allocationModeNone
+	}
+	return allocationModeFlag
+}
+
+// preferredAllocationAvailable returns true if the kubelet is to ask the plugin for the
+// preferred vDevices
+func (m *NvidiaDevicePlugin) preferredAllocationAvailable() bool {
+	return m.allocationMode() == allocationModeKubeletPreferred
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of allocation trace records
+const (
+	traceInventory = "inventory"
+	tracePreferred = "preferred"
+	traceAllocate  = "allocate"
+	traceRelease   = "release"
+)
+
+// allocationTracer is non-nil when --record-file is set
+var allocationTracer *AllocationTracer
+
+// traceGPU is a physical GPU of an inventory record
+type traceGPU struct {
+	UUID string `json:"uuid"`
+	// Memory is the physical memory in MiB
+	Memory   uint64   `json:"memory"`
+	VDevices []string `json:"vdevices"`
+}
+
+// traceRecord is one line of the allocation trace replayed by the simulate command
+type traceRecord struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Resource string    `json:"resource"`
+	// Inventory
+	SplitCount    uint       `json:"splitCount,omitempty"`
+	MemoryScaling float64    `json:"memoryScaling,omitempty"`
+	GPUs          []traceGPU `json:"gpus,omitempty"`
+	// Preferred and allocate
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	Size      int    `json:"size,omitempty"`
+	Available int    `json:"available,omitempty"`
+	// Memory is the memory limit in MiB of each allocated vDevice, 0 for the whole vDevice
+	Memory []uint64 `json:"memory,omitempty"`
+	// Allocate and release
+	Devices []string `json:"devices,omitempty"`
+}
+
+// AllocationTracer appends the allocation decisions of the plugin to a JSON Lines file
+type AllocationTracer struct {
+	mux  sync.Mutex
+	file *os.File
+}
+
+// NewAllocationTracer returns a reference to a new AllocationTracer appending to path
+func NewAllocationTracer(path string) (*AllocationTracer, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &AllocationTracer{file: f}, nil
+}
+
+func (t *AllocationTracer) write(r *traceRecord) {
+	if t == nil {
+		return
+	}
+	r.Time = time.Now()
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Error: failed to encode trace record: %v", err)
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error: failed to write allocation trace: %v", err)
+	}
+}
+
+// traceInventoryOf records the GPUs and vDevices a plugin serves
+func (t *AllocationTracer) traceInventoryOf(resource string, vdevices []*VDevice) {
+	if t == nil || len(vdevices) == 0 {
+		return
+	}
+	r := &traceRecord{
+		Type:          traceInventory,
+		Resource:      resource,
+		SplitCount:    deviceSplitCountFlag,
+		MemoryScaling: deviceMemoryScalingFlag,
+	}
+	index := make(map[string]int)
+	for _, vd := range vdevices {
+		i, ok := index[vd.dev.ID]
+		if !ok {
+			g := traceGPU{UUID: vd.dev.ID}
+			if m, err := getGPUModel(vd.dev.ID); err == nil {
+				g.Memory = m.memory
+			}
+			i = len(r.GPUs)
+			index[vd.dev.ID] = i
+			r.GPUs = append(r.GPUs, g)
+		}
+		r.GPUs[i].VDevices = append(r.GPUs[i].VDevices, vd.ID)
+	}
+	t.write(r)
+}
+
+// traceAllocation records the vDevices allocated to a container
+func (t *AllocationTracer) traceAllocation(a *containerAllocation) {
+	if t == nil {
+		return
+	}
+	r := &traceRecord{
+		Type:      traceAllocate,
+		Resource:  a.plugin.resourceName,
+		Container: a.container,
+		Size:      len(a.deviceIDs),
+		Devices:   a.deviceIDs,
+	}
+	if a.pod.Name != "" {
+		r.Pod = a.pod.Namespace + "/" + a.pod.Name
+	}
+	for i, vd := range a.vdevices {
+		memory := uint64(0)
+		if i < len(a.memoryLimits) && a.memoryLimits[i] != vd.memory {
+			memory = a.memoryLimits[i]
+		}
+		r.Memory = append(r.Memory, memory)
+	}
+	t.write(r)
+}
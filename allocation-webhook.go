@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Failure policies of the allocation webhook
+const (
+	webhookFailurePolicyFail   = "fail"
+	webhookFailurePolicyIgnore = "ignore"
+)
+
+// allocationWebhookMount is a mount of the container, as sent to and returned by the webhook
+type allocationWebhookMount struct {
+	HostPath      string `json:"hostPath"`
+	ContainerPath string `json:"containerPath"`
+	ReadOnly      bool   `json:"readOnly"`
+}
+
+// allocationWebhookRequest is POSTed to --allocation-webhook before answering Allocate
+type allocationWebhookRequest struct {
+	Node         string                   `json:"node"`
+	ResourceName string                   `json:"resourceName"`
+	PodNamespace string                   `json:"podNamespace,omitempty"`
+	PodName      string                   `json:"podName,omitempty"`
+	PodUID       string                   `json:"podUID,omitempty"`
+	Container    string                   `json:"container,omitempty"`
+	Requested    []string                 `json:"requested"`
+	Allocated    []string                 `json:"allocated"`
+	PhysicalGPUs []string                 `json:"physicalGPUs"`
+	MemoryLimits []uint64                 `json:"memoryLimits"`
+	Envs         map[string]string        `json:"envs"`
+	Mounts       []allocationWebhookMount `json:"mounts"`
+}
+
+// allocationWebhookResponse is the answer of the webhook. A denied allocation fails with the
+// reason; an allowed one gets Envs merged into its environment (an empty value removes the
+// variable) and Mounts appended.
+type allocationWebhookResponse struct {
+	Allowed bool                     `json:"allowed"`
+	Reason  string                   `json:"reason,omitempty"`
+	Envs    map[string]string        `json:"envs,omitempty"`
+	Mounts  []allocationWebhookMount `json:"mounts,omitempty"`
+}
+
+// callAllocationWebhook asks the webhook to review the allocation of a container
+func callAllocationWebhook(ctx context.Context, a *containerAllocation) (*allocationWebhookResponse, error) {
+	req := &allocationWebhookRequest{
+		Node:         os.Getenv("NODE_NAME"),
+		ResourceName: a.plugin.resourceName,
+		PodNamespace: a.pod.Namespace,
+		PodName:      a.pod.Name,
+		PodUID:       string(a.pod.UID),
+		Container:    a.container,
+		Requested:    a.request.DevicesIDs,
+		Allocated:    a.deviceIDs,
+		PhysicalGPUs: a.uuids,
+		MemoryLimits: a.memoryLimits,
+		Envs:         a.response.Envs,
+	}
+	for _, m := range a.response.Mounts {
+		req.Mounts = append(req.Mounts, allocationWebhookMount{HostPath: m.HostPath, ContainerPath: m.ContainerPath, ReadOnly: m.ReadOnly})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, allocationWebhookTimeoutFlag)
+	defer cancel()
+	httpReq, err := http.NewRequest(http.MethodPost, allocationWebhookFlag, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, data)
+	}
+	review := &allocationWebhookResponse{}
+	if err := json.Unmarshal(data, review); err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+// webhookStage lets --allocation-webhook veto or amend the allocation before it is recorded
+func webhookStage(a *containerAllocation) error {
+	if allocationWebhookFlag == "" || a.dryRun {
+		return nil
+	}
+	review, err := callAllocationWebhook(a.ctx, a)
+	if err != nil {
+		if allocationWebhookFailurePolicyFlag == webhookFailurePolicyIgnore {
+			log.Printf("Warning: allocation webhook failed, ignoring: %v", err)
+			return nil
+		}
+		return fmt.Errorf("allocation webhook failed: %v", err)
+	}
+	if !review.Allowed {
+		recordEvent(eventAllocate, a.plugin.resourceName, a.deviceIDs, "pod %s/%s denied by the allocation webhook: %s", a.pod.Namespace, a.pod.Name, review.Reason)
+		return fmt.Errorf("allocation denied by webhook: %s", review.Reason)
+	}
+	for k, v := range review.Envs {
+		if v == "" {
+			delete(a.response.Envs, k)
+			continue
+		}
+		a.response.Envs[k] = v
+	}
+	for _, m := range review.Mounts {
+		a.response.Mounts = append(a.response.Mounts, &pluginapi.Mount{HostPath: m.HostPath, ContainerPath: m.ContainerPath, ReadOnly: m.ReadOnly})
+	}
+	return nil
+}
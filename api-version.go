@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// devicePluginAPI binds the plugin to one version of the kubelet device plugin API
+type devicePluginAPI struct {
+	version string
+	// registerServer registers the DevicePlugin service of this version on s
+	registerServer func(s *grpc.Server, m *NvidiaDevicePlugin)
+	// register calls the Registration service of this version on the kubelet
+	register func(conn *grpc.ClientConn, m *NvidiaDevicePlugin, endpoint string) error
+}
+
+// devicePluginAPIs lists the supported device plugin API versions, newest first.
+// Support for a new version is added by appending its adapter here.
+var devicePluginAPIs = []devicePluginAPI{
+	{
+		version: pluginapi.Version,
+		registerServer: func(s *grpc.Server, m *NvidiaDevicePlugin) {
+			pluginapi.RegisterDevicePluginServer(s, m)
+		},
+		register: func(conn *grpc.ClientConn, m *NvidiaDevicePlugin, endpoint string) error {
+			client := pluginapi.NewRegistrationClient(conn)
+			reqt := &pluginapi.RegisterRequest{
+				Version:      pluginapi.Version,
+				Endpoint:     endpoint,
+				ResourceName: m.resourceName,
+				Options: &pluginapi.DevicePluginOptions{
+					GetPreferredAllocationAvailable: m.preferredAllocationAvailable(),
+					PreStartRequired:                m.preStartRequired(),
+				},
+			}
+			_, err := client.Register(context.Background(), reqt)
+			return err
+		},
+	},
+}
+
+// isUnsupportedVersionError returns true if the kubelet rejected the registration because of its API version
+func isUnsupportedVersionError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "version") && strings.Contains(msg, "not supported") ||
+		strings.Contains(msg, "unimplemented")
+}
+
+// negotiateRegistration registers with the newest API version the kubelet accepts
+func negotiateRegistration(conn *grpc.ClientConn, m *NvidiaDevicePlugin, endpoint string) (string, error) {
+	var errs []string
+	for _, api := range devicePluginAPIs {
+		err := api.register(conn, m, endpoint)
+		if err == nil {
+			return api.version, nil
+		}
+		if !isUnsupportedVersionError(err) {
+			return "", err
+		}
+		log.Printf("Kubelet does not support device plugin API %s: %v", api.version, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", api.version, err))
+	}
+	return "", fmt.Errorf("no device plugin API version supported by kubelet: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,145 @@
+// Package v1alpha1 defines the gRPC interface of external allocators, services the device
+// plugin delegates the selection of vDevices to when --external-allocator is set.
+//
+// Messages are encoded as JSON with the "json" content subtype (application/grpc+json), so
+// that allocators can be written without generated protobuf code. Go servers importing this
+// package get the codec registered and serve the interface through RegisterAllocatorServer.
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ServiceName is the full name of the Allocator service
+const ServiceName = "vgpu.allocator.v1alpha1.Allocator"
+
+// AllocateMethod is the full method name of Allocator.Allocate
+const AllocateMethod = "/" + ServiceName + "/Allocate"
+
+// Pod identifies the pod and container being allocated. It is empty when the plugin
+// could not resolve the pod.
+type Pod struct {
+	Namespace   string            `json:"namespace,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	UID         string            `json:"uid,omitempty"`
+	Container   string            `json:"container,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// VDevice is a vDevice available for the allocation
+type VDevice struct {
+	// ID is the vDevice ID advertised to the kubelet
+	ID string `json:"id"`
+	// UUID is the UUID of the physical GPU of the vDevice
+	UUID string `json:"uuid"`
+	// Index is the NVML index of the physical GPU
+	Index string `json:"index"`
+	// Memory is the memory of the vDevice in MiB
+	Memory uint64 `json:"memory"`
+	// Model is the product name of the physical GPU
+	Model string `json:"model,omitempty"`
+	// NUMANode is the NUMA node of the physical GPU, -1 if unknown
+	NUMANode int64 `json:"numaNode"`
+}
+
+// AllocateRequest asks for Size vDevices out of Available
+type AllocateRequest struct {
+	Node         string    `json:"node"`
+	ResourceName string    `json:"resourceName"`
+	Pod          Pod       `json:"pod"`
+	Size         int       `json:"size"`
+	Available    []VDevice `json:"available"`
+}
+
+// AllocateResponse lists the IDs of the selected vDevices. The plugin falls back to its
+// built-in policy unless exactly Size distinct available vDevices are returned.
+type AllocateResponse struct {
+	DeviceIDs []string `json:"deviceIDs"`
+}
+
+// AllocatorServer is the interface implemented by external allocators
+type AllocatorServer interface {
+	Allocate(ctx context.Context, req *AllocateRequest) (*AllocateResponse, error)
+}
+
+// RegisterAllocatorServer serves srv on s
+func RegisterAllocatorServer(s *grpc.Server, srv AllocatorServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*AllocatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Allocate",
+			Handler:    allocateHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func allocateHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &AllocateRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AllocatorServer).Allocate(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AllocateMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AllocatorServer).Allocate(ctx, req.(*AllocateRequest))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+// AllocatorClient calls an external allocator
+type AllocatorClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewAllocatorClient returns a client of the allocator served on cc
+func NewAllocatorClient(cc *grpc.ClientConn) *AllocatorClient {
+	return &AllocatorClient{cc: cc}
+}
+
+// Allocate asks the allocator to select vDevices
+func (c *AllocatorClient) Allocate(ctx context.Context, req *AllocateRequest, opts ...grpc.CallOption) (*AllocateResponse, error) {
+	resp := &AllocateResponse{}
+	opts = append([]grpc.CallOption{grpc.ForceCodec(Codec{})}, opts...)
+	if err := c.cc.Invoke(ctx, AllocateMethod, req, resp, opts...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Codec encodes the messages of the Allocator service as JSON
+type Codec struct{}
+
+// Marshal returns the JSON encoding of v
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the JSON encoded data into v
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name returns the content subtype of the codec
+func (Codec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(Codec{})
+}
@@ -0,0 +1,118 @@
+// Package v1alpha1 defines the local gRPC interface between the device plugin and the
+// vgpu-monitor, the "nvidia-device-plugin monitor" component owning the shared cache
+// directories of the containers, the watch of the pods of the node and the usage scraping.
+//
+// Messages are encoded as JSON with the "json" content subtype (application/grpc+json), like
+// the api/allocator/v1alpha1 interface.
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ServiceName is the full name of the Monitor service
+const ServiceName = "vgpu.monitor.v1alpha1.Monitor"
+
+// CreateCacheDirMethod is the full method name of Monitor.CreateCacheDir
+const CreateCacheDirMethod = "/" + ServiceName + "/CreateCacheDir"
+
+// CreateCacheDirRequest asks for the shared cache directory of a container being allocated.
+// The pod is not known yet, the monitor finds it later from the kubelet checkpoint.
+type CreateCacheDirRequest struct {
+	ResourceName string `json:"resourceName"`
+	// DeviceUUIDs are the UUIDs of the physical GPUs of the container
+	DeviceUUIDs []string `json:"deviceUUIDs"`
+	// NUMANode is the NUMA node of the first GPU, -1 if unknown
+	NUMANode int64 `json:"numaNode"`
+}
+
+// CreateCacheDirResponse is the host path of the created directory
+type CreateCacheDirResponse struct {
+	HostPath string `json:"hostPath"`
+}
+
+// MonitorServer is the interface implemented by the monitor
+type MonitorServer interface {
+	CreateCacheDir(ctx context.Context, req *CreateCacheDirRequest) (*CreateCacheDirResponse, error)
+}
+
+// RegisterMonitorServer serves srv on s
+func RegisterMonitorServer(s *grpc.Server, srv MonitorServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*MonitorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateCacheDir",
+			Handler:    createCacheDirHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func createCacheDirHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &CreateCacheDirRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServer).CreateCacheDir(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CreateCacheDirMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServer).CreateCacheDir(ctx, req.(*CreateCacheDirRequest))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+// MonitorClient calls the monitor
+type MonitorClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewMonitorClient returns a client of the monitor served on cc
+func NewMonitorClient(cc *grpc.ClientConn) *MonitorClient {
+	return &MonitorClient{cc: cc}
+}
+
+// CreateCacheDir asks the monitor for the shared cache directory of a container
+func (c *MonitorClient) CreateCacheDir(ctx context.Context, req *CreateCacheDirRequest, opts ...grpc.CallOption) (*CreateCacheDirResponse, error) {
+	resp := &CreateCacheDirResponse{}
+	opts = append([]grpc.CallOption{grpc.ForceCodec(Codec{})}, opts...)
+	if err := c.cc.Invoke(ctx, CreateCacheDirMethod, req, resp, opts...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Codec encodes the messages of the Monitor service as JSON
+type Codec struct{}
+
+// Marshal returns the JSON encoding of v
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the JSON encoded data into v
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name returns the content subtype of the codec
+func (Codec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(Codec{})
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+)
+
+// tegraReleaseFile exists on the Jetson boards, whose integrated GPU is not a PCI device and
+// is not enumerated by NVML
+const tegraReleaseFile = "/etc/nv_tegra_release"
+
+// tegraNode returns true on a Jetson board, mount tegraReleaseFile into the plugin to detect it
+func tegraNode() bool {
+	_, err := os.Stat(tegraReleaseFile)
+	return err == nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// auditLogger is non-nil when --audit-log-file is set
+var auditLogger *AuditLogger
+
+// auditRecord is one line of the allocation audit log
+type auditRecord struct {
+	Time         time.Time         `json:"time"`
+	Resource     string            `json:"resource"`
+	PodNamespace string            `json:"podNamespace,omitempty"`
+	PodName      string            `json:"podName,omitempty"`
+	PodUID       string            `json:"podUID,omitempty"`
+	Container    string            `json:"container,omitempty"`
+	Requested    []string          `json:"requested"`
+	Allocated    []string          `json:"allocated"`
+	PhysicalGPUs []string          `json:"physicalGPUs"`
+	Envs         map[string]string `json:"envs,omitempty"`
+	Mounts       []string          `json:"mounts,omitempty"`
+}
+
+// AuditLogger writes allocation records as JSON Lines, rotating the file when it grows past maxSize
+type AuditLogger struct {
+	mux        sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewAuditLogger returns a reference to a new AuditLogger; maxSizeMB of 0 disables rotation
+func NewAuditLogger(path string, maxSizeMB int, maxBackups int) (*AuditLogger, error) {
+	l := &AuditLogger{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AuditLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest backup, and reopens path
+func (l *AuditLogger) rotate() error {
+	l.file.Close()
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxBackups > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *AuditLogger) write(r *auditRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Error: failed to encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Error: failed to rotate audit log: %v", err)
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Error: failed to write audit log: %v", err)
+	}
+}
+
+// auditAllocation records the response to one container allocate request
+func auditAllocation(resource string, pod *v1.Pod, container string, requested []string, allocated []string, uuids []string, response *pluginapi.ContainerAllocateResponse) {
+	if auditLogger == nil {
+		return
+	}
+	r := &auditRecord{
+		Time:         time.Now(),
+		Resource:     resource,
+		Container:    container,
+		Requested:    requested,
+		Allocated:    allocated,
+		PhysicalGPUs: uuids,
+		Envs:         response.Envs,
+	}
+	if pod != nil && pod.UID != "" {
+		r.PodNamespace = pod.Namespace
+		r.PodName = pod.Name
+		r.PodUID = string(pod.UID)
+	}
+	for _, m := range response.Mounts {
+		r.Mounts = append(r.Mounts, m.HostPath+":"+m.ContainerPath)
+	}
+	auditLogger.write(r)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// canaryAllocStrategy is the strategy of the plugin advertising --canary-resource
+const canaryAllocStrategy = "canary"
+
+// canaryDeviceID is the single device of the canary resource
+const canaryDeviceID = "canary-0"
+
+// canaryResults counts the canary allocations by outcome
+var canaryResults = struct {
+	sync.Mutex
+	passed uint64
+	failed uint64
+}{}
+
+// CanaryDeviceManager implements the ResourceManager interface for the synthetic canary device
+type CanaryDeviceManager struct{}
+
+// Devices returns the canary device, which does not consume any GPU
+func (g *CanaryDeviceManager) Devices() []*Device {
+	dev := &Device{Index: canaryDeviceID}
+	dev.ID = canaryDeviceID
+	dev.Health = pluginapi.Healthy
+	return []*Device{dev}
+}
+
+// CheckHealth is a no-op for the canary device
+func (g *CanaryDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth) {
+	<-stop
+}
+
+// getCanaryPlugin returns the plugin advertising --canary-resource
+func getCanaryPlugin() *NvidiaDevicePlugin {
+	plugin := NewNvidiaDevicePlugin(
+		canaryResourceFlag,
+		&CanaryDeviceManager{},
+		"",
+		nil,
+		devicePluginSocket("vgpu-canary.sock"))
+	plugin.migStrategy = canaryAllocStrategy
+	return plugin
+}
+
+// CanaryAllocate runs the allocation pipeline of each vGPU plugin against its first vDevice
+// without acquiring it, like the self-test, and fails the allocation if one of them fails. The
+// container gets no GPU, only the outcome in VGPU_CANARY.
+func (m *NvidiaDevicePlugin) CanaryAllocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	tested := 0
+	var err error
+	for _, p := range getAdminPlugins() {
+		if p.migStrategy != MigStrategyNone || len(p.getVDevices()) == 0 {
+			continue
+		}
+		if err = p.selfTest(); err != nil {
+			err = fmt.Errorf("canary allocation of '%s' failed: %v", p.resourceName, err)
+			break
+		}
+		tested++
+	}
+	if err == nil && tested == 0 {
+		err = fmt.Errorf("canary allocation failed: no vGPU resource is served")
+	}
+
+	canaryResults.Lock()
+	if err != nil {
+		canaryResults.failed++
+	} else {
+		canaryResults.passed++
+	}
+	canaryResults.Unlock()
+	if err != nil {
+		recordEvent(eventAllocate, m.resourceName, []string{canaryDeviceID}, "%v", err)
+		return nil, err
+	}
+
+	responses := pluginapi.AllocateResponse{}
+	for range reqs.ContainerRequests {
+		responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+			Envs: map[string]string{"VGPU_CANARY": fmt.Sprintf("passed %d resources", tested)},
+		})
+	}
+	recordEvent(eventAllocate, m.resourceName, []string{canaryDeviceID}, "canary passed")
+	return &responses, nil
+}
+
+func writeCanaryMetrics(w io.Writer) {
+	canaryResults.Lock()
+	defer canaryResults.Unlock()
+	fmt.Fprintln(w, "# HELP vgpu_canary_allocations_total Allocations of the canary resource by result.")
+	fmt.Fprintln(w, "# TYPE vgpu_canary_allocations_total counter")
+	fmt.Fprintf(w, "vgpu_canary_allocations_total{result=\"passed\"} %d\n", canaryResults.passed)
+	fmt.Fprintf(w, "vgpu_canary_allocations_total{result=\"failed\"} %d\n", canaryResults.failed)
+}
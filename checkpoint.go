@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/kubelet/checkpointmanager/checksum"
+	"k8s.io/kubernetes/pkg/kubelet/cm/devicemanager/checkpoint"
+	hashutil "k8s.io/kubernetes/pkg/util/hash"
+)
+
+// Formats of the device manager checkpoint of the kubelet. The checkpoint carries no version, the
+// format is told apart by the DeviceIDs of its entries.
+const (
+	// checkpointV1 is written by kubelets before 1.20, DeviceIDs is a list
+	checkpointV1 = "v1"
+	// checkpointV2 is written by kubelets since 1.20, DeviceIDs is a list per NUMA node
+	checkpointV2 = "v2"
+)
+
+// checkpointEntry is a container allocation of the checkpoint, whatever its format
+type checkpointEntry struct {
+	PodUID        string
+	ContainerName string
+	ResourceName  string
+	DeviceIDs     []string
+	AllocResp     []byte
+}
+
+// kubeletCheckpoint is the decoded device manager checkpoint of the kubelet
+type kubeletCheckpoint struct {
+	version    string
+	entries    []checkpointEntry
+	registered map[string][]string
+}
+
+// GetData returns the container allocations and the registered devices by resource
+func (cp *kubeletCheckpoint) GetData() ([]checkpointEntry, map[string][]string) {
+	return cp.entries, cp.registered
+}
+
+// rawCheckpoint is the checkpoint with the entries left undecoded until the format is known
+type rawCheckpoint struct {
+	Data struct {
+		PodDeviceEntries  []json.RawMessage
+		RegisteredDevices map[string][]string
+	}
+	Checksum *checksum.Checksum
+}
+
+// The types below mirror the v2 checkpoint of the kubelet, which is not vendored. The checksum
+// hashes the Go representation of the data including the type names, see checksumV2.
+type devicesPerNUMA map[int64][]string
+
+type podDevicesEntryV2 struct {
+	PodUID        string
+	ContainerName string
+	ResourceName  string
+	DeviceIDs     devicesPerNUMA
+	AllocResp     []byte
+}
+
+type checkpointDataV2 struct {
+	PodDeviceEntries  []podDevicesEntryV2
+	RegisteredDevices map[string][]string
+}
+
+// kubeletTypeNames maps the names of the mirrored types to those of the kubelet
+var kubeletTypeNames = strings.NewReplacer(
+	"main.checkpointDataV2", "checkpoint.checkpointData",
+	"main.podDevicesEntryV2", "checkpoint.PodDevicesEntry",
+	"main.devicesPerNUMA", "checkpoint.DevicesPerNUMA",
+)
+
+// readKubeletCheckpoint reads the device manager checkpoint of the kubelet
+func readKubeletCheckpoint() (*kubeletCheckpoint, error) {
+	if err := takeFault(faultCheckpoint); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(devicePluginDir, kubeletDeviceManagerCheckpoint))
+	if err != nil {
+		return nil, err
+	}
+	return decodeKubeletCheckpoint(data)
+}
+
+// decodeKubeletCheckpoint detects the format of a checkpoint, verifies its checksum and decodes it
+func decodeKubeletCheckpoint(data []byte) (*kubeletCheckpoint, error) {
+	var raw rawCheckpoint
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid kubelet checkpoint: %v", err)
+	}
+	if raw.Checksum == nil {
+		return nil, fmt.Errorf("unsupported kubelet checkpoint format: no checksum")
+	}
+	version, err := checkpointVersion(raw.Data.PodDeviceEntries)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case checkpointV1:
+		return decodeCheckpointV1(data)
+	case checkpointV2:
+		return decodeCheckpointV2(data)
+	}
+	return nil, fmt.Errorf("unsupported kubelet checkpoint format %s", version)
+}
+
+// checkpointVersion returns the format of the entries, which must all be of the same one
+func checkpointVersion(entries []json.RawMessage) (string, error) {
+	version, known := checkpointV1, false
+	for i, raw := range entries {
+		var entry struct {
+			DeviceIDs json.RawMessage
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return "", fmt.Errorf("invalid kubelet checkpoint entry %d: %v", i, err)
+		}
+		var v string
+		switch ids := bytes.TrimSpace(entry.DeviceIDs); {
+		case len(ids) == 0 || bytes.Equal(ids, []byte("null")):
+			continue
+		case ids[0] == '[':
+			v = checkpointV1
+		case ids[0] == '{':
+			v = checkpointV2
+		default:
+			return "", fmt.Errorf("unsupported kubelet checkpoint format: DeviceIDs of entry %d is %.32s, expected a list (v1) or lists by NUMA node (v2)", i, ids)
+		}
+		if known && v != version {
+			return "", fmt.Errorf("unsupported kubelet checkpoint format: entries mix %s and %s", version, v)
+		}
+		version, known = v, true
+	}
+	return version, nil
+}
+
+// decodeCheckpointV1 decodes a checkpoint with the vendored format of the kubelet
+func decodeCheckpointV1(data []byte) (*kubeletCheckpoint, error) {
+	cp := checkpoint.New(make([]checkpoint.PodDevicesEntry, 0), make(map[string][]string))
+	if err := cp.UnmarshalCheckpoint(data); err != nil {
+		return nil, fmt.Errorf("invalid %s kubelet checkpoint: %v", checkpointV1, err)
+	}
+	if err := cp.VerifyChecksum(); err != nil {
+		return nil, fmt.Errorf("%s kubelet checkpoint: %v", checkpointV1, err)
+	}
+	podDevices, registered := cp.GetData()
+	result := &kubeletCheckpoint{version: checkpointV1, registered: registered}
+	for _, pde := range podDevices {
+		result.entries = append(result.entries, checkpointEntry{
+			PodUID:        pde.PodUID,
+			ContainerName: pde.ContainerName,
+			ResourceName:  pde.ResourceName,
+			DeviceIDs:     pde.DeviceIDs,
+			AllocResp:     pde.AllocResp,
+		})
+	}
+	return result, nil
+}
+
+// decodeCheckpointV2 decodes a checkpoint of the kubelets since 1.20, flattening the devices of
+// each entry in the order of their NUMA nodes
+func decodeCheckpointV2(data []byte) (*kubeletCheckpoint, error) {
+	var cp struct {
+		Data     checkpointDataV2
+		Checksum checksum.Checksum
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid %s kubelet checkpoint: %v", checkpointV2, err)
+	}
+	if sum := checksumV2(cp.Data); sum != cp.Checksum {
+		return nil, fmt.Errorf("%s kubelet checkpoint: checkpoint is corrupted, checksum %d, computed %d", checkpointV2, cp.Checksum, sum)
+	}
+	result := &kubeletCheckpoint{version: checkpointV2, registered: cp.Data.RegisteredDevices}
+	for _, pde := range cp.Data.PodDeviceEntries {
+		var nodes []int64
+		for node := range pde.DeviceIDs {
+			nodes = append(nodes, node)
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+		var ids []string
+		for _, node := range nodes {
+			ids = append(ids, pde.DeviceIDs[node]...)
+		}
+		result.entries = append(result.entries, checkpointEntry{
+			PodUID:        pde.PodUID,
+			ContainerName: pde.ContainerName,
+			ResourceName:  pde.ResourceName,
+			DeviceIDs:     ids,
+			AllocResp:     pde.AllocResp,
+		})
+	}
+	return result, nil
+}
+
+// checksumV2 computes the checksum the kubelet writes in v2 checkpoints, renaming the mirrored
+// types in the hashed representation as the kubelet does for its v1 compatibility
+func checksumV2(data checkpointDataV2) checksum.Checksum {
+	var repr typeNameBuffer
+	hashutil.DeepHashObject(&repr, data)
+	hash := fnv.New32a()
+	kubeletTypeNames.WriteString(hash, repr.String())
+	return checksum.Checksum(hash.Sum32())
+}
+
+// typeNameBuffer collects what DeepHashObject writes to rename the types before hashing
+type typeNameBuffer struct {
+	bytes.Buffer
+}
+
+func (b *typeNameBuffer) Sum(in []byte) []byte {
+	return append(in, b.Bytes()...)
+}
+
+func (b *typeNameBuffer) Size() int {
+	return b.Len()
+}
+
+func (b *typeNameBuffer) BlockSize() int {
+	return 1
+}
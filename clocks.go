@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	annLockedClocks = "4paradigm.com/vgpu-locked-clocks"
+	annPowerLimit   = "4paradigm.com/vgpu-power-limit"
+)
+
+const gpuTunerResyncPeriod = 30 * time.Second
+
+// gpuTuner is non-nil when --enable-gpu-tuning is set
+var gpuTuner *GpuTuner
+
+// gpuTuning records the settings applied to a GPU on behalf of a pod
+type gpuTuning struct {
+	podUID        string
+	lockedClocks  bool
+	originalPower *uint
+}
+
+// GpuTuner applies locked clocks and power limits requested by pod annotations
+// and reverts them once the owning pod has terminated. The NVML bindings in use
+// do not expose the setters, so nvidia-smi is used to apply them.
+type GpuTuner struct {
+	mux   sync.Mutex
+	tuned map[string]*gpuTuning
+}
+
+// NewGpuTuner returns a reference to a new GpuTuner
+func NewGpuTuner() *GpuTuner {
+	return &GpuTuner{
+		tuned: make(map[string]*gpuTuning),
+	}
+}
+
+// parseLockedClocks parses a "min,max" graphics clock range in MHz
+func parseLockedClocks(value string) (uint, uint, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid %s annotation: %q", annLockedClocks, value)
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid %s annotation: %q", annLockedClocks, value)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil || max < min {
+		return 0, 0, fmt.Errorf("invalid %s annotation: %q", annLockedClocks, value)
+	}
+	return uint(min), uint(max), nil
+}
+
+// checkWholeGPUs refuses the clock and power annotations of a pod sharing a GPU of the container
+// with other pods: the settings apply to the whole GPU, so the pod must hold it exclusively with
+// annExclusive, or hold every vDevice of it
+func checkWholeGPUs(a *containerAllocation) error {
+	_, hasClocks := a.pod.Annotations[annLockedClocks]
+	_, hasPower := a.pod.Annotations[annPowerLimit]
+	if !hasClocks && !hasPower {
+		return nil
+	}
+
+	held := make(map[string]map[string]bool)
+	hold := func(ids []string) {
+		for _, id := range ids {
+			if gpu := vDeviceGPU(id); gpu != "" {
+				if held[gpu] == nil {
+					held[gpu] = make(map[string]bool)
+				}
+				held[gpu][id] = true
+			}
+		}
+	}
+	hold(a.deviceIDs)
+	for _, ids := range a.using {
+		hold(ids)
+	}
+	// The containers of the pod allocated by earlier Allocate calls
+	if cp, err := readKubeletCheckpoint(); err == nil {
+		podDevices, _ := cp.GetData()
+		for _, pde := range podDevices {
+			if pde.PodUID == string(a.pod.UID) {
+				hold(pde.DeviceIDs)
+			}
+		}
+	}
+
+	for _, vd := range a.vdevices {
+		gpu := vd.dev.ID
+		if exclusive.heldBy(gpu, string(a.pod.UID)) {
+			continue
+		}
+		if uint(len(held[gpu])) < vd.split {
+			return fmt.Errorf("%s and %s need whole GPUs, pod %s holds %d of the %d vDevices of %s; annotate it with %s or request all the vDevices of the GPU",
+				annLockedClocks, annPowerLimit, a.pod.Name, len(held[gpu]), vd.split, gpu, annExclusive)
+		}
+	}
+	return nil
+}
+
+// apply locks clocks and caps power on the given GPUs according to the pod annotations, once
+// every container of the Allocate call is allocated. A GPU already tuned on behalf of another
+// pod is left untouched. On error, the GPUs tuned by this call are reverted.
+func (t *GpuTuner) apply(pod *v1.Pod, uuids []string) error {
+	clocks, hasClocks := pod.Annotations[annLockedClocks]
+	power, hasPower := pod.Annotations[annPowerLimit]
+	if !hasClocks && !hasPower {
+		return nil
+	}
+
+	var minClock, maxClock uint
+	var watts uint64
+	var err error
+	if hasClocks {
+		minClock, maxClock, err = parseLockedClocks(clocks)
+		if err != nil {
+			return err
+		}
+	}
+	if hasPower {
+		watts, err = strconv.ParseUint(strings.TrimSpace(power), 10, 32)
+		if err != nil || watts == 0 {
+			return fmt.Errorf("invalid %s annotation: %q", annPowerLimit, power)
+		}
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var tuned []string
+	rollback := func() {
+		for _, uuid := range tuned {
+			t.revertLocked(uuid, t.tuned[uuid])
+		}
+	}
+	for _, uuid := range uuids {
+		if tuning, ok := t.tuned[uuid]; ok {
+			if tuning.podUID != string(pod.UID) {
+				log.Printf("Warning: %s is already tuned for pod %s, ignoring request from %s", uuid, tuning.podUID, pod.Name)
+			}
+			continue
+		}
+		tuning := &gpuTuning{podUID: string(pod.UID)}
+		t.tuned[uuid] = tuning
+		if hasClocks {
+			if err := nvidiaSmi("-i", uuid, "-lgc", fmt.Sprintf("%d,%d", minClock, maxClock)); err != nil {
+				t.revertLocked(uuid, tuning)
+				rollback()
+				return fmt.Errorf("failed to lock clocks on %s: %v", uuid, err)
+			}
+			tuning.lockedClocks = true
+		}
+		if hasPower {
+			dev, err := gpuLibrary.deviceByUUID(uuid)
+			if err != nil {
+				t.revertLocked(uuid, tuning)
+				rollback()
+				return err
+			}
+			tuning.originalPower = dev.Power
+			if err := nvidiaSmi("-i", uuid, "-pl", fmt.Sprint(watts)); err != nil {
+				t.revertLocked(uuid, tuning)
+				rollback()
+				return fmt.Errorf("failed to set power limit on %s: %v", uuid, err)
+			}
+		}
+		tuned = append(tuned, uuid)
+		log.Printf("Applied clock/power settings on %s for pod %s", uuid, pod.Name)
+	}
+	return nil
+}
+
+// defaultPowerLimit returns the default power limit of the GPU in watts
+func defaultPowerLimit(uuid string) (*uint, error) {
+	out, err := exec.Command("nvidia-smi", "-i", uuid, "--query-gpu=power.default_limit", "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, err
+	}
+	watts, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected power.default_limit %q", strings.TrimSpace(string(out)))
+	}
+	limit := uint(watts)
+	return &limit, nil
+}
+
+// restore rebuilds the tuned GPUs of the pods of the node with tuning annotations after the
+// plugin restarts, users being the pods using each GPU according to the kubelet checkpoint. The
+// settings applied before the restart are kept until their pod ends; the power limit is then
+// reset to the default of the GPU, the limit before the pod is not known anymore.
+func (t *GpuTuner) restore(pods []v1.Pod, users map[string]map[string]bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, p := range pods {
+		if p.Status.Phase != v1.PodPending && p.Status.Phase != v1.PodRunning {
+			continue
+		}
+		_, hasClocks := p.Annotations[annLockedClocks]
+		_, hasPower := p.Annotations[annPowerLimit]
+		if !hasClocks && !hasPower {
+			continue
+		}
+		for uuid, uids := range users {
+			if !uids[string(p.UID)] {
+				continue
+			}
+			if _, ok := t.tuned[uuid]; ok {
+				continue
+			}
+			tuning := &gpuTuning{podUID: string(p.UID), lockedClocks: hasClocks}
+			if hasPower {
+				limit, err := defaultPowerLimit(uuid)
+				if err != nil {
+					log.Printf("Warning: failed to read the default power limit of %s: %v", uuid, err)
+				}
+				tuning.originalPower = limit
+			}
+			t.tuned[uuid] = tuning
+			log.Printf("Restored the clock/power settings of %s for pod %s/%s", uuid, p.Namespace, p.Name)
+		}
+	}
+}
+
+// revertLocked restores the settings recorded in tuning; t.mux must be held
+func (t *GpuTuner) revertLocked(uuid string, tuning *gpuTuning) {
+	if tuning.lockedClocks {
+		if err := nvidiaSmi("-i", uuid, "-rgc"); err != nil {
+			log.Printf("Error: failed to reset clocks on %s: %v", uuid, err)
+		}
+	}
+	if tuning.originalPower != nil {
+		if err := nvidiaSmi("-i", uuid, "-pl", fmt.Sprint(*tuning.originalPower)); err != nil {
+			log.Printf("Error: failed to restore power limit on %s: %v", uuid, err)
+		}
+	}
+	delete(t.tuned, uuid)
+}
+
+// reconcile reverts the settings of GPUs whose owning pod is no longer active
+func (t *GpuTuner) reconcile(pods []v1.Pod) {
+	active := make(map[string]bool)
+	for _, p := range pods {
+		if p.Status.Phase == v1.PodPending || p.Status.Phase == v1.PodRunning {
+			active[string(p.UID)] = true
+		}
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for uuid, tuning := range t.tuned {
+		if !active[tuning.podUID] {
+			log.Printf("Reverting clock/power settings on %s, pod %s is gone", uuid, tuning.podUID)
+			t.revertLocked(uuid, tuning)
+		}
+	}
+}
+
+// run restores the GPUs tuned before the plugin started, then periodically reconciles tuned
+// GPUs against the pods on this node
+func (t *GpuTuner) run(stop <-chan struct{}) {
+	client, err := newKubeClient()
+	if err != nil {
+		log.Printf("Error: GPU tuner cannot create kubernetes client: %v", err)
+		return
+	}
+	opts := nodePodsListOptions()
+	ticker := time.NewTicker(gpuTunerResyncPeriod)
+	defer ticker.Stop()
+	restored := false
+	for {
+		ctx, cancel := kubeContext(context.Background())
+		pods, err := client.CoreV1().Pods("").List(ctx, opts)
+		cancel()
+		if err != nil {
+			log.Printf("Error: GPU tuner failed to list pods: %v", err)
+		} else {
+			if !restored {
+				if users, err := gpuPods(); err != nil {
+					log.Printf("Error: GPU tuner failed to read the GPUs in use: %v", err)
+				} else {
+					t.restore(pods.Items, users)
+					restored = true
+				}
+			}
+			// The GPUs of running pods are not reverted before their settings are restored
+			if restored {
+				t.reconcile(pods.Items)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func nvidiaSmi(args ...string) error {
+	out, err := exec.Command("nvidia-smi", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// kubectl-vgpu prints the vGPU state of nodes running the device plugin with
+// its metrics address enabled. Installed on the PATH it runs as `kubectl vgpu`.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// The types below mirror the /debug/devices response of the device plugin
+
+type nodeStatus struct {
+	Node    string         `json:"node"`
+	Devices []deviceStatus `json:"devices"`
+}
+
+type deviceStatus struct {
+	UUID          string          `json:"uuid"`
+	Resource      string          `json:"resource"`
+	Health        string          `json:"health"`
+	HealthReason  string          `json:"healthReason,omitempty"`
+	MemoryTotal   uint64          `json:"memoryTotal"`
+	MemoryGranted uint64          `json:"memoryGranted"`
+	VDevices      []vDeviceStatus `json:"vdevices"`
+}
+
+type vDeviceStatus struct {
+	ID        string `json:"id"`
+	Memory    uint64 `json:"memory"`
+	Health    string `json:"health"`
+	Pod       string `json:"pod,omitempty"`
+	PodUID    string `json:"podUID,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+func main() {
+	c := cli.NewApp()
+	c.Name = "kubectl-vgpu"
+	c.Usage = "show the GPU, vGPU and pod mapping of nodes"
+	c.ArgsUsage = "[NODE...]"
+	c.Action = run
+	c.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "query a plugin at host:port directly instead of resolving nodes",
+		},
+		&cli.IntFlag{
+			Name:  "port",
+			Value: 9394,
+			Usage: "the metrics port of the device plugin",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "table",
+			Usage:   "the output format: [table | json]",
+		},
+		&cli.StringFlag{
+			Name:    "kubeconfig",
+			Value:   filepath.Join(os.Getenv("HOME"), ".kube", "config"),
+			EnvVars: []string{"KUBECONFIG"},
+			Usage:   "the kubeconfig used to resolve node addresses",
+		},
+	}
+	if err := c.Run(os.Args); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func run(c *cli.Context) error {
+	output := c.String("output")
+	if output != "table" && output != "json" {
+		return fmt.Errorf("invalid --output option: %v", output)
+	}
+
+	var addresses []string
+	if c.String("address") != "" {
+		addresses = append(addresses, c.String("address"))
+	} else {
+		var err error
+		addresses, err = nodeAddresses(c.String("kubeconfig"), c.Args().Slice(), c.Int("port"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var statuses []*nodeStatus
+	for _, addr := range addresses {
+		status, err := fetchStatus(addr)
+		if err != nil {
+			log.Printf("Warning: %s: %v", addr, err)
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+	printTable(statuses)
+	return nil
+}
+
+// nodeAddresses returns the plugin addresses of the named nodes, or of all nodes if none is named
+func nodeAddresses(kubeconfig string, names []string, port int) ([]string, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []v1.Node
+	if len(names) == 0 {
+		list, err := client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		nodes = list.Items
+	} else {
+		for _, name := range names {
+			node, err := client.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, *node)
+		}
+	}
+	var addresses []string
+	for _, node := range nodes {
+		if _, ok := node.Status.Capacity["nvidia.com/gpu"]; !ok && len(names) == 0 {
+			continue
+		}
+		for _, a := range node.Status.Addresses {
+			if a.Type == v1.NodeInternalIP {
+				addresses = append(addresses, fmt.Sprintf("%s:%d", a.Address, port))
+				break
+			}
+		}
+	}
+	return addresses, nil
+}
+
+func fetchStatus(addr string) (*nodeStatus, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + addr + "/debug/devices")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	status := &nodeStatus{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, err
+	}
+	if status.Node == "" {
+		status.Node = addr
+	}
+	return status, nil
+}
+
+func printTable(statuses []*nodeStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tGPU\tHEALTH\tMEMORY(MiB)\tFREE(MiB)\tVDEVICE\tVMEMORY(MiB)\tPOD\tCONTAINER")
+	for _, n := range statuses {
+		for _, d := range n.Devices {
+			free := int64(d.MemoryTotal) - int64(d.MemoryGranted)
+			if free < 0 {
+				free = 0
+			}
+			health := d.Health
+			if d.HealthReason != "" && d.Health != "Healthy" {
+				health += " (" + d.HealthReason + ")"
+			}
+			if len(d.VDevices) == 0 {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t-\t-\t-\t-\n", n.Node, d.UUID, health, d.MemoryTotal, free)
+			}
+			for _, vd := range d.VDevices {
+				pod := vd.Pod
+				if pod == "" {
+					pod = vd.PodUID
+				}
+				if pod == "" {
+					pod = "-"
+				}
+				container := vd.Container
+				if container == "" {
+					container = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%d\t%s\t%s\n", n.Node, d.UUID, health, d.MemoryTotal, free, vd.ID, vd.Memory, pod, container)
+			}
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,172 @@
+// vgpu-isolation-hook is an OCI createRuntime (or prestart) hook refusing Kubernetes containers
+// that reach NVIDIA GPUs without having them allocated by the device plugin, such as images
+// setting NVIDIA_VISIBLE_DEVICES=all or privileged containers seeing every /dev/nvidia* node.
+//
+// The device plugin must run with --device-list-strategy=volume-mounts: its allocations are then
+// the /var/run/nvidia-container-devices mounts, which a pod spec cannot forge through an
+// environment variable, and any NVIDIA_VISIBLE_DEVICES listing devices comes from elsewhere.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// deviceListMountRoot is where the device plugin mounts the allocated devices with the
+// volume-mounts device list strategy
+const deviceListMountRoot = "/var/run/nvidia-container-devices"
+
+// Annotations of the pod namespace set by containerd and CRI-O
+var podNamespaceAnnotations = []string{
+	"io.kubernetes.cri.sandbox-namespace",
+	"io.kubernetes.pod.namespace",
+}
+
+// gpuDeviceNode matches the per GPU device nodes, not the control ones such as /dev/nvidiactl
+var gpuDeviceNode = regexp.MustCompile(`^/dev/nvidia[0-9]+$`)
+
+// The subset of the OCI state and runtime spec read by the hook
+
+type state struct {
+	ID     string `json:"id"`
+	Bundle string `json:"bundle"`
+}
+
+type spec struct {
+	Process *struct {
+		Env []string `json:"env"`
+	} `json:"process"`
+	Mounts []struct {
+		Destination string `json:"destination"`
+		Source      string `json:"source"`
+	} `json:"mounts"`
+	Linux *struct {
+		Devices []struct {
+			Path string `json:"path"`
+		} `json:"devices"`
+	} `json:"linux"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func main() {
+	mode := flag.String("mode", "enforce", "enforce to fail the containers reaching GPUs they were not allocated, audit to only log them")
+	exempt := flag.String("exempt-namespaces", "kube-system", "comma separated namespaces whose containers may reach any GPU, such as the one of the device plugin")
+	logFile := flag.String("log-file", "", "a file to append the decisions to, in addition to stderr")
+	flag.Parse()
+
+	if *logFile != "" {
+		if f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			log.SetOutput(f)
+			defer f.Close()
+		}
+	}
+
+	var st state
+	if err := json.NewDecoder(os.Stdin).Decode(&st); err != nil {
+		// Never block containers because of a broken runtime integration
+		log.Printf("Warning: vgpu-isolation-hook failed to read the container state: %v", err)
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(st.Bundle, "config.json"))
+	if err != nil {
+		log.Printf("Warning: vgpu-isolation-hook failed to read the spec of %s: %v", st.ID, err)
+		return
+	}
+	var s spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		log.Printf("Warning: vgpu-isolation-hook failed to parse the spec of %s: %v", st.ID, err)
+		return
+	}
+
+	namespace, ok := podNamespace(&s)
+	if !ok || contains(strings.Split(*exempt, ","), namespace) {
+		return
+	}
+	reason := violation(&s)
+	if reason == "" {
+		return
+	}
+	message := fmt.Sprintf("container %s in namespace %s %s without a GPU allocated by the device plugin", st.ID, namespace, reason)
+	if *mode == "audit" {
+		log.Printf("Audit: %s", message)
+		return
+	}
+	log.Printf("Denied: %s", message)
+	if *logFile != "" {
+		// The runtime reports the stderr of a failed hook as the container creation error
+		fmt.Fprintf(os.Stderr, "vgpu-isolation-hook: %s\n", message)
+	}
+	os.Exit(1)
+}
+
+// podNamespace returns the namespace of the pod of a Kubernetes container
+func podNamespace(s *spec) (string, bool) {
+	for _, a := range podNamespaceAnnotations {
+		if ns, ok := s.Annotations[a]; ok {
+			return ns, true
+		}
+	}
+	return "", false
+}
+
+// violation returns how a container reaches GPUs the device plugin did not allocate, or an
+// empty string
+func violation(s *spec) string {
+	allocated := false
+	for _, m := range s.Mounts {
+		if strings.HasPrefix(m.Destination, deviceListMountRoot+"/") {
+			allocated = true
+		}
+	}
+
+	visible, ok := env(s, "NVIDIA_VISIBLE_DEVICES")
+	if ok && visible != "" && visible != "void" && visible != "none" && visible != deviceListMountRoot {
+		return fmt.Sprintf("sets NVIDIA_VISIBLE_DEVICES=%s", visible)
+	}
+	if allocated {
+		return ""
+	}
+	if s.Linux != nil {
+		for _, d := range s.Linux.Devices {
+			if gpuDeviceNode.MatchString(d.Path) {
+				return fmt.Sprintf("gets the device %s", d.Path)
+			}
+		}
+	}
+	for _, m := range s.Mounts {
+		if gpuDeviceNode.MatchString(m.Source) {
+			return fmt.Sprintf("mounts the device %s", m.Source)
+		}
+	}
+	return ""
+}
+
+// env returns the last value of an environment variable of the container process
+func env(s *spec, name string) (string, bool) {
+	if s.Process == nil {
+		return "", false
+	}
+	value, found := "", false
+	for _, e := range s.Process.Env {
+		if strings.HasPrefix(e, name+"=") {
+			value, found = strings.TrimPrefix(e, name+"="), true
+		}
+	}
+	return value, found
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.TrimSpace(v) == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+// vgpu-webhook is an admission webhook for vGPU pods. On /mutate it sets the default
+// vGPU memory and cores annotations on pods requesting vGPUs without them; on /validate
+// it rejects pods whose annotations are invalid or can never be satisfied. The device
+// plugin honors the annotations in Allocate when started with --pod-annotations.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotations read by the device plugin, see pod-limits.go
+const (
+	annMemoryLimit      = "4paradigm.com/vgpu-memory"
+	annMemoryPercentage = "nvidia.com/gpumem-percentage"
+	annCoresLimit       = "4paradigm.com/vgpu-cores"
+)
+
+// The types below mirror the admission.k8s.io/v1 AdmissionReview fields used by the webhook
+
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID       `json:"uid"`
+	Namespace string          `json:"namespace,omitempty"`
+	Operation string          `json:"operation"`
+	Object    json.RawMessage `json:"object,omitempty"`
+}
+
+type admissionResponse struct {
+	UID       types.UID `json:"uid"`
+	Allowed   bool      `json:"allowed"`
+	Result    *status   `json:"status,omitempty"`
+	Patch     []byte    `json:"patch,omitempty"`
+	PatchType *string   `json:"patchType,omitempty"`
+}
+
+type status struct {
+	Message string `json:"message,omitempty"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// webhook holds the defaults injected into pods
+type webhook struct {
+	resourceName string
+	memory       uint64
+	cores        int
+}
+
+func main() {
+	var certFile, keyFile, address string
+	wh := &webhook{}
+	va := &validator{}
+	var memory, maxMemory, memoryQuantum string
+
+	c := cli.NewApp()
+	c.Name = "vgpu-webhook"
+	c.Usage = "default and validate the vGPU memory and cores annotations of pods"
+	c.Action = func(ctx *cli.Context) error {
+		if wh.cores < 0 || wh.cores > 100 {
+			return fmt.Errorf("invalid --default-cores option: %v", wh.cores)
+		}
+		if va.memoryScaling <= 0 {
+			return fmt.Errorf("invalid --device-memory-scaling option: %v", va.memoryScaling)
+		}
+		if va.splitCount < 1 {
+			return fmt.Errorf("invalid --device-split-count option: %v", va.splitCount)
+		}
+		if memory != "" {
+			var err error
+			wh.memory, err = parseMemoryMiB(memory)
+			if err != nil {
+				return fmt.Errorf("invalid --default-memory option: %v", err)
+			}
+		}
+		if maxMemory != "" {
+			var err error
+			va.maxMemory, err = parseMemoryMiB(maxMemory)
+			if err != nil {
+				return fmt.Errorf("invalid --max-device-memory option: %v", err)
+			}
+		}
+		if memoryQuantum != "" {
+			var err error
+			va.memoryQuantum, err = parseMemoryMiB(memoryQuantum)
+			if err != nil || va.memoryQuantum == 0 {
+				return fmt.Errorf("invalid --vdevice-memory-quantum option: %v", memoryQuantum)
+			}
+		}
+		http.HandleFunc("/mutate", wh.serveMutate)
+		http.HandleFunc("/validate", va.serveValidate)
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+		log.Printf("Serving vgpu-webhook on %s", address)
+		return http.ListenAndServeTLS(address, certFile, keyFile, nil)
+	}
+	c.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "address",
+			Value:       ":8443",
+			Usage:       "the address to serve the webhook on",
+			Destination: &address,
+			EnvVars:     []string{"ADDRESS"},
+		},
+		&cli.StringFlag{
+			Name:        "tls-cert-file",
+			Value:       "/etc/vgpu-webhook/tls.crt",
+			Usage:       "the TLS certificate of the webhook",
+			Destination: &certFile,
+			EnvVars:     []string{"TLS_CERT_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "tls-key-file",
+			Value:       "/etc/vgpu-webhook/tls.key",
+			Usage:       "the TLS private key of the webhook",
+			Destination: &keyFile,
+			EnvVars:     []string{"TLS_KEY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "resource-name",
+			Value:       "nvidia.com/gpu",
+			Usage:       "the vGPU count resource",
+			Destination: &wh.resourceName,
+			EnvVars:     []string{"RESOURCE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:        "default-memory",
+			Value:       "",
+			Usage:       "the default memory of each vGPU, in MiB or with a unit such as 4Gi, empty leaves it unset",
+			Destination: &memory,
+			EnvVars:     []string{"DEFAULT_MEMORY"},
+		},
+		&cli.IntFlag{
+			Name:        "default-cores",
+			Value:       0,
+			Usage:       "the default SM percentage of each vGPU, 0 leaves it unset",
+			Destination: &wh.cores,
+			EnvVars:     []string{"DEFAULT_CORES"},
+		},
+		&cli.StringFlag{
+			Name:        "max-device-memory",
+			Value:       "",
+			Usage:       "the memory of the largest GPU, in MiB or with a unit such as 80Gi, empty discovers it from the nvidia.com/gpu.memory node labels",
+			Destination: &maxMemory,
+			EnvVars:     []string{"MAX_DEVICE_MEMORY"},
+		},
+		&cli.Float64Flag{
+			Name:        "device-memory-scaling",
+			Value:       1.0,
+			Usage:       "the device-memory-scaling of the device plugins",
+			Destination: &va.memoryScaling,
+			EnvVars:     []string{"DEVICE_MEMORY_SCALING"},
+		},
+		&cli.UintFlag{
+			Name:        "device-split-count",
+			Value:       2,
+			Usage:       "the device-split-count of the device plugins, the vGPU memory a pod can request is the GPU memory divided by it",
+			Destination: &va.splitCount,
+			EnvVars:     []string{"DEVICE_SPLIT_COUNT"},
+		},
+		&cli.StringFlag{
+			Name:        "vdevice-memory-quantum",
+			Value:       "",
+			Usage:       "the vdevice-memory-quantum of the device plugins, if set",
+			Destination: &memoryQuantum,
+			EnvVars:     []string{"VDEVICE_MEMORY_QUANTUM"},
+		},
+	}
+
+	if err := c.Run(os.Args); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func (wh *webhook) serveMutate(w http.ResponseWriter, r *http.Request) {
+	review, ok := readReview(w, r)
+	if !ok {
+		return
+	}
+	review.Response = wh.mutate(review.Request)
+	review.Request = nil
+	writeReview(w, review)
+}
+
+// readReview decodes the AdmissionReview of a request, replying with an error if it is invalid
+func readReview(w http.ResponseWriter, r *http.Request) (*admissionReview, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	review := &admissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	return review, true
+}
+
+func writeReview(w http.ResponseWriter, review *admissionReview) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Printf("Error: failed to write AdmissionReview: %v", err)
+	}
+}
+
+func decodePod(req *admissionRequest) (*v1.Pod, error) {
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(req.Object, pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// mutate returns the response to an admission request; it never rejects a pod
+func (wh *webhook) mutate(req *admissionRequest) *admissionResponse {
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	pod, err := decodePod(req)
+	if err != nil {
+		log.Printf("Warning: failed to decode pod in %s: %v", req.Namespace, err)
+		resp.Result = &status{Message: err.Error()}
+		return resp
+	}
+	patch := wh.patch(pod)
+	if len(patch) == 0 {
+		return resp
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		resp.Result = &status{Message: err.Error()}
+		return resp
+	}
+	patchType := "JSONPatch"
+	resp.Patch = data
+	resp.PatchType = &patchType
+	log.Printf("Defaulted vGPU annotations of pod %s/%s", req.Namespace, podName(pod))
+	return resp
+}
+
+// patch returns the JSON patch adding the missing default annotations to a pod requesting vGPUs
+func (wh *webhook) patch(pod *v1.Pod) []patchOperation {
+	if !requestsResource(pod, v1.ResourceName(wh.resourceName)) {
+		return nil
+	}
+	defaults := make(map[string]string)
+	_, hasMemory := pod.Annotations[annMemoryLimit]
+	_, hasPercentage := pod.Annotations[annMemoryPercentage]
+	if !hasMemory && !hasPercentage && wh.memory > 0 {
+		defaults[annMemoryLimit] = strconv.FormatUint(wh.memory, 10)
+	}
+	if _, ok := pod.Annotations[annCoresLimit]; !ok && wh.cores > 0 {
+		defaults[annCoresLimit] = strconv.Itoa(wh.cores)
+	}
+	if len(defaults) == 0 {
+		return nil
+	}
+	if pod.Annotations == nil {
+		return []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: defaults}}
+	}
+	var ops []patchOperation
+	for _, k := range []string{annMemoryLimit, annCoresLimit} {
+		if v, ok := defaults[k]; ok {
+			ops = append(ops, patchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(k), Value: v})
+		}
+	}
+	return ops
+}
+
+// requestsResource returns true if a container of the pod has a limit on the resource
+func requestsResource(pod *v1.Pod, name v1.ResourceName) bool {
+	for _, ctr := range pod.Spec.Containers {
+		if _, ok := ctr.Resources.Limits[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// podName returns the name of a pod, which is not set yet for pods created with generateName
+func podName(pod *v1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The memory size parsing below is a copy of memory-units.go of the device plugin
+
+// memoryUnits maps the accepted memory suffixes to their size in bytes. Single letter
+// suffixes such as "M", "G" or the "m" written to CUDA_DEVICE_MEMORY_LIMIT_* are rejected
+// because they are ambiguous between binary and decimal units, or mean milli in Kubernetes.
+var memoryUnits = map[string]uint64{
+	"Mi":  1 << 20,
+	"MiB": 1 << 20,
+	"Gi":  1 << 30,
+	"GiB": 1 << 30,
+	"Ti":  1 << 40,
+	"TiB": 1 << 40,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+}
+
+// parseMemoryMiB parses a memory size into MiB. A plain number is in MiB; decimal units
+// are rounded down to a whole MiB.
+func parseMemoryMiB(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i == 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	if i < 0 {
+		return strconv.ParseUint(s, 10, 64)
+	}
+	value, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size %q: %v", s, err)
+	}
+	unit := strings.TrimSpace(s[i:])
+	bytes, ok := memoryUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid memory size %q: unit must be one of Mi, Gi, Ti, MiB, GiB, TiB, MB, GB, TB", s)
+	}
+	return value * bytes / (1 << 20), nil
+}
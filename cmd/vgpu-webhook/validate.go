@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// gpuMemoryLabel is the GPU memory in MiB published on nodes by gpu-feature-discovery
+const gpuMemoryLabel = "nvidia.com/gpu.memory"
+
+// nodeMemoryRefresh is how long the largest GPU memory of the cluster is cached
+const nodeMemoryRefresh = time.Minute
+
+// migResourcePrefix prefixes the MIG resources, which ignore the vGPU limits
+const migResourcePrefix = "nvidia.com/mig-"
+
+// validator rejects pods whose vGPU requests can never be satisfied
+type validator struct {
+	// maxMemory overrides the largest GPU memory in MiB discovered from the node labels
+	maxMemory     uint64
+	memoryScaling float64
+	// splitCount and memoryQuantum are the --device-split-count and --vdevice-memory-quantum of
+	// the device plugins, which size the vGPUs of a GPU
+	splitCount    uint
+	memoryQuantum uint64
+
+	mux       sync.Mutex
+	client    kubernetes.Interface
+	cached    uint64
+	refreshed time.Time
+}
+
+func (va *validator) serveValidate(w http.ResponseWriter, r *http.Request) {
+	review, ok := readReview(w, r)
+	if !ok {
+		return
+	}
+	review.Response = va.validate(review.Request)
+	review.Request = nil
+	writeReview(w, review)
+}
+
+// validate returns the response to an admission request, denying pods with impossible vGPU requests
+func (va *validator) validate(req *admissionRequest) *admissionResponse {
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	pod, err := decodePod(req)
+	if err != nil {
+		log.Printf("Warning: failed to decode pod in %s: %v", req.Namespace, err)
+		return resp
+	}
+	if err := va.check(pod); err != nil {
+		log.Printf("Denied pod %s/%s: %v", req.Namespace, podName(pod), err)
+		resp.Allowed = false
+		resp.Result = &status{Message: err.Error()}
+	}
+	return resp
+}
+
+// check returns an error if the vGPU requests of the pod are invalid or larger than any GPU
+func (va *validator) check(pod *v1.Pod) error {
+	_, hasMemory := pod.Annotations[annMemoryLimit]
+	_, hasPercentage := pod.Annotations[annMemoryPercentage]
+	_, hasCores := pod.Annotations[annCoresLimit]
+	if !hasMemory && !hasPercentage && !hasCores {
+		return nil
+	}
+	if requestsResourcePrefix(pod, migResourcePrefix) {
+		return fmt.Errorf("%s, %s and %s do not apply to MIG devices", annMemoryLimit, annMemoryPercentage, annCoresLimit)
+	}
+	if hasPercentage {
+		value := pod.Annotations[annMemoryPercentage]
+		percent, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("invalid %s annotation %q: must be a percentage between 1 and 100", annMemoryPercentage, value)
+		}
+	}
+	if hasCores {
+		value := pod.Annotations[annCoresLimit]
+		cores, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || cores <= 0 || cores > 100 {
+			return fmt.Errorf("invalid %s annotation %q: must be a percentage between 1 and 100", annCoresLimit, value)
+		}
+	}
+	if hasMemory {
+		value := pod.Annotations[annMemoryLimit]
+		memory, err := parseMemoryMiB(value)
+		if err != nil || memory == 0 {
+			return fmt.Errorf("invalid %s annotation %q: must be a positive number of MiB or a size such as 8Gi", annMemoryLimit, value)
+		}
+		largest := va.largestMemory()
+		if largest > 0 && memory > largest {
+			return fmt.Errorf("%s annotation requests %vMiB per vGPU, more than the vGPUs of the largest GPU in the cluster (%vMiB)", annMemoryLimit, memory, largest)
+		}
+	}
+	return nil
+}
+
+// vdeviceMemory returns the memory in MiB of each vGPU of a GPU, split as the device plugins do
+func (va *validator) vdeviceMemory(gpuMemory uint64) uint64 {
+	scaled := uint64(float64(gpuMemory) * va.memoryScaling)
+	if va.memoryQuantum == 0 {
+		return scaled / uint64(va.splitCount)
+	}
+	if scaled < va.memoryQuantum {
+		return scaled
+	}
+	return va.memoryQuantum
+}
+
+// largestMemory returns the largest vGPU memory in MiB a pod can be granted, or 0 if unknown
+func (va *validator) largestMemory() uint64 {
+	if va.maxMemory > 0 {
+		return va.vdeviceMemory(va.maxMemory)
+	}
+	va.mux.Lock()
+	defer va.mux.Unlock()
+	if time.Since(va.refreshed) < nodeMemoryRefresh {
+		return va.cached
+	}
+	largest, err := va.discoverMemory()
+	if err != nil {
+		log.Printf("Warning: failed to discover GPU memory of nodes: %v", err)
+		return va.cached
+	}
+	va.cached = va.vdeviceMemory(largest)
+	va.refreshed = time.Now()
+	return va.cached
+}
+
+// discoverMemory returns the largest gpu-feature-discovery memory label of the nodes
+func (va *validator) discoverMemory() (uint64, error) {
+	if va.client == nil {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return 0, err
+		}
+		va.client, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			return 0, err
+		}
+	}
+	nodes, err := va.client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{LabelSelector: gpuMemoryLabel})
+	if err != nil {
+		return 0, err
+	}
+	var largest uint64
+	for _, node := range nodes.Items {
+		memory, err := strconv.ParseUint(node.Labels[gpuMemoryLabel], 10, 64)
+		if err != nil {
+			continue
+		}
+		if memory > largest {
+			largest = memory
+		}
+	}
+	return largest, nil
+}
+
+// requestsResourcePrefix returns true if a container of the pod has a limit on a resource with the prefix
+func requestsResourcePrefix(pod *v1.Pod, prefix string) bool {
+	for _, ctr := range pod.Spec.Containers {
+		for name := range ctr.Resources.Limits {
+			if strings.HasPrefix(string(name), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
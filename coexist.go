@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// upstreamResourceName is the resource advertised by the upstream NVIDIA device plugin
+const upstreamResourceName = "nvidia.com/gpu"
+
+// upstreamSocket returns the socket of the upstream NVIDIA device plugin
+func upstreamSocket() string {
+	return devicePluginSocket("nvidia-gpu.sock")
+}
+
+// upstreamClaimsInterval is the interval at which GPUs claimed through the upstream plugin are checked
+const upstreamClaimsInterval = 10 * time.Second
+
+// gpuResourceName returns the resource name of full GPUs, which differs from the upstream one in coexistence mode
+func gpuResourceName() string {
+	if coexistFlag {
+		return coexistResourceNameFlag
+	}
+	return upstreamResourceName
+}
+
+// gpuSocket returns the socket of the full GPU plugin
+func gpuSocket() string {
+	if coexistFlag {
+		return devicePluginSocket("vgpu-nvidia-gpu.sock")
+	}
+	return upstreamSocket()
+}
+
+// upstreamPluginRunning returns true if the upstream NVIDIA device plugin serves or registered nvidia.com/gpu
+func upstreamPluginRunning() bool {
+	if _, err := os.Stat(upstreamSocket()); err == nil {
+		return true
+	}
+	cp, err := readKubeletCheckpoint()
+	if err != nil {
+		return false
+	}
+	_, registered := cp.GetData()
+	_, ok := registered[upstreamResourceName]
+	return ok
+}
+
+// upstreamClaims returns the UUIDs and indexes of the GPUs allocated through the upstream plugin
+func upstreamClaims() (map[string]bool, error) {
+	cp, err := readKubeletCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	podDevices, _ := cp.GetData()
+	claims := make(map[string]bool)
+	for _, pde := range podDevices {
+		if pde.ResourceName != upstreamResourceName {
+			continue
+		}
+		for _, id := range pde.DeviceIDs {
+			claims[id] = true
+		}
+	}
+	return claims, nil
+}
+
+// watchUpstreamClaims masks the GPUs allocated through the upstream plugin by marking them
+// unhealthy until they are released, so that their vDevices are not shared meanwhile
+func (m *NvidiaDevicePlugin) watchUpstreamClaims(stop <-chan interface{}, devices []*Device, health chan<- *DeviceHealth) {
+	masked := make(map[string]bool)
+	for {
+		claims, err := upstreamClaims()
+		if err != nil {
+			log.Printf("Warning: failed to read GPUs claimed through %s: %v", upstreamResourceName, err)
+		}
+		for _, d := range devices {
+			if err != nil {
+				break
+			}
+			claimed := claims[d.ID] || claims[d.Index]
+			var h *DeviceHealth
+			switch {
+			case claimed && !masked[d.ID]:
+				log.Printf("GPU %s claimed through %s, masking it from '%s'", d.ID, upstreamResourceName, m.resourceName)
+				h = unhealthyEvent(d, "claimed through %s", upstreamResourceName)
+			case !claimed && masked[d.ID]:
+				log.Printf("GPU %s released by %s, unmasking it", d.ID, upstreamResourceName)
+				h = &DeviceHealth{Device: d, Health: pluginapi.Healthy, Reason: "released by " + upstreamResourceName}
+			default:
+				continue
+			}
+			select {
+			case health <- h:
+				masked[d.ID] = claimed
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(upstreamClaimsInterval):
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ccAllocStrategy is the strategy of the plugin advertising the GPUs in confidential computing
+// mode as whole devices
+const ccAllocStrategy = "confidential"
+
+// annConfidentialComputing is the node annotation reporting the confidential computing state of
+// the GPUs as JSON
+const annConfidentialComputing = "4paradigm.com/vgpu-confidential-computing"
+
+// ccModeLabel labels the nodes whose GPUs run in confidential computing mode
+const ccModeLabel = "4paradigm.com/vgpu-cc-mode"
+
+// ccState is the confidential computing state of the GPUs of the node
+type ccState struct {
+	// Mode is the CC state reported by the driver, "on", "devtools" or "off"
+	Mode string `json:"mode"`
+	// Ready is set once the GPUs accept work, after the attestation of the confidential VM
+	Ready bool     `json:"ready"`
+	GPUs  []string `json:"gpus,omitempty"`
+}
+
+// confidentialComputing is the state detected at startup, nil if the driver does not support
+// confidential computing
+var confidentialComputing *ccState
+
+// enabled returns true if the GPUs run in confidential computing mode
+func (s *ccState) enabled() bool {
+	return s != nil && s.Mode != "" && s.Mode != "off"
+}
+
+// detectConfidentialComputing reads the confidential computing state of the driver. The NVML
+// bindings in use do not expose it, so nvidia-smi is used. The driver enables the mode for all
+// the GPUs of the node at once.
+func detectConfidentialComputing() *ccState {
+	out, err := exec.Command("nvidia-smi", "conf-compute", "-q").Output()
+	if err != nil {
+		log.Printf("Confidential computing not supported by the driver: %v", err)
+		return nil
+	}
+	s := parseConfCompute(out)
+	if s.enabled() {
+		log.Printf("GPUs in confidential computing mode %s, ready: %v. They are advertised as whole '%s' devices.", s.Mode, s.Ready, ccResourceNameFlag)
+	}
+	return s
+}
+
+// parseConfCompute parses the "<key> : <value>" lines printed by nvidia-smi conf-compute -q
+func parseConfCompute(out []byte) *ccState {
+	s := &ccState{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.ToLower(strings.TrimSpace(kv[1]))
+		switch key {
+		case "CC State", "CC status":
+			s.Mode = value
+		case "CC GPUs Ready State":
+			s.Ready = value == "ready"
+		}
+	}
+	return s
+}
+
+// isConfidentialGPU returns true if the GPU runs in confidential computing mode, which does not
+// support the software split: it is only advertised whole, by the plugin of ccResourceNameFlag
+func isConfidentialGPU(uuid string) bool {
+	return confidentialComputing.enabled()
+}
+
+// NewConfidentialGpuDeviceManager returns a reference to a new GpuDeviceManager for the GPUs in
+// confidential computing mode
+func NewConfidentialGpuDeviceManager() *GpuDeviceManager {
+	return &GpuDeviceManager{
+		skipMigEnabledGPUs: true,
+		confidential:       true,
+	}
+}
+
+// getConfidentialPlugin returns the plugin advertising the GPUs in confidential computing mode
+func getConfidentialPlugin() *NvidiaDevicePlugin {
+	plugin := NewNvidiaDevicePlugin(
+		ccResourceNameFlag,
+		NewConfidentialGpuDeviceManager(),
+		"NVIDIA_VISIBLE_DEVICES",
+		nil,
+		devicePluginSocket("vgpu-cc.sock"))
+	plugin.migStrategy = ccAllocStrategy
+	return plugin
+}
+
+// publishConfidentialComputing labels the node of the plugin and sets its
+// annConfidentialComputing annotation to the state of its GPUs
+func publishConfidentialComputing(plugin *NvidiaDevicePlugin) error {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" || !confidentialComputing.enabled() {
+		return nil
+	}
+	state := *confidentialComputing
+	for _, d := range plugin.Devices() {
+		state.GPUs = append(state.GPUs, d.ID)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{ccModeLabel: state.Mode},
+			"annotations": map[string]interface{}{annConfidentialComputing: string(data)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	_, err = client.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
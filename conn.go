@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// connManager dials gRPC servers listening on unix sockets, such as the kubelet
+// registration socket and the plugin's own socket
+type connManager struct {
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+}
+
+// defaultConnManager is used for all dials of the plugin
+var defaultConnManager = &connManager{
+	timeout: 5 * time.Second,
+	retries: 3,
+	backoff: time.Second,
+}
+
+func dialUnix(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", addr)
+}
+
+// dial connects to the unix socket, retrying with a linear backoff. The returned
+// connection is ready to use; dial errors are surfaced instead of a bare timeout.
+func (c *connManager) dial(unixSocketPath string) (*grpc.ClientConn, error) {
+	var lastErr error
+	for attempt := 0; attempt < c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * c.backoff)
+		}
+		conn, err := c.dialOnce(unixSocketPath)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		log.Printf("Failed to dial %s (attempt %d/%d): %v", unixSocketPath, attempt+1, c.retries, err)
+	}
+	return nil, fmt.Errorf("failed to dial %s: %v", unixSocketPath, lastErr)
+}
+
+func (c *connManager) dialOnce(unixSocketPath string) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, unixSocketPath,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithContextDialer(dialUnix),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if state := conn.GetState(); state != connectivity.Ready {
+		conn.Close()
+		return nil, fmt.Errorf("connection is %v", state)
+	}
+	return conn, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+)
+
+// allocationConstraints is the JSON content of --allocation-constraints: expressions evaluated
+// for each candidate vDevice of an allocation, see expr.go for the supported CEL subset.
+//
+//	{
+//	  "filter": ["gpu.model.contains('A100') || pod.namespace != 'prod'"],
+//	  "rank": "gpu.freeVDevices"
+//	}
+//
+// Each expression sees the variables pod (namespace, name, container, labels, annotations),
+// gpu (uuid, index, model, memory, major, minor, numaNode, totalVDevices, freeVDevices),
+// vdevice (id, memory) and request (count).
+type allocationConstraints struct {
+	// Filter are expressions all candidates must satisfy
+	Filter []string `json:"filter"`
+	// Rank is a numeric expression, candidates with the highest value are preferred
+	Rank string `json:"rank"`
+
+	filters []expr
+	rank    expr
+}
+
+// constraints is non-nil when --allocation-constraints is set
+var constraints *allocationConstraints
+
+// loadAllocationConstraints reads and compiles the constraints of a file
+func loadAllocationConstraints(path string) (*allocationConstraints, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &allocationConstraints{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	for _, f := range c.Filter {
+		e, err := compileExpr(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", f, err)
+		}
+		c.filters = append(c.filters, e)
+	}
+	if c.Rank != "" {
+		c.rank, err = compileExpr(c.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank %q: %v", c.Rank, err)
+		}
+	}
+	return c, nil
+}
+
+// constraintVars returns the variables of the expressions for each candidate vDevice
+func constraintVars(a *containerAllocation, ids []string) map[string]map[string]interface{} {
+	total := make(map[string]int64)
+	for _, vd := range a.plugin.vDevices {
+		total[vd.dev.ID]++
+	}
+	candidates, _ := VDevicesByIDs(a.plugin.vDevices, ids)
+	free := make(map[string]int64)
+	if a.plugin.vDeviceController != nil {
+		available, _ := VDevicesByIDs(a.plugin.vDevices, a.plugin.vDeviceController.available())
+		for _, vd := range available {
+			free[vd.dev.ID]++
+		}
+	}
+	pod := map[string]interface{}{
+		"namespace":   a.pod.Namespace,
+		"name":        a.pod.Name,
+		"container":   a.container,
+		"labels":      map[string]string(a.pod.Labels),
+		"annotations": map[string]string(a.pod.Annotations),
+	}
+	request := map[string]interface{}{"count": int64(len(a.request.DevicesIDs))}
+
+	vars := make(map[string]map[string]interface{})
+	for _, vd := range candidates {
+		gpu := map[string]interface{}{
+			"uuid":          vd.dev.ID,
+			"index":         vd.dev.Index,
+			"numaNode":      int64(-1),
+			"totalVDevices": total[vd.dev.ID],
+			"freeVDevices":  free[vd.dev.ID],
+		}
+		if m, err := getGPUModel(vd.dev.ID); err == nil {
+			gpu["model"] = m.name
+			gpu["memory"] = int64(m.memory)
+			gpu["major"] = int64(m.major)
+			gpu["minor"] = int64(m.minor)
+		}
+		if vd.dev.Topology != nil && len(vd.dev.Topology.Nodes) > 0 {
+			gpu["numaNode"] = vd.dev.Topology.Nodes[0].ID
+		}
+		vars[vd.ID] = map[string]interface{}{
+			"pod":     pod,
+			"gpu":     gpu,
+			"vdevice": map[string]interface{}{"id": vd.ID, "memory": int64(vd.memory)},
+			"request": request,
+		}
+	}
+	return vars
+}
+
+// apply returns the candidates satisfying the filters, restricted to the best ranked ones
+// still covering n vDevices. Candidates failing to evaluate are rejected.
+func (c *allocationConstraints) apply(a *containerAllocation, ids []string, n int) []string {
+	if c == nil {
+		return ids
+	}
+	vars := constraintVars(a, ids)
+	var kept []string
+	scores := make(map[string]float64)
+OUTER:
+	for _, id := range ids {
+		for i, f := range c.filters {
+			ok, err := f.evalBool(vars[id])
+			if err != nil {
+				log.Printf("Warning: rejecting %s, filter %q failed: %v", id, c.Filter[i], err)
+			}
+			if !ok {
+				continue OUTER
+			}
+		}
+		if c.rank != nil {
+			score, err := c.rank.evalNumber(vars[id])
+			if err != nil {
+				log.Printf("Warning: rejecting %s, rank %q failed: %v", id, c.Rank, err)
+				continue
+			}
+			scores[id] = score
+		}
+		kept = append(kept, id)
+	}
+	if c.rank == nil || len(kept) < n {
+		return kept
+	}
+	return preferHighestScores(kept, scores, n)
+}
+
+// preferHighestScores returns the ids with the highest score, widening to the next score until
+// there are at least n of them
+func preferHighestScores(ids []string, scores map[string]float64, n int) []string {
+	if n <= 0 || len(ids) <= n {
+		return ids
+	}
+	sorted := append([]string(nil), ids...)
+	sort.SliceStable(sorted, func(i, j int) bool { return scores[sorted[i]] > scores[sorted[j]] })
+	for i := n; i < len(sorted); i++ {
+		if scores[sorted[i]] < scores[sorted[n-1]] {
+			return sorted[:i]
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// DCGM field identifiers sampled through dcgmi dmon
+const (
+	dcgmFieldGPUUtil          = 203
+	dcgmFieldMemCopyUtil      = 204
+	dcgmFieldECCDBEVolTotal   = 311
+	dcgmFieldNVLinkCRCFlitErr = 409
+)
+
+const dcgmHealthInterval = 10 * time.Second
+
+// dcgmClient is non-nil when --dcgm-address is set
+var dcgmClient *DcgmClient
+
+// gpuSample is a single sample of a physical GPU
+type gpuSample struct {
+	gpuUtil    uint64
+	memoryUtil uint64
+	eccDBE     uint64
+	nvlinkErr  uint64
+}
+
+// DcgmClient samples GPU fields from a host engine through the dcgmi CLI. A single poller,
+// run, samples the GPUs of the node for the health checks of all the plugins.
+type DcgmClient struct {
+	address     string
+	mux         sync.Mutex
+	subscribers map[chan map[uint]gpuSample]struct{}
+}
+
+// NewDcgmClient returns a reference to a new DcgmClient connecting to the host engine at address
+func NewDcgmClient(address string) *DcgmClient {
+	return &DcgmClient{
+		address: address,
+	}
+}
+
+// sample returns the latest field values keyed by GPU index
+func (c *DcgmClient) sample() (map[uint]gpuSample, error) {
+	fields := fmt.Sprintf("%d,%d,%d,%d", dcgmFieldGPUUtil, dcgmFieldMemCopyUtil, dcgmFieldECCDBEVolTotal, dcgmFieldNVLinkCRCFlitErr)
+	out, err := exec.Command("dcgmi", "dmon", "--host", c.address, "-e", fields, "-c", "1").Output()
+	if err != nil {
+		return nil, fmt.Errorf("dcgmi dmon failed: %v", err)
+	}
+	return parseDcgmDmon(out)
+}
+
+// parseDcgmDmon parses the "GPU <index> <values...>" rows printed by dcgmi dmon.
+// Unsupported fields are reported as N/A and read as zero.
+func parseDcgmDmon(out []byte) (map[uint]gpuSample, error) {
+	samples := make(map[uint]gpuSample)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		cols := strings.Fields(scanner.Text())
+		if len(cols) < 6 || cols[0] != "GPU" {
+			continue
+		}
+		idx, err := strconv.ParseUint(cols[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		var values [4]uint64
+		for i := range values {
+			values[i], _ = strconv.ParseUint(cols[2+i], 10, 64)
+		}
+		samples[uint(idx)] = gpuSample{
+			gpuUtil:    values[0],
+			memoryUtil: values[1],
+			eccDBE:     values[2],
+			nvlinkErr:  values[3],
+		}
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no GPU rows in dcgmi output")
+	}
+	return samples, nil
+}
+
+// gpuSamples returns utilization samples keyed by GPU UUID, from DCGM when
+// available and from NVML otherwise
+func gpuSamples() (map[string]gpuSample, error) {
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		return nil, err
+	}
+	var dcgmSamples map[uint]gpuSample
+	if dcgmClient != nil {
+		dcgmSamples, err = dcgmClient.sample()
+		if err != nil {
+			log.Printf("Warning: falling back to NVML: %v", err)
+		}
+	}
+	samples := make(map[string]gpuSample)
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		if err != nil {
+			if isNVMLStale(err) {
+				reportNVMLLost(err)
+			}
+			return nil, err
+		}
+		if s, ok := dcgmSamples[i]; ok {
+			samples[d.UUID] = s
+			continue
+		}
+		status, err := d.Status()
+		if err != nil {
+			log.Printf("Warning: failed to get status of %s: %v", d.UUID, err)
+			continue
+		}
+		s := gpuSample{}
+		if status.Utilization.GPU != nil {
+			s.gpuUtil = uint64(*status.Utilization.GPU)
+		}
+		if status.Utilization.Memory != nil {
+			s.memoryUtil = uint64(*status.Utilization.Memory)
+		}
+		samples[d.UUID] = s
+	}
+	return samples, nil
+}
+
+func writeUtilizationMetrics(w io.Writer) {
+	samples, err := gpuSamples()
+	if err != nil {
+		log.Printf("Error: failed to sample GPUs: %v", err)
+		return
+	}
+	fmt.Fprintln(w, "# HELP vgpu_device_utilization GPU utilization in percent.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_utilization gauge")
+	for uuid, s := range samples {
+		writeGauge(w, "vgpu_device_utilization", uuid, s.gpuUtil)
+	}
+	fmt.Fprintln(w, "# HELP vgpu_device_memory_utilization GPU memory controller utilization in percent.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_memory_utilization gauge")
+	for uuid, s := range samples {
+		writeGauge(w, "vgpu_device_memory_utilization", uuid, s.memoryUtil)
+	}
+}
+
+// subscribe returns a channel receiving the latest samples of the poller, and the func
+// unsubscribing it
+func (c *DcgmClient) subscribe() (<-chan map[uint]gpuSample, func()) {
+	ch := make(chan map[uint]gpuSample, 1)
+	c.mux.Lock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan map[uint]gpuSample]struct{})
+	}
+	c.subscribers[ch] = struct{}{}
+	c.mux.Unlock()
+	return ch, func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		delete(c.subscribers, ch)
+	}
+}
+
+// run samples the GPUs every dcgmHealthInterval and passes the samples to the subscribers. A
+// subscriber that did not read the previous samples yet only gets the latest ones.
+func (c *DcgmClient) run(stop <-chan struct{}) {
+	for {
+		samples, err := c.sample()
+		if err != nil {
+			log.Printf("Warning: DCGM health check failed: %v", err)
+		} else {
+			c.mux.Lock()
+			for ch := range c.subscribers {
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- samples
+			}
+			c.mux.Unlock()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(dcgmHealthInterval):
+		}
+	}
+}
+
+// checkDcgmHealth marks devices unhealthy when DCGM reports new double-bit ECC or NVLink errors
+func checkDcgmHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth) {
+	updates, unsubscribe := dcgmClient.subscribe()
+	defer unsubscribe()
+	baseline := make(map[uint]gpuSample)
+	for {
+		var samples map[uint]gpuSample
+		select {
+		case <-stop:
+			return
+		case samples = <-updates:
+		}
+		for idx, s := range samples {
+			prev, seen := baseline[idx]
+			baseline[idx] = s
+			if !seen || (s.eccDBE <= prev.eccDBE && s.nvlinkErr <= prev.nvlinkErr) {
+				continue
+			}
+			for _, d := range devices {
+				if health, _ := d.health(); d.Index != strconv.Itoa(int(idx)) || health == pluginapi.Unhealthy {
+					continue
+				}
+				log.Printf("DCGM: ECC DBE %d->%d, NVLink errors %d->%d on Device=%s, the device will go unhealthy.",
+					prev.eccDBE, s.eccDBE, prev.nvlinkErr, s.nvlinkErr, d.ID)
+				if s.eccDBE > prev.eccDBE {
+					reportGPUFault(npdReasonECC, d.ID, "double-bit ECC errors %d->%d", prev.eccDBE, s.eccDBE)
+				}
+				if s.nvlinkErr > prev.nvlinkErr {
+					reportGPUFault(npdReasonNVLink, d.ID, "NVLink CRC errors %d->%d", prev.nvlinkErr, s.nvlinkErr)
+				}
+				unhealthy <- unhealthyEvent(d, "DCGM: ECC DBE %d->%d, NVLink errors %d->%d", prev.eccDBE, s.eccDBE, prev.nvlinkErr, s.nvlinkErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// verboseDecisions is the --verbose level from which the allocation decisions are logged
+const verboseDecisions = 3
+
+// Types of the decision records
+const (
+	decisionPreferred = "preferred"
+	decisionPodMatch  = "pod-match"
+	decisionAllocate  = "allocate"
+)
+
+// decisionRecord explains an allocation decision: what was chosen, why, and why the other
+// candidates were not. Only the fields of its type are set.
+type decisionRecord struct {
+	Type     string `json:"type"`
+	Resource string `json:"resource"`
+	Pod      string `json:"pod,omitempty"`
+	// Container is the container of an allocate decision, when the pod is known
+	Container string   `json:"container,omitempty"`
+	Size      int      `json:"size,omitempty"`
+	Chosen    []string `json:"chosen,omitempty"`
+	// GPUs are the candidate GPUs of a preferred decision, the chosen ones first
+	GPUs []gpuDecision `json:"gpus,omitempty"`
+	// Pods are the candidate pods of a pod-match decision
+	Pods   []podDecision `json:"pods,omitempty"`
+	Mounts []string      `json:"mounts,omitempty"`
+}
+
+// gpuDecision is a candidate GPU and the reason it was chosen or rejected
+type gpuDecision struct {
+	UUID        string `json:"uuid"`
+	Chosen      bool   `json:"chosen"`
+	Reason      string `json:"reason"`
+	Remaining   uint64 `json:"remainingMiB"`
+	Used        int    `json:"vdevicesInUse"`
+	Utilization uint64 `json:"utilization,omitempty"`
+}
+
+// podDecision is a candidate pending pod of Allocate and the reason it matched or not
+type podDecision struct {
+	Pod    string `json:"pod"`
+	Reason string `json:"reason"`
+}
+
+// decisionLog writes the decision records as JSON log lines, at most --decision-log-rate per
+// second so that a burst of pods does not flood the log
+type decisionLog struct {
+	mux         sync.Mutex
+	windowStart time.Time
+	written     int
+	suppressed  int
+}
+
+var decisions = &decisionLog{}
+
+// enabled returns true if the decisions are logged, the callers skip building the records
+// otherwise
+func (d *decisionLog) enabled() bool {
+	return verboseFlag >= verboseDecisions
+}
+
+// write logs the record unless the rate of the current second is exhausted
+func (d *decisionLog) write(r *decisionRecord) {
+	if !d.enabled() {
+		return
+	}
+	d.mux.Lock()
+	now := time.Now()
+	if now.Sub(d.windowStart) >= time.Second {
+		if d.suppressed > 0 {
+			log.Printf("Decision: %d records suppressed by --decision-log-rate=%d", d.suppressed, decisionLogRateFlag)
+		}
+		d.windowStart, d.written, d.suppressed = now, 0, 0
+	}
+	if d.written >= decisionLogRateFlag {
+		d.suppressed++
+		d.mux.Unlock()
+		return
+	}
+	d.written++
+	d.mux.Unlock()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Warning: failed to encode the %s decision of %s: %v", r.Type, r.Resource, err)
+		return
+	}
+	log.Printf("Decision: %s", data)
+}
+
+// droppedGPUs returns the GPUs of before without a vDevice in after, which a filter rejected
+func droppedGPUs(before, after []*VDevice) []string {
+	kept := make(map[string]bool)
+	for _, vd := range after {
+		kept[vd.dev.ID] = true
+	}
+	var dropped []string
+	for _, uuid := range UniqueDeviceIDs(before) {
+		if !kept[uuid] {
+			dropped = append(dropped, uuid)
+		}
+	}
+	return dropped
+}
+
+// preferredDecision returns the record of a preferred allocation: the GPUs of the chosen
+// vDevices, then the GPUs offered to the allocation policy but not chosen, then the GPUs the
+// filters rejected with the reason of rejected
+func preferredDecision(resourceName string, size int, vdevices []*VDevice, chosen, picked, offered []string,
+	loads map[string]*gpuLoad, rejected map[string]string) *decisionRecord {
+	r := &decisionRecord{Type: decisionPreferred, Resource: resourceName, Size: size, Chosen: chosen}
+	isPicked := make(map[string]bool)
+	for _, uuid := range picked {
+		isPicked[uuid] = true
+	}
+	chosenVDevs, _ := VDevicesByIDs(vdevices, chosen)
+	isChosen := make(map[string]bool)
+	add := func(uuid string, chosen bool, reason string) {
+		g := gpuDecision{UUID: uuid, Chosen: chosen, Reason: reason}
+		if l, ok := loads[uuid]; ok {
+			g.Remaining, g.Used, g.Utilization = l.remaining(), l.used, l.utilization
+		}
+		r.GPUs = append(r.GPUs, g)
+	}
+	for _, uuid := range UniqueDeviceIDs(chosenVDevs) {
+		isChosen[uuid] = true
+		if isPicked[uuid] {
+			add(uuid, true, "picked by the allocation policy among the least loaded GPUs")
+		} else {
+			add(uuid, true, "completes the vDevices of the GPUs picked by the allocation policy")
+		}
+	}
+	for _, uuid := range offered {
+		if isChosen[uuid] {
+			continue
+		}
+		reason := "more loaded than the chosen GPUs or farther in the topology"
+		if l, ok := loads[uuid]; ok && l.busy {
+			reason = fmt.Sprintf("busy, recent utilization %d%%", l.utilization)
+		}
+		add(uuid, false, reason)
+	}
+	var uuids []string
+	for uuid := range rejected {
+		if !isChosen[uuid] {
+			uuids = append(uuids, uuid)
+		}
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		add(uuid, false, rejected[uuid])
+	}
+	return r
+}
+
+// allocateDecision returns the record of the vDevices granted to a container and its mounts
+func allocateDecision(a *containerAllocation) *decisionRecord {
+	r := &decisionRecord{Type: decisionAllocate, Resource: a.plugin.resourceName, Size: len(a.request.DevicesIDs),
+		Chosen: a.deviceIDs, Container: a.container}
+	if len(a.pod.UID) > 0 {
+		r.Pod = a.pod.Namespace + "/" + a.pod.Name
+	}
+	for i, vd := range a.vdevices {
+		reason := "holds vDevice " + vd.ID
+		if i < len(a.memoryLimits) {
+			reason += fmt.Sprintf(" limited to %d MiB", a.memoryLimits[i])
+		}
+		r.GPUs = append(r.GPUs, gpuDecision{UUID: vd.dev.ID, Chosen: true, Reason: reason})
+	}
+	r.Mounts = mountPaths(a.response.Mounts)
+	return r
+}
+
+// mountPaths formats the mounts of a response as host:container[:ro]
+func mountPaths(mounts []*pluginapi.Mount) []string {
+	var paths []string
+	for _, m := range mounts {
+		p := m.HostPath + ":" + m.ContainerPath
+		if m.ReadOnly {
+			p += ":ro"
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// deviceCache is the content of --device-cache-file: the immutable attributes of the GPUs,
+// valid as long as the driver version does not change
+type deviceCache struct {
+	DriverVersion string               `json:"driverVersion"`
+	GPUs          map[string]cachedGPU `json:"gpus"`
+}
+
+type cachedGPU struct {
+	Name   string `json:"name"`
+	Memory uint64 `json:"memory"`
+	Major  int    `json:"major"`
+	Minor  int    `json:"minor"`
+	BusID  string `json:"busID"`
+}
+
+// loadDeviceCache seeds the GPU models from the cache file, ignoring it if it was written by another driver
+func loadDeviceCache(path string) {
+	version, err := nvml.GetDriverVersion()
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read device cache %s: %v", path, err)
+		}
+		return
+	}
+	var cache deviceCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Warning: ignoring corrupted device cache %s: %v", path, err)
+		return
+	}
+	if cache.DriverVersion != version {
+		log.Printf("Ignoring device cache of driver %s, running %s", cache.DriverVersion, version)
+		return
+	}
+	gpuModelsMux.Lock()
+	defer gpuModelsMux.Unlock()
+	for uuid, g := range cache.GPUs {
+		gpuModels[uuid] = &gpuModel{name: g.Name, memory: g.Memory, major: g.Major, minor: g.Minor, busID: g.BusID}
+	}
+	log.Printf("Loaded %d GPUs from device cache %s", len(cache.GPUs), path)
+}
+
+// saveDeviceCache writes the GPU models to the cache file if new GPUs were queried
+func saveDeviceCache(path string) {
+	version, err := nvml.GetDriverVersion()
+	if err != nil {
+		return
+	}
+	gpuModelsMux.Lock()
+	if !gpuModelsDirty {
+		gpuModelsMux.Unlock()
+		return
+	}
+	cache := deviceCache{DriverVersion: version, GPUs: make(map[string]cachedGPU)}
+	for uuid, m := range gpuModels {
+		cache.GPUs[uuid] = cachedGPU{Name: m.name, Memory: m.memory, Major: m.major, Minor: m.minor, BusID: m.busID}
+	}
+	gpuModelsDirty = false
+	gpuModelsMux.Unlock()
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	// Write then rename so that a crash never leaves a truncated cache
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Warning: failed to write device cache %s: %v", path, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Warning: failed to write device cache %s: %v", path, err)
+	}
+}
+
+// warmGPUModels looks up the models of the GPUs concurrently
+func warmGPUModels(uuids []string) {
+	var wg sync.WaitGroup
+	for _, uuid := range uuids {
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+			if _, err := getGPUModel(uuid); err != nil {
+				log.Printf("Warning: failed to query GPU %s: %v", uuid, err)
+			}
+		}(uuid)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	v1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceConfigRoot is the host directory of the per container device config directories
+const deviceConfigRoot = "/usr/local/vgpu/config"
+
+// deviceConfigContainerDir is where containers see their device config directory
+const deviceConfigContainerDir = "/usr/local/vgpu/config"
+
+// deviceConfigFile is the name of the device config file, the path of which libvgpu reads from
+// VGPU_DEVICE_CONFIG
+const deviceConfigFile = "devices.json"
+
+// deviceConfigStaged is the name of the config written by Allocate, which PreStartContainer
+// publishes as deviceConfigFile
+const deviceConfigStaged = ".staged.json"
+
+// stageDeviceConfig is the allocation stage staging the device config file
+const stageDeviceConfig = "device-config"
+
+// deviceConfigVersion is the version of the format of the device config file. Version 2 added
+// the shared cache, the QoS class and the generation.
+const deviceConfigVersion = 2
+
+func init() {
+	registerAllocateStage(stageDeviceConfig, stageInject, deviceConfigStage)
+}
+
+// deviceConfig is the control file of a container: what libvgpu otherwise reads from
+// NVIDIA_DEVICE_MAP, CUDA_DEVICE_MEMORY_LIMIT_<index>, CUDA_DEVICE_SM_LIMIT and
+// CUDA_DEVICE_MEMORY_SHARED_CACHE, which do not fit the environment of containers with many
+// vDevices and cannot change once the container started. The file is only ever replaced as a
+// whole, libvgpu reloads it when Generation changes.
+type deviceConfig struct {
+	Version    int                 `json:"version"`
+	Generation uint64              `json:"generation"`
+	Devices    []deviceConfigEntry `json:"devices"`
+	// SMLimit is the percentage of the SMs of each GPU the container may use
+	SMLimit int `json:"smLimit"`
+	// SharedCache is the path in the container of the file libvgpu shares its accounting in
+	SharedCache string `json:"sharedCache"`
+	// QoS is the Kubernetes QoS class of the pod, empty if the pod is not known
+	QoS v1.PodQOSClass `json:"qos,omitempty"`
+	// Oversubscribe is set when the container may use more memory than its limits
+	Oversubscribe bool `json:"oversubscribe,omitempty"`
+
+	// Requested are the device IDs of the container the kubelet passes to PreStartContainer
+	Requested []string `json:"requested"`
+	Pod       string   `json:"pod,omitempty"`
+	Container string   `json:"container,omitempty"`
+}
+
+// deviceConfigEntry is a vDevice of the container, in the order of the CUDA devices
+type deviceConfigEntry struct {
+	Index   int    `json:"index"`
+	UUID    string `json:"uuid"`
+	VDevice string `json:"vdevice"`
+	// MemoryLimit is the memory limit in MiB
+	MemoryLimit uint64 `json:"memoryLimit"`
+}
+
+// newDeviceConfig returns the device config of the container from its computed limits
+func newDeviceConfig(a *containerAllocation) *deviceConfig {
+	envs := a.response.Envs
+	c := &deviceConfig{
+		Version:       deviceConfigVersion,
+		SharedCache:   envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"],
+		QoS:           a.pod.Status.QOSClass,
+		Oversubscribe: envs["CUDA_OVERSUBSCRIBE"] != "",
+		Requested:     a.request.DevicesIDs,
+		Container:     a.container,
+	}
+	if len(a.pod.UID) > 0 {
+		c.Pod = a.pod.Namespace + "/" + a.pod.Name
+	}
+	c.SMLimit, _ = strconv.Atoi(envs["CUDA_DEVICE_SM_LIMIT"])
+	for i, vd := range a.vdevices {
+		e := deviceConfigEntry{Index: i, UUID: vd.dev.ID, VDevice: vd.ID}
+		if i < len(a.memoryLimits) {
+			e.MemoryLimit = a.memoryLimits[i]
+		}
+		c.Devices = append(c.Devices, e)
+	}
+	return c
+}
+
+// writeFileAtomic replaces path through a temporary file of the same directory, so that
+// readers see either the previous or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// readDeviceConfig reads the config of the file
+func readDeviceConfig(path string) (*deviceConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &deviceConfig{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid device config %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// updateDeviceConfig applies update to the published config of the container directory and
+// replaces the file with the next generation, for the limits changing at runtime
+func updateDeviceConfig(dir string, update func(c *deviceConfig)) error {
+	path := filepath.Join(dir, deviceConfigFile)
+	c, err := readDeviceConfig(path)
+	if err != nil {
+		return err
+	}
+	update(c)
+	c.Version = deviceConfigVersion
+	c.Generation++
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// stageDeviceConfigFile writes the config to a new directory of deviceConfigRoot under a name
+// libvgpu does not read, and returns the directory
+func stageDeviceConfigFile(c *deviceConfig) (string, error) {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(deviceConfigRoot, uuid.NewString())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, deviceConfigStaged), data); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// publishDeviceConfig publishes the staged config of the container with the device IDs, called
+// from PreStartContainer. The staged files are looked up on disk so that containers allocated
+// before a restart of the plugin still start.
+func publishDeviceConfig(ids []string) error {
+	key := strings.Join(sortedStrings(ids), annSep)
+	staged, _ := filepath.Glob(filepath.Join(deviceConfigRoot, "*", deviceConfigStaged))
+	// The latest Allocate of the devices is the one of the starting container
+	modTimes := make(map[string]int64)
+	for _, path := range staged {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime().UnixNano()
+		}
+	}
+	sort.SliceStable(staged, func(i, j int) bool { return modTimes[staged[i]] > modTimes[staged[j]] })
+	for _, path := range staged {
+		c, err := readDeviceConfig(path)
+		if err != nil || strings.Join(sortedStrings(c.Requested), annSep) != key {
+			continue
+		}
+		c.Generation = 1
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(path)
+		if err := writeFileAtomic(filepath.Join(dir, deviceConfigFile), data); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+	// A restarted container finds the file published at its first start
+	return nil
+}
+
+func sortedStrings(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// deviceConfigStage stages the control file of the container with --device-config-file and
+// mounts its directory. PreStartContainer publishes the file right before the container starts.
+// The environment variables are still set for the libraries that do not read the file.
+func deviceConfigStage(a *containerAllocation) error {
+	if !deviceConfigFileFlag || podUsesVMRuntime(&a.pod) || podUsesGVisor(&a.pod) {
+		return nil
+	}
+	dir := filepath.Join(deviceConfigRoot, "dry-run")
+	if !a.dryRun {
+		var err error
+		if dir, err = stageDeviceConfigFile(newDeviceConfig(a)); err != nil {
+			return err
+		}
+	}
+	a.response.Mounts = append(a.response.Mounts,
+		&pluginapi.Mount{ContainerPath: deviceConfigContainerDir, HostPath: dir, ReadOnly: true})
+	a.response.Envs["VGPU_DEVICE_CONFIG"] = filepath.Join(deviceConfigContainerDir, deviceConfigFile)
+	return nil
+}
+
+// publishedDeviceConfigs returns the published configs by container directory
+func publishedDeviceConfigs() map[string]*deviceConfig {
+	paths, _ := filepath.Glob(filepath.Join(deviceConfigRoot, "*", deviceConfigFile))
+	configs := make(map[string]*deviceConfig)
+	for _, path := range paths {
+		if c, err := readDeviceConfig(path); err == nil {
+			configs[filepath.Base(filepath.Dir(path))] = c
+		}
+	}
+	return configs
+}
+
+// serveDeviceConfigs handles /admin/device-configs: GET lists the published configs and POST
+// changes them, see updateDeviceConfigs
+func serveDeviceConfigs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(publishedDeviceConfigs())
+		return
+	}
+	adminPost(updateDeviceConfigs)(w, r)
+}
+
+// updateDeviceConfigs handles POST /admin/device-configs?pod=<namespace>/<name>&container=<name>
+// with sm-limit=<percent> or memory-limit=<size>, which changes the limits of a running
+// container that libvgpu applies when it reloads the file
+func updateDeviceConfigs(w http.ResponseWriter, r *http.Request) {
+	configs := publishedDeviceConfigs()
+	query := r.URL.Query()
+	var update []func(c *deviceConfig)
+	if value := query.Get("sm-limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > 100 {
+			http.Error(w, fmt.Sprintf("invalid sm-limit: %q", value), http.StatusBadRequest)
+			return
+		}
+		update = append(update, func(c *deviceConfig) { c.SMLimit = limit })
+	}
+	if value := query.Get("memory-limit"); value != "" {
+		limit, err := parseMemoryMiB(value)
+		if err != nil || limit == 0 {
+			http.Error(w, fmt.Sprintf("invalid memory-limit: %q", value), http.StatusBadRequest)
+			return
+		}
+		update = append(update, func(c *deviceConfig) {
+			for i := range c.Devices {
+				c.Devices[i].MemoryLimit = limit
+			}
+		})
+	}
+	if len(update) == 0 {
+		http.Error(w, "missing sm-limit or memory-limit", http.StatusBadRequest)
+		return
+	}
+	pod, container := query.Get("pod"), query.Get("container")
+	updated := 0
+	for id, c := range configs {
+		if c.Pod != pod || container != "" && c.Container != container {
+			continue
+		}
+		err := updateDeviceConfig(filepath.Join(deviceConfigRoot, id), func(c *deviceConfig) {
+			for _, u := range update {
+				u(c)
+			}
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to update the device config of %s: %v", id, err), http.StatusInternalServerError)
+			return
+		}
+		updated++
+	}
+	if updated == 0 {
+		http.Error(w, fmt.Sprintf("no device config of pod %q", pod), http.StatusNotFound)
+		return
+	}
+	log.Printf("Device configs of pod %s updated by admin request: %s", pod, r.URL.RawQuery)
+	fmt.Fprintf(w, "%d device configs updated\n", updated)
+}
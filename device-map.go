@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// deviceMapKey is the key of the ConfigMap data holding the vDevice map
+const deviceMapKey = "vdevices.json"
+
+// deviceMapNodeLabel labels the device map ConfigMaps with their node
+const deviceMapNodeLabel = "4paradigm.com/vgpu-node"
+
+// deviceMapReporter is non-nil when --device-map-namespace is set
+var deviceMapReporter *DeviceMapReporter
+
+// deviceMapEntry is a vDevice of the node, the physical GPU backing it and the container it
+// is assigned to. ID is the device ID the kubelet reports through the PodResources API.
+type deviceMapEntry struct {
+	ID        string `json:"id"`
+	Resource  string `json:"resource"`
+	UUID      string `json:"uuid"`
+	Memory    uint64 `json:"memory"`
+	Pod       string `json:"pod,omitempty"`
+	PodUID    string `json:"podUID,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+// DeviceMapReporter keeps a ConfigMap per node mapping the vDevices to their physical GPU and
+// memory, for exporters joining the kubelet PodResources with the physical GPUs
+type DeviceMapReporter struct {
+	namespace string
+	nodeName  string
+	trigger   chan struct{}
+}
+
+// NewDeviceMapReporter returns a reference to a new DeviceMapReporter
+func NewDeviceMapReporter(namespace, nodeName string) *DeviceMapReporter {
+	return &DeviceMapReporter{
+		namespace: namespace,
+		nodeName:  nodeName,
+		trigger:   make(chan struct{}, 1),
+	}
+}
+
+// newDeviceMapReporterFromFlags builds the reporter from the flags and the environment
+func newDeviceMapReporterFromFlags() (*DeviceMapReporter, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME must be set to publish the device map")
+	}
+	return NewDeviceMapReporter(deviceMapNamespaceFlag, nodeName), nil
+}
+
+// name returns the name of the ConfigMap of the node
+func (r *DeviceMapReporter) name() string {
+	return "vgpu-device-map-" + r.nodeName
+}
+
+// notify schedules a sync of the ConfigMap without blocking
+func (r *DeviceMapReporter) notify() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run syncs the ConfigMap on notifications and periodically until stop is closed
+func (r *DeviceMapReporter) run(stop chan struct{}) {
+	ticker := time.NewTicker(vgpuNodeResync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+			time.Sleep(vgpuNodeDebounce)
+		}
+		if err := r.sync(); err != nil {
+			log.Printf("Error: failed to update the device map ConfigMap %s/%s: %v", r.namespace, r.name(), err)
+		}
+	}
+}
+
+// sync creates or replaces the ConfigMap of the node with the current vDevices
+func (r *DeviceMapReporter) sync() error {
+	entries := []deviceMapEntry{}
+	for _, d := range collectNodeStatus().Devices {
+		for _, vd := range d.VDevices {
+			entries = append(entries, deviceMapEntry{
+				ID:        vd.ID,
+				Resource:  d.Resource,
+				UUID:      d.UUID,
+				Memory:    vd.Memory,
+				Pod:       vd.Pod,
+				PodUID:    vd.PodUID,
+				Container: vd.Container,
+			})
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      r.name(),
+			Namespace: r.namespace,
+			Labels:    map[string]string{deviceMapNodeLabel: r.nodeName},
+		},
+		Data: map[string]string{deviceMapKey: string(data)},
+	}
+
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	configMaps := client.CoreV1().ConfigMaps(r.namespace)
+	current, err := configMaps.Get(ctx, cm.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if current.Data[deviceMapKey] == cm.Data[deviceMapKey] {
+		return nil
+	}
+	cm.ResourceVersion = current.ResourceVersion
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
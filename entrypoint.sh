@@ -1,3 +1,8 @@
 #!/bin/bash
-cp -f /etc/vgpu/* /usr/local/vgpu/
-exec nvidia-device-plugin $@
\ No newline at end of file
+cp -f /etc/vgpu/* /usr/local/vgpu/ 2>/dev/null
+# The builds of libvgpu.so and vgpuvalidator for the architecture of the node, e.g.
+# /etc/vgpu/aarch64, replace the default x86_64 ones
+if [ -d "/etc/vgpu/$(uname -m)" ]; then
+    cp -f "/etc/vgpu/$(uname -m)"/* /usr/local/vgpu/
+fi
+exec nvidia-device-plugin $@
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// stageRenameEnvs is the allocation stage renaming the control environment variables
+const stageRenameEnvs = "rename-envs"
+
+// controlEnvs are the environment variables read by libvgpu, subject to --env-prefix and
+// --env-name-map. Names ending with "_" stand for the indexed variables they prefix. Variables
+// read by the container toolkit or CUDA itself, such as NVIDIA_VISIBLE_DEVICES or
+// CUDA_MPS_PIPE_DIRECTORY, keep their names.
+var controlEnvs = []string{
+	"CUDA_DEVICE_MEMORY_LIMIT_",
+	"CUDA_DEVICE_SM_LIMIT",
+	"CUDA_DEVICE_MEMORY_SHARED_CACHE",
+	"CUDA_OVERSUBSCRIBE",
+	"CUDA_OVERSUBSCRIBE_EVICT_WATERMARK",
+	"CUDA_OVERSUBSCRIBE_EVICT_POLICY",
+	"NVIDIA_DEVICE_MAP",
+	"VGPU_DEVICE_CONFIG",
+	"VGPU_PROTOCOL_VERSION",
+	"VGPU_SHARED_CACHE_NUMA_NODE",
+}
+
+// envNamePattern matches valid environment variable names
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envNameMap is the parsed --env-name-map
+var envNameMap map[string]string
+
+func init() {
+	registerAllocateStage(stageRenameEnvs, stageWebhook, renameEnvsStage)
+}
+
+// parseEnvNameMap parses "FROM=TO,..." where FROM is one of controlEnvs
+func parseEnvNameMap(s string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || !envNamePattern.MatchString(parts[1]) {
+			return nil, fmt.Errorf("expected FROM=TO, got %q", entry)
+		}
+		if !containsString(controlEnvs, parts[0]) {
+			return nil, fmt.Errorf("%s is not a control environment variable, expected one of %s", parts[0], strings.Join(controlEnvs, ", "))
+		}
+		if strings.HasSuffix(parts[0], "_") != strings.HasSuffix(parts[1], "_") {
+			return nil, fmt.Errorf("%s and %s must both end with _ or not", parts[0], parts[1])
+		}
+		names[parts[0]] = parts[1]
+	}
+	return names, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// controlEnvName returns the name a control environment variable is injected as
+func controlEnvName(name string) string {
+	if envPrefixFlag == "" && len(envNameMap) == 0 {
+		return name
+	}
+	if to, ok := envNameMap[name]; ok {
+		return to
+	}
+	for _, from := range controlEnvs {
+		if name == from {
+			return envPrefixFlag + name
+		}
+		if strings.HasSuffix(from, "_") && strings.HasPrefix(name, from) {
+			if to, ok := envNameMap[from]; ok {
+				return to + strings.TrimPrefix(name, from)
+			}
+			return envPrefixFlag + name
+		}
+	}
+	return name
+}
+
+// renameEnvsStage renames the control environment variables of the response and tells
+// libvgpu how they were renamed
+func renameEnvsStage(a *containerAllocation) error {
+	if envPrefixFlag == "" && len(envNameMap) == 0 {
+		return nil
+	}
+	envs := make(map[string]string)
+	for k, v := range a.response.Envs {
+		envs[controlEnvName(k)] = v
+	}
+	if envPrefixFlag != "" {
+		envs["VGPU_ENV_PREFIX"] = envPrefixFlag
+	}
+	if len(envNameMap) > 0 {
+		var entries []string
+		for from, to := range envNameMap {
+			entries = append(entries, from+"="+to)
+		}
+		sort.Strings(entries)
+		envs["VGPU_ENV_MAP"] = strings.Join(entries, ",")
+	}
+	a.response.Envs = envs
+	return nil
+}
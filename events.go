@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// Device lifecycle event types
+const (
+	eventAllocate   = "allocate"
+	eventRelease    = "release"
+	eventHealth     = "health"
+	eventRegister   = "register"
+	eventCheckpoint = "checkpoint"
+)
+
+// deviceEvent is a single entry of the device lifecycle event log
+type deviceEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Resource string    `json:"resource,omitempty"`
+	Devices  []string  `json:"devices,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// eventRing keeps the last events in a fixed size ring buffer
+type eventRing struct {
+	mux    sync.Mutex
+	events []deviceEvent
+	next   int
+	full   bool
+}
+
+// deviceEvents is resized from --event-buffer-size on start
+var deviceEvents = newEventRing(1000)
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{
+		events: make([]deviceEvent, size),
+	}
+}
+
+func (r *eventRing) add(e deviceEvent) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.events) == 0 {
+		return
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the buffered events, oldest first
+func (r *eventRing) list() []deviceEvent {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var events []deviceEvent
+	if r.full {
+		events = append(events, r.events[r.next:]...)
+	}
+	return append(events, r.events[:r.next]...)
+}
+
+// recordEvent appends an event to the device lifecycle event log
+func recordEvent(eventType string, resource string, devices []string, format string, args ...interface{}) {
+	deviceEvents.add(deviceEvent{
+		Time:     time.Now(),
+		Type:     eventType,
+		Resource: resource,
+		Devices:  devices,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	if vgpuNodeReporter != nil {
+		vgpuNodeReporter.notify()
+	}
+	if deviceMapReporter != nil {
+		deviceMapReporter.notify()
+	}
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deviceEvents.list())
+}
+
+// dumpEvents is the action of the 'dump' subcommand, printing the events of a running plugin
+func dumpEvents(c *cli.Context) error {
+	resp, err := http.Get("http://" + c.String("address") + "/debug/events")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	var events []deviceEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return err
+	}
+	for _, e := range events {
+		fmt.Fprintf(os.Stdout, "%s %-10s %-20s %v %s\n", e.Time.Format(time.RFC3339), e.Type, e.Resource, e.Devices, e.Message)
+	}
+	return nil
+}
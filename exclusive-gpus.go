@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+)
+
+// annExclusive makes the vDevices of a pod come from GPUs no other pod uses, the other vDevices
+// of those GPUs are kept for the pod until it ends
+const annExclusive = "nvidia.com/vgpu-exclusive"
+
+// stageExclusiveGPUs is the allocation stage enforcing annExclusive
+const stageExclusiveGPUs = "exclusive-gpus"
+
+// exclusiveClaimGrace keeps the claim of a pod not in the kubelet checkpoint yet, which the
+// kubelet writes after Allocate returns
+const exclusiveClaimGrace = time.Minute
+
+// exclusiveClaim is a GPU held by a pod with annExclusive
+type exclusiveClaim struct {
+	podUID string
+	pod    string
+	since  time.Time
+}
+
+// exclusiveGPUs tracks the GPUs held by the pods with annExclusive
+type exclusiveGPUs struct {
+	mux    sync.Mutex
+	loaded bool
+	claims map[string]*exclusiveClaim
+}
+
+// exclusive is non-nil when --enable-exclusive-gpus is set
+var exclusive *exclusiveGPUs
+
+func init() {
+	registerAllocateStage(stageExclusiveGPUs, stageSelectVDevices, exclusiveStage)
+}
+
+// podWantsExclusive returns true if the pod sets annExclusive
+func podWantsExclusive(pod *v1.Pod) (bool, error) {
+	value, ok := pod.Annotations[annExclusive]
+	if !ok {
+		return false, nil
+	}
+	exclusive, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation: %q", annExclusive, value)
+	}
+	return exclusive, nil
+}
+
+// vDeviceGPU returns the UUID of the GPU of a vDevice ID, or "" for other devices
+func vDeviceGPU(id string) string {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || !strings.HasPrefix(id, "GPU-") {
+		return ""
+	}
+	return id[:i]
+}
+
+// gpuPods returns the UIDs of the pods using each GPU according to the kubelet checkpoint
+func gpuPods() (map[string]map[string]bool, error) {
+	cp, err := readKubeletCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]map[string]bool)
+	podDevices, _ := cp.GetData()
+	for _, pde := range podDevices {
+		for _, id := range pde.DeviceIDs {
+			gpu := vDeviceGPU(id)
+			if gpu == "" {
+				continue
+			}
+			if users[gpu] == nil {
+				users[gpu] = make(map[string]bool)
+			}
+			users[gpu][pde.PodUID] = true
+		}
+	}
+	return users, nil
+}
+
+// refresh drops the claims of the pods that ended and, the first time, restores the claims of
+// the pods with annExclusive allocated before the plugin started. The caller holds e.mux.
+func (e *exclusiveGPUs) refresh(users map[string]map[string]bool) {
+	if !e.loaded {
+		e.loaded = true
+		e.restore(users)
+	}
+	for gpu, c := range e.claims {
+		if !users[gpu][c.podUID] && time.Since(c.since) > exclusiveClaimGrace {
+			log.Printf("Pod %s released its exclusive GPU %s", c.pod, gpu)
+			delete(e.claims, gpu)
+		}
+	}
+}
+
+// restore claims the GPUs used by the pods of the node with annExclusive
+func (e *exclusiveGPUs) restore(users map[string]map[string]bool) {
+	client, err := newKubeClient()
+	if err != nil {
+		log.Printf("Warning: failed to restore the exclusive GPUs: %v", err)
+		return
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	pods, err := client.CoreV1().Pods("").List(ctx, nodePodsListOptions())
+	if err != nil {
+		log.Printf("Warning: failed to restore the exclusive GPUs: %v", err)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if ok, _ := podWantsExclusive(pod); !ok {
+			continue
+		}
+		for gpu, uids := range users {
+			if uids[string(pod.UID)] {
+				e.claims[gpu] = &exclusiveClaim{podUID: string(pod.UID), pod: pod.Namespace + "/" + pod.Name, since: time.Now()}
+				log.Printf("Restored the exclusive GPU %s of pod %s/%s", gpu, pod.Namespace, pod.Name)
+			}
+		}
+	}
+}
+
+// heldBy returns true if the GPU is held exclusively by the pod
+func (e *exclusiveGPUs) heldBy(gpu, podUID string) bool {
+	if e == nil {
+		return false
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	c, ok := e.claims[gpu]
+	return ok && c.podUID == podUID
+}
+
+// usable returns true if the pod may get vDevices of the GPU: it is not held by another pod
+// and, for a pod with annExclusive, no other pod uses it
+func (e *exclusiveGPUs) usable(gpu, podUID string, wantsExclusive bool, users map[string]map[string]bool) bool {
+	if c, ok := e.claims[gpu]; ok && c.podUID != podUID {
+		return false
+	}
+	if !wantsExclusive {
+		return true
+	}
+	for uid := range users[gpu] {
+		if uid != podUID {
+			return false
+		}
+	}
+	return true
+}
+
+// filterForPod keeps the vDevices of ids the pod may use
+func (e *exclusiveGPUs) filterForPod(a *containerAllocation, ids []string) ([]string, error) {
+	if e == nil {
+		return ids, nil
+	}
+	wantsExclusive, err := podWantsExclusive(&a.pod)
+	if err != nil {
+		return nil, err
+	}
+	users, err := gpuPods()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the GPUs in use: %v", err)
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.refresh(users)
+	var usable []string
+	for _, id := range ids {
+		if e.usable(vDeviceGPU(id), string(a.pod.UID), wantsExclusive, users) {
+			usable = append(usable, id)
+		}
+	}
+	return usable, nil
+}
+
+// withoutClaimed removes the vDevices of the GPUs held by pods from the candidates of a
+// preferred allocation, which does not know the pod, unless too few would be left
+func (e *exclusiveGPUs) withoutClaimed(vdevices []*VDevice, required []*VDevice, n int) []*VDevice {
+	if e == nil {
+		return vdevices
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if len(e.claims) == 0 {
+		return vdevices
+	}
+	for _, vd := range required {
+		if _, ok := e.claims[vd.dev.ID]; ok {
+			return vdevices
+		}
+	}
+	var unclaimed []*VDevice
+	for _, vd := range vdevices {
+		if _, ok := e.claims[vd.dev.ID]; !ok {
+			unclaimed = append(unclaimed, vd)
+		}
+	}
+	if len(unclaimed) < n {
+		return vdevices
+	}
+	return unclaimed
+}
+
+// exclusiveStage refuses vDevices of GPUs held by another pod and, for a pod with annExclusive,
+// of GPUs other pods use, then claims the GPUs of the pod. The kubelet picks the vDevices unless
+// the plugin runs in the legacy allocation mode, so this is the only check in the other modes.
+func exclusiveStage(a *containerAllocation) error {
+	e := exclusive
+	if e == nil || a.dryRun {
+		return nil
+	}
+	wantsExclusive, err := podWantsExclusive(&a.pod)
+	if err != nil {
+		return err
+	}
+	e.mux.Lock()
+	empty := len(e.claims) == 0 && e.loaded
+	e.mux.Unlock()
+	if empty && !wantsExclusive {
+		return nil
+	}
+
+	users, err := gpuPods()
+	if err != nil {
+		return fmt.Errorf("failed to read the GPUs in use: %v", err)
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.refresh(users)
+	podUID := string(a.pod.UID)
+	for _, uuid := range a.uuids {
+		if c, ok := e.claims[uuid]; ok && c.podUID != podUID {
+			return fmt.Errorf("GPU %s is held exclusively by pod %s", uuid, c.pod)
+		}
+		if wantsExclusive && !e.usable(uuid, podUID, true, users) {
+			return fmt.Errorf("GPU %s is used by other pods, pod %s requested exclusive GPUs", uuid, a.pod.Name)
+		}
+	}
+	if !wantsExclusive {
+		return nil
+	}
+	for _, uuid := range a.uuids {
+		if _, ok := e.claims[uuid]; !ok {
+			e.claims[uuid] = &exclusiveClaim{podUID: podUID, pod: a.pod.Namespace + "/" + a.pod.Name, since: time.Now()}
+			log.Printf("Pod %s/%s holds GPU %s exclusively", a.pod.Namespace, a.pod.Name, uuid)
+			recordEvent(eventAllocate, a.plugin.resourceName, []string{uuid}, "GPU held exclusively by pod %s/%s", a.pod.Namespace, a.pod.Name)
+		}
+	}
+	return nil
+}
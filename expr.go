@@ -0,0 +1,734 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file implements the subset of CEL (https://github.com/google/cel-spec) used by the
+// allocation constraints: literals, field and index access, the logical, relational,
+// arithmetic and conditional operators, `in`, and the size, contains, startsWith, endsWith
+// and matches functions. Values are bool, int64, float64, string, lists and maps.
+
+// expr is a compiled expression
+type expr func(vars map[string]interface{}) (interface{}, error)
+
+// compileExpr parses an expression
+func compileExpr(src string) (expr, error) {
+	toks, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	e, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.peek().text, p.peek().pos)
+	}
+	return e, nil
+}
+
+// evalBool evaluates an expression expected to return a bool
+func (e expr) evalBool(vars map[string]interface{}) (bool, error) {
+	v, err := e(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool, got %T", v)
+	}
+	return b, nil
+}
+
+// evalNumber evaluates an expression expected to return a number
+func (e expr) evalNumber(vars map[string]interface{}) (float64, error) {
+	v, err := e(vars)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, got %T", v)
+	}
+	return f, nil
+}
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokInt
+	tokFloat
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ",", "?", ":"}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, exprToken{tokIdent, src[i:j], i})
+			i = j
+		case unicode.IsDigit(c):
+			j := i
+			kind := tokInt
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				if src[j] == '.' {
+					kind = tokFloat
+				}
+				j++
+			}
+			toks = append(toks, exprToken{kind, src[i:j], i})
+			i = j
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && rune(src[j]) != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, exprToken{tokString, sb.String(), i})
+			i = j + 1
+		default:
+			found := false
+			for _, op := range exprOps {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, exprToken{tokOp, op, i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(toks, exprToken{tokEOF, "end of expression", len(src)}), nil
+}
+
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator or keyword op
+func (p *exprParser) accept(op string) bool {
+	t := p.peek()
+	if (t.kind == tokOp || t.kind == tokIdent) && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		return fmt.Errorf("expected %q, got %q at offset %d", op, p.peek().text, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseConditional() (expr, error) {
+	cond, err := p.parseOr()
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	then, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	return func(vars map[string]interface{}) (interface{}, error) {
+		b, err := cond.evalBool(vars)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return then(vars)
+		}
+		return otherwise(vars)
+	}, nil
+}
+
+// parseOr and parseAnd follow CEL in tolerating an error on one side when the other
+// side decides the result
+func (p *exprParser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		l := left
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = func(vars map[string]interface{}) (interface{}, error) {
+			lb, lerr := l.evalBool(vars)
+			if lerr == nil && lb {
+				return true, nil
+			}
+			rb, rerr := r.evalBool(vars)
+			if rerr == nil && rb {
+				return true, nil
+			}
+			if lerr != nil {
+				return nil, lerr
+			}
+			return false, rerr
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	left, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		l := left
+		r, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		left = func(vars map[string]interface{}) (interface{}, error) {
+			lb, lerr := l.evalBool(vars)
+			if lerr == nil && !lb {
+				return false, nil
+			}
+			rb, rerr := r.evalBool(vars)
+			if rerr == nil && !rb {
+				return false, nil
+			}
+			if lerr != nil {
+				return nil, lerr
+			}
+			return true, rerr
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseRelation() (expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if !(t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">=")) &&
+			!(t.kind == tokIdent && t.text == "in") {
+			return left, nil
+		}
+		p.next()
+		l := left
+		r, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		left = func(vars map[string]interface{}) (interface{}, error) {
+			lv, err := l(vars)
+			if err != nil {
+				return nil, err
+			}
+			rv, err := r(vars)
+			if err != nil {
+				return nil, err
+			}
+			return compareValues(op, lv, rv)
+		}
+	}
+}
+
+func (p *exprParser) parseAdditive() (expr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "+" && t.text != "-") {
+			return left, nil
+		}
+		p.next()
+		r, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(t.text, left, r)
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return left, nil
+		}
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(t.text, left, r)
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.accept("!") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(vars map[string]interface{}) (interface{}, error) {
+			b, err := e.evalBool(vars)
+			return !b, err
+		}, nil
+	}
+	if p.accept("-") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return arithmetic("-", func(map[string]interface{}) (interface{}, error) { return int64(0), nil }, e), nil
+	}
+	return p.parseMember()
+}
+
+func (p *exprParser) parseMember() (expr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, fmt.Errorf("expected a field name at offset %d", name.pos)
+			}
+			if p.accept("(") {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				e, err = callFunction(name.text, append([]expr{e}, args...))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			e = selectField(e, name.text)
+		case p.accept("["):
+			index, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = indexValue(e, index)
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *exprParser) parseArgs() ([]expr, error) {
+	var args []expr
+	if p.accept(")") {
+		return args, nil
+	}
+	for {
+		a, err := p.parseConditional()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if p.accept(")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt:
+		v, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return constant(v), nil
+	case tokFloat:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return constant(v), nil
+	case tokString:
+		return constant(t.text), nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "null":
+			return constant(nil), nil
+		}
+		if p.accept("(") {
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return callFunction(t.text, args)
+		}
+		name := t.text
+		return func(vars map[string]interface{}) (interface{}, error) {
+			v, ok := vars[name]
+			if !ok {
+				return nil, fmt.Errorf("undeclared reference to %q", name)
+			}
+			return v, nil
+		}, nil
+	case tokOp:
+		if t.text == "(" {
+			e, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		}
+		if t.text == "[" {
+			args, err := p.parseList()
+			if err != nil {
+				return nil, err
+			}
+			return func(vars map[string]interface{}) (interface{}, error) {
+				var list []interface{}
+				for _, a := range args {
+					v, err := a(vars)
+					if err != nil {
+						return nil, err
+					}
+					list = append(list, v)
+				}
+				return list, nil
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+func (p *exprParser) parseList() ([]expr, error) {
+	var items []expr
+	if p.accept("]") {
+		return items, nil
+	}
+	for {
+		item, err := p.parseConditional()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.accept("]") {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func constant(v interface{}) expr {
+	return func(map[string]interface{}) (interface{}, error) { return v, nil }
+}
+
+func selectField(e expr, name string) expr {
+	return indexValue(e, constant(name))
+}
+
+func indexValue(e, index expr) expr {
+	return func(vars map[string]interface{}) (interface{}, error) {
+		v, err := e(vars)
+		if err != nil {
+			return nil, err
+		}
+		i, err := index(vars)
+		if err != nil {
+			return nil, err
+		}
+		switch c := v.(type) {
+		case map[string]interface{}:
+			key, ok := i.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key must be a string, got %T", i)
+			}
+			if r, ok := c[key]; ok {
+				return r, nil
+			}
+			return nil, fmt.Errorf("no such key: %s", key)
+		case map[string]string:
+			key, ok := i.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key must be a string, got %T", i)
+			}
+			if r, ok := c[key]; ok {
+				return r, nil
+			}
+			return nil, fmt.Errorf("no such key: %s", key)
+		case []interface{}:
+			n, ok := i.(int64)
+			if !ok || n < 0 || n >= int64(len(c)) {
+				return nil, fmt.Errorf("invalid list index %v", i)
+			}
+			return c[n], nil
+		}
+		return nil, fmt.Errorf("cannot index %T", v)
+	}
+}
+
+func callFunction(name string, args []expr) (expr, error) {
+	arity := map[string]int{"size": 1, "contains": 2, "startsWith": 2, "endsWith": 2, "matches": 2, "has": 1}
+	n, ok := arity[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, n, len(args))
+	}
+	return func(vars map[string]interface{}) (interface{}, error) {
+		if name == "has" {
+			_, err := args[0](vars)
+			return err == nil, nil
+		}
+		var vals []interface{}
+		for _, a := range args {
+			v, err := a(vars)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+		}
+		if name == "size" {
+			switch c := vals[0].(type) {
+			case string:
+				return int64(len(c)), nil
+			case []interface{}:
+				return int64(len(c)), nil
+			case map[string]interface{}:
+				return int64(len(c)), nil
+			case map[string]string:
+				return int64(len(c)), nil
+			}
+			return nil, fmt.Errorf("size of %T", vals[0])
+		}
+		s, ok1 := vals[0].(string)
+		arg, ok2 := vals[1].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s expects strings, got %T and %T", name, vals[0], vals[1])
+		}
+		switch name {
+		case "contains":
+			return strings.Contains(s, arg), nil
+		case "startsWith":
+			return strings.HasPrefix(s, arg), nil
+		case "endsWith":
+			return strings.HasSuffix(s, arg), nil
+		}
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	}, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func arithmetic(op string, l, r expr) expr {
+	return func(vars map[string]interface{}) (interface{}, error) {
+		lv, err := l(vars)
+		if err != nil {
+			return nil, err
+		}
+		rv, err := r(vars)
+		if err != nil {
+			return nil, err
+		}
+		if ls, ok := lv.(string); ok && op == "+" {
+			if rs, ok := rv.(string); ok {
+				return ls + rs, nil
+			}
+		}
+		li, lint := lv.(int64)
+		ri, rint := rv.(int64)
+		if lint && rint {
+			switch op {
+			case "+":
+				return li + ri, nil
+			case "-":
+				return li - ri, nil
+			case "*":
+				return li * ri, nil
+			}
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				return li / ri, nil
+			}
+			return li % ri, nil
+		}
+		lf, ok1 := toFloat(lv)
+		rf, ok2 := toFloat(rv)
+		if !ok1 || !ok2 || op == "%" {
+			return nil, fmt.Errorf("no such overload: %T %s %T", lv, op, rv)
+		}
+		switch op {
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		}
+		return lf / rf, nil
+	}
+}
+
+func compareValues(op string, l, r interface{}) (interface{}, error) {
+	if op == "in" {
+		switch c := r.(type) {
+		case []interface{}:
+			for _, item := range c {
+				if eq, _ := compareValues("==", l, item); eq == true {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}, map[string]string:
+			key, ok := l.(string)
+			if !ok {
+				return false, nil
+			}
+			_, err := indexValue(constant(r), constant(key))(nil)
+			return err == nil, nil
+		}
+		return nil, fmt.Errorf("no such overload: %T in %T", l, r)
+	}
+	if lf, ok := toFloat(l); ok {
+		rf, ok := toFloat(r)
+		if !ok {
+			return nil, fmt.Errorf("no such overload: %T %s %T", l, op, r)
+		}
+		switch op {
+		case "==":
+			return lf == rf, nil
+		case "!=":
+			return lf != rf, nil
+		case "<":
+			return lf < rf, nil
+		case "<=":
+			return lf <= rf, nil
+		case ">":
+			return lf > rf, nil
+		}
+		return lf >= rf, nil
+	}
+	if ls, ok := l.(string); ok {
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("no such overload: %T %s %T", l, op, r)
+		}
+		switch op {
+		case "==":
+			return ls == rs, nil
+		case "!=":
+			return ls != rs, nil
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		}
+		return ls >= rs, nil
+	}
+	// Only bools and null remain comparable, lists and maps are not
+	_, lbool := l.(bool)
+	_, rbool := r.(bool)
+	if (lbool || l == nil) && (rbool || r == nil) {
+		switch op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %T %s %T", l, op, r)
+}
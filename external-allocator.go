@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	allocatorapi "github.com/NVIDIA/k8s-device-plugin/api/allocator/v1alpha1"
+)
+
+// externalAllocator is non-nil when --external-allocator is set
+var externalAllocator *ExternalAllocator
+
+// ExternalAllocator delegates the selection of vDevices to a service implementing the
+// api/allocator/v1alpha1 interface
+type ExternalAllocator struct {
+	address string
+	client  *allocatorapi.AllocatorClient
+}
+
+// NewExternalAllocator returns an ExternalAllocator for the service at address, either
+// unix:///path/to.sock or host:port. The connection is established lazily.
+func NewExternalAllocator(address string) (*ExternalAllocator, error) {
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	target := address
+	if strings.HasPrefix(address, "unix://") {
+		target = strings.TrimPrefix(address, "unix://")
+		opts = append(opts, grpc.WithContextDialer(dialUnix))
+	}
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalAllocator{
+		address: address,
+		client:  allocatorapi.NewAllocatorClient(conn),
+	}, nil
+}
+
+// allocate asks the external allocator for size vDevices out of the available ones. It fails
+// on timeout and when the answer is not size distinct available vDevices.
+func (e *ExternalAllocator) allocate(ctx context.Context, a *containerAllocation, available []string, size int) ([]string, error) {
+	req := &allocatorapi.AllocateRequest{
+		Node:         os.Getenv("NODE_NAME"),
+		ResourceName: a.plugin.resourceName,
+		Pod: allocatorapi.Pod{
+			Namespace:   a.pod.Namespace,
+			Name:        a.pod.Name,
+			UID:         string(a.pod.UID),
+			Container:   a.container,
+			Annotations: a.pod.Annotations,
+			Labels:      a.pod.Labels,
+		},
+		Size: size,
+	}
+	vdevices, err := VDevicesByIDs(a.plugin.vDevices, available)
+	if err != nil {
+		return nil, err
+	}
+	for _, vd := range vdevices {
+		v := allocatorapi.VDevice{
+			ID:       vd.ID,
+			UUID:     vd.dev.ID,
+			Index:    vd.dev.Index,
+			Memory:   vd.memory,
+			NUMANode: -1,
+		}
+		if m, err := getGPUModel(vd.dev.ID); err == nil {
+			v.Model = m.name
+		}
+		if vd.dev.Topology != nil && len(vd.dev.Topology.Nodes) > 0 {
+			v.NUMANode = vd.dev.Topology.Nodes[0].ID
+		}
+		req.Available = append(req.Available, v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, externalAllocatorTimeoutFlag)
+	defer cancel()
+	resp, err := e.client.Allocate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.DeviceIDs) != size {
+		return nil, fmt.Errorf("%d vDevices returned, %d requested", len(resp.DeviceIDs), size)
+	}
+	offered := make(map[string]bool)
+	for _, id := range available {
+		offered[id] = true
+	}
+	for _, id := range resp.DeviceIDs {
+		if !offered[id] {
+			return nil, fmt.Errorf("vDevice %s returned is not available or returned twice", id)
+		}
+		delete(offered, id)
+	}
+	return resp.DeviceIDs, nil
+}
+
+// externalAllocation returns the vDevices selected by the external allocator, or nil to
+// fall back to the built-in policy
+func externalAllocation(a *containerAllocation, available []string, size int) []string {
+	if externalAllocator == nil {
+		return nil
+	}
+	ids, err := externalAllocator.allocate(a.ctx, a, available, size)
+	if err != nil {
+		log.Printf("Warning: external allocator %s failed, falling back to the built-in policy: %v", externalAllocator.address, err)
+		return nil
+	}
+	return ids
+}
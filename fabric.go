@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nvswitchDevicesPath lists the NVSwitches of HGX systems, one entry per switch
+const nvswitchDevicesPath = "/proc/driver/nvidia-nvswitch/devices"
+
+const fabricHealthInterval = 30 * time.Second
+
+// fabricManaged is true on NVSwitch systems, whose GPUs depend on the fabric manager
+var fabricManaged bool
+
+// fabricPartitions are the GPU indices of each fabric partition, parsed from --fabric-partitions
+var fabricPartitions [][]string
+
+// hasNVSwitch returns true if the GPUs of the node are connected through NVSwitches
+func hasNVSwitch() bool {
+	entries, err := ioutil.ReadDir(nvswitchDevicesPath)
+	return err == nil && len(entries) > 0
+}
+
+// parseFabricPartitions parses semicolon separated partitions of comma separated GPU indices, e.g. "0,1,2,3;4,5,6,7"
+func parseFabricPartitions(s string) ([][]string, error) {
+	var partitions [][]string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(s, ";") {
+		var partition []string
+		for _, idx := range strings.Split(p, ",") {
+			idx = strings.TrimSpace(idx)
+			if _, err := strconv.ParseUint(idx, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid GPU index %q", idx)
+			}
+			if seen[idx] {
+				return nil, fmt.Errorf("GPU %s is in several partitions", idx)
+			}
+			seen[idx] = true
+			partition = append(partition, idx)
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
+
+// fabricPartition returns the partition of a GPU index, or -1 if it is in none
+func fabricPartition(index string) int {
+	for i, p := range fabricPartitions {
+		for _, idx := range p {
+			if idx == index {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// fabricPartitionVDevices restricts the available vDevices of a multi-GPU request to a single
+// fabric partition: the one of the required vDevices, else the first one with n vDevices
+func fabricPartitionVDevices(available []*VDevice, required []*VDevice, n int) []*VDevice {
+	if len(fabricPartitions) == 0 || n < 2 {
+		return available
+	}
+	byPartition := make(map[int][]*VDevice)
+	for _, vd := range available {
+		p := fabricPartition(vd.dev.Index)
+		byPartition[p] = append(byPartition[p], vd)
+	}
+	if len(required) > 0 {
+		return byPartition[fabricPartition(required[0].dev.Index)]
+	}
+	for i := range fabricPartitions {
+		if len(byPartition[i]) >= n {
+			return byPartition[i]
+		}
+	}
+	log.Printf("Warning: no fabric partition has %d available devices", n)
+	return available
+}
+
+// checkFabricHealth marks all devices unhealthy while the fabric manager is unreachable, as the
+// GPUs of an NVSwitch system cannot run CUDA workloads until it has configured the fabric
+func checkFabricHealth(stop <-chan interface{}, devices []*Device, health chan<- *DeviceHealth) {
+	down := false
+	for {
+		conn, err := net.DialTimeout("tcp", fabricManagerAddressFlag, 5*time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		if (err != nil) != down {
+			down = err != nil
+			if down {
+				log.Printf("Fabric manager at %s is unreachable, all devices will go unhealthy: %v", fabricManagerAddressFlag, err)
+			} else {
+				log.Printf("Fabric manager at %s is reachable again", fabricManagerAddressFlag)
+			}
+			for _, d := range devices {
+				h := &DeviceHealth{Device: d, Health: pluginapi.Healthy, Reason: "fabric manager reachable"}
+				if down {
+					h = unhealthyEvent(d, "fabric manager unreachable: %v", err)
+				}
+				select {
+				case health <- h:
+				case <-stop:
+					return
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(fabricHealthInterval):
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Faults that can be injected through /admin/faults with --enable-fault-injection
+const (
+	faultRegister        = "register"
+	faultAllocateLatency = "allocate-latency"
+	faultHealthFlap      = "health-flap"
+	faultCheckpoint      = "checkpoint"
+	// faultClear disarms the faults
+	faultClear = "clear"
+)
+
+// eventFault is the device lifecycle event type of the injected faults
+const eventFault = "fault"
+
+// faultState are the faults armed through the admin API, for testing how the cluster copes
+// with a misbehaving plugin
+type faultState struct {
+	// RegisterFailures and CheckpointErrors are the numbers of registrations and checkpoint
+	// reads left to fail
+	RegisterFailures int           `json:"registerFailures"`
+	CheckpointErrors int           `json:"checkpointErrors"`
+	AllocateLatency  time.Duration `json:"allocateLatency"`
+}
+
+var (
+	injectedFaultsMux sync.Mutex
+	injectedFaults    faultState
+)
+
+// takeFault consumes one failure of a counted fault, returning the error to inject or nil
+func takeFault(fault string) error {
+	if !enableFaultInjectionFlag {
+		return nil
+	}
+	injectedFaultsMux.Lock()
+	defer injectedFaultsMux.Unlock()
+	count := &injectedFaults.RegisterFailures
+	if fault == faultCheckpoint {
+		count = &injectedFaults.CheckpointErrors
+	}
+	if *count == 0 {
+		return nil
+	}
+	*count--
+	recordEvent(eventFault, "", nil, "injected %s failure, %d left", fault, *count)
+	return fmt.Errorf("injected %s failure", fault)
+}
+
+// injectAllocateLatency delays an Allocate by the injected latency
+func injectAllocateLatency() {
+	if !enableFaultInjectionFlag {
+		return
+	}
+	injectedFaultsMux.Lock()
+	latency := injectedFaults.AllocateLatency
+	injectedFaultsMux.Unlock()
+	if latency > 0 {
+		log.Printf("Delaying Allocate by the injected latency of %v", latency)
+		time.Sleep(latency)
+	}
+}
+
+// flap marks the device unhealthy for duration then healthy again; it returns false if the
+// plugin does not serve it
+func (m *NvidiaDevicePlugin) flap(uuid string, duration time.Duration) bool {
+	for _, d := range m.cachedDevices {
+		if d.ID != uuid {
+			continue
+		}
+		health, stop := m.health, m.stop
+		go func() {
+			select {
+			case health <- &DeviceHealth{Device: d, Health: pluginapi.Unhealthy, Reason: "injected health flap"}:
+			case <-stop:
+				return
+			}
+			select {
+			case <-time.After(duration):
+			case <-stop:
+				return
+			}
+			select {
+			case health <- &DeviceHealth{Device: d, Health: pluginapi.Healthy, Reason: "end of injected health flap"}:
+			case <-stop:
+			}
+		}()
+		return true
+	}
+	return false
+}
+
+// serveFaults handles /admin/faults: GET returns the armed faults and POST changes them, see
+// armFaults
+func serveFaults(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeInjectedFaults(w)
+		return
+	}
+	adminPost(armFaults)(w, r)
+}
+
+// armFaults handles POST /admin/faults?fault=<fault>, which arms a fault and returns the armed
+// faults: register&count=<n> and checkpoint&count=<n> fail the next n registrations with the
+// kubelet or reads of its checkpoint, allocate-latency&duration=<d> delays every Allocate by d
+// (0 stops it), health-flap&uuid=<uuid>&duration=<d> marks the GPU unhealthy for d, 30s by
+// default, and clear disarms them all
+func armFaults(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch fault := query.Get("fault"); fault {
+	case faultClear:
+		injectedFaultsMux.Lock()
+		injectedFaults = faultState{}
+		injectedFaultsMux.Unlock()
+		log.Printf("Injected faults cleared by admin request")
+	default:
+		var duration time.Duration
+		if value := query.Get("duration"); value != "" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil || duration < 0 {
+				http.Error(w, fmt.Sprintf("invalid duration: %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		count := 1
+		if value := query.Get("count"); value != "" {
+			var err error
+			if count, err = strconv.Atoi(value); err != nil || count < 0 {
+				http.Error(w, fmt.Sprintf("invalid count: %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		switch fault {
+		case faultRegister, faultCheckpoint, faultAllocateLatency:
+			injectedFaultsMux.Lock()
+			switch fault {
+			case faultRegister:
+				injectedFaults.RegisterFailures = count
+			case faultCheckpoint:
+				injectedFaults.CheckpointErrors = count
+			default:
+				injectedFaults.AllocateLatency = duration
+			}
+			injectedFaultsMux.Unlock()
+		case faultHealthFlap:
+			uuid := query.Get("uuid")
+			if duration == 0 {
+				duration = 30 * time.Second
+			}
+			found := false
+			for _, p := range getAdminPlugins() {
+				if p.health != nil && p.flap(uuid, duration) {
+					found = true
+				}
+			}
+			if !found {
+				http.Error(w, fmt.Sprintf("unknown device: %s", uuid), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, fmt.Sprintf("unknown fault: %q", fault), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Fault %s injected by admin request: %s", fault, r.URL.RawQuery)
+		recordEvent(eventFault, "", nil, "armed %s", r.URL.RawQuery)
+	}
+	writeInjectedFaults(w)
+}
+
+// writeInjectedFaults writes the armed faults as JSON
+func writeInjectedFaults(w http.ResponseWriter) {
+	injectedFaultsMux.Lock()
+	defer injectedFaultsMux.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&injectedFaults)
+}
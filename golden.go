@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// goldenCase is an Allocate call recorded to --golden-dir: the request, the pod it was matched
+// to, the vDevices that were picked and the response sent to the kubelet
+type goldenCase struct {
+	Time     time.Time                              `json:"time"`
+	Resource string                                 `json:"resource"`
+	Pod      v1.Pod                                 `json:"pod"`
+	Requests []*pluginapi.ContainerAllocateRequest  `json:"requests"`
+	Using    [][]string                             `json:"using"`
+	Response []*pluginapi.ContainerAllocateResponse `json:"response"`
+}
+
+// goldenCacheFile matches the random file name of the shared cache of a container
+var goldenCacheFile = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\.cache$`)
+
+// goldenFileName returns a file name unique to the Allocate call, sorting by time
+func goldenFileName(c *goldenCase) string {
+	name := c.Time.UTC().Format("20060102T150405.000000000")
+	for _, part := range []string{c.Resource, c.Pod.Namespace, c.Pod.Name} {
+		if part != "" {
+			name += "_" + strings.NewReplacer("/", "-", ".", "-").Replace(part)
+		}
+	}
+	return name + ".json"
+}
+
+// recordGolden writes the Allocate call to --golden-dir, failures are only logged
+func recordGolden(r *allocateRequest, resp *pluginapi.AllocateResponse) {
+	if goldenDirFlag == "" {
+		return
+	}
+	c := &goldenCase{
+		Time:     time.Now(),
+		Resource: r.plugin.resourceName,
+		Pod:      r.pod,
+		Requests: r.requests,
+		Using:    r.using,
+		Response: resp.ContainerResponses,
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(goldenDirFlag, goldenFileName(c)), data, 0640)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to record the golden file of the allocation: %v", err)
+	}
+}
+
+// normalizeGolden masks what legitimately differs between two runs of the same allocation: the
+// random shared cache files, the per-container shared cache and device config directories and
+// the annotations only written when the vDevices are acquired
+func normalizeGolden(resp *pluginapi.ContainerAllocateResponse) *pluginapi.ContainerAllocateResponse {
+	n := &pluginapi.ContainerAllocateResponse{
+		Envs:        make(map[string]string),
+		Annotations: make(map[string]string),
+		Devices:     resp.Devices,
+	}
+	for k, v := range resp.Envs {
+		n.Envs[k] = goldenCacheFile.ReplaceAllString(v, "<random>.cache")
+	}
+	for k, v := range resp.Annotations {
+		if k != annRequest && k != annUsing {
+			n.Annotations[k] = v
+		}
+	}
+	for _, mount := range resp.Mounts {
+		if strings.HasPrefix(mount.HostPath, sharedCacheRoot+"/") {
+			mount = &pluginapi.Mount{ContainerPath: "<shared-cache>", HostPath: "<shared-cache>", ReadOnly: mount.ReadOnly}
+		}
+		if strings.HasPrefix(mount.HostPath, deviceConfigRoot+"/") {
+			mount = &pluginapi.Mount{ContainerPath: mount.ContainerPath, HostPath: "<device-config>", ReadOnly: mount.ReadOnly}
+		}
+		n.Mounts = append(n.Mounts, mount)
+	}
+	return n
+}
+
+// diffGolden returns the differences between the recorded and the replayed response
+func diffGolden(recorded, replayed *pluginapi.ContainerAllocateResponse) []string {
+	recorded, replayed = normalizeGolden(recorded), normalizeGolden(replayed)
+	var diffs []string
+	diffMaps := func(kind string, want, got map[string]string) {
+		keys := make(map[string]bool)
+		for k := range want {
+			keys[k] = true
+		}
+		for k := range got {
+			keys[k] = true
+		}
+		var sorted []string
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			w, inWant := want[k]
+			g, inGot := got[k]
+			switch {
+			case !inGot:
+				diffs = append(diffs, fmt.Sprintf("%s %s=%q is missing", kind, k, w))
+			case !inWant:
+				diffs = append(diffs, fmt.Sprintf("%s %s=%q is unexpected", kind, k, g))
+			case w != g:
+				diffs = append(diffs, fmt.Sprintf("%s %s is %q, recorded %q", kind, k, g, w))
+			}
+		}
+	}
+	diffMaps("env", recorded.Envs, replayed.Envs)
+	diffMaps("annotation", recorded.Annotations, replayed.Annotations)
+	for _, kind := range []struct {
+		name      string
+		want, got interface{}
+	}{
+		{"mounts", recorded.Mounts, replayed.Mounts},
+		{"devices", recorded.Devices, replayed.Devices},
+	} {
+		want, _ := json.Marshal(kind.want)
+		got, _ := json.Marshal(kind.got)
+		if string(want) != string(got) {
+			diffs = append(diffs, fmt.Sprintf("%s are %s, recorded %s", kind.name, got, want))
+		}
+	}
+	return diffs
+}
+
+// replayGolden runs the allocation pipeline again for the recorded call, without acquiring the
+// vDevices, and returns the differences with the recorded response. The call is skipped if the
+// plugin does not serve the recorded vDevices, golden files only replay on the node or the GPU
+// models they were recorded on.
+func replayGolden(plugins []*NvidiaDevicePlugin, c *goldenCase) (diffs []string, skipped string, err error) {
+	var plugin *NvidiaDevicePlugin
+	for _, p := range plugins {
+		if p.resourceName == c.Resource && p.migStrategy == MigStrategyNone {
+			plugin = p
+		}
+	}
+	if plugin == nil {
+		return nil, fmt.Sprintf("resource %s is not served", c.Resource), nil
+	}
+	if len(c.Using) != len(c.Requests) || len(c.Response) != len(c.Requests) {
+		return nil, "", fmt.Errorf("the recorded call has %d requests, %d allocations and %d responses", len(c.Requests), len(c.Using), len(c.Response))
+	}
+	for _, ids := range c.Using {
+		if _, err := VDevicesByIDs(plugin.getVDevices(), ids); err != nil {
+			return nil, fmt.Sprintf("the recorded vDevices are not served: %v", err), nil
+		}
+	}
+	r := &allocateRequest{
+		ctx:      context.Background(),
+		plugin:   plugin,
+		requests: c.Requests,
+		pod:      c.Pod,
+		replay:   c.Using,
+		dryRun:   true,
+	}
+	resp, err := r.allocate()
+	if err != nil {
+		return nil, "", fmt.Errorf("allocation failed: %v", err)
+	}
+	for i, replayed := range resp.ContainerResponses {
+		for _, diff := range diffGolden(c.Response[i], replayed) {
+			diffs = append(diffs, fmt.Sprintf("container %d: %s", i, diff))
+		}
+	}
+	return diffs, "", nil
+}
+
+// replayGoldenFiles replays the golden files of --golden-replay-dir against the started plugins
+// and returns an error if a replayed response differs from the recorded one
+func replayGoldenFiles(plugins []*NvidiaDevicePlugin) error {
+	files, err := filepath.Glob(filepath.Join(goldenReplayDirFlag, "*.json"))
+	if err != nil {
+		return err
+	}
+	passed, skipped, failed := 0, 0, 0
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var c goldenCase
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("failed to parse golden file %s: %v", file, err)
+		}
+		diffs, skip, err := replayGolden(plugins, &c)
+		switch {
+		case err != nil:
+			log.Printf("FAIL %s: %v", filepath.Base(file), err)
+			failed++
+		case skip != "":
+			log.Printf("SKIP %s: %s", filepath.Base(file), skip)
+			skipped++
+		case len(diffs) > 0:
+			log.Printf("FAIL %s:\n  %s", filepath.Base(file), strings.Join(diffs, "\n  "))
+			failed++
+		default:
+			log.Printf("PASS %s", filepath.Base(file))
+			passed++
+		}
+	}
+	log.Printf("Replayed %d golden files: %d passed, %d failed, %d skipped", len(files), passed, failed, skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d golden files failed", failed, len(files))
+	}
+	if passed == 0 {
+		log.Printf("Warning: no golden file of %s was replayed", goldenReplayDirFlag)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReplayGolden replays the golden files of testdata/golden, recorded with --golden-dir on the
+// fake GPUs split in 2, through the allocation pipeline of the plugin
+func TestReplayGolden(t *testing.T) {
+	plugin, p, stop := startTestPlugin(t, "--device-split-count=2")
+	defer stop()
+	if _, err := p.WaitForDevices(4, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join("testdata", "golden", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden file in testdata/golden")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c goldenCase
+			if err := json.Unmarshal(data, &c); err != nil {
+				t.Fatal(err)
+			}
+			diffs, skipped, err := replayGolden([]*NvidiaDevicePlugin{plugin}, &c)
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case skipped != "":
+				t.Fatalf("skipped: %s", skipped)
+			case len(diffs) > 0:
+				t.Errorf("replayed response differs:\n  %s", strings.Join(diffs, "\n  "))
+			}
+		})
+	}
+}
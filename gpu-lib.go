@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// gpuLib enumerates and describes the GPUs of the node. The plugin uses NVML; tests replace it
+// with a fake set of GPUs to run the plugin on machines without GPUs.
+type gpuLib interface {
+	// deviceCount returns the number of GPUs
+	deviceCount() (uint, error)
+	// deviceAt returns the GPU at index i, with its UUID, path and CPU affinity, and whether MIG
+	// is enabled on it
+	deviceAt(i uint) (*nvml.Device, bool, error)
+	// deviceByUUID returns the GPU with its model, memory, PCI bus ID and compute capability
+	deviceByUUID(uuid string) (*nvml.Device, error)
+}
+
+// gpuLibrary is the gpuLib of the plugin
+var gpuLibrary gpuLib = nvmlLib{}
+
+// nvmlLib is the gpuLib of the GPUs seen by NVML
+type nvmlLib struct{}
+
+func (nvmlLib) deviceCount() (uint, error) {
+	return nvml.GetDeviceCount()
+}
+
+func (nvmlLib) deviceAt(i uint) (*nvml.Device, bool, error) {
+	d, err := nvml.NewDeviceLite(i)
+	if err != nil {
+		return nil, false, err
+	}
+	migEnabled, err := d.IsMigEnabled()
+	if err != nil {
+		return nil, false, err
+	}
+	return d, migEnabled, nil
+}
+
+func (nvmlLib) deviceByUUID(uuid string) (*nvml.Device, error) {
+	return nvml.NewDeviceByUUID(uuid)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+)
+
+// Paths of a GPU Operator managed node
+const (
+	operatorDriverRoot = "/run/nvidia/driver"
+	operatorToolkitDir = "/usr/local/nvidia/toolkit"
+)
+
+// driverRootAuto makes the plugin detect the driver root
+const driverRootAuto = "auto"
+
+// clusterPolicyPath is the ClusterPolicy of the GPU Operator
+const clusterPolicyPath = "/apis/nvidia.com/v1/clusterpolicies"
+
+// clusterPolicy holds the ClusterPolicy fields used as plugin defaults
+type clusterPolicy struct {
+	Spec struct {
+		Driver struct {
+			Enabled *bool `json:"enabled"`
+		} `json:"driver"`
+		MIG struct {
+			Strategy string `json:"strategy"`
+		} `json:"mig"`
+	} `json:"spec"`
+}
+
+// detectDriverRoot returns the driver root of a GPU Operator driver container if one is mounted, else "/"
+func detectDriverRoot() string {
+	for _, p := range []string{"usr/bin/nvidia-smi", "bin/nvidia-smi"} {
+		if _, err := os.Stat(filepath.Join(operatorDriverRoot, p)); err == nil {
+			return operatorDriverRoot
+		}
+	}
+	return "/"
+}
+
+// prependPath prepends the existing directories to the PATH of the plugin, so that the
+// nvidia-smi, nvidia-cuda-mps-control and dcgmi binaries of the driver root are found
+func prependPath(dirs ...string) {
+	var existing []string
+	for _, d := range dirs {
+		if _, err := os.Stat(d); err == nil {
+			existing = append(existing, d)
+		}
+	}
+	if len(existing) == 0 {
+		return
+	}
+	os.Setenv("PATH", strings.Join(append(existing, os.Getenv("PATH")), string(os.PathListSeparator)))
+}
+
+// readClusterPolicy returns the first ClusterPolicy of the GPU Operator
+func readClusterPolicy() (*clusterPolicy, error) {
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	raw, err := client.Discovery().RESTClient().Get().AbsPath(clusterPolicyPath).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := struct {
+		Items []clusterPolicy `json:"items"`
+	}{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, nil
+	}
+	return &list.Items[0], nil
+}
+
+// applyGPUOperatorDefaults resolves --nvidia-driver-root=auto and, with --gpu-operator-cluster-policy,
+// uses the ClusterPolicy for the options not set on the command line
+func applyGPUOperatorDefaults(c *cli.Context) {
+	if gpuOperatorClusterPolicyFlag {
+		policy, err := readClusterPolicy()
+		if err != nil {
+			log.Printf("Warning: failed to read the GPU Operator ClusterPolicy: %v", err)
+		}
+		if policy != nil {
+			if s := policy.Spec.MIG.Strategy; s != "" && !c.IsSet("mig-strategy") {
+				log.Printf("Using MIG strategy '%s' from the GPU Operator ClusterPolicy.", s)
+				migStrategyFlag = s
+			}
+			if d := policy.Spec.Driver.Enabled; d != nil && *d && nvidiaDriverRootFlag == driverRootAuto {
+				log.Printf("The GPU Operator manages the driver, using driver root %s.", operatorDriverRoot)
+				nvidiaDriverRootFlag = operatorDriverRoot
+			}
+		}
+	}
+
+	if nvidiaDriverRootFlag == driverRootAuto {
+		nvidiaDriverRootFlag = detectDriverRoot()
+		log.Printf("Detected driver root %s.", nvidiaDriverRootFlag)
+	}
+	if nvidiaDriverRootFlag != "/" {
+		prependPath(
+			filepath.Join(nvidiaDriverRootFlag, "usr/bin"),
+			filepath.Join(nvidiaDriverRootFlag, "bin"),
+			operatorToolkitDir)
+	}
+}
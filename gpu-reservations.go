@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	v1 "k8s.io/api/core/v1"
+)
+
+// gpuReservation keeps whole GPUs for the pods matching a selector, e.g.
+//
+//	{"name": "monitoring", "count": 1, "selector": "pod.namespace == 'kube-system'"}
+//	{"name": "transcode", "gpus": ["GPU-8f6b..."], "selector": "pod.labels['app'] == 'transcode'"}
+//
+// The selector is an expression of the --allocation-constraints subset seeing the variable pod
+// (namespace, name, container, labels, annotations).
+type gpuReservation struct {
+	Name string `json:"name"`
+	// GPUs are the UUIDs of the reserved GPUs
+	GPUs []string `json:"gpus"`
+	// Count reserves that many GPUs not reserved otherwise, the highest indexes first
+	Count    int    `json:"count"`
+	Selector string `json:"selector"`
+
+	selector expr
+	uuids    map[string]bool
+}
+
+// gpuReservations is the content of --gpu-reservations
+type gpuReservations struct {
+	reservations []*gpuReservation
+	// reserved maps the reserved GPUs to their reservation
+	reserved map[string]*gpuReservation
+}
+
+// reservations is non-nil when --gpu-reservations is set
+var reservations *gpuReservations
+
+// loadGPUReservations reads and compiles the reservations of a file
+func loadGPUReservations(path string) (*gpuReservations, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &gpuReservations{}
+	if err := json.Unmarshal(data, &r.reservations); err != nil {
+		return nil, err
+	}
+	for i, res := range r.reservations {
+		if res.Name == "" {
+			res.Name = strconv.Itoa(i)
+		}
+		if len(res.GPUs) == 0 && res.Count <= 0 {
+			return nil, fmt.Errorf("reservation %q reserves no GPU, set gpus or count", res.Name)
+		}
+		if res.Selector == "" {
+			return nil, fmt.Errorf("reservation %q has no selector", res.Name)
+		}
+		res.selector, err = compileExpr(res.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q of reservation %q: %v", res.Selector, res.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// resolve picks the GPUs of the node each reservation holds, failing if a GPU is reserved twice
+// or a count cannot be satisfied
+func (r *gpuReservations) resolve() error {
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		return err
+	}
+	var uuids []string
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		if err != nil {
+			return err
+		}
+		uuids = append(uuids, d.UUID)
+	}
+
+	r.reserved = make(map[string]*gpuReservation)
+	for _, res := range r.reservations {
+		res.uuids = make(map[string]bool)
+		for _, uuid := range res.GPUs {
+			if other, ok := r.reserved[uuid]; ok {
+				return fmt.Errorf("GPU %s is reserved by both %q and %q", uuid, other.Name, res.Name)
+			}
+			r.reserved[uuid] = res
+			res.uuids[uuid] = true
+		}
+	}
+	for _, res := range r.reservations {
+		for i := len(uuids) - 1; i >= 0 && len(res.uuids) < len(res.GPUs)+res.Count; i-- {
+			if _, ok := r.reserved[uuids[i]]; !ok {
+				r.reserved[uuids[i]] = res
+				res.uuids[uuids[i]] = true
+			}
+		}
+		if len(res.uuids) < len(res.GPUs)+res.Count {
+			return fmt.Errorf("not enough GPUs left to reserve %d for %q", res.Count, res.Name)
+		}
+		var reserved []string
+		for uuid := range res.uuids {
+			reserved = append(reserved, uuid)
+		}
+		sort.Strings(reserved)
+		log.Printf("Reserved GPUs %v for %q (%s)", reserved, res.Name, res.Selector)
+	}
+	return nil
+}
+
+// matches returns true if the pod is selected by the reservation
+func (res *gpuReservation) matches(pod *v1.Pod, container string) bool {
+	vars := map[string]interface{}{
+		"pod": map[string]interface{}{
+			"namespace":   pod.Namespace,
+			"name":        pod.Name,
+			"container":   container,
+			"labels":      map[string]string(pod.Labels),
+			"annotations": map[string]string(pod.Annotations),
+		},
+	}
+	ok, err := res.selector.evalBool(vars)
+	if err != nil {
+		log.Printf("Warning: selector %q of reservation %q failed for pod %s: %v", res.Selector, res.Name, pod.Name, err)
+	}
+	return ok
+}
+
+// filterForPod keeps the vDevices of ids the pod may use: the unreserved ones and those of the
+// reservations it matches. Pods matching a reservation get its GPUs only while they have
+// n vDevices available.
+func (r *gpuReservations) filterForPod(a *containerAllocation, ids []string, n int) []string {
+	if r == nil || len(r.reserved) == 0 {
+		return ids
+	}
+	matched := make(map[*gpuReservation]bool)
+	if len(a.pod.UID) > 0 {
+		for _, res := range r.reservations {
+			if res.matches(&a.pod, a.container) {
+				matched[res] = true
+			}
+		}
+	}
+	candidates, err := VDevicesByIDs(a.plugin.vDevices, ids)
+	if err != nil {
+		return ids
+	}
+	var allowed, reserved []string
+	for _, vd := range candidates {
+		res, ok := r.reserved[vd.dev.ID]
+		switch {
+		case !ok:
+			allowed = append(allowed, vd.ID)
+		case matched[res]:
+			allowed = append(allowed, vd.ID)
+			reserved = append(reserved, vd.ID)
+		}
+	}
+	if len(reserved) >= n {
+		return reserved
+	}
+	return allowed
+}
+
+// withoutReserved removes the vDevices of reserved GPUs from the candidates of a preferred
+// allocation, which does not know the pod, unless too few would be left
+func (r *gpuReservations) withoutReserved(vdevices []*VDevice, required []*VDevice, n int) []*VDevice {
+	if r == nil || len(r.reserved) == 0 {
+		return vdevices
+	}
+	for _, vd := range required {
+		if _, ok := r.reserved[vd.dev.ID]; ok {
+			return vdevices
+		}
+	}
+	var unreserved []*VDevice
+	for _, vd := range vdevices {
+		if _, ok := r.reserved[vd.dev.ID]; !ok {
+			unreserved = append(unreserved, vd)
+		}
+	}
+	if len(unreserved) < n {
+		return vdevices
+	}
+	return unreserved
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Pod annotations restricting the GPU models a pod is allocated
+const (
+	annUseGPUType           = "nvidia.com/use-gputype"
+	annNoUseGPUType         = "nvidia.com/nouse-gputype"
+	annMinComputeCapability = "4paradigm.com/vgpu-min-compute-capability"
+)
+
+// gpuModel is the product name, memory in MiB, CUDA compute capability and PCI address of a physical GPU
+type gpuModel struct {
+	name   string
+	memory uint64
+	major  int
+	minor  int
+	// busID is the PCI address in the sysfs form, e.g. 0000:3b:00.0
+	busID string
+}
+
+var (
+	gpuModelsMux sync.Mutex
+	gpuModels    = make(map[string]*gpuModel)
+	// gpuModelsDirty is true when gpuModels has entries missing from the device cache file
+	gpuModelsDirty bool
+)
+
+// getGPUModel returns the model of the GPU with the given UUID, caching NVML lookups
+func getGPUModel(uuid string) (*gpuModel, error) {
+	gpuModelsMux.Lock()
+	m, ok := gpuModels[uuid]
+	gpuModelsMux.Unlock()
+	if ok {
+		return m, nil
+	}
+	if strings.Contains(uuid, "MIG") {
+		return nil, fmt.Errorf("model selectors are not supported on MIG device %s", uuid)
+	}
+	// Query NVML without holding the lock so that GPUs can be looked up concurrently
+	d, err := gpuLibrary.deviceByUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	m = &gpuModel{}
+	if d.Model != nil {
+		m.name = *d.Model
+	}
+	if d.Memory != nil {
+		m.memory = *d.Memory
+	}
+	// NVML reports 8 digit PCI domains, sysfs uses 4
+	if id := strings.ToLower(d.PCI.BusID); len(id) >= 12 {
+		m.busID = id[len(id)-12:]
+	}
+	if d.CudaComputeCapability.Major != nil && d.CudaComputeCapability.Minor != nil {
+		m.major = *d.CudaComputeCapability.Major
+		m.minor = *d.CudaComputeCapability.Minor
+	}
+	gpuModelsMux.Lock()
+	gpuModels[uuid] = m
+	gpuModelsDirty = true
+	gpuModelsMux.Unlock()
+	return m, nil
+}
+
+// gpuSelector is the set of GPU model constraints of a pod
+type gpuSelector struct {
+	use   []string
+	nouse []string
+	major int
+	minor int
+}
+
+// newGPUSelector returns the GPU model constraints of the pod annotations, or nil if it has none
+func newGPUSelector(pod *v1.Pod) (*gpuSelector, error) {
+	if !podAnnotationsFlag || len(pod.UID) == 0 {
+		return nil, nil
+	}
+	s := &gpuSelector{
+		use:   splitGPUTypes(pod.Annotations[annUseGPUType]),
+		nouse: splitGPUTypes(pod.Annotations[annNoUseGPUType]),
+	}
+	if value, ok := pod.Annotations[annMinComputeCapability]; ok {
+		parts := strings.SplitN(strings.TrimSpace(value), ".", 2)
+		var err error
+		s.major, err = strconv.Atoi(parts[0])
+		if err == nil && len(parts) == 2 {
+			s.minor, err = strconv.Atoi(parts[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on pod %s: %q", annMinComputeCapability, pod.Name, value)
+		}
+	}
+	if len(s.use) == 0 && len(s.nouse) == 0 && s.major == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+func splitGPUTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, strings.ToUpper(t))
+		}
+	}
+	return types
+}
+
+// matches returns nil if the GPU satisfies the selector, or the reason it does not
+func (s *gpuSelector) matches(uuid string) error {
+	if s == nil {
+		return nil
+	}
+	m, err := getGPUModel(uuid)
+	if err != nil {
+		return err
+	}
+	name := strings.ToUpper(m.name)
+	if len(s.use) > 0 {
+		found := false
+		for _, t := range s.use {
+			if strings.Contains(name, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not one of %s", m.name, strings.Join(s.use, ","))
+		}
+	}
+	for _, t := range s.nouse {
+		if strings.Contains(name, t) {
+			return fmt.Errorf("%s is excluded by %s", m.name, t)
+		}
+	}
+	if m.major < s.major || m.major == s.major && m.minor < s.minor {
+		return fmt.Errorf("%s has compute capability %d.%d, below %d.%d", m.name, m.major, m.minor, s.major, s.minor)
+	}
+	return nil
+}
+
+// filterVDeviceIDs returns the IDs of the vDevices on GPUs satisfying the selector
+func (s *gpuSelector) filterVDeviceIDs(vdevices []*VDevice, ids []string) []string {
+	if s == nil {
+		return ids
+	}
+	var filtered []string
+	for _, id := range ids {
+		for _, vd := range vdevices {
+			if vd.ID == id && s.matches(vd.dev.ID) == nil {
+				filtered = append(filtered, id)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// check returns an error naming the first vDevice on a GPU not satisfying the selector
+func (s *gpuSelector) check(vdevices []*VDevice) error {
+	for _, vd := range vdevices {
+		if err := s.matches(vd.dev.ID); err != nil {
+			return fmt.Errorf("vDevice %s does not satisfy the GPU model selector of the pod: %v", vd.ID, err)
+		}
+	}
+	return nil
+}
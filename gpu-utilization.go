@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// utilizationWindow is the number of samples the recent utilization of a GPU is averaged over
+const utilizationWindow = 6
+
+// utilizationMonitor is non-nil when --busy-gpu-threshold is set
+var utilizationMonitor *UtilizationMonitor
+
+// UtilizationMonitor periodically samples the SM utilization of the GPUs so that the preferred
+// allocation offers the busy GPUs last, whatever the number of vDevices granted on them
+type UtilizationMonitor struct {
+	mux       sync.Mutex
+	threshold uint64
+	interval  time.Duration
+	samples   map[string][]uint64
+}
+
+// NewUtilizationMonitor returns a reference to a new UtilizationMonitor, threshold is the recent
+// utilization in percent from which a GPU is busy
+func NewUtilizationMonitor(threshold uint64, interval time.Duration) *UtilizationMonitor {
+	return &UtilizationMonitor{
+		threshold: threshold,
+		interval:  interval,
+		samples:   make(map[string][]uint64),
+	}
+}
+
+// sample records the current utilization of the GPUs, keeping the last utilizationWindow samples
+func (u *UtilizationMonitor) sample() error {
+	samples, err := gpuSamples()
+	if err != nil {
+		return err
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	for uuid := range u.samples {
+		if _, ok := samples[uuid]; !ok {
+			delete(u.samples, uuid)
+		}
+	}
+	for uuid, s := range samples {
+		window := append(u.samples[uuid], s.gpuUtil)
+		if len(window) > utilizationWindow {
+			window = window[len(window)-utilizationWindow:]
+		}
+		u.samples[uuid] = window
+	}
+	return nil
+}
+
+// recent returns the average utilization of the GPU over the last samples. The caller holds
+// u.mux.
+func (u *UtilizationMonitor) recent(uuid string) (uint64, bool) {
+	window := u.samples[uuid]
+	if len(window) == 0 {
+		return 0, false
+	}
+	var sum uint64
+	for _, v := range window {
+		sum += v
+	}
+	return sum / uint64(len(window)), true
+}
+
+// markBusy sets the recent utilization of the GPUs of loads and flags the busy ones
+func (u *UtilizationMonitor) markBusy(loads map[string]*gpuLoad) {
+	if u == nil {
+		return
+	}
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	for uuid, l := range loads {
+		if util, ok := u.recent(uuid); ok {
+			l.utilization = util
+			l.busy = util >= u.threshold
+		}
+	}
+}
+
+// run samples the GPUs every interval until stop is closed
+func (u *UtilizationMonitor) run(stop <-chan struct{}) {
+	for {
+		if err := u.sample(); err != nil {
+			log.Printf("Warning: failed to sample the GPU utilization: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(u.interval):
+		}
+	}
+}
+
+func (u *UtilizationMonitor) writeMetrics(w io.Writer) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	fmt.Fprintln(w, "# HELP vgpu_device_recent_utilization GPU utilization in percent averaged over the recent samples of --busy-gpu-threshold.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_recent_utilization gauge")
+	for uuid := range u.samples {
+		util, _ := u.recent(uuid)
+		writeGauge(w, "vgpu_device_recent_utilization", uuid, util)
+	}
+	fmt.Fprintln(w, "# HELP vgpu_device_busy 1 if the GPU is offered last by the preferred allocation for its recent utilization.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_busy gauge")
+	for uuid := range u.samples {
+		util, _ := u.recent(uuid)
+		value := 0
+		if util >= u.threshold {
+			value = 1
+		}
+		writeGauge(w, "vgpu_device_busy", uuid, value)
+	}
+}
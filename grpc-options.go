@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// grpcServerOptions returns the options for the device plugin gRPC server built from the command line flags
+func grpcServerOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if grpcMaxRecvMsgSizeFlag > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(grpcMaxRecvMsgSizeFlag))
+	}
+	if grpcMaxSendMsgSizeFlag > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(grpcMaxSendMsgSizeFlag))
+	}
+	if grpcKeepaliveTimeFlag > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    grpcKeepaliveTimeFlag,
+			Timeout: grpcKeepaliveTimeoutFlag,
+		}))
+	}
+	return opts
+}
+
+// parseSocketMode parses an octal file mode such as "0660"
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// applySocketPermissions sets the mode and ownership of a unix socket from the command line flags
+func applySocketPermissions(socket string) error {
+	if socketModeFlag != "" {
+		mode, err := parseSocketMode(socketModeFlag)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(socket, mode); err != nil {
+			return err
+		}
+	}
+	if socketUIDFlag >= 0 || socketGIDFlag >= 0 {
+		if err := os.Chown(socket, socketUIDFlag, socketGIDFlag); err != nil {
+			return err
+		}
+	}
+	label, err := socketSELinuxLabel(socket)
+	if err != nil {
+		return err
+	}
+	if label != "" {
+		if err := syscall.Setxattr(socket, selinuxXattr, []byte(label), 0); err != nil {
+			return fmt.Errorf("failed to set the SELinux label %s of %s: %v", label, socket, err)
+		}
+	}
+	return nil
+}
+
+// selinuxXattr is the extended attribute holding the SELinux label of a file
+const selinuxXattr = "security.selinux"
+
+// kubeletConnectTimeout is the time the kubelet has to call ListAndWatch once the plugin is registered
+const kubeletConnectTimeout = 30 * time.Second
+
+// selinuxEnabled returns true if SELinux is enabled on the host
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// getSELinuxLabel returns the SELinux label of a file, or an empty string if it has none
+func getSELinuxLabel(path string) string {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(path, selinuxXattr, buf)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	return strings.TrimRight(string(buf[:n]), "\x00")
+}
+
+// socketSELinuxLabel returns the SELinux label to give a socket: --socket-selinux-label, else
+// the label of its directory, which the kubelet is allowed to access, when SELinux is enabled
+func socketSELinuxLabel(socket string) (string, error) {
+	if socketSELinuxLabelFlag != "" {
+		return socketSELinuxLabelFlag, nil
+	}
+	if !selinuxEnabled() {
+		return "", nil
+	}
+	label := getSELinuxLabel(filepath.Dir(socket))
+	if label == "" || label == getSELinuxLabel(socket) {
+		return "", nil
+	}
+	return label, nil
+}
+
+// describeSocket returns the mode, ownership and SELinux label of a socket
+func describeSocket(socket string) string {
+	info, err := os.Stat(socket)
+	if err != nil {
+		return err.Error()
+	}
+	desc := fmt.Sprintf("mode %v", info.Mode().Perm())
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		desc += fmt.Sprintf(", owner %d:%d", st.Uid, st.Gid)
+	}
+	if label := getSELinuxLabel(socket); label != "" {
+		desc += ", SELinux label " + label
+	}
+	return desc
+}
+
+// verifyKubeletConnects reports a plugin the kubelet registered but never connected to, which
+// happens when the permissions or the SELinux label of the socket keep the kubelet out
+func (m *NvidiaDevicePlugin) verifyKubeletConnects(stop <-chan interface{}, connected <-chan struct{}, socket string) {
+	select {
+	case <-stop:
+	case <-connected:
+	case <-time.After(kubeletConnectTimeout):
+		log.Printf("Error: the kubelet did not connect to '%s' within %v of its registration, check that it can access %s (%s), see --socket-mode, --socket-uid, --socket-gid and --socket-selinux-label",
+			m.resourceName, kubeletConnectTimeout, socket, describeSocket(socket))
+	}
+}
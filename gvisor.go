@@ -0,0 +1,37 @@
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// annGVisorNVProxy enables the nvproxy of runsc for the sandbox of the pod, honored when runsc
+// runs with --allow-flag-override
+const annGVisorNVProxy = "dev.gvisor.flag.nvproxy"
+
+// gvisorRuntimeClasses is the parsed --gvisor-runtime-classes
+var gvisorRuntimeClasses []string
+
+// podUsesGVisor returns true if the pod runs in a gVisor sandbox, whose nvproxy forwards the
+// ioctls of the driver but not the preloaded interception of libvgpu
+func podUsesGVisor(pod *v1.Pod) bool {
+	if gvisorNVProxyFlag {
+		return true
+	}
+	if len(gvisorRuntimeClasses) == 0 || pod.Spec.RuntimeClassName == nil {
+		return false
+	}
+	return containsString(gvisorRuntimeClasses, *pod.Spec.RuntimeClassName)
+}
+
+// injectGVisorStage gives the sandbox the device nodes of the allocated GPUs and enables its
+// nvproxy, without the libvgpu mounts and environment
+func injectGVisorStage(a *containerAllocation) error {
+	m := a.plugin
+	response := a.response
+	response.Envs = m.apiEnvs(m.deviceListEnvvar, m.deviceIDsFromUUIDs(a.uuids))
+	response.Envs["NVIDIA_DRIVER_CAPABILITIES"] = "compute,utility"
+	response.Mounts = nil
+	response.Devices = m.apiDeviceSpecs(nvidiaDriverRootFlag, a.uuids)
+	response.Annotations = map[string]string{annGVisorNVProxy: "true"}
+	return nil
+}
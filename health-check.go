@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Depths of the health checks set with --health-check-depth
+const (
+	// healthCheckXIDs only watches the critical XID events
+	healthCheckXIDs = "xids"
+	// healthCheckFull also queries the status of every GPU through NVML at each interval
+	healthCheckFull = "full"
+)
+
+// queryGPUStatus starts a query of the status of the GPU through NVML
+func queryGPUStatus(uuid string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		d, err := nvml.NewDeviceLiteByUUID(uuid)
+		if err == nil {
+			_, err = d.Status()
+		}
+		result <- err
+	}()
+	return result
+}
+
+// statusChecker marks the devices of the GPUs failing their status query unhealthy, and healthy
+// again once the query succeeds
+type statusChecker struct {
+	devices []*Device
+	last    time.Time
+	// failed are the GPUs whose last status query failed
+	failed map[string]bool
+	// pending are the queries that timed out and did not return yet, a GPU gets no new query
+	// until its pending one returns
+	pending map[string]<-chan error
+}
+
+func newStatusChecker(devices []*Device) *statusChecker {
+	return &statusChecker{devices: devices, failed: make(map[string]bool), pending: make(map[string]<-chan error)}
+}
+
+// query returns the outcome of the status query of the GPU, failing if it does not answer
+// within --health-check-timeout
+func (c *statusChecker) query(gpu string) error {
+	result, ok := c.pending[gpu]
+	if !ok {
+		result = queryGPUStatus(gpu)
+	}
+	var timeout <-chan time.Time
+	if healthCheckTimeoutFlag > 0 {
+		timeout = time.After(healthCheckTimeoutFlag)
+	}
+	select {
+	case err := <-result:
+		delete(c.pending, gpu)
+		return err
+	case <-timeout:
+		c.pending[gpu] = result
+		return fmt.Errorf("no answer within %v", healthCheckTimeoutFlag)
+	}
+}
+
+// check queries the GPUs if --health-check-interval elapsed since the last query
+func (c *statusChecker) check(unhealthy chan<- *DeviceHealth) {
+	if healthCheckDepthFlag != healthCheckFull || time.Since(c.last) < healthCheckIntervalFlag {
+		return
+	}
+	c.last = time.Now()
+
+	byGPU := make(map[string][]*Device)
+	var gpus []string
+	for _, d := range c.devices {
+		gpu, _, _, err := nvml.ParseMigDeviceUUID(d.ID)
+		if err != nil {
+			gpu = d.ID
+		}
+		if _, ok := byGPU[gpu]; !ok {
+			gpus = append(gpus, gpu)
+		}
+		byGPU[gpu] = append(byGPU[gpu], d)
+	}
+	for _, gpu := range gpus {
+		err := c.query(gpu)
+		switch {
+		case err != nil && !c.failed[gpu]:
+			c.failed[gpu] = true
+			log.Printf("Status query of GPU %s failed, its devices will go unhealthy: %v", gpu, err)
+			for _, d := range byGPU[gpu] {
+				reportGPUFault(npdReasonStatusQuery, d.ID, "status query failed: %v", err)
+				unhealthy <- unhealthyEvent(d, "status query failed: %v", err)
+			}
+		case err == nil && c.failed[gpu]:
+			delete(c.failed, gpu)
+			log.Printf("Status query of GPU %s succeeded again", gpu)
+			for _, d := range byGPU[gpu] {
+				unhealthy <- &DeviceHealth{Device: d, Health: pluginapi.Healthy, Reason: "status query succeeded"}
+			}
+		}
+	}
+}
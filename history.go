@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// historySegments is the number of files the retention period is split into; the oldest
+// file is removed once all its samples are past the retention period
+const historySegments = 24
+
+// usageHistory is non-nil when --history-dir is set
+var usageHistory *UsageHistory
+
+// usageSample is the usage of the GPUs and of the pods using them at a point in time
+type usageSample struct {
+	Time time.Time        `json:"time"`
+	GPUs []gpuUsageSample `json:"gpus"`
+	Pods []podUsageSample `json:"pods,omitempty"`
+}
+
+// gpuUsageSample is the usage of a physical GPU; memory is in MiB
+type gpuUsageSample struct {
+	UUID        string `json:"uuid"`
+	Utilization uint64 `json:"utilization"`
+	MemoryUtil  uint64 `json:"memoryUtilization"`
+	MemoryUsed  uint64 `json:"memoryUsed"`
+}
+
+// podUsageSample is the memory in MiB used by the processes of a pod on a GPU
+type podUsageSample struct {
+	Pod        string `json:"pod"`
+	PodUID     string `json:"podUID"`
+	GPU        string `json:"gpu"`
+	MemoryUsed uint64 `json:"memoryUsed"`
+}
+
+// UsageHistory samples the GPU and pod usage periodically into a bounded set of JSON Lines
+// segment files under dir
+type UsageHistory struct {
+	mux       sync.Mutex
+	dir       string
+	interval  time.Duration
+	retention time.Duration
+	file      *os.File
+	started   time.Time
+}
+
+// NewUsageHistory returns a reference to a new UsageHistory writing to dir
+func NewUsageHistory(dir string, interval, retention time.Duration) (*UsageHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &UsageHistory{
+		dir:       dir,
+		interval:  interval,
+		retention: retention,
+	}, nil
+}
+
+// segments returns the segment files and their start time, oldest first
+func (h *UsageHistory) segments() ([]string, []time.Time) {
+	matches, _ := filepath.Glob(filepath.Join(h.dir, "history-*.jsonl"))
+	sort.Strings(matches)
+	var paths []string
+	var starts []time.Time
+	for _, path := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "history-"), ".jsonl")
+		sec, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, path)
+		starts = append(starts, time.Unix(sec, 0))
+	}
+	return paths, starts
+}
+
+// rotate opens a new segment once the current one spans its share of the retention
+// period, and removes the segments entirely past the retention period
+func (h *UsageHistory) rotate(now time.Time) error {
+	segment := h.retention / historySegments
+	if h.file != nil && now.Sub(h.started) < segment {
+		return nil
+	}
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+	// File names are zero-padded so that they sort by time
+	path := filepath.Join(h.dir, fmt.Sprintf("history-%012d.jsonl", now.Unix()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	h.file = f
+	h.started = now
+
+	paths, starts := h.segments()
+	for i := range paths {
+		// A segment ends where the next one starts
+		if i+1 < len(starts) && now.Sub(starts[i+1]) > h.retention {
+			os.Remove(paths[i])
+		}
+	}
+	return nil
+}
+
+// record appends a sample to the current segment
+func (h *UsageHistory) record(s *usageSample) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if err := h.rotate(s.Time); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = h.file.Write(append(data, '\n'))
+	return err
+}
+
+// query returns the samples taken since the given time, restricted to a GPU and a pod
+// ("namespace/name" or UID) when not empty
+func (h *UsageHistory) query(since time.Time, gpu, pod string) ([]usageSample, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	paths, starts := h.segments()
+	var samples []usageSample
+	for i, path := range paths {
+		if i+1 < len(starts) && starts[i+1].Before(since) {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var s usageSample
+			if err := json.Unmarshal(scanner.Bytes(), &s); err != nil || s.Time.Before(since) {
+				continue
+			}
+			if filterUsageSample(&s, gpu, pod) {
+				samples = append(samples, s)
+			}
+		}
+		f.Close()
+	}
+	return samples, nil
+}
+
+// filterUsageSample keeps the entries of s matching gpu and pod, returning false if none remains
+func filterUsageSample(s *usageSample, gpu, pod string) bool {
+	if gpu != "" {
+		var gpus []gpuUsageSample
+		for _, g := range s.GPUs {
+			if g.UUID == gpu {
+				gpus = append(gpus, g)
+			}
+		}
+		s.GPUs = gpus
+	}
+	var pods []podUsageSample
+	for _, p := range s.Pods {
+		if (gpu == "" || p.GPU == gpu) && (pod == "" || p.Pod == pod || p.PodUID == pod) {
+			pods = append(pods, p)
+		}
+	}
+	s.Pods = pods
+	if pod != "" {
+		s.GPUs = nil
+		return len(s.Pods) > 0
+	}
+	return len(s.GPUs) > 0
+}
+
+// podUIDPattern matches the pod UID in the cgroup path of a container process, with either
+// the cgroupfs ("pod<uid>") or the systemd ("pod<uid with underscores>.slice") driver
+var podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// podUIDOfProcess returns the UID of the pod a process runs in, or an empty string
+func podUIDOfProcess(pid uint) string {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	m := podUIDPattern.FindStringSubmatch(string(data))
+	if m == nil {
+		return ""
+	}
+	return strings.Replace(m[1], "_", "-", -1)
+}
+
+// sampleUsage returns the current usage of the GPUs and of the pods running processes on them
+func sampleUsage() (*usageSample, error) {
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		return nil, err
+	}
+	s := &usageSample{Time: time.Now()}
+	var podNames map[string]string
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		if err != nil {
+			if isNVMLStale(err) {
+				reportNVMLLost(err)
+			}
+			return nil, err
+		}
+		status, err := d.Status()
+		if err != nil {
+			log.Printf("Warning: failed to get status of %s: %v", d.UUID, err)
+			continue
+		}
+		g := gpuUsageSample{UUID: d.UUID}
+		if status.Utilization.GPU != nil {
+			g.Utilization = uint64(*status.Utilization.GPU)
+		}
+		if status.Utilization.Memory != nil {
+			g.MemoryUtil = uint64(*status.Utilization.Memory)
+		}
+		if status.Memory.Global.Used != nil {
+			g.MemoryUsed = *status.Memory.Global.Used
+		}
+		s.GPUs = append(s.GPUs, g)
+
+		used := make(map[string]uint64)
+		for _, p := range status.Processes {
+			if uid := podUIDOfProcess(p.PID); uid != "" {
+				used[uid] += p.MemoryUsed
+			}
+		}
+		if len(used) > 0 && podNames == nil {
+			podNames = podNamesByUID()
+		}
+		for uid, memory := range used {
+			s.Pods = append(s.Pods, podUsageSample{Pod: podNames[uid], PodUID: uid, GPU: d.UUID, MemoryUsed: memory})
+		}
+	}
+	return s, nil
+}
+
+// run samples the usage every interval until stop is closed
+func (h *UsageHistory) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			h.mux.Lock()
+			if h.file != nil {
+				h.file.Close()
+			}
+			h.mux.Unlock()
+			return
+		case <-time.After(h.interval):
+		}
+		s, err := sampleUsage()
+		if err != nil {
+			log.Printf("Warning: failed to sample usage history: %v", err)
+			continue
+		}
+		if err := h.record(s); err != nil {
+			log.Printf("Warning: failed to record usage history: %v", err)
+		}
+	}
+}
+
+// serveUsageHistory handles GET /admin/history?since=<duration>&gpu=<uuid>&pod=<namespace/name or uid>,
+// returning the samples as a JSON array
+func serveUsageHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if usageHistory == nil {
+		http.Error(w, "usage history is disabled, see --history-dir", http.StatusNotFound)
+		return
+	}
+	since := time.Hour
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = time.ParseDuration(value)
+		if err != nil || since <= 0 {
+			http.Error(w, fmt.Sprintf("invalid since: %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	samples, err := usageHistory.query(time.Now().Add(-since), r.URL.Query().Get("gpu"), r.URL.Query().Get("pod"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if samples == nil {
+		samples = []usageSample{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// instanceLockPath is the lock file held by the running plugin. It is not in the device plugin
+// directory, whose files the kubelet deletes when it restarts.
+const instanceLockPath = "/usr/local/vgpu/device-plugin.lock"
+
+// socketProbeTimeout bounds the dial telling a served socket from a stale one
+const socketProbeTimeout = time.Second
+
+// instanceLock is the open lock file, held until the plugin exits. The kernel releases the lock
+// when its holder dies, whatever the way, so a lock file left behind is never in the way.
+var instanceLock *os.File
+
+// acquireInstanceLock makes sure no other instance of the plugin serves the node, e.g. the old
+// pod of a botched rollout. It waits up to timeout for the previous owner to exit, then fails
+// naming it. Called again on each restart of the plugins, it locks the file anew if it was
+// deleted meanwhile.
+func acquireInstanceLock(timeout time.Duration) error {
+	path := instanceLockPath
+	if instanceLock != nil {
+		held, err := instanceLock.Stat()
+		if current, statErr := os.Stat(path); err == nil && statErr == nil && os.SameFile(held, current) {
+			return nil
+		}
+		log.Printf("Warning: the instance lock %s was deleted, locking it again", path)
+		instanceLock.Close()
+		instanceLock = nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the instance lock %s: %v", path, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			owner, _ := ioutil.ReadFile(path)
+			f.Close()
+			return fmt.Errorf("another instance of the plugin (%s) holds %s, refusing to start; stop it or wait for it to exit",
+				strings.TrimSpace(string(owner)), path)
+		}
+		log.Printf("Waiting for the instance of the plugin holding %s to exit", path)
+		time.Sleep(time.Second)
+	}
+	if owner, _ := ioutil.ReadFile(path); len(owner) > 0 {
+		log.Printf("Taking over from the previous instance of the plugin (%s), which exited", strings.TrimSpace(string(owner)))
+	}
+	hostname, _ := os.Hostname()
+	f.Truncate(0)
+	f.WriteAt([]byte(fmt.Sprintf("pid %d on %s\n", os.Getpid(), hostname)), 0)
+	instanceLock = f
+	return nil
+}
+
+// takeOverSocket removes the socket of a plugin that is no longer served, so that the plugin can
+// listen on it. It fails if a server still accepts connections on it.
+func takeOverSocket(socket string) error {
+	if _, err := os.Stat(socket); os.IsNotExist(err) {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", socket, socketProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is served by another instance of the plugin, refusing to take it over", socket)
+	}
+	log.Printf("Taking over the stale socket %s: %v", socket, err)
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
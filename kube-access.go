@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// kubePermission is an access to the API server needed by an enabled feature
+type kubePermission struct {
+	feature     string
+	verb        string
+	group       string
+	resource    string
+	subresource string
+	// name restricts the access to one object, such as the node of the plugin
+	name string
+}
+
+// requiredKubePermissions returns the accesses to the API server of the enabled features only,
+// so that the plugin can run with a service account granted nothing more
+func requiredKubePermissions() []kubePermission {
+	var perms []kubePermission
+	add := func(feature, group, resource, subresource, name string, verbs ...string) {
+		for _, verb := range verbs {
+			perms = append(perms, kubePermission{feature: feature, verb: verb, group: group, resource: resource, subresource: subresource, name: name})
+		}
+	}
+	nodeName := os.Getenv("NODE_NAME")
+
+	if podLookupEnabled() {
+		add("pod lookup on Allocate", "", "pods", "", "", "list")
+	}
+	if enableExclusiveGPUsFlag {
+		add("--enable-exclusive-gpus", "", "pods", "", "", "list")
+	}
+	if allocationModeFlag == allocationModePluginManaged {
+		add("--allocation-mode=plugin-managed", "", "pods", "", "", "list", "watch")
+	}
+	if defaultDeviceMemoryFlag != "" {
+		add("--default-device-memory", "", "pods", "", "", "patch")
+	}
+	if namespaceQuotaFlag {
+		add("--namespace-quota", "", "namespaces", "", "", "get")
+	}
+	if monitorModeFlag == monitorModeFullMetrics {
+		add("--monitor-mode=full-metrics", "", "pods", "", "", "list")
+	}
+	if metricsAddressFlag != "" || historyDirFlag != "" {
+		add("pod names in the status", "", "pods", "", "", "list")
+	}
+	if reportNodeHealthFlag {
+		add("--report-node-health", "", "nodes", "", nodeName, "get", "update")
+		add("--report-node-health", "", "nodes", "status", nodeName, "update")
+	}
+	if rebalanceIntervalFlag > 0 {
+		add("--rebalance-interval", "", "nodes", "", nodeName, "patch")
+	}
+	if vgpuNodeCRDFlag {
+		add("--vgpu-node-crd", "vgpu.4paradigm.com", "vgpunodes", "", "", "get", "create", "update")
+	}
+	if deviceMapNamespaceFlag != "" {
+		add("--device-map-namespace", "", "configmaps", "", "", "get", "create", "update")
+	}
+	if vgpuConfigCRDFlag {
+		add("--vgpu-config-crd", "", "nodes", "", nodeName, "get")
+		add("--vgpu-config-crd", "vgpu.4paradigm.com", "vgpuconfigs", "", "", "list")
+	}
+	if enableVfioFlag {
+		add("--enable-vfio", "", "nodes", "", nodeName, "get")
+	}
+	if confidentialComputing.enabled() && nodeName != "" {
+		add("confidential computing GPUs", "", "nodes", "", nodeName, "patch")
+	}
+	if gpuOperatorClusterPolicyFlag {
+		add("--gpu-operator-cluster-policy", "nvidia.com", "clusterpolicies", "", "", "list")
+	}
+	if memoryPressureThresholdFlag > 0 && nodeName != "" {
+		add("--memory-pressure-threshold", "", "events", "", "", "create")
+	}
+	if (sharedCacheQuotaMiB > 0 || sharedCacheDirLimitMiB > 0) && nodeName != "" {
+		add("--shared-cache-quota", "", "events", "", "", "create")
+	}
+	if licenseSecretFlag != "" {
+		parts := strings.SplitN(licenseSecretFlag, "/", 2)
+		add("--license-secret", "", "secrets", "", parts[len(parts)-1], "get")
+	}
+	if (licenseURLFlag != "" || licenseSecretFlag != "") && nodeName != "" {
+		add("license expiry events", "", "events", "", "", "create")
+	}
+	return perms
+}
+
+// checkKubePermissions asks the API server which of perms the plugin is not granted
+func checkKubePermissions(perms []kubePermission) ([]kubePermission, error) {
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	var missing []kubePermission
+	for _, p := range perms {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:        p.verb,
+					Group:       p.group,
+					Resource:    p.resource,
+					Subresource: p.subresource,
+					Name:        p.name,
+				},
+			},
+		}
+		var resp *authorizationv1.SelfSubjectAccessReview
+		err = retryKube(context.Background(), func(ctx context.Context) error {
+			resp, err = client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to review access to %s %s: %v", p.verb, p.resource, err)
+		}
+		if !resp.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// formatKubePermissions formats perms as the ClusterRole rules granting them, commented with the
+// features needing them
+func formatKubePermissions(perms []kubePermission) string {
+	type rule struct {
+		group    string
+		resource string
+		verbs    []string
+		features []string
+	}
+	rules := make(map[string]*rule)
+	var keys []string
+	for _, p := range perms {
+		resource := p.resource
+		if p.subresource != "" {
+			resource += "/" + p.subresource
+		}
+		key := p.group + "|" + resource
+		r, ok := rules[key]
+		if !ok {
+			r = &rule{group: p.group, resource: resource}
+			rules[key] = r
+			keys = append(keys, key)
+		}
+		r.verbs = appendUnique(r.verbs, p.verb)
+		r.features = appendUnique(r.features, p.feature)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		r := rules[key]
+		fmt.Fprintf(&b, "- apiGroups: [%q]\n", r.group)
+		fmt.Fprintf(&b, "  resources: [%q]\n", r.resource)
+		fmt.Fprintf(&b, "  verbs: [\"%s\"] # %s\n", strings.Join(r.verbs, "\", \""), strings.Join(r.features, ", "))
+	}
+	return b.String()
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// validateKubePermissions fails with the rules to add to the ClusterRole of the plugin if the
+// enabled features need accesses it is not granted
+func validateKubePermissions() error {
+	perms := requiredKubePermissions()
+	if len(perms) == 0 {
+		return nil
+	}
+	missing, err := checkKubePermissions(perms)
+	if err != nil {
+		// Failures to reach the API server are reported by the features themselves
+		log.Printf("Warning: could not validate the RBAC permissions of the plugin: %v", err)
+		return nil
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the service account of the plugin lacks permissions needed by the enabled features, add to its ClusterRole:\n%s", formatKubePermissions(missing))
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeAPITimeout bounds each request to the API server
+const kubeAPITimeout = 10 * time.Second
+
+// kubeRetryBackoff spaces the retries of the API requests made while allocating
+var kubeRetryBackoff = wait.Backoff{
+	Duration: 200 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    4,
+}
+
+// conflictRetryBackoff spaces the retries of an update refused because the object changed since
+// it was read, like retry.DefaultRetry of client-go
+var conflictRetryBackoff = wait.Backoff{
+	Duration: 10 * time.Millisecond,
+	Factor:   1,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
+var (
+	kubeClientMux sync.Mutex
+	kubeClient    kubernetes.Interface
+)
+
+// newKubeClient returns a clientset using the in-cluster config, falling back to KUBECONFIG.
+// The clientset is shared by all the callers once created.
+func newKubeClient() (kubernetes.Interface, error) {
+	kubeClientMux.Lock()
+	defer kubeClientMux.Unlock()
+	if kubeClient != nil {
+		return kubeClient, nil
+	}
+	kubeConfig := os.Getenv("KUBECONFIG")
+	if kubeConfig == "" {
+		kubeConfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		inClusterErr := err
+		config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("no in-cluster config (%v) nor kubeconfig at %s (%v), run the plugin in a pod with a service account or set KUBECONFIG", inClusterErr, kubeConfig, err)
+		}
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	kubeClient = client
+	return kubeClient, nil
+}
+
+// nodePodsListOptions restricts a pod list to the pods bound to the node of the plugin when
+// NODE_NAME is set
+func nodePodsListOptions() metav1.ListOptions {
+	opts := metav1.ListOptions{}
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		opts.FieldSelector = fields.SelectorFromSet(fields.Set{"spec.nodeName": nodeName}).String()
+	}
+	return opts
+}
+
+// kubeContext returns a context bounding a request to the API server to kubeAPITimeout
+func kubeContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, kubeAPITimeout)
+}
+
+// isTransientKubeError returns true if a failed API request may succeed when retried:
+// the API server could not be reached, timed out or was overloaded
+func isTransientKubeError(err error) bool {
+	if _, ok := err.(*url.Error); ok {
+		return true
+	}
+	return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err)
+}
+
+// retryKube calls fn with a bounded context until it succeeds, fails with a permanent error,
+// kubeRetryBackoff is exhausted or parent is done
+func retryKube(parent context.Context, fn func(ctx context.Context) error) error {
+	backoff := kubeRetryBackoff
+	for {
+		ctx, cancel := kubeContext(parent)
+		err := fn(ctx)
+		cancel()
+		if err == nil || !isTransientKubeError(err) || backoff.Steps <= 1 {
+			return err
+		}
+		select {
+		case <-parent.Done():
+			return err
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// retryOnConflict calls fn, which reads an object and updates it, again while the update
+// fails with a conflict, like retry.RetryOnConflict of client-go
+func retryOnConflict(fn func() error) error {
+	var err error
+	waitErr := wait.ExponentialBackoff(conflictRetryBackoff, func() (bool, error) {
+		err = fn()
+		if err == nil {
+			return true, nil
+		}
+		if apierrors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	})
+	if waitErr == wait.ErrWaitTimeout {
+		return err
+	}
+	return waitErr
+}
+
+// createNodeEvent creates a Warning Event on the node, shown by kubectl describe node
+func createNodeEvent(nodeName, reason, message string) error {
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: nodeName + ".",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "nvidia-device-plugin", Host: nodeName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	_, err = client.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// devicePluginDirAuto makes the plugin detect the device plugin directory of the kubelet
+const devicePluginDirAuto = "auto"
+
+// kubeletRootCandidates are the kubelet root directories of the common distributions, probed
+// in order when the root directory of the running kubelet is not known
+var kubeletRootCandidates = []string{
+	"/var/lib/kubelet",
+	"/var/snap/microk8s/common/var/lib/kubelet",
+	"/var/lib/k0s/kubelet",
+	"/var/lib/rancher/k3s/agent/kubelet",
+}
+
+// kubeletBinaries are the names of the processes running the kubelet, microk8s runs it in kubelite
+var kubeletBinaries = map[string]bool{"kubelet": true, "kubelite": true}
+
+// devicePluginDir is the directory of the kubelet socket and of the plugin sockets, resolved
+// from --device-plugin-dir at startup
+var devicePluginDir = pluginapi.DevicePluginPath
+
+// devicePluginSocket returns the path of a socket in the device plugin directory
+func devicePluginSocket(name string) string {
+	return filepath.Join(devicePluginDir, name)
+}
+
+// kubeletSocket returns the path of the registration socket of the kubelet
+func kubeletSocket() string {
+	return devicePluginSocket(filepath.Base(pluginapi.KubeletSocket))
+}
+
+// kubeletRootFlag returns the --root-dir of the kubelet running on the node, read from its
+// command line, or "" if the kubelet processes are not visible (the plugin needs hostPID)
+func kubeletRootFlag() string {
+	cmdlines, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, path := range cmdlines {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		if !kubeletBinaries[filepath.Base(args[0])] {
+			continue
+		}
+		for i, arg := range args {
+			switch {
+			case strings.HasPrefix(arg, "--root-dir="):
+				return strings.TrimPrefix(arg, "--root-dir=")
+			case arg == "--root-dir" && i+1 < len(args):
+				return args[i+1]
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// detectDevicePluginDir returns the device plugin directory of the kubelet: the one under the
+// --root-dir of the running kubelet, else the first candidate holding the kubelet socket, else
+// the upstream default
+func detectDevicePluginDir() string {
+	var roots []string
+	if root := kubeletRootFlag(); root != "" {
+		roots = append(roots, root)
+	}
+	roots = append(roots, kubeletRootCandidates...)
+	for _, root := range roots {
+		dir := filepath.Join(root, "device-plugins")
+		if _, err := os.Stat(filepath.Join(dir, filepath.Base(pluginapi.KubeletSocket))); err == nil {
+			return dir
+		}
+	}
+	return pluginapi.DevicePluginPath
+}
+
+// resolveDevicePluginDir sets devicePluginDir from --device-plugin-dir
+func resolveDevicePluginDir() {
+	if devicePluginDirFlag != devicePluginDirAuto {
+		devicePluginDir = devicePluginDirFlag
+		return
+	}
+	devicePluginDir = detectDevicePluginDir()
+	log.Printf("Detected device plugin directory %s.", devicePluginDir)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// licenseDir is the host directory of the license files, mounted at /vgpu in the containers.
+// The directory rather than the files is mounted so that renewed files are seen by running
+// containers.
+const licenseDir = "/usr/local/vgpu/license"
+
+// licenseFile is the file the license fetched from --license-url is written to
+const licenseFile = "license"
+
+// licenseExpiryWarning is how long before its expiry a license is reported as expiring
+const licenseExpiryWarning = 14 * 24 * time.Hour
+
+// eventLicense is the device lifecycle event type of the license changes
+const eventLicense = "license"
+
+// licenseExpiryHeader is the response header of the license server giving the expiry, when it
+// is not in the license itself
+const licenseExpiryHeader = "X-License-Expiry"
+
+// licenseExpiryLine matches the expiry line of a license file, e.g. "expiry: 2022-01-31"
+var licenseExpiryLine = regexp.MustCompile(`(?im)^\s*"?(?:expiry|expires|expiration|not_after)"?\s*[:=]\s*"?([0-9][0-9TZ:+.\-]*)"?`)
+
+// licenseManager keeps the license files of licenseDir up to date, it is nil in open-source mode
+var licenseManager *LicenseManager
+
+// enforcementMounts returns the mounts of the validator and the license, which the open-source
+// mode leaves out
+func enforcementMounts() []*pluginapi.Mount {
+	if openSourceModeFlag {
+		return nil
+	}
+	return []*pluginapi.Mount{
+		{ContainerPath: "/usr/bin/vgpuvalidator", HostPath: "/usr/local/vgpu/vgpuvalidator", ReadOnly: true},
+		{ContainerPath: "/vgpu", HostPath: licenseDir, ReadOnly: true},
+	}
+}
+
+// LicenseManager fetches the license from a license server or a secret into licenseDir,
+// refreshes it periodically and reports its expiry as metrics and node events
+type LicenseManager struct {
+	mux      sync.Mutex
+	dir      string
+	url      string
+	secret   string
+	interval time.Duration
+	nodeName string
+	client   *http.Client
+
+	expiry      time.Time
+	lastRefresh time.Time
+	failures    int
+	// reported is the reason of the last node event, not to repeat it every refresh
+	reported string
+}
+
+// NewLicenseManager returns a reference to a new LicenseManager. With neither url nor secret,
+// the license files are provisioned on the host and only their expiry is monitored.
+func NewLicenseManager(dir, url, secret string, interval time.Duration, nodeName string) *LicenseManager {
+	return &LicenseManager{
+		dir:      dir,
+		url:      url,
+		secret:   secret,
+		interval: interval,
+		nodeName: nodeName,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// managed returns true if the manager fetches the license rather than only monitoring it
+func (l *LicenseManager) managed() bool {
+	return l.url != "" || l.secret != ""
+}
+
+// refresh fetches the license if it is managed, then reads its expiry from licenseDir
+func (l *LicenseManager) refresh() error {
+	var headerExpiry time.Time
+	var err error
+	switch {
+	case l.url != "":
+		headerExpiry, err = l.fetchURL()
+	case l.secret != "":
+		err = l.fetchSecret()
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err != nil {
+		l.failures++
+		return err
+	}
+	l.lastRefresh = time.Now()
+	l.expiry = headerExpiry
+	if expiry, ok := licenseDirExpiry(l.dir); ok {
+		l.expiry = expiry
+	}
+	return nil
+}
+
+// fetchURL downloads the license from the license server, returning the expiry it announces
+func (l *LicenseManager) fetchURL() (time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, l.url, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if l.nodeName != "" {
+		q := req.URL.Query()
+		q.Set("node", l.nodeName)
+		req.URL.RawQuery = q.Encode()
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to reach the license server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("license server returned %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read the license: %v", err)
+	}
+	if len(data) == 0 {
+		return time.Time{}, fmt.Errorf("license server returned an empty license")
+	}
+	if err := writeLicenseFile(l.dir, licenseFile, data); err != nil {
+		return time.Time{}, err
+	}
+	expiry, _ := parseLicenseExpiry(resp.Header.Get(licenseExpiryHeader))
+	return expiry, nil
+}
+
+// fetchSecret writes every key of the secret as a license file
+func (l *LicenseManager) fetchSecret() error {
+	parts := strings.SplitN(l.secret, "/", 2)
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	var secret *corev1.Secret
+	err = retryKube(context.Background(), func(ctx context.Context) error {
+		secret, err = client.CoreV1().Secrets(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get the license secret %s: %v", l.secret, err)
+	}
+	if len(secret.Data) == 0 {
+		return fmt.Errorf("license secret %s is empty", l.secret)
+	}
+	for name, data := range secret.Data {
+		if err := writeLicenseFile(l.dir, name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLicenseFile replaces a license file atomically, leaving it untouched if unchanged. The
+// containers see the new file through the mount of its directory.
+func writeLicenseFile(dir, name string, data []byte) error {
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid license file name %q", name)
+	}
+	path := filepath.Join(dir, name)
+	if current, err := ioutil.ReadFile(path); err == nil && string(current) == string(data) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Printf("Updated license file %s", path)
+	recordEvent(eventLicense, "", nil, "updated license file %s", path)
+	return nil
+}
+
+// licenseDirExpiry returns the earliest expiry found in the license files of dir
+func licenseDirExpiry(dir string) (time.Time, bool) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var earliest time.Time
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		m := licenseExpiryLine.FindSubmatch(data)
+		if m == nil {
+			continue
+		}
+		if expiry, ok := parseLicenseExpiry(string(m[1])); ok && (earliest.IsZero() || expiry.Before(earliest)) {
+			earliest = expiry
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// parseLicenseExpiry parses an RFC 3339 time or a date
+func parseLicenseExpiry(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// check logs and reports to the node events a license expiring, expired or failing to refresh
+func (l *LicenseManager) check(refreshErr error) {
+	l.mux.Lock()
+	expiry := l.expiry
+	l.mux.Unlock()
+
+	reason, message := "", ""
+	switch {
+	case refreshErr != nil:
+		reason, message = "LicenseRefreshFailed", fmt.Sprintf("failed to refresh the vGPU license: %v", refreshErr)
+	case expiry.IsZero():
+	case time.Now().After(expiry):
+		reason, message = "LicenseExpired", fmt.Sprintf("the vGPU license expired on %s", expiry.Format(time.RFC3339))
+	case time.Until(expiry) < licenseExpiryWarning:
+		reason, message = "LicenseExpiring", fmt.Sprintf("the vGPU license expires on %s", expiry.Format(time.RFC3339))
+	}
+	if reason == "" {
+		l.reported = ""
+		return
+	}
+	log.Printf("Warning: %s", message)
+	if reason == l.reported {
+		return
+	}
+	recordEvent(eventLicense, "", nil, "%s", message)
+	if err := l.emitNodeEvent(reason, message); err != nil {
+		log.Printf("Warning: failed to create the %s node event: %v", reason, err)
+		return
+	}
+	l.reported = reason
+}
+
+// emitNodeEvent reports a license problem as a node event, when the license is managed
+func (l *LicenseManager) emitNodeEvent(reason, message string) error {
+	if !l.managed() || l.nodeName == "" {
+		return nil
+	}
+	return createNodeEvent(l.nodeName, reason, message)
+}
+
+// run refreshes the license every interval until stop is closed
+func (l *LicenseManager) run(stop <-chan struct{}) {
+	for {
+		err := l.refresh()
+		if err != nil {
+			log.Printf("Error: failed to refresh the license: %v", err)
+		}
+		l.check(err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(l.interval):
+		}
+	}
+}
+
+func (l *LicenseManager) writeMetrics(w io.Writer) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !l.expiry.IsZero() {
+		fmt.Fprintln(w, "# HELP vgpu_license_expiry_timestamp_seconds Unix time at which the vGPU license expires.")
+		fmt.Fprintln(w, "# TYPE vgpu_license_expiry_timestamp_seconds gauge")
+		fmt.Fprintf(w, "vgpu_license_expiry_timestamp_seconds %d\n", l.expiry.Unix())
+	}
+	if !l.managed() {
+		return
+	}
+	fmt.Fprintln(w, "# HELP vgpu_license_last_refresh_timestamp_seconds Unix time of the last successful refresh of the vGPU license.")
+	fmt.Fprintln(w, "# TYPE vgpu_license_last_refresh_timestamp_seconds gauge")
+	var lastRefresh int64
+	if !l.lastRefresh.IsZero() {
+		lastRefresh = l.lastRefresh.Unix()
+	}
+	fmt.Fprintf(w, "vgpu_license_last_refresh_timestamp_seconds %d\n", lastRefresh)
+	fmt.Fprintln(w, "# HELP vgpu_license_refresh_failures_total Failed refreshes of the vGPU license.")
+	fmt.Fprintln(w, "# TYPE vgpu_license_refresh_failures_total counter")
+	fmt.Fprintf(w, "vgpu_license_refresh_failures_total %d\n", l.failures)
+}
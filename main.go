@@ -22,13 +22,14 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	"github.com/fsnotify/fsnotify"
 	cli "github.com/urfave/cli/v2"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 var migStrategyFlag string
@@ -40,16 +41,195 @@ var nvidiaDriverRootFlag string
 var deviceSplitCountFlag uint
 var deviceMemoryScalingFlag float64
 var deviceCoresScalingFlag float64
+var oversubscribeEvictWatermarkFlag int
+var oversubscribeEvictPolicyFlag string
+var memoryPressureThresholdFlag int
+var avoidPressuredGPUsFlag bool
 var enableLegacyPreferredFlag bool
+var allocationModeFlag string
+var enableGPUTuningFlag bool
+var enableExclusiveGPUsFlag bool
+var spreadVDevicesFlag bool
+var deviceConfigFileFlag bool
+var busyGPUThresholdFlag int
+var utilizationSampleIntervalFlag time.Duration
+var contextOverheadFlag string
+var ccResourceNameFlag string
+var workloadProfilesFlag string
+var passMigCapsFlag bool
+var allocationJournalFileFlag string
+var decisionLogRateFlag int
+var migResourceTemplateFlag string
+var migSocketTemplateFlag string
+var instanceLockTimeoutFlag time.Duration
+var otlpEndpointFlag string
+var adminTokenFileFlag string
+var podAnnotationsFlag bool
+var namespaceQuotaFlag bool
+var vgpuNodeCRDFlag bool
+var vgpuConfigCRDFlag bool
+var defaultDeviceMemoryFlag string
+var modelResourceNamesFlag bool
+var modelResourceMapFlag string
+var coexistFlag bool
+var coexistResourceNameFlag string
+var gpuOperatorClusterPolicyFlag bool
+var enableVfioFlag bool
+var vfioResourceNameFlag string
+var mdevTypeFlag string
+var rdmaResourcesFlag string
+var fabricPartitionsFlag string
+var fabricManagerAddressFlag string
+var deviceCacheFileFlag string
+var externalAllocatorFlag string
+var allocationConstraintsFlag string
+var gpuReservationsFlag string
+var numaSharedCacheDirFlag string
+var envPrefixFlag string
+var envNameMapFlag string
+var readOnlyRootfsFlag bool
+var vmRuntimeClassesFlag string
+var gvisorRuntimeClassesFlag string
+var gvisorNVProxyFlag bool
+var vdeviceReconcileIntervalFlag time.Duration
+var monitorSocketFlag string
+var monitorModeFlag string
+var sharedCacheQuotaFlag string
+var sharedCacheDirLimitFlag string
+var deviceMapNamespaceFlag string
+var devicePluginDirFlag string
+var vdeviceMemoryQuantumFlag string
+var minVDeviceMemoryFlag string
+var maxVDeviceMemoryFlag string
+var canaryResourceFlag string
+var enableFaultInjectionFlag bool
+var goldenDirFlag string
+var goldenReplayDirFlag string
+var healthCheckIntervalFlag time.Duration
+var healthCheckDepthFlag string
+var healthCheckTimeoutFlag time.Duration
+var allocationWebhookFlag string
+var allocationWebhookTimeoutFlag time.Duration
+var allocationWebhookFailurePolicyFlag string
+var recordFileFlag string
+var rebalanceIntervalFlag time.Duration
+var historyDirFlag string
+var historyIntervalFlag time.Duration
+var historyRetentionFlag time.Duration
+var probeAddressFlag string
+var selfTestFlag bool
+var openSourceModeFlag bool
+var licenseURLFlag string
+var licenseSecretFlag string
+var licenseRefreshIntervalFlag time.Duration
+var cdiKindFlag string
+var externalAllocatorTimeoutFlag time.Duration
+var enableMPSFlag bool
+var metricsAddressFlag string
+var dcgmAddressFlag string
+var eventBufferSizeFlag int
+var auditLogFileFlag string
+var auditLogMaxSizeFlag int
+var auditLogMaxBackupsFlag int
+var reportNodeHealthFlag bool
+var unhealthyTaintFlag string
+var npdLogFileFlag string
+var npdLogMaxSizeFlag int
+var npdLogMaxBackupsFlag int
+var usePluginWatcherFlag bool
+var grpcMaxRecvMsgSizeFlag int
+var grpcMaxSendMsgSizeFlag int
+var grpcKeepaliveTimeFlag time.Duration
+var grpcKeepaliveTimeoutFlag time.Duration
+var socketModeFlag string
+var socketUIDFlag int
+var socketGIDFlag int
+var socketSELinuxLabelFlag string
 var verboseFlag int
 
 var version string // This should be set at build time to indicate the actual version
 
+var openSourceMode string // Set to "true" at build time to default to the open-source mode
+
 func main() {
+	err := newApp().Run(os.Args)
+	if err != nil {
+		log.SetOutput(os.Stderr)
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+}
+
+// newApp returns the command line application of the plugin, whose flags set the flag variables
+func newApp() *cli.App {
 	c := cli.NewApp()
 	c.Version = version
 	c.Before = validateFlags
 	c.Action = start
+	c.Commands = []*cli.Command{
+		{
+			Name:   "dump",
+			Usage:  "print the device lifecycle events of a running plugin",
+			Action: dumpEvents,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "address",
+					Value: "localhost:9394",
+					Usage: "the metrics address of the running plugin",
+				},
+			},
+		},
+		{
+			Name:   "monitor",
+			Usage:  "run the vgpu-monitor, which manages the shared cache directories of the containers for the plugins started with --monitor-socket",
+			Action: runMonitor,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "socket",
+					Value:   defaultMonitorSocket,
+					Usage:   "the unix socket to serve the plugin on",
+					EnvVars: []string{"MONITOR_SOCKET"},
+				},
+				&cli.StringFlag{
+					Name:    "metrics-address",
+					Value:   "",
+					Usage:   "the address to serve the Prometheus metrics of the monitor on, disabled when empty",
+					EnvVars: []string{"MONITOR_METRICS_ADDRESS"},
+				},
+				&cli.DurationFlag{
+					Name:    "interval",
+					Value:   30 * time.Second,
+					Usage:   "the interval at which the directories of deleted pods are removed and the usage of the pods sampled",
+					EnvVars: []string{"MONITOR_INTERVAL"},
+				},
+			},
+		},
+		{
+			Name:   "simulate",
+			Usage:  "replay an allocation trace recorded with --record-file against other policies and split configurations",
+			Action: simulateTrace,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "trace",
+					Usage:    "the allocation trace to replay",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "policies",
+					Value: "first,pack,spread",
+					Usage: "comma separated placement policies to compare: [first | pack | spread]",
+				},
+				&cli.StringFlag{
+					Name:  "split-counts",
+					Usage: "comma separated device split counts to compare, the recorded one by default",
+				},
+				&cli.StringFlag{
+					Name:  "memory-scalings",
+					Usage: "comma separated device memory scalings to compare, the recorded one by default",
+				},
+			},
+		},
+	}
 
 	migStrategyFlag = MigStrategyNone
 	c.Flags = []cli.Flag{
@@ -77,10 +257,17 @@ func main() {
 		&cli.StringFlag{
 			Name:        "device-list-strategy",
 			Value:       "envvar",
-			Usage:       "the desired strategy for passing the device list to the underlying runtime:\n\t\t[envvar | volume-mounts]",
+			Usage:       "the desired strategy for passing the device list to the underlying runtime:\n\t\t[envvar | volume-mounts | cdi-annotations]",
 			Destination: &deviceListStrategyFlag,
 			EnvVars:     []string{"DEVICE_LIST_STRATEGY"},
 		},
+		&cli.StringFlag{
+			Name:        "cdi-kind",
+			Value:       "nvidia.com/gpu",
+			Usage:       "the kind of the CDI devices requested with --device-list-strategy=cdi-annotations",
+			Destination: &cdiKindFlag,
+			EnvVars:     []string{"CDI_KIND"},
+		},
 		&cli.StringFlag{
 			Name:        "device-id-strategy",
 			Value:       "uuid",
@@ -91,7 +278,7 @@ func main() {
 		&cli.StringFlag{
 			Name:        "nvidia-driver-root",
 			Value:       "/",
-			Usage:       "the root path for the NVIDIA driver installation (typical values are '/' or '/run/nvidia/driver')",
+			Usage:       "the root path for the NVIDIA driver installation (typical values are '/', '/run/nvidia/driver' or 'auto' to detect a GPU Operator driver container)",
 			Destination: &nvidiaDriverRootFlag,
 			EnvVars:     []string{"NVIDIA_DRIVER_ROOT"},
 		},
@@ -116,13 +303,728 @@ func main() {
 			Destination: &deviceCoresScalingFlag,
 			EnvVars:     []string{"DEVICE_CORES_SCALING"},
 		},
+		&cli.IntFlag{
+			Name:        "oversubscribe-evict-watermark",
+			Value:       90,
+			Usage:       "the percentage of the physical memory of its vGPU above which libvgpu starts evicting the memory of an oversubscribing container to host memory",
+			Destination: &oversubscribeEvictWatermarkFlag,
+			EnvVars:     []string{"OVERSUBSCRIBE_EVICT_WATERMARK"},
+		},
+		&cli.StringFlag{
+			Name:        "oversubscribe-evict-policy",
+			Value:       evictPolicyLRU,
+			Usage:       "the order in which libvgpu evicts the memory of an oversubscribing container: [lru | fifo | none]",
+			Destination: &oversubscribeEvictPolicyFlag,
+			EnvVars:     []string{"OVERSUBSCRIBE_EVICT_POLICY"},
+		},
+		&cli.IntFlag{
+			Name:        "memory-pressure-threshold",
+			Value:       0,
+			Usage:       "the percentage of the physical memory used above which an oversubscribed GPU is reported under memory pressure, 0 to disable",
+			Destination: &memoryPressureThresholdFlag,
+			EnvVars:     []string{"MEMORY_PRESSURE_THRESHOLD"},
+		},
+		&cli.BoolFlag{
+			Name:        "avoid-pressured-gpus",
+			Value:       false,
+			Usage:       "do not allocate vDevices of GPUs under memory pressure",
+			Destination: &avoidPressuredGPUsFlag,
+			EnvVars:     []string{"AVOID_PRESSURED_GPUS"},
+		},
+		&cli.StringFlag{
+			Name:        "allocation-mode",
+			Value:       allocationModeKubeletPreferred,
+			Usage:       "who picks the vDevices of a container:\n\t\t[kubelet-preferred | plugin-managed | none]: the kubelet asking the plugin through GetPreferredAllocation, the plugin itself for kubelets without preferred allocation, or the kubelet alone; preferred and legacy are deprecated names of the first two",
+			Destination: &allocationModeFlag,
+			EnvVars:     []string{"ALLOCATION_MODE"},
+		},
 		&cli.BoolFlag{
 			Name:        "enable-legacy-preferred",
 			Value:       false,
-			Usage:       "enable when kubelet does not support preferred allocation",
+			Usage:       "deprecated, use --allocation-mode=plugin-managed",
 			Destination: &enableLegacyPreferredFlag,
 			EnvVars:     []string{"ENABLE_LEGACY_PREFERRED"},
 		},
+		&cli.DurationFlag{
+			Name:        "vdevice-reconcile-interval",
+			Value:       5 * time.Minute,
+			Usage:       "the interval at which the vDevices in use with --allocation-mode=plugin-managed are reconciled with the kubelet checkpoint, 0 to disable",
+			Destination: &vdeviceReconcileIntervalFlag,
+			EnvVars:     []string{"VDEVICE_RECONCILE_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:        "pod-annotations",
+			Value:       false,
+			Usage:       "resolve the pod on Allocate and honor its vGPU memory and cores annotations, requires permission to list pods",
+			Destination: &podAnnotationsFlag,
+			EnvVars:     []string{"POD_ANNOTATIONS"},
+		},
+		&cli.BoolFlag{
+			Name:        "namespace-quota",
+			Value:       false,
+			Usage:       "deny allocations exceeding the 4paradigm.com/vgpu-memory-quota annotation of the pod namespace, requires permission to get namespaces and list pods",
+			Destination: &namespaceQuotaFlag,
+			EnvVars:     []string{"NAMESPACE_QUOTA"},
+		},
+		&cli.BoolFlag{
+			Name:        "vgpu-node-crd",
+			Value:       false,
+			Usage:       "keep the VGPUNode custom resource of the node up to date, requires the CRD in deployments/crd",
+			Destination: &vgpuNodeCRDFlag,
+			EnvVars:     []string{"VGPU_NODE_CRD"},
+		},
+		&cli.BoolFlag{
+			Name:        "vgpu-config-crd",
+			Value:       false,
+			Usage:       "watch the VGPUConfig custom resources matching the node and restart the plugins with their options",
+			Destination: &vgpuConfigCRDFlag,
+			EnvVars:     []string{"VGPU_CONFIG_CRD"},
+		},
+		&cli.StringFlag{
+			Name:        "default-device-memory",
+			Value:       "",
+			Usage:       "the memory limit of vGPUs without a memory annotation, in MiB or in percent of the card (e.g. 50%), capped to the vGPU memory",
+			Destination: &defaultDeviceMemoryFlag,
+			EnvVars:     []string{"DEFAULT_DEVICE_MEMORY"},
+		},
+		&cli.BoolFlag{
+			Name:        "model-resource-names",
+			Value:       false,
+			Usage:       "advertise full GPUs under model-qualified resource names such as nvidia.com/gpu-t4 instead of nvidia.com/gpu",
+			Destination: &modelResourceNamesFlag,
+			EnvVars:     []string{"MODEL_RESOURCE_NAMES"},
+		},
+		&cli.StringFlag{
+			Name:        "model-resource-map",
+			Value:       "",
+			Usage:       "map product names to resource name suffixes for --model-resource-names, e.g. 'A100=a100,Tesla T4=t4'",
+			Destination: &modelResourceMapFlag,
+			EnvVars:     []string{"MODEL_RESOURCE_MAP"},
+		},
+		&cli.BoolFlag{
+			Name:        "coexist",
+			Value:       false,
+			Usage:       "run next to the upstream NVIDIA device plugin: advertise full GPUs under --coexist-resource-name and mask GPUs allocated through nvidia.com/gpu",
+			Destination: &coexistFlag,
+			EnvVars:     []string{"COEXIST"},
+		},
+		&cli.StringFlag{
+			Name:        "coexist-resource-name",
+			Value:       "4paradigm.com/vgpu",
+			Usage:       "the resource name of full GPUs in coexistence mode",
+			Destination: &coexistResourceNameFlag,
+			EnvVars:     []string{"COEXIST_RESOURCE_NAME"},
+		},
+		&cli.BoolFlag{
+			Name:        "gpu-operator-cluster-policy",
+			Value:       false,
+			Usage:       "use the MIG strategy and driver settings of the GPU Operator ClusterPolicy for the options not set on the command line",
+			Destination: &gpuOperatorClusterPolicyFlag,
+			EnvVars:     []string{"GPU_OPERATOR_CLUSTER_POLICY"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable-vfio",
+			Value:       false,
+			Usage:       "advertise GPUs bound to vfio-pci for KubeVirt VMs and move GPUs between sharing and passthrough according to the 4paradigm.com/vgpu-passthrough node annotation",
+			Destination: &enableVfioFlag,
+			EnvVars:     []string{"ENABLE_VFIO"},
+		},
+		&cli.StringFlag{
+			Name:        "vfio-resource-name",
+			Value:       "nvidia.com/gpu-passthrough",
+			Usage:       "the resource name of passthrough GPUs",
+			Destination: &vfioResourceNameFlag,
+			EnvVars:     []string{"VFIO_RESOURCE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:        "mdev-type",
+			Value:       "",
+			Usage:       "advertise mediated devices of this NVIDIA vGPU type (e.g. nvidia-63) instead of the software split, creating them on allocation",
+			Destination: &mdevTypeFlag,
+			EnvVars:     []string{"MDEV_TYPE"},
+		},
+		&cli.StringFlag{
+			Name:        "rdma-resources",
+			Value:       "",
+			Usage:       "comma separated resource name prefixes of RDMA NICs (e.g. 'rdma/,nvidia.com/hostdev'); pods requesting them get GPUs close to an RDMA NIC",
+			Destination: &rdmaResourcesFlag,
+			EnvVars:     []string{"RDMA_RESOURCES"},
+		},
+		&cli.StringFlag{
+			Name:        "fabric-partitions",
+			Value:       "",
+			Usage:       "the fabric partitions of NVSwitch systems as semicolon separated lists of GPU indices (e.g. '0,1,2,3;4,5,6,7'); multi-GPU allocations stay within one",
+			Destination: &fabricPartitionsFlag,
+			EnvVars:     []string{"FABRIC_PARTITIONS"},
+		},
+		&cli.StringFlag{
+			Name:        "fabric-manager-address",
+			Value:       "127.0.0.1:6666",
+			Usage:       "the address of the fabric manager, whose reachability is health checked on NVSwitch systems; empty to disable the check",
+			Destination: &fabricManagerAddressFlag,
+			EnvVars:     []string{"FABRIC_MANAGER_ADDRESS"},
+		},
+		&cli.StringFlag{
+			Name:        "device-cache-file",
+			Value:       "/var/lib/kubelet/device-plugins/vgpu-device-cache.json",
+			Usage:       "the file caching the immutable GPU attributes across restarts of the plugin; empty to disable",
+			Destination: &deviceCacheFileFlag,
+			EnvVars:     []string{"DEVICE_CACHE_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "external-allocator",
+			Value:       "",
+			Usage:       "the address (unix:///path/to.sock or host:port) of an external allocator selecting the vDevices of pods, see api/allocator/v1alpha1",
+			Destination: &externalAllocatorFlag,
+			EnvVars:     []string{"EXTERNAL_ALLOCATOR"},
+		},
+		&cli.DurationFlag{
+			Name:        "external-allocator-timeout",
+			Value:       time.Second,
+			Usage:       "the time to wait for the external allocator before falling back to the built-in policy",
+			Destination: &externalAllocatorTimeoutFlag,
+			EnvVars:     []string{"EXTERNAL_ALLOCATOR_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:        "allocation-constraints",
+			Value:       "",
+			Usage:       "a file of CEL expressions filtering and ranking the candidate vDevices of each allocation",
+			Destination: &allocationConstraintsFlag,
+			EnvVars:     []string{"ALLOCATION_CONSTRAINTS"},
+		},
+		&cli.StringFlag{
+			Name:        "vm-runtime-classes",
+			Value:       "",
+			Usage:       "comma separated RuntimeClass names of VM isolated runtimes such as Kata Containers, whose pods get the GPUs passed through without libvgpu",
+			Destination: &vmRuntimeClassesFlag,
+			EnvVars:     []string{"VM_RUNTIME_CLASSES"},
+		},
+		&cli.StringFlag{
+			Name:        "gvisor-runtime-classes",
+			Value:       "",
+			Usage:       "comma separated RuntimeClass names of gVisor, whose pods get the GPUs through the runsc nvproxy without libvgpu",
+			Destination: &gvisorRuntimeClassesFlag,
+			EnvVars:     []string{"GVISOR_RUNTIME_CLASSES"},
+		},
+		&cli.BoolFlag{
+			Name:        "gvisor-nvproxy",
+			Value:       false,
+			Usage:       "allocate the GPUs of every pod for the runsc nvproxy, on nodes running all pods with gVisor",
+			Destination: &gvisorNVProxyFlag,
+			EnvVars:     []string{"GVISOR_NVPROXY"},
+		},
+		&cli.BoolFlag{
+			Name:        "read-only-rootfs",
+			Value:       false,
+			Usage:       "support containers with readOnlyRootFilesystem: preload libvgpu with LD_PRELOAD instead of /etc/ld.so.preload and keep its writable files in a mounted /run/vgpu",
+			Destination: &readOnlyRootfsFlag,
+			EnvVars:     []string{"READ_ONLY_ROOTFS"},
+		},
+		&cli.StringFlag{
+			Name:        "env-prefix",
+			Value:       "",
+			Usage:       "the prefix of the control environment variables read by libvgpu, such as CUDA_DEVICE_MEMORY_LIMIT_0",
+			Destination: &envPrefixFlag,
+			EnvVars:     []string{"ENV_PREFIX"},
+		},
+		&cli.StringFlag{
+			Name:        "env-name-map",
+			Value:       "",
+			Usage:       "comma separated FROM=TO names of the control environment variables, taking precedence over --env-prefix (e.g. 'CUDA_DEVICE_MEMORY_LIMIT_=VGPU_MEMORY_LIMIT_')",
+			Destination: &envNameMapFlag,
+			EnvVars:     []string{"ENV_NAME_MAP"},
+		},
+		&cli.StringFlag{
+			Name:        "numa-shared-cache-dir",
+			Value:       "",
+			Usage:       "the host directory of the shared cache of the containers using GPUs of NUMA node %d, a tmpfs bound to that node (e.g. '/var/run/vgpu/numa%d')",
+			Destination: &numaSharedCacheDirFlag,
+			EnvVars:     []string{"NUMA_SHARED_CACHE_DIR"},
+		},
+		&cli.StringFlag{
+			Name:        "gpu-reservations",
+			Value:       "",
+			Usage:       "a JSON file of whole GPUs reserved for the pods matching a selector",
+			Destination: &gpuReservationsFlag,
+			EnvVars:     []string{"GPU_RESERVATIONS"},
+		},
+		&cli.StringFlag{
+			Name:        "allocation-webhook",
+			Value:       "",
+			Usage:       "the URL of a webhook reviewing each allocation before the kubelet is answered; it can deny it or add environment variables and mounts",
+			Destination: &allocationWebhookFlag,
+			EnvVars:     []string{"ALLOCATION_WEBHOOK"},
+		},
+		&cli.DurationFlag{
+			Name:        "allocation-webhook-timeout",
+			Value:       2 * time.Second,
+			Usage:       "the time to wait for the allocation webhook",
+			Destination: &allocationWebhookTimeoutFlag,
+			EnvVars:     []string{"ALLOCATION_WEBHOOK_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:        "allocation-webhook-failure-policy",
+			Value:       webhookFailurePolicyFail,
+			Usage:       "what to do when the allocation webhook cannot be reached or answers an error:\n\t\t[fail | ignore]",
+			Destination: &allocationWebhookFailurePolicyFlag,
+			EnvVars:     []string{"ALLOCATION_WEBHOOK_FAILURE_POLICY"},
+		},
+		&cli.StringFlag{
+			Name:        "record-file",
+			Value:       "",
+			Usage:       "the file recording the allocation decisions, for replay with the simulate command",
+			Destination: &recordFileFlag,
+			EnvVars:     []string{"RECORD_FILE"},
+		},
+		&cli.DurationFlag{
+			Name:        "rebalance-interval",
+			Value:       0,
+			Usage:       "the interval at which fragmented GPUs are looked for and the rebalancing recommendations and compaction report published, 0 to disable",
+			Destination: &rebalanceIntervalFlag,
+			EnvVars:     []string{"REBALANCE_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:        "history-dir",
+			Value:       "",
+			Usage:       "the directory the GPU and pod usage samples are recorded to, queryable at /admin/history",
+			Destination: &historyDirFlag,
+			EnvVars:     []string{"HISTORY_DIR"},
+		},
+		&cli.DurationFlag{
+			Name:        "history-interval",
+			Value:       time.Minute,
+			Usage:       "the interval at which the usage is sampled into --history-dir",
+			Destination: &historyIntervalFlag,
+			EnvVars:     []string{"HISTORY_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:        "history-retention",
+			Value:       24 * time.Hour,
+			Usage:       "the time the usage samples are kept in --history-dir",
+			Destination: &historyRetentionFlag,
+			EnvVars:     []string{"HISTORY_RETENTION"},
+		},
+		&cli.StringFlag{
+			Name:        "probe-address",
+			Value:       "",
+			Usage:       "the address to serve the /healthz and /readyz probes on, when they are not served on --metrics-address",
+			Destination: &probeAddressFlag,
+			EnvVars:     []string{"PROBE_ADDRESS"},
+		},
+		&cli.BoolFlag{
+			Name:        "self-test",
+			Value:       false,
+			Usage:       "allocate a vDevice to a synthetic container when the plugins start, failing readiness if the response is invalid",
+			Destination: &selfTestFlag,
+			EnvVars:     []string{"SELF_TEST"},
+		},
+		&cli.BoolFlag{
+			Name:        "open-source-mode",
+			Value:       openSourceMode == "true",
+			Usage:       "run without the vgpuvalidator and license mounts and the license management, only limiting memory and cores",
+			Destination: &openSourceModeFlag,
+			EnvVars:     []string{"OPEN_SOURCE_MODE"},
+		},
+		&cli.StringFlag{
+			Name:        "license-url",
+			Value:       "",
+			Usage:       "the license server URL to fetch the vGPU license from into /usr/local/vgpu/license",
+			Destination: &licenseURLFlag,
+			EnvVars:     []string{"LICENSE_URL"},
+		},
+		&cli.StringFlag{
+			Name:        "license-secret",
+			Value:       "",
+			Usage:       "the namespace/name of the secret to copy the vGPU license files from into /usr/local/vgpu/license",
+			Destination: &licenseSecretFlag,
+			EnvVars:     []string{"LICENSE_SECRET"},
+		},
+		&cli.DurationFlag{
+			Name:        "license-refresh-interval",
+			Value:       time.Hour,
+			Usage:       "the interval at which the vGPU license is refreshed and its expiry checked",
+			Destination: &licenseRefreshIntervalFlag,
+			EnvVars:     []string{"LICENSE_REFRESH_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:        "monitor-mode",
+			Value:       monitorModeOff,
+			Usage:       "where the shared cache of libvgpu lives and what is exported of it:\n\t\t[off | shared-cache | full-metrics]",
+			Destination: &monitorModeFlag,
+			EnvVars:     []string{"MONITOR_MODE"},
+		},
+		&cli.StringFlag{
+			Name:        "monitor-socket",
+			Value:       "",
+			Usage:       "the unix socket of the vgpu-monitor creating the shared cache directories, e.g. " + defaultMonitorSocket,
+			Destination: &monitorSocketFlag,
+			EnvVars:     []string{"MONITOR_SOCKET"},
+		},
+		&cli.StringFlag{
+			Name:        "shared-cache-quota",
+			Value:       "",
+			Usage:       "the disk the shared cache directories may use in total before new containers are refused a shared cache, e.g. 10Gi",
+			Destination: &sharedCacheQuotaFlag,
+			EnvVars:     []string{"SHARED_CACHE_QUOTA"},
+		},
+		&cli.StringFlag{
+			Name:        "shared-cache-dir-limit",
+			Value:       "",
+			Usage:       "the disk the shared cache directory of a container may use before it is reported, e.g. 512Mi",
+			Destination: &sharedCacheDirLimitFlag,
+			EnvVars:     []string{"SHARED_CACHE_DIR_LIMIT"},
+		},
+		&cli.StringFlag{
+			Name:        "device-map-namespace",
+			Value:       "",
+			Usage:       "the namespace of the vgpu-device-map-<node> ConfigMaps mapping the vDevices to their physical GPU, disabled when empty",
+			Destination: &deviceMapNamespaceFlag,
+			EnvVars:     []string{"DEVICE_MAP_NAMESPACE"},
+		},
+		&cli.StringFlag{
+			Name:        "vdevice-memory-quantum",
+			Value:       "",
+			Usage:       "split each GPU into vDevices of this memory, e.g. 4Gi, at most --device-split-count of them, instead of dividing its memory by --device-split-count",
+			Destination: &vdeviceMemoryQuantumFlag,
+			EnvVars:     []string{"VDEVICE_MEMORY_QUANTUM"},
+		},
+		&cli.StringFlag{
+			Name:        "min-vdevice-memory",
+			Value:       "",
+			Usage:       "refuse to start when a GPU would be split into vDevices with less memory than this, e.g. 1Gi",
+			Destination: &minVDeviceMemoryFlag,
+			EnvVars:     []string{"MIN_VDEVICE_MEMORY"},
+		},
+		&cli.StringFlag{
+			Name:        "max-vdevice-memory",
+			Value:       "",
+			Usage:       "refuse to start when a GPU would be split into vDevices with more memory than this, e.g. 40Gi",
+			Destination: &maxVDeviceMemoryFlag,
+			EnvVars:     []string{"MAX_VDEVICE_MEMORY"},
+		},
+		&cli.StringFlag{
+			Name:        "canary-resource",
+			Value:       "",
+			Usage:       "advertise a single device of this resource, e.g. nvidia.com/vgpu-canary, whose allocation runs the allocation pipeline of the vGPU resources without consuming them; disabled when empty",
+			Destination: &canaryResourceFlag,
+			EnvVars:     []string{"CANARY_RESOURCE"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable-fault-injection",
+			Value:       false,
+			Usage:       "serve /admin/faults to inject registration failures, Allocate latency, health flaps and checkpoint errors, for resilience testing only",
+			Destination: &enableFaultInjectionFlag,
+			EnvVars:     []string{"ENABLE_FAULT_INJECTION"},
+			Hidden:      true,
+		},
+		&cli.StringFlag{
+			Name:        "golden-dir",
+			Value:       "",
+			Usage:       "the directory recording each Allocate call of the vGPU resources and its response as a golden file, for regression tests with --golden-replay-dir",
+			Destination: &goldenDirFlag,
+			EnvVars:     []string{"GOLDEN_DIR"},
+		},
+		&cli.StringFlag{
+			Name:        "golden-replay-dir",
+			Value:       "",
+			Usage:       "replay the golden files of this directory through the allocation pipeline once the plugins are started, then exit with an error if a response differs; changes made by the allocation webhook and MPS are not replayed",
+			Destination: &goldenReplayDirFlag,
+			EnvVars:     []string{"GOLDEN_REPLAY_DIR"},
+		},
+		&cli.DurationFlag{
+			Name:        "health-check-interval",
+			Value:       5 * time.Second,
+			Usage:       "the interval at which the health checks wait for XID events and, with --health-check-depth=full, query the GPUs",
+			Destination: &healthCheckIntervalFlag,
+			EnvVars:     []string{"HEALTH_CHECK_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:        "health-check-depth",
+			Value:       healthCheckXIDs,
+			Usage:       "the health checks run: 'xids' only watches critical XID events, 'full' also queries the status of every GPU at each interval and marks the GPUs failing it unhealthy",
+			Destination: &healthCheckDepthFlag,
+			EnvVars:     []string{"HEALTH_CHECK_DEPTH"},
+		},
+		&cli.DurationFlag{
+			Name:        "health-check-timeout",
+			Value:       10 * time.Second,
+			Usage:       "the time a GPU has to answer the status query of the full health checks before it is marked unhealthy, 0 to wait indefinitely",
+			Destination: &healthCheckTimeoutFlag,
+			EnvVars:     []string{"HEALTH_CHECK_TIMEOUT"},
+		},
+		&cli.BoolFlag{
+			Name:        "spread-vdevices",
+			Value:       false,
+			Usage:       "give each vDevice of a container its own GPU, refusing allocations of several vDevices of one GPU; pods override it with the " + annSpread + " annotation when --pod-annotations is set",
+			Destination: &spreadVDevicesFlag,
+			EnvVars:     []string{"SPREAD_VDEVICES"},
+		},
+		&cli.BoolFlag{
+			Name:        "device-config-file",
+			Value:       false,
+			Usage:       "also write the device map and the limits of each container to a JSON file mounted into it, named by VGPU_DEVICE_CONFIG, for containers with more vDevices than their environment can carry",
+			Destination: &deviceConfigFileFlag,
+			EnvVars:     []string{"DEVICE_CONFIG_FILE"},
+		},
+		&cli.IntFlag{
+			Name:        "busy-gpu-threshold",
+			Value:       0,
+			Usage:       "the recent SM utilization in percent from which the preferred allocation offers a GPU last, whatever the number of vDevices granted on it, 0 to disable",
+			Destination: &busyGPUThresholdFlag,
+			EnvVars:     []string{"BUSY_GPU_THRESHOLD"},
+		},
+		&cli.DurationFlag{
+			Name:        "utilization-sample-interval",
+			Value:       10 * time.Second,
+			Usage:       "the interval at which the SM utilization of the GPUs is sampled for --busy-gpu-threshold, the recent utilization is the average of the last 6 samples",
+			Destination: &utilizationSampleIntervalFlag,
+			EnvVars:     []string{"UTILIZATION_SAMPLE_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:        "context-overhead",
+			Value:       "",
+			Usage:       "the memory each process sharing a GPU needs for its CUDA context, e.g. 300Mi, deducted from the memory limit of every vDevice so that the limits plus the contexts fit the GPU",
+			Destination: &contextOverheadFlag,
+			EnvVars:     []string{"CONTEXT_OVERHEAD"},
+		},
+		&cli.StringFlag{
+			Name:        "cc-resource-name",
+			Value:       "nvidia.com/gpu-cc",
+			Usage:       "the resource name of the GPUs in confidential computing mode, which are advertised whole since they cannot be split",
+			Destination: &ccResourceNameFlag,
+			EnvVars:     []string{"CC_RESOURCE_NAME"},
+		},
+		&cli.StringFlag{
+			Name:        "workload-profiles",
+			Value:       "",
+			Usage:       "a JSON file of named profiles bundling the memory, SM limit and driver capabilities of a kind of workload, selected by pods with the " + annProfile + " annotation; requires --pod-annotations",
+			Destination: &workloadProfilesFlag,
+			EnvVars:     []string{"WORKLOAD_PROFILES"},
+		},
+		&cli.BoolFlag{
+			Name:        "pass-mig-caps",
+			Value:       false,
+			Usage:       "pass the /dev/nvidia-caps nodes of the allocated MIG devices as device specs, for container runtimes that do not inject them; implied by --pass-device-specs",
+			Destination: &passMigCapsFlag,
+			EnvVars:     []string{"PASS_MIG_CAPS"},
+		},
+		&cli.StringFlag{
+			Name:        "allocation-journal-file",
+			Value:       "/usr/local/vgpu/allocation-journal.json",
+			Usage:       "the file keeping the vDevices in use with --allocation-mode=plugin-managed across restarts of the plugin, removed in the other modes; empty to disable",
+			Destination: &allocationJournalFileFlag,
+			EnvVars:     []string{"ALLOCATION_JOURNAL_FILE"},
+		},
+		&cli.IntFlag{
+			Name:        "decision-log-rate",
+			Value:       10,
+			Usage:       "the maximum number of allocation decisions logged per second from --verbose=3, the others are counted as suppressed",
+			Destination: &decisionLogRateFlag,
+			EnvVars:     []string{"DECISION_LOG_RATE"},
+		},
+		&cli.StringFlag{
+			Name:        "mig-resource-template",
+			Value:       "nvidia.com/mig-%gpu%g.%mem%gb",
+			Usage:       "the resource name of the MIG devices of a profile with --mig-strategy=mixed, %gpu%, %ci% and %mem% standing for its GPU instance slices, compute instance slices and memory in GB",
+			Destination: &migResourceTemplateFlag,
+			EnvVars:     []string{"MIG_RESOURCE_TEMPLATE"},
+		},
+		&cli.StringFlag{
+			Name:        "mig-socket-template",
+			Value:       "nvidia-mig-%gpu%g.%mem%gb.sock",
+			Usage:       "the socket name of the plugin of a MIG profile with --mig-strategy=mixed, with the placeholders of --mig-resource-template",
+			Destination: &migSocketTemplateFlag,
+			EnvVars:     []string{"MIG_SOCKET_TEMPLATE"},
+		},
+		&cli.DurationFlag{
+			Name:        "instance-lock-timeout",
+			Value:       30 * time.Second,
+			Usage:       "how long to wait for another instance of the plugin on the node to exit before refusing to start, 0 to refuse at once",
+			Destination: &instanceLockTimeoutFlag,
+			EnvVars:     []string{"INSTANCE_LOCK_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:        "otlp-endpoint",
+			Value:       "",
+			Usage:       "the URL of an OTLP/HTTP collector, e.g. http://otel-collector:4318, to send the spans of Allocate, GetPreferredAllocation, the checkpoint reconciliation and the Kubernetes API calls to",
+			Destination: &otlpEndpointFlag,
+			EnvVars:     []string{"OTLP_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:        "admin-token-file",
+			Value:       "",
+			Usage:       "the file holding the bearer token required by the POST requests of the admin API on --metrics-address, which are refused when empty",
+			Destination: &adminTokenFileFlag,
+			EnvVars:     []string{"ADMIN_TOKEN_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "device-plugin-dir",
+			Value:       devicePluginDirAuto,
+			Usage:       "the device plugin directory of the kubelet holding kubelet.sock, or 'auto' to detect it from the kubelet --root-dir and the paths of k3s, microk8s and k0s",
+			Destination: &devicePluginDirFlag,
+			EnvVars:     []string{"DEVICE_PLUGIN_DIR"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable-gpu-tuning",
+			Value:       false,
+			Usage:       "allow pods to lock GPU clocks and cap power through annotations",
+			Destination: &enableGPUTuningFlag,
+			EnvVars:     []string{"ENABLE_GPU_TUNING"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable-exclusive-gpus",
+			Value:       false,
+			Usage:       "allow pods to get GPUs no other pod uses through the " + annExclusive + " annotation, keeping the rest of those GPUs for them",
+			Destination: &enableExclusiveGPUsFlag,
+			EnvVars:     []string{"ENABLE_EXCLUSIVE_GPUS"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable-mps",
+			Value:       false,
+			Usage:       "run an MPS control daemon per shared GPU and connect containers to it",
+			Destination: &enableMPSFlag,
+			EnvVars:     []string{"ENABLE_MPS"},
+		},
+		&cli.StringFlag{
+			Name:        "metrics-address",
+			Value:       "",
+			Usage:       "the address to serve Prometheus metrics and the admin API on, empty to disable (e.g. ':9394')",
+			Destination: &metricsAddressFlag,
+			EnvVars:     []string{"METRICS_ADDRESS"},
+		},
+		&cli.IntFlag{
+			Name:        "event-buffer-size",
+			Value:       1000,
+			Usage:       "the number of device lifecycle events kept in memory for /debug/events",
+			Destination: &eventBufferSizeFlag,
+			EnvVars:     []string{"EVENT_BUFFER_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:        "audit-log-file",
+			Value:       "",
+			Usage:       "the JSON Lines file to record every allocation to, empty to disable",
+			Destination: &auditLogFileFlag,
+			EnvVars:     []string{"AUDIT_LOG_FILE"},
+		},
+		&cli.IntFlag{
+			Name:        "audit-log-max-size",
+			Value:       100,
+			Usage:       "the size in megabytes after which the audit log is rotated, 0 to disable rotation",
+			Destination: &auditLogMaxSizeFlag,
+			EnvVars:     []string{"AUDIT_LOG_MAX_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:        "audit-log-max-backups",
+			Value:       5,
+			Usage:       "the number of rotated audit log files to keep",
+			Destination: &auditLogMaxBackupsFlag,
+			EnvVars:     []string{"AUDIT_LOG_MAX_BACKUPS"},
+		},
+		&cli.StringFlag{
+			Name:        "dcgm-address",
+			Value:       "",
+			Usage:       "the address of a DCGM host engine used for health checks and utilization, empty to use NVML only",
+			Destination: &dcgmAddressFlag,
+			EnvVars:     []string{"DCGM_ADDRESS"},
+		},
+		&cli.BoolFlag{
+			Name:        "report-node-health",
+			Value:       false,
+			Usage:       "set the GPUHealthy node condition to False when all GPUs on the node are unhealthy",
+			Destination: &reportNodeHealthFlag,
+			EnvVars:     []string{"REPORT_NODE_HEALTH"},
+		},
+		&cli.StringFlag{
+			Name:        "unhealthy-taint",
+			Value:       "",
+			Usage:       "the taint to apply when all GPUs are unhealthy, requires --report-node-health:\n\t\t[key[=value]:effect]",
+			Destination: &unhealthyTaintFlag,
+			EnvVars:     []string{"UNHEALTHY_TAINT"},
+		},
+		&cli.StringFlag{
+			Name:        "npd-log-file",
+			Value:       "",
+			Usage:       "the file to log GPU faults to for node-problem-detector, empty to disable",
+			Destination: &npdLogFileFlag,
+			EnvVars:     []string{"NPD_LOG_FILE"},
+		},
+		&cli.IntFlag{
+			Name:        "npd-log-max-size",
+			Value:       10,
+			Usage:       "the size in megabytes after which the node-problem-detector log is rotated, 0 to disable rotation",
+			Destination: &npdLogMaxSizeFlag,
+			EnvVars:     []string{"NPD_LOG_MAX_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:        "npd-log-max-backups",
+			Value:       1,
+			Usage:       "the number of rotated node-problem-detector log files to keep",
+			Destination: &npdLogMaxBackupsFlag,
+			EnvVars:     []string{"NPD_LOG_MAX_BACKUPS"},
+		},
+		&cli.BoolFlag{
+			Name:        "use-plugin-watcher",
+			Value:       false,
+			Usage:       "register through the kubelet plugin watcher directory instead of dialing the kubelet socket",
+			Destination: &usePluginWatcherFlag,
+			EnvVars:     []string{"USE_PLUGIN_WATCHER"},
+		},
+		&cli.IntFlag{
+			Name:        "grpc-max-recv-msg-size",
+			Value:       0,
+			Usage:       "the maximum message size in bytes the gRPC server can receive, 0 for the gRPC default",
+			Destination: &grpcMaxRecvMsgSizeFlag,
+			EnvVars:     []string{"GRPC_MAX_RECV_MSG_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:        "grpc-max-send-msg-size",
+			Value:       0,
+			Usage:       "the maximum message size in bytes the gRPC server can send, 0 for the gRPC default",
+			Destination: &grpcMaxSendMsgSizeFlag,
+			EnvVars:     []string{"GRPC_MAX_SEND_MSG_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:        "grpc-keepalive-time",
+			Value:       0,
+			Usage:       "ping idle clients after this duration, 0 to disable",
+			Destination: &grpcKeepaliveTimeFlag,
+			EnvVars:     []string{"GRPC_KEEPALIVE_TIME"},
+		},
+		&cli.DurationFlag{
+			Name:        "grpc-keepalive-timeout",
+			Value:       20 * time.Second,
+			Usage:       "close the connection if a keepalive ping is not acknowledged within this duration",
+			Destination: &grpcKeepaliveTimeoutFlag,
+			EnvVars:     []string{"GRPC_KEEPALIVE_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:        "socket-mode",
+			Value:       "",
+			Usage:       "the octal file mode of the device plugin socket (e.g. '0660'), empty to keep the default",
+			Destination: &socketModeFlag,
+			EnvVars:     []string{"SOCKET_MODE"},
+		},
+		&cli.IntFlag{
+			Name:        "socket-uid",
+			Value:       -1,
+			Usage:       "the owner uid of the device plugin socket, -1 to keep the default",
+			Destination: &socketUIDFlag,
+			EnvVars:     []string{"SOCKET_UID"},
+		},
+		&cli.IntFlag{
+			Name:        "socket-gid",
+			Value:       -1,
+			Usage:       "the owner gid of the device plugin socket, -1 to keep the default",
+			Destination: &socketGIDFlag,
+			EnvVars:     []string{"SOCKET_GID"},
+		},
+		&cli.StringFlag{
+			Name:        "socket-selinux-label",
+			Value:       "",
+			Usage:       "the SELinux label of the device plugin socket (e.g. 'system_u:object_r:container_file_t:s0'), empty to use the label of the socket directory when SELinux is enabled",
+			Destination: &socketSELinuxLabelFlag,
+			EnvVars:     []string{"SOCKET_SELINUX_LABEL"},
+		},
 		&cli.IntFlag{
 			Name:        "verbose",
 			Value:       0,
@@ -131,20 +1033,34 @@ func main() {
 			EnvVars:     []string{"VERBOSE"},
 		},
 	}
-
-	err := c.Run(os.Args)
-	if err != nil {
-		log.SetOutput(os.Stderr)
-		log.Printf("Error: %v", err)
-		os.Exit(1)
-	}
+	return c
 }
 
 func validateFlags(c *cli.Context) error {
-	if deviceListStrategyFlag != DeviceListStrategyEnvvar && deviceListStrategyFlag != DeviceListStrategyVolumeMounts {
+	if deviceListStrategyFlag != DeviceListStrategyEnvvar && deviceListStrategyFlag != DeviceListStrategyVolumeMounts && deviceListStrategyFlag != DeviceListStrategyCDIAnnotations {
 		return fmt.Errorf("invalid --device-list-strategy option: %v", deviceListStrategyFlag)
 	}
+	if deviceListStrategyFlag == DeviceListStrategyCDIAnnotations && strings.Count(cdiKindFlag, "/") != 1 {
+		return fmt.Errorf("invalid --cdi-kind option: %v, expected <vendor>/<class>", cdiKindFlag)
+	}
 
+	if err := validateAllocationMode(c.IsSet("allocation-mode")); err != nil {
+		return err
+	}
+	if decisionLogRateFlag < 1 {
+		return fmt.Errorf("invalid --decision-log-rate option: %v", decisionLogRateFlag)
+	}
+	if err := validateMigTemplates(); err != nil {
+		return err
+	}
+	if instanceLockTimeoutFlag < 0 {
+		return fmt.Errorf("invalid --instance-lock-timeout option: %v", instanceLockTimeoutFlag)
+	}
+	if otlpEndpointFlag != "" {
+		if err := validateOTLPEndpoint(otlpEndpointFlag); err != nil {
+			return err
+		}
+	}
 	if deviceIDStrategyFlag != DeviceIDStrategyUUID && deviceIDStrategyFlag != DeviceIDStrategyIndex {
 		return fmt.Errorf("invalid --device-id-strategy option: %v", deviceIDStrategyFlag)
 	}
@@ -154,39 +1070,272 @@ func validateFlags(c *cli.Context) error {
 	if deviceMemoryScalingFlag <= 0 {
 		return fmt.Errorf("invalid --device-memory-scaling option: %v", deviceMemoryScalingFlag)
 	}
+	if oversubscribeEvictWatermarkFlag <= 0 || oversubscribeEvictWatermarkFlag > 100 {
+		return fmt.Errorf("invalid --oversubscribe-evict-watermark option: %v", oversubscribeEvictWatermarkFlag)
+	}
+	if !validEvictPolicy(oversubscribeEvictPolicyFlag) {
+		return fmt.Errorf("invalid --oversubscribe-evict-policy option: %v", oversubscribeEvictPolicyFlag)
+	}
+	if memoryPressureThresholdFlag < 0 || memoryPressureThresholdFlag > 100 {
+		return fmt.Errorf("invalid --memory-pressure-threshold option: %v", memoryPressureThresholdFlag)
+	}
+	if avoidPressuredGPUsFlag && memoryPressureThresholdFlag == 0 {
+		return fmt.Errorf("invalid --avoid-pressured-gpus option: --memory-pressure-threshold is not set")
+	}
+	if busyGPUThresholdFlag < 0 || busyGPUThresholdFlag > 100 {
+		return fmt.Errorf("invalid --busy-gpu-threshold option: %v", busyGPUThresholdFlag)
+	}
+	if utilizationSampleIntervalFlag < time.Second {
+		return fmt.Errorf("invalid --utilization-sample-interval option: %v", utilizationSampleIntervalFlag)
+	}
 	if deviceCoresScalingFlag <= 0 {
 		return fmt.Errorf("invalid --device-core-scaling option: %v", deviceCoresScalingFlag)
 	}
+	if eventBufferSizeFlag < 0 {
+		return fmt.Errorf("invalid --event-buffer-size option: %v", eventBufferSizeFlag)
+	}
+	if auditLogMaxSizeFlag < 0 || auditLogMaxBackupsFlag < 0 {
+		return fmt.Errorf("invalid audit log rotation: max size %v, max backups %v", auditLogMaxSizeFlag, auditLogMaxBackupsFlag)
+	}
+	if npdLogMaxSizeFlag < 0 || npdLogMaxBackupsFlag < 0 {
+		return fmt.Errorf("invalid node-problem-detector log rotation: max size %v, max backups %v", npdLogMaxSizeFlag, npdLogMaxBackupsFlag)
+	}
+	if grpcMaxRecvMsgSizeFlag < 0 || grpcMaxSendMsgSizeFlag < 0 {
+		return fmt.Errorf("invalid gRPC message size: recv %v, send %v", grpcMaxRecvMsgSizeFlag, grpcMaxSendMsgSizeFlag)
+	}
+	if socketModeFlag != "" {
+		if _, err := parseSocketMode(socketModeFlag); err != nil {
+			return fmt.Errorf("invalid --socket-mode option: %v", err)
+		}
+	}
+	if coexistFlag && (coexistResourceNameFlag == upstreamResourceName || !strings.Contains(coexistResourceNameFlag, "/")) {
+		return fmt.Errorf("invalid --coexist-resource-name option: %v", coexistResourceNameFlag)
+	}
+	if externalAllocatorFlag != "" && externalAllocatorTimeoutFlag <= 0 {
+		return fmt.Errorf("invalid --external-allocator-timeout option: %v", externalAllocatorTimeoutFlag)
+	}
+	monitorMode := monitorModeFlag
+	if !c.IsSet("monitor-mode") {
+		monitorMode = monitorModeFromEnv()
+	}
+	if !validMonitorMode(monitorMode) {
+		return fmt.Errorf("invalid --monitor-mode option: %v", monitorMode)
+	}
+	if monitorMode == monitorModeFullMetrics && metricsAddressFlag == "" {
+		return fmt.Errorf("invalid --monitor-mode option: %v needs --metrics-address", monitorMode)
+	}
+	if sharedCacheQuotaFlag != "" || sharedCacheDirLimitFlag != "" {
+		if monitorMode == monitorModeOff && monitorSocketFlag == "" && numaSharedCacheDirFlag == "" && !readOnlyRootfsFlag {
+			return fmt.Errorf("invalid --shared-cache-quota option: the containers have no shared cache directory without --monitor-mode")
+		}
+	}
+	if canaryResourceFlag != "" && strings.Count(canaryResourceFlag, "/") != 1 {
+		return fmt.Errorf("invalid --canary-resource option: %v, expected <domain>/<name>", canaryResourceFlag)
+	}
+	if goldenReplayDirFlag != "" {
+		if info, err := os.Stat(goldenReplayDirFlag); err != nil || !info.IsDir() {
+			return fmt.Errorf("invalid --golden-replay-dir option: %v, expected a directory", goldenReplayDirFlag)
+		}
+	}
+	if healthCheckIntervalFlag < time.Millisecond {
+		return fmt.Errorf("invalid --health-check-interval option: %v", healthCheckIntervalFlag)
+	}
+	if healthCheckDepthFlag != healthCheckXIDs && healthCheckDepthFlag != healthCheckFull {
+		return fmt.Errorf("invalid --health-check-depth option: %v, expected '%s' or '%s'", healthCheckDepthFlag, healthCheckXIDs, healthCheckFull)
+	}
+	if healthCheckTimeoutFlag < 0 {
+		return fmt.Errorf("invalid --health-check-timeout option: %v", healthCheckTimeoutFlag)
+	}
+	if devicePluginDirFlag != devicePluginDirAuto && !filepath.IsAbs(devicePluginDirFlag) {
+		return fmt.Errorf("invalid --device-plugin-dir option: %v, expected an absolute path or '%s'", devicePluginDirFlag, devicePluginDirAuto)
+	}
+	if vdeviceReconcileIntervalFlag < 0 {
+		return fmt.Errorf("invalid --vdevice-reconcile-interval option: %v", vdeviceReconcileIntervalFlag)
+	}
+	if rebalanceIntervalFlag < 0 {
+		return fmt.Errorf("invalid --rebalance-interval option: %v", rebalanceIntervalFlag)
+	}
+	if historyDirFlag != "" && historyIntervalFlag <= 0 {
+		return fmt.Errorf("invalid --history-interval option: %v", historyIntervalFlag)
+	}
+	if historyDirFlag != "" && historyRetentionFlag < historyIntervalFlag {
+		return fmt.Errorf("invalid --history-retention option: %v is shorter than --history-interval", historyRetentionFlag)
+	}
+	if openSourceModeFlag && (licenseURLFlag != "" || licenseSecretFlag != "") {
+		return fmt.Errorf("invalid --open-source-mode option: the license is not managed in open-source mode, unset --license-url and --license-secret")
+	}
+	if licenseURLFlag != "" && licenseSecretFlag != "" {
+		return fmt.Errorf("invalid --license-secret option: --license-url is already set")
+	}
+	if parts := strings.Split(licenseSecretFlag, "/"); licenseSecretFlag != "" && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+		return fmt.Errorf("invalid --license-secret option: %q is not namespace/name", licenseSecretFlag)
+	}
+	if licenseRefreshIntervalFlag <= 0 {
+		return fmt.Errorf("invalid --license-refresh-interval option: %v", licenseRefreshIntervalFlag)
+	}
+	if envPrefixFlag != "" && !envNamePattern.MatchString(envPrefixFlag) {
+		return fmt.Errorf("invalid --env-prefix option: %q", envPrefixFlag)
+	}
+	if numaSharedCacheDirFlag != "" {
+		if err := validNUMASharedCacheDir(numaSharedCacheDirFlag); err != nil {
+			return fmt.Errorf("invalid --numa-shared-cache-dir option: %v", err)
+		}
+	}
+	if workloadProfilesFlag != "" && !podAnnotationsFlag {
+		return fmt.Errorf("invalid --workload-profiles option: --pod-annotations is not set")
+	}
+	if allocationWebhookFailurePolicyFlag != webhookFailurePolicyFail && allocationWebhookFailurePolicyFlag != webhookFailurePolicyIgnore {
+		return fmt.Errorf("invalid --allocation-webhook-failure-policy option: %v", allocationWebhookFailurePolicyFlag)
+	}
+	if allocationWebhookFlag != "" && allocationWebhookTimeoutFlag <= 0 {
+		return fmt.Errorf("invalid --allocation-webhook-timeout option: %v", allocationWebhookTimeoutFlag)
+	}
+	if unhealthyTaintFlag != "" {
+		if _, err := parseTaint(unhealthyTaintFlag); err != nil {
+			return fmt.Errorf("invalid --unhealthy-taint option: %v", err)
+		}
+	}
+	return nil
+}
+
+// loadFlags reads the files and parses the values the flags name into the globals they
+// configure, once validateFlags accepted them
+func loadFlags(c *cli.Context) error {
+	var err error
+	resolveAllocationMode()
+	if adminTokenFileFlag != "" {
+		if err := readAdminToken(adminTokenFileFlag); err != nil {
+			return fmt.Errorf("invalid --admin-token-file option: %v", err)
+		}
+	}
+	if defaultDeviceMemoryFlag != "" {
+		defaultMemory, err = parseDefaultDeviceMemory(defaultDeviceMemoryFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --default-device-memory option: %v", err)
+		}
+	}
+	if modelResourceMapFlag != "" {
+		modelResourceMap, err = parseModelResourceMap(modelResourceMapFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --model-resource-map option: %v", err)
+		}
+	}
+	if !c.IsSet("monitor-mode") {
+		monitorModeFlag = monitorModeFromEnv()
+	}
+	if sharedCacheQuotaFlag != "" {
+		if sharedCacheQuotaMiB, err = parseMemoryMiB(sharedCacheQuotaFlag); err != nil || sharedCacheQuotaMiB == 0 {
+			return fmt.Errorf("invalid --shared-cache-quota option: %v", sharedCacheQuotaFlag)
+		}
+	}
+	if sharedCacheDirLimitFlag != "" {
+		if sharedCacheDirLimitMiB, err = parseMemoryMiB(sharedCacheDirLimitFlag); err != nil || sharedCacheDirLimitMiB == 0 {
+			return fmt.Errorf("invalid --shared-cache-dir-limit option: %v", sharedCacheDirLimitFlag)
+		}
+	}
+	if vdeviceMemoryQuantumFlag != "" {
+		if vdeviceMemoryQuantumMiB, err = parseMemoryMiB(vdeviceMemoryQuantumFlag); err != nil || vdeviceMemoryQuantumMiB == 0 {
+			return fmt.Errorf("invalid --vdevice-memory-quantum option: %v", vdeviceMemoryQuantumFlag)
+		}
+	}
+	if minVDeviceMemoryFlag != "" {
+		if minVDeviceMemoryMiB, err = parseMemoryMiB(minVDeviceMemoryFlag); err != nil || minVDeviceMemoryMiB == 0 {
+			return fmt.Errorf("invalid --min-vdevice-memory option: %v", minVDeviceMemoryFlag)
+		}
+	}
+	if maxVDeviceMemoryFlag != "" {
+		if maxVDeviceMemoryMiB, err = parseMemoryMiB(maxVDeviceMemoryFlag); err != nil || maxVDeviceMemoryMiB == 0 || maxVDeviceMemoryMiB < minVDeviceMemoryMiB {
+			return fmt.Errorf("invalid --max-vdevice-memory option: %v", maxVDeviceMemoryFlag)
+		}
+	}
+	if contextOverheadFlag != "" {
+		if contextOverheadMiB, err = parseMemoryMiB(contextOverheadFlag); err != nil {
+			return fmt.Errorf("invalid --context-overhead option: %v", contextOverheadFlag)
+		}
+	}
+	if goldenDirFlag != "" {
+		if err := os.MkdirAll(goldenDirFlag, 0750); err != nil {
+			return fmt.Errorf("invalid --golden-dir option: %v", err)
+		}
+	}
+	if allocationConstraintsFlag != "" {
+		constraints, err = loadAllocationConstraints(allocationConstraintsFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --allocation-constraints option: %v", err)
+		}
+	}
+	if envNameMapFlag != "" {
+		envNameMap, err = parseEnvNameMap(envNameMapFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --env-name-map option: %v", err)
+		}
+	}
+	if gpuReservationsFlag != "" {
+		reservations, err = loadGPUReservations(gpuReservationsFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --gpu-reservations option: %v", err)
+		}
+	}
+	if fabricPartitionsFlag != "" {
+		fabricPartitions, err = parseFabricPartitions(fabricPartitionsFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --fabric-partitions option: %v", err)
+		}
+	}
+	if workloadProfilesFlag != "" {
+		workloadProfiles, err = loadWorkloadProfiles(workloadProfilesFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --workload-profiles option: %v", err)
+		}
+	}
+	vmRuntimeClasses = parseRuntimeClasses(vmRuntimeClassesFlag)
+	gvisorRuntimeClasses = parseRuntimeClasses(gvisorRuntimeClassesFlag)
 	return nil
 }
 
 func start(c *cli.Context) error {
-	log.Println("Loading PciInfo")
-	cmd := exec.Command("lspci")
-	out, err := cmd.Output()
-	if err != nil {
+	if err := loadFlags(c); err != nil {
 		return err
 	}
-	pcibusfile := os.Getenv("PCIBUSFILE")
-	pcibusstr := ""
-	for idx, val := range strings.Split(string(out), "\n") {
-		fmt.Println(idx, "=", val)
-		if len(val) > 1 {
-			pcibusid := strings.Split(val, " ")[0]
-			if strings.Contains(val, "NVIDIA") {
-				fmt.Println("found", pcibusid)
-				pcibusstr = pcibusstr + pcibusid + "\n"
+	applyGPUOperatorDefaults(c)
+	resolveDevicePluginDir()
+	if !c.IsSet("device-cache-file") {
+		deviceCacheFileFlag = devicePluginSocket(filepath.Base(deviceCacheFileFlag))
+	}
+	if err := acquireInstanceLock(instanceLockTimeoutFlag); err != nil {
+		return err
+	}
+
+	var err error
+	// lspci is slow on large nodes, only run it when its output is wanted
+	if pcibusfile := os.Getenv("PCIBUSFILE"); len(pcibusfile) > 0 {
+		log.Println("Loading PciInfo")
+		cmd := exec.Command("lspci")
+		out, err := cmd.Output()
+		if err != nil {
+			return err
+		}
+		pcibusstr := ""
+		for idx, val := range strings.Split(string(out), "\n") {
+			fmt.Println(idx, "=", val)
+			if len(val) > 1 {
+				pcibusid := strings.Split(val, " ")[0]
+				if strings.Contains(val, "NVIDIA") {
+					fmt.Println("found", pcibusid)
+					pcibusstr = pcibusstr + pcibusid + "\n"
+				}
 			}
 		}
-	}
-	fmt.Println("pcibusstr=", pcibusstr)
-	if len(pcibusfile) > 0 {
+		fmt.Println("pcibusstr=", pcibusstr)
 		ioutil.WriteFile(pcibusfile, []byte(pcibusstr), 0644)
 	}
 	log.Println("Loading NVML")
 	if err := nvml.Init(); err != nil {
 		log.SetOutput(os.Stderr)
 		log.Printf("Failed to initialize NVML: %v.", err)
+		if tegraNode() {
+			log.Printf("This is a Jetson node: its integrated GPU is not managed through NVML and cannot be shared by this plugin.")
+		}
 		log.Printf("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
 		log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
 		log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
@@ -198,30 +1347,356 @@ func start(c *cli.Context) error {
 	}
 	defer func() { log.Println("Shutdown of NVML returned:", nvml.Shutdown()) }()
 
+	if deviceCacheFileFlag != "" {
+		loadDeviceCache(deviceCacheFileFlag)
+	}
+	if allocationJournalFileFlag != "" {
+		if allocationModeFlag == allocationModePluginManaged {
+			if journal, err = openAllocationJournal(allocationJournalFileFlag); err != nil {
+				return err
+			}
+		} else {
+			removeAllocationJournal(allocationJournalFileFlag)
+		}
+	}
+
+	if numaSharedCacheDirFlag != "" {
+		checkSharedCacheDirs()
+	}
+	if monitorModeFlag != monitorModeOff && monitorSocketFlag == "" {
+		if err := checkSharedCacheRoot(); err != nil {
+			return fmt.Errorf("--monitor-mode=%s needs %s mounted from the host: %v", monitorModeFlag, sharedCacheRoot, err)
+		}
+	}
+
+	if reservations != nil {
+		if err := reservations.resolve(); err != nil {
+			return fmt.Errorf("invalid --gpu-reservations option: %v", err)
+		}
+	}
+
+	confidentialComputing = detectConfidentialComputing()
+
+	if err := checkVDeviceMemory(); err != nil {
+		return fmt.Errorf("invalid vDevice memory: %v", err)
+	}
+
+	deviceEvents = newEventRing(eventBufferSizeFlag)
+
+	if coexistFlag {
+		if upstreamPluginRunning() {
+			log.Printf("Detected the upstream NVIDIA device plugin, advertising GPUs as '%s'.", coexistResourceNameFlag)
+		} else {
+			log.Printf("Upstream NVIDIA device plugin not detected, advertising GPUs as '%s' anyway.", coexistResourceNameFlag)
+		}
+	}
+
+	if hasNVSwitch() {
+		log.Printf("Detected NVSwitches, GPUs depend on the fabric manager.")
+		fabricManaged = true
+	}
+
+	if recordFileFlag != "" {
+		log.Printf("Recording allocations to %s.", recordFileFlag)
+		allocationTracer, err = NewAllocationTracer(recordFileFlag)
+		if err != nil {
+			return fmt.Errorf("failed to open allocation trace: %v", err)
+		}
+	}
+
+	if otlpEndpointFlag != "" {
+		startSpanExporter(otlpEndpointFlag)
+	}
+
+	if externalAllocatorFlag != "" {
+		log.Printf("Delegating device selection to the external allocator at %s.", externalAllocatorFlag)
+		externalAllocator, err = NewExternalAllocator(externalAllocatorFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create external allocator client: %v", err)
+		}
+	}
+
+	if monitorSocketFlag != "" {
+		log.Printf("Using the vgpu-monitor at %s for the shared cache directories.", monitorSocketFlag)
+		vgpuMonitor, err = NewVGPUMonitorClient(monitorSocketFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create vgpu-monitor client: %v", err)
+		}
+	}
+
+	if dcgmAddressFlag != "" {
+		log.Printf("Using DCGM host engine at %s.", dcgmAddressFlag)
+		dcgmClient = NewDcgmClient(dcgmAddressFlag)
+		dcgmStop := make(chan struct{})
+		defer close(dcgmStop)
+		go dcgmClient.run(dcgmStop)
+	}
+
+	if metricsAddressFlag != "" {
+		registerMetrics(writeUtilizationMetrics)
+		registerMetrics(writeSpanMetrics)
+		registerMetrics(writeOversubscriptionMetrics)
+		registerMetrics(writeVDeviceMetrics)
+		if canaryResourceFlag != "" {
+			registerMetrics(writeCanaryMetrics)
+		}
+		if monitorModeFlag == monitorModeFullMetrics {
+			registerMetrics(writePodUsageMetrics)
+		}
+		registerAdminHandlers()
+		httpMux.HandleFunc("/debug/events", serveEvents)
+		httpMux.HandleFunc("/debug/devices", serveDeviceStatus)
+		httpMux.HandleFunc("/", serveStatusPage)
+		registerProbeHandlers(httpMux)
+		startHTTPServer(metricsAddressFlag)
+	}
+
+	if probeAddressFlag != "" && probeAddressFlag != metricsAddressFlag {
+		startProbeServer(probeAddressFlag)
+	}
+
+	if reportNodeHealthFlag {
+		nodeHealthReporter, err = newNodeHealthReporterFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to create node health reporter: %v", err)
+		}
+	}
+
+	if deviceMapNamespaceFlag != "" {
+		deviceMapReporter, err = newDeviceMapReporterFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to create device map reporter: %v", err)
+		}
+		deviceMapStop := make(chan struct{})
+		defer close(deviceMapStop)
+		go deviceMapReporter.run(deviceMapStop)
+	}
+
+	if vgpuNodeCRDFlag {
+		vgpuNodeReporter, err = newVGPUNodeReporterFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to create VGPUNode reporter: %v", err)
+		}
+		reporterStop := make(chan struct{})
+		defer close(reporterStop)
+		go vgpuNodeReporter.run(reporterStop)
+	}
+
+	if rebalanceIntervalFlag > 0 {
+		rebalanceAnalyzer, err = newRebalanceAnalyzerFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to create rebalance analyzer: %v", err)
+		}
+		registerMetrics(rebalanceAnalyzer.writeMetrics)
+		rebalanceStop := make(chan struct{})
+		defer close(rebalanceStop)
+		go rebalanceAnalyzer.run(rebalanceStop)
+	}
+
+	if sharedCacheQuotaMiB > 0 || sharedCacheDirLimitMiB > 0 {
+		sharedCacheQuota = newSharedCacheQuotaFromFlags()
+		registerMetrics(sharedCacheQuota.writeMetrics)
+		quotaStop := make(chan struct{})
+		defer close(quotaStop)
+		go sharedCacheQuota.run(quotaStop)
+	}
+
+	if memoryPressureThresholdFlag > 0 {
+		memoryPressureMonitor = newMemoryPressureMonitorFromFlags()
+		registerMetrics(memoryPressureMonitor.writeMetrics)
+		pressureStop := make(chan struct{})
+		defer close(pressureStop)
+		go memoryPressureMonitor.run(pressureStop)
+	}
+
+	if busyGPUThresholdFlag > 0 {
+		utilizationMonitor = NewUtilizationMonitor(uint64(busyGPUThresholdFlag), utilizationSampleIntervalFlag)
+		registerMetrics(utilizationMonitor.writeMetrics)
+		utilizationStop := make(chan struct{})
+		defer close(utilizationStop)
+		go utilizationMonitor.run(utilizationStop)
+	}
+
+	if historyDirFlag != "" {
+		log.Printf("Recording usage history to %s.", historyDirFlag)
+		usageHistory, err = NewUsageHistory(historyDirFlag, historyIntervalFlag, historyRetentionFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create usage history: %v", err)
+		}
+		historyStop := make(chan struct{})
+		defer close(historyStop)
+		go usageHistory.run(historyStop)
+	}
+
+	if openSourceModeFlag {
+		log.Printf("Running in open-source mode, without the validator and the license.")
+	} else {
+		licenseManager = NewLicenseManager(licenseDir, licenseURLFlag, licenseSecretFlag, licenseRefreshIntervalFlag, os.Getenv("NODE_NAME"))
+		if licenseManager.managed() {
+			log.Printf("Managing the vGPU license in %s.", licenseDir)
+		}
+		registerMetrics(licenseManager.writeMetrics)
+		licenseStop := make(chan struct{})
+		defer close(licenseStop)
+		go licenseManager.run(licenseStop)
+	}
+
+	if auditLogFileFlag != "" {
+		auditLogger, err = NewAuditLogger(auditLogFileFlag, auditLogMaxSizeFlag, auditLogMaxBackupsFlag)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %v", err)
+		}
+	}
+
+	if npdLogFileFlag != "" {
+		npdLogger, err = NewNpdLogger(npdLogFileFlag, npdLogMaxSizeFlag, npdLogMaxBackupsFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create node-problem-detector log: %v", err)
+		}
+	}
+
+	if err := adaptToPrivileges(); err != nil {
+		return err
+	}
+
+	if err := checkVGPULibrary(); err != nil {
+		log.Printf("Error: vGPU allocations will fail: %v", err)
+	}
+
+	if enableGPUTuningFlag {
+		log.Println("Starting GPU tuner.")
+		gpuTuner = NewGpuTuner()
+		tunerStop := make(chan struct{})
+		defer close(tunerStop)
+		go gpuTuner.run(tunerStop)
+	}
+
+	if enableExclusiveGPUsFlag {
+		exclusive = &exclusiveGPUs{claims: make(map[string]*exclusiveClaim)}
+	}
+
+	if enableMPSFlag && deviceSplitCountFlag > 1 {
+		log.Println("Starting MPS manager.")
+		mpsManager = NewMpsManager(mpsRootDir)
+		mpsStop := make(chan struct{})
+		defer close(mpsStop)
+		go mpsManager.run(mpsStop)
+	}
+
+	if err := validateKubePermissions(); err != nil {
+		return err
+	}
+
 	log.Println("Starting FS watcher.")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+	watcher, err := newFSWatcher(devicePluginDir)
 	if err != nil {
 		return fmt.Errorf("failed to create FS watcher: %v", err)
 	}
 	defer watcher.Close()
 
+	var configChanges chan *pluginConfig
+	if vgpuConfigCRDFlag {
+		log.Println("Starting VGPUConfig watcher.")
+		configWatcher, err := newVGPUConfigWatcherFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to create VGPUConfig watcher: %v", err)
+		}
+		configChanges = configWatcher.changes
+		configStop := make(chan struct{})
+		defer close(configStop)
+		go configWatcher.run(configStop)
+	}
+
+	var passthroughChanges chan []string
+	if enableVfioFlag {
+		log.Println("Starting passthrough watcher.")
+		passthroughWatcher, err := newPassthroughWatcherFromFlags()
+		if err != nil {
+			return fmt.Errorf("failed to create passthrough watcher: %v", err)
+		}
+		passthroughChanges = passthroughWatcher.changes
+		passthroughStop := make(chan struct{})
+		defer close(passthroughStop)
+		go passthroughWatcher.run(passthroughStop)
+	}
+
 	log.Println("Starting OS watcher.")
 	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	var plugins []*NvidiaDevicePlugin
+	var pendingConfig *pluginConfig
+	var pendingPassthrough []string
+	var shrinkRetry <-chan time.Time
+	rebind := false
+	reinit := false
 restart:
+	setProbeStarted(false)
+	if err := acquireInstanceLock(instanceLockTimeoutFlag); err != nil {
+		return err
+	}
+	shrinkRetry = nil
 	// If we are restarting, idempotently stop any running plugins before
 	// recreating them below.
 	for _, p := range plugins {
 		p.Stop()
 	}
+	sharedDevices.reset()
+
+	// Apply the options of a changed VGPUConfig while no plugin is running.
+	if pendingConfig != nil {
+		previous := currentPluginConfig()
+		pendingConfig.apply()
+		if err := checkVDeviceMemory(); err != nil {
+			log.Printf("Error: ignoring the VGPUConfig options: %v", err)
+			previous.apply()
+		}
+		pendingConfig = nil
+	}
+
+	// Rebind GPUs between nvidia and vfio-pci while NVML does not hold them.
+	if rebind {
+		log.Println("Shutdown of NVML returned:", nvml.Shutdown())
+		if err := rebindPassthrough(pendingPassthrough); err != nil {
+			log.Printf("Error: failed to move GPUs to passthrough %v: %v", pendingPassthrough, err)
+		}
+		if err := nvml.Init(); err != nil {
+			return fmt.Errorf("failed to initialize NVML after rebinding GPUs: %v", err)
+		}
+		rebind = false
+	}
+
+	// Re-initialize NVML once the plugins no longer use the stale handles.
+	if reinit {
+		if err := reinitNVML(); err != nil {
+			return err
+		}
+		reinit = false
+	}
 
 	log.Println("Retreiving plugins.")
 	migStrategy, err := NewMigStrategy(migStrategyFlag)
 	if err != nil {
 		return fmt.Errorf("error creating MIG strategy: %v", err)
 	}
-	plugins = migStrategy.GetPlugins()
+	if mdevTypeFlag != "" {
+		plugins = []*NvidiaDevicePlugin{getMdevPlugin()}
+	} else {
+		plugins = migStrategy.GetPlugins()
+	}
+	if enableVfioFlag {
+		plugins = append(plugins, getVfioPlugin())
+	}
+	if canaryResourceFlag != "" {
+		plugins = append(plugins, getCanaryPlugin())
+	}
+	if confidentialComputing.enabled() && mdevTypeFlag == "" {
+		ccPlugin := getConfidentialPlugin()
+		plugins = append(plugins, ccPlugin)
+		if err := publishConfidentialComputing(ccPlugin); err != nil {
+			log.Printf("Warning: failed to publish the confidential computing state of the node: %v", err)
+		}
+	}
+	setAdminPlugins(plugins)
 
 	// Loop through all plugins, starting them if they have any devices
 	// to serve. If even one plugin fails to start properly, try
@@ -243,12 +1718,24 @@ restart:
 			close(pluginStartError)
 			goto events
 		}
+		if selfTestFlag {
+			p.runSelfTest()
+		}
 		started++
 	}
 
+	if goldenReplayDirFlag != "" {
+		return replayGoldenFiles(plugins)
+	}
+
 	if started == 0 {
 		log.Println("No devices found. Waiting indefinitely.")
 	}
+	setProbeStarted(true)
+
+	if deviceCacheFileFlag != "" {
+		saveDeviceCache(deviceCacheFileFlag)
+	}
 
 events:
 	// Start an infinite loop, waiting for several indicators to either log
@@ -260,14 +1747,57 @@ events:
 			goto restart
 
 		// Detect a kubelet restart by watching for a newly created
-		// 'pluginapi.KubeletSocket' file. When this occurs, restart this loop,
+		// kubelet socket file. When this occurs, restart this loop,
 		// restarting all of the plugins in the process.
 		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				log.Printf("inotify: %s created, restarting.", pluginapi.KubeletSocket)
+			if event.Name == kubeletSocket() && event.Op&fsnotify.Create == fsnotify.Create {
+				log.Printf("inotify: %s created, restarting.", kubeletSocket())
 				goto restart
 			}
 
+		// Restart the plugins with the options of the VGPUConfigs matching the node,
+		// or resize their vDevices in place when only the split count changed.
+		case config := <-configChanges:
+			if config.splitCountOnly() {
+				previous := currentPluginConfig()
+				config.apply()
+				if err := checkVDeviceMemory(); err != nil {
+					log.Printf("Error: ignoring the VGPUConfig options: %v", err)
+					previous.apply()
+					continue
+				}
+				log.Printf("VGPUConfig changed the split count to %v, resizing the vDevices.", config.deviceSplitCount)
+				shrinkRetry = nil
+				if resizeVDevices(plugins) {
+					shrinkRetry = time.After(shrinkRetryInterval)
+				}
+				continue
+			}
+			log.Printf("VGPUConfig changed: split count %v, memory scaling %v, cores scaling %v, %d excluded devices, restarting.",
+				config.deviceSplitCount, config.deviceMemoryScaling, config.deviceCoresScaling, len(config.excludeDevices))
+			pendingConfig = config
+			goto restart
+
+		// Retry shrinking the vDevices once more of them may have been released.
+		case <-shrinkRetry:
+			shrinkRetry = nil
+			if resizeVDevices(plugins) {
+				shrinkRetry = time.After(shrinkRetryInterval)
+			}
+
+		// Restart the plugins with the GPUs moved between sharing and passthrough.
+		case addresses := <-passthroughChanges:
+			log.Printf("Passthrough GPUs changed to %v, restarting.", addresses)
+			pendingPassthrough = addresses
+			rebind = true
+			goto restart
+
+		// Rebuild the devices after the driver was reloaded underneath the plugin.
+		case reason := <-nvmlLost:
+			log.Printf("NVML handles went stale (%s), re-initializing NVML and restarting.", reason)
+			reinit = true
+			goto restart
+
 		// Watch for any other fs errors and log them.
 		case err := <-watcher.Errors:
 			log.Printf("inotify: %s", err)
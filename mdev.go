@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Mediated device sysfs layout of the NVIDIA vGPU host driver
+const (
+	mdevBusPath       = "/sys/class/mdev_bus"
+	mdevDevicesPath   = "/sys/bus/mdev/devices"
+	mdevAllocStrategy = "mdev"
+)
+
+// mdevReconcileInterval is the interval at which mdevs of released slots are removed
+const mdevReconcileInterval = 30 * time.Second
+
+// mdevNamespace derives stable mdev UUIDs from slot IDs, so that the mdev of a slot
+// is found again after a restart of the plugin
+var mdevNamespace = uuid.MustParse("6ba7b812-9dad-11d1-80b4-00c04fd430c8")
+
+// MdevDeviceManager implements the ResourceManager interface for the mdev slots of one mdev type
+type MdevDeviceManager struct {
+	mdevType string
+}
+
+// mdevUUID returns the UUID of the mdev backing a slot
+func mdevUUID(slot string) string {
+	return uuid.NewSHA1(mdevNamespace, []byte(slot)).String()
+}
+
+// mdevParent returns the parent PCI address of a slot ID "<parent>-<n>"
+func mdevParent(slot string) string {
+	return slot[:strings.LastIndex(slot, "-")]
+}
+
+// mdevTypeName returns the human readable name of an mdev type, e.g. "GRID T4-4Q"
+func mdevTypeName(mdevType string) string {
+	parents, _ := ioutil.ReadDir(mdevBusPath)
+	for _, p := range parents {
+		if name := readSysfs(filepath.Join(mdevBusPath, p.Name(), "mdev_supported_types", mdevType, "name")); name != "" {
+			return name
+		}
+	}
+	return mdevType
+}
+
+// mdevResourceName returns the resource name of an mdev type, e.g. nvidia.com/grid-t4-4q
+func mdevResourceName(mdevType string) string {
+	name := strings.ToLower(mdevTypeName(mdevType))
+	return "nvidia.com/" + strings.Trim(modelInvalidChars.ReplaceAllString(name, "-"), "-")
+}
+
+// Devices returns one slot per mdev of the type the parents can host, created or not
+func (g *MdevDeviceManager) Devices() []*Device {
+	parents, err := ioutil.ReadDir(mdevBusPath)
+	if err != nil {
+		log.Printf("Error: failed to list mdev parents: %v", err)
+		return nil
+	}
+	var devs []*Device
+	for _, p := range parents {
+		typePath := filepath.Join(mdevBusPath, p.Name(), "mdev_supported_types", g.mdevType)
+		available, err := strconv.Atoi(readSysfs(filepath.Join(typePath, "available_instances")))
+		if err != nil {
+			continue
+		}
+		existing, _ := ioutil.ReadDir(filepath.Join(typePath, "devices"))
+		for i := 0; i < available+len(existing); i++ {
+			dev := &Device{Index: p.Name()}
+			dev.ID = fmt.Sprintf("%s-%d", p.Name(), i)
+			dev.Health = pluginapi.Healthy
+			devs = append(devs, dev)
+		}
+	}
+	return devs
+}
+
+// CheckHealth is a no-op for mdev slots
+func (g *MdevDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth) {
+	<-stop
+}
+
+// getMdevPlugin returns the plugin advertising the mdev slots of --mdev-type
+func getMdevPlugin() *NvidiaDevicePlugin {
+	plugin := NewNvidiaDevicePlugin(
+		mdevResourceName(mdevTypeFlag),
+		&MdevDeviceManager{mdevType: mdevTypeFlag},
+		"",
+		nil,
+		devicePluginSocket("vgpu-mdev.sock"))
+	plugin.migStrategy = mdevAllocStrategy
+	return plugin
+}
+
+// createMdev creates the mdev of a slot if it does not exist yet and returns its UUID
+func createMdev(mdevType, slot string) (string, error) {
+	id := mdevUUID(slot)
+	if _, err := os.Stat(filepath.Join(mdevDevicesPath, id)); err == nil {
+		return id, nil
+	}
+	create := filepath.Join(mdevBusPath, mdevParent(slot), "mdev_supported_types", mdevType, "create")
+	if err := writeSysfs(create, id); err != nil {
+		return "", fmt.Errorf("failed to create mdev %s on %s: %v", id, mdevParent(slot), err)
+	}
+	log.Printf("Created mdev %s of type %s on %s", id, mdevType, mdevParent(slot))
+	return id, nil
+}
+
+// removeMdev removes the mdev of a slot if it exists
+func removeMdev(slot string) error {
+	id := mdevUUID(slot)
+	path := filepath.Join(mdevDevicesPath, id)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	log.Printf("Removing mdev %s of released slot %s", id, slot)
+	return writeSysfs(filepath.Join(path, "remove"), "1")
+}
+
+// MdevAllocate creates the mdevs of the requested slots and passes their vfio groups to the pod
+func (m *NvidiaDevicePlugin) MdevAllocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		response := pluginapi.ContainerAllocateResponse{
+			Devices: []*pluginapi.DeviceSpec{{
+				ContainerPath: filepath.Join(vfioDevicePath, "vfio"),
+				HostPath:      filepath.Join(vfioDevicePath, "vfio"),
+				Permissions:   "mrw",
+			}},
+		}
+		var ids []string
+		for _, slot := range req.DevicesIDs {
+			if !m.deviceExists(slot) {
+				return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", m.resourceName, slot)
+			}
+			id, err := createMdev(mdevTypeFlag, slot)
+			if err != nil {
+				return nil, err
+			}
+			group, err := os.Readlink(filepath.Join(mdevDevicesPath, id, "iommu_group"))
+			if err != nil {
+				return nil, fmt.Errorf("mdev %s has no IOMMU group: %v", id, err)
+			}
+			p := filepath.Join(vfioDevicePath, filepath.Base(group))
+			response.Devices = append(response.Devices, &pluginapi.DeviceSpec{ContainerPath: p, HostPath: p, Permissions: "mrw"})
+			ids = append(ids, id)
+		}
+		response.Envs = map[string]string{"MDEV_" + kubevirtResourceEnv(m.resourceName): strings.Join(ids, ",")}
+		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+		recordEvent(eventAllocate, m.resourceName, req.DevicesIDs, "mdevs %v", ids)
+	}
+	return &responses, nil
+}
+
+// reconcileMdevs removes the mdevs of slots the kubelet checkpoint no longer assigns
+func (m *NvidiaDevicePlugin) reconcileMdevs(stop <-chan interface{}, devices []*Device) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(mdevReconcileInterval):
+		}
+		assignments, err := readCheckpointAssignments(m.resourceName)
+		if err != nil {
+			log.Printf("Warning: failed to read kubelet checkpoint for mdevs: %v", err)
+			continue
+		}
+		for _, d := range devices {
+			if _, ok := assignments[d.ID]; ok {
+				continue
+			}
+			if err := removeMdev(d.ID); err != nil {
+				log.Printf("Error: failed to remove mdev of slot %s: %v", d.ID, err)
+			}
+		}
+	}
+}
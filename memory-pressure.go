@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// memoryPressureInterval is the interval at which the memory used on the GPUs is checked
+const memoryPressureInterval = 30 * time.Second
+
+// eventMemoryPressure is the device lifecycle event type of the memory pressure changes
+const eventMemoryPressure = "memory-pressure"
+
+// memoryPressureMonitor is non-nil when --memory-pressure-threshold is set
+var memoryPressureMonitor *MemoryPressureMonitor
+
+// gpuMemoryPressure is the memory state of a GPU in MiB at the last check
+type gpuMemoryPressure struct {
+	total   uint64
+	granted uint64
+	used    uint64
+}
+
+// MemoryPressureMonitor periodically compares the memory used on each oversubscribed GPU to its
+// physical memory, reporting the GPUs above the threshold and optionally keeping new vDevices
+// off them
+type MemoryPressureMonitor struct {
+	mux       sync.Mutex
+	threshold uint64
+	avoid     bool
+	nodeName  string
+	gpus      map[string]gpuMemoryPressure
+	pressured map[string]bool
+}
+
+// NewMemoryPressureMonitor returns a reference to a new MemoryPressureMonitor, threshold is in
+// percent of the physical memory
+func NewMemoryPressureMonitor(threshold uint64, avoid bool, nodeName string) *MemoryPressureMonitor {
+	return &MemoryPressureMonitor{
+		threshold: threshold,
+		avoid:     avoid,
+		nodeName:  nodeName,
+		gpus:      make(map[string]gpuMemoryPressure),
+		pressured: make(map[string]bool),
+	}
+}
+
+// check samples the used memory of the GPUs and reports the ones entering or leaving pressure
+func (p *MemoryPressureMonitor) check() error {
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]uint64)
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		if err != nil {
+			if isNVMLStale(err) {
+				reportNVMLLost(err)
+			}
+			return err
+		}
+		status, err := d.Status()
+		if err != nil || status.Memory.Global.Used == nil {
+			continue
+		}
+		used[d.UUID] = *status.Memory.Global.Used
+	}
+
+	gpus := make(map[string]gpuMemoryPressure)
+	pressured := make(map[string]bool)
+	for _, plugin := range getAdminPlugins() {
+		for _, d := range plugin.deviceStatuses(nil) {
+			memory, ok := used[d.UUID]
+			if !ok || d.MemoryTotal == 0 {
+				continue
+			}
+			g := gpuMemoryPressure{total: d.MemoryTotal, granted: d.MemoryGranted, used: memory}
+			gpus[d.UUID] = g
+			// Only oversubscribed GPUs can run out of physical memory
+			if g.granted > g.total && g.used*100 >= g.total*p.threshold {
+				pressured[d.UUID] = true
+			}
+		}
+	}
+
+	p.mux.Lock()
+	previous := p.pressured
+	p.gpus = gpus
+	p.pressured = pressured
+	p.mux.Unlock()
+
+	for uuid := range pressured {
+		if !previous[uuid] {
+			g := gpus[uuid]
+			p.report(uuid, "GPUMemoryPressure", fmt.Sprintf("GPU %s uses %vMiB of its %vMiB of physical memory while %vMiB are granted", uuid, g.used, g.total, g.granted))
+		}
+	}
+	for uuid := range previous {
+		if !pressured[uuid] {
+			log.Printf("GPU %s is no longer under memory pressure", uuid)
+			recordEvent(eventMemoryPressure, "", []string{uuid}, "memory pressure relieved")
+		}
+	}
+	return nil
+}
+
+// report logs a GPU entering memory pressure and creates a node event for it
+func (p *MemoryPressureMonitor) report(uuid, reason, message string) {
+	log.Printf("Warning: %s", message)
+	recordEvent(eventMemoryPressure, "", []string{uuid}, "%s", message)
+	if p.nodeName == "" {
+		return
+	}
+	if err := createNodeEvent(p.nodeName, reason, message); err != nil {
+		log.Printf("Warning: failed to create the %s node event: %v", reason, err)
+	}
+}
+
+// filterVDeviceIDs removes the vDevices of the GPUs under memory pressure from ids when
+// --avoid-pressured-gpus is set
+func (p *MemoryPressureMonitor) filterVDeviceIDs(vdevices []*VDevice, ids []string) []string {
+	if p == nil || !p.avoid {
+		return ids
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if len(p.pressured) == 0 {
+		return ids
+	}
+	gpus := make(map[string]string)
+	for _, vd := range vdevices {
+		gpus[vd.ID] = vd.dev.ID
+	}
+	var filtered []string
+	for _, id := range ids {
+		if !p.pressured[gpus[id]] {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered
+}
+
+// run checks the GPUs every memoryPressureInterval until stop is closed
+func (p *MemoryPressureMonitor) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(memoryPressureInterval):
+		}
+		if err := p.check(); err != nil {
+			log.Printf("Warning: failed to check the GPU memory pressure: %v", err)
+		}
+	}
+}
+
+func (p *MemoryPressureMonitor) writeMetrics(w io.Writer) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	fmt.Fprintln(w, "# HELP vgpu_device_memory_pressure 1 if the oversubscribed GPU uses more physical memory than --memory-pressure-threshold.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_memory_pressure gauge")
+	for uuid := range p.gpus {
+		value := 0
+		if p.pressured[uuid] {
+			value = 1
+		}
+		writeGauge(w, "vgpu_device_memory_pressure", uuid, value)
+	}
+}
+
+// newMemoryPressureMonitorFromFlags returns a MemoryPressureMonitor for the node of the plugin
+func newMemoryPressureMonitorFromFlags() *MemoryPressureMonitor {
+	return NewMemoryPressureMonitor(uint64(memoryPressureThresholdFlag), avoidPressuredGPUsFlag, os.Getenv("NODE_NAME"))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// httpMux serves the metrics endpoint along with any other plugin endpoints
+var httpMux = http.NewServeMux()
+
+var (
+	metricsMux        sync.Mutex
+	metricsCollectors []func(w io.Writer)
+)
+
+// registerMetrics adds a collector writing Prometheus text format to the metrics endpoint
+func registerMetrics(collector func(w io.Writer)) {
+	metricsMux.Lock()
+	defer metricsMux.Unlock()
+	metricsCollectors = append(metricsCollectors, collector)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMux.Lock()
+	collectors := make([]func(w io.Writer), len(metricsCollectors))
+	copy(collectors, metricsCollectors)
+	metricsMux.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// startHTTPServer serves httpMux on addr in the background
+func startHTTPServer(addr string) {
+	httpMux.HandleFunc("/metrics", serveMetrics)
+	go func() {
+		log.Printf("Serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, httpMux); err != nil {
+			log.Printf("Error: metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// writeGauge writes a single gauge sample with an uuid label
+func writeGauge(w io.Writer, name string, uuid string, value interface{}) {
+	fmt.Fprintf(w, "%s{uuid=%q} %v\n", name, uuid, value)
+}
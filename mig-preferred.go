@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// migParent returns the index of the GPU of a MIG device, from its "<gpu>:<mig>" index
+func migParent(d *Device) string {
+	return strings.SplitN(d.Index, ":", 2)[0]
+}
+
+// migPreferredAllocation prefers MIG devices of the same GPU: the required devices, then the
+// other devices of their GPUs, then the GPUs with the fewest available devices left, so that
+// a multi-device container stays on one GPU and the GPUs with most free devices stay whole
+func (m *NvidiaDevicePlugin) migPreferredAllocation(r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	devices := make(map[string]*Device, len(m.cachedDevices))
+	for _, d := range m.cachedDevices {
+		devices[d.ID] = d
+	}
+	response := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range r.ContainerRequests {
+		size := int(req.AllocationSize)
+		var ids []string
+		chosen := make(map[string]bool)
+		parents := make(map[string]bool)
+		for _, id := range req.MustIncludeDeviceIDs {
+			d, ok := devices[id]
+			if !ok {
+				return nil, fmt.Errorf("invalid preferred allocation request for '%s': unknown device: %s", m.resourceName, id)
+			}
+			if !chosen[id] {
+				ids = append(ids, id)
+				chosen[id] = true
+				parents[migParent(d)] = true
+			}
+		}
+
+		byParent := make(map[string][]string)
+		for _, id := range req.AvailableDeviceIDs {
+			d, ok := devices[id]
+			if !ok {
+				return nil, fmt.Errorf("invalid preferred allocation request for '%s': unknown device: %s", m.resourceName, id)
+			}
+			if !chosen[id] {
+				byParent[migParent(d)] = append(byParent[migParent(d)], id)
+			}
+		}
+		var order []string
+		for parent := range byParent {
+			order = append(order, parent)
+		}
+		sort.Slice(order, func(i, j int) bool {
+			pi, pj := order[i], order[j]
+			if parents[pi] != parents[pj] {
+				return parents[pi]
+			}
+			// A GPU with enough devices for the whole request comes before one without
+			enoughI, enoughJ := len(byParent[pi]) >= size-len(ids), len(byParent[pj]) >= size-len(ids)
+			if enoughI != enoughJ {
+				return enoughI
+			}
+			if len(byParent[pi]) != len(byParent[pj]) {
+				return len(byParent[pi]) < len(byParent[pj])
+			}
+			return pi < pj
+		})
+		for _, parent := range order {
+			for _, id := range byParent[parent] {
+				if len(ids) < size {
+					ids = append(ids, id)
+				}
+			}
+		}
+		if len(ids) > size {
+			ids = nil
+		}
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{DeviceIDs: ids})
+	}
+	return response, nil
+}
+
+// noPreferredAllocation answers the containers of the request without a preference, which
+// makes the kubelet pick the devices itself
+func noPreferredAllocation(r *pluginapi.PreferredAllocationRequest) *pluginapi.PreferredAllocationResponse {
+	response := &pluginapi.PreferredAllocationResponse{}
+	for range r.ContainerRequests {
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{})
+	}
+	return response
+}
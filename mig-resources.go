@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// migProfile is the size of the MIG devices of a profile, which the templates of
+// --mig-resource-template and --mig-socket-template refer to as %gpu%, %ci% and %mem%
+type migProfile struct {
+	// gpu is the number of GPU instance slices
+	gpu uint32
+	// ci is the number of compute instance slices
+	ci uint32
+	// mem is the memory in GB, rounded up
+	mem uint64
+}
+
+var (
+	migResourceNameFormat = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?/[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	migSocketNameFormat   = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.]*\.sock$`)
+)
+
+// getMigProfile returns the profile of a MIG device
+func getMigProfile(mig *nvml.Device) migProfile {
+	attr, err := mig.GetAttributes()
+	check(err)
+	return migProfile{
+		gpu: attr.GpuInstanceSliceCount,
+		ci:  attr.ComputeInstanceSliceCount,
+		mem: (attr.MemorySizeMB + 1024 - 1) / 1024,
+	}
+}
+
+// render replaces the placeholders of the template with the size of the profile
+func (p migProfile) render(template string) string {
+	return strings.NewReplacer(
+		"%gpu%", strconv.FormatUint(uint64(p.gpu), 10),
+		"%ci%", strconv.FormatUint(uint64(p.ci), 10),
+		"%mem%", strconv.FormatUint(p.mem, 10),
+	).Replace(template)
+}
+
+// migResourceName returns the resource name the MIG devices of the profile are advertised as
+// with --mig-strategy=mixed
+func (p migProfile) migResourceName() string {
+	return p.render(migResourceTemplateFlag)
+}
+
+// migSocket returns the socket of the plugin of the profile
+func (p migProfile) migSocket() string {
+	return devicePluginSocket(p.render(migSocketTemplateFlag))
+}
+
+// validateMigTemplates checks that the templates give a valid resource name and socket name for
+// every profile, and tell the profiles apart
+func validateMigTemplates() error {
+	for _, t := range []struct {
+		flag, template string
+		format         *regexp.Regexp
+	}{
+		{"--mig-resource-template", migResourceTemplateFlag, migResourceNameFormat},
+		{"--mig-socket-template", migSocketTemplateFlag, migSocketNameFormat},
+	} {
+		if !strings.Contains(t.template, "%gpu%") || !strings.Contains(t.template, "%mem%") {
+			return fmt.Errorf("invalid %s option: %q must contain %%gpu%% and %%mem%% to tell the MIG profiles apart", t.flag, t.template)
+		}
+		if name := (migProfile{gpu: 1, ci: 1, mem: 5}).render(t.template); !t.format.MatchString(name) {
+			return fmt.Errorf("invalid %s option: %q gives the invalid name %q", t.flag, t.template, name)
+		}
+	}
+	return nil
+}
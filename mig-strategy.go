@@ -22,7 +22,6 @@ import (
 
 	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 // Constants representing the various MIG strategies
@@ -60,13 +59,16 @@ type migStrategyMixed struct{}
 
 // migStrategyNone
 func (s *migStrategyNone) GetPlugins() []*NvidiaDevicePlugin {
+	if modelResourceNamesFlag {
+		return getModelResourcePlugins()
+	}
 	return []*NvidiaDevicePlugin{
 		NewNvidiaDevicePlugin(
-			"nvidia.com/gpu",
+			gpuResourceName(),
 			NewGpuDeviceManager(false), // Enumerate device even if MIG enabled
 			"NVIDIA_VISIBLE_DEVICES",
 			gpuallocator.NewBestEffortPolicy(),
-			pluginapi.DevicePluginPath+"nvidia-gpu.sock"),
+			gpuSocket()),
 	}
 }
 
@@ -130,7 +132,7 @@ func (s *migStrategySingle) GetPlugins() []*NvidiaDevicePlugin {
 			NewMigDeviceManager(s, "gpu"),
 			"NVIDIA_VISIBLE_DEVICES",
 			gpuallocator.Policy(nil),
-			pluginapi.DevicePluginPath+"nvidia-gpu.sock"),
+			devicePluginSocket("nvidia-gpu.sock")),
 	}
 }
 
@@ -177,6 +179,7 @@ func (s *migStrategyMixed) GetPlugins() []*NvidiaDevicePlugin {
 	if err != nil {
 		panic(fmt.Errorf("Unable to retrieve list of MIG devices: %v", err))
 	}
+	profiles := make(map[string]migProfile)
 	for _, mig := range migs {
 		r := s.getResourceName(mig)
 		if !s.validMigDevice(mig) {
@@ -184,6 +187,7 @@ func (s *migStrategyMixed) GetPlugins() []*NvidiaDevicePlugin {
 			continue
 		}
 		resources[r] = struct{}{}
+		profiles[r] = getMigProfile(mig)
 	}
 
 	plugins := []*NvidiaDevicePlugin{
@@ -192,16 +196,20 @@ func (s *migStrategyMixed) GetPlugins() []*NvidiaDevicePlugin {
 			NewGpuDeviceManager(true),
 			"NVIDIA_VISIBLE_DEVICES",
 			gpuallocator.NewBestEffortPolicy(),
-			pluginapi.DevicePluginPath+"nvidia-gpu.sock"),
+			devicePluginSocket("nvidia-gpu.sock")),
 	}
 
+	// The resource names and sockets come from the templates, the profile names stay the keys
+	// the MIG devices are matched with
 	for resource := range resources {
+		profile := profiles[resource]
+		log.Printf("Advertising the MIG devices of profile %s as '%s'", resource, profile.migResourceName())
 		plugin := NewNvidiaDevicePlugin(
-			"nvidia.com/"+resource,
+			profile.migResourceName(),
 			NewMigDeviceManager(s, resource),
 			"NVIDIA_VISIBLE_DEVICES",
 			gpuallocator.Policy(nil),
-			pluginapi.DevicePluginPath+"nvidia-"+resource+".sock")
+			profile.migSocket())
 		plugin.migStrategy = "mixed"
 		plugins = append(plugins, plugin)
 	}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 )
@@ -224,3 +226,57 @@ func GetMigDeviceNodePaths(parent *nvml.Device, mig *nvml.Device) ([]string, err
 
 	return devicePaths, nil
 }
+
+// migInstanceCapabilityPaths returns the capability device nodes of all the GPU and compute
+// instances of the MIG enabled GPU with the given capabilities of GetMigCapabilityDevicePaths.
+// A process given the whole GPU may use any of its instances. It returns nil for the GPUs with
+// MIG disabled.
+func migInstanceCapabilityPaths(capDevicePaths map[string]string, gpuPath string) []string {
+	var gpu int
+	if _, err := fmt.Sscanf(gpuPath, "/dev/nvidia%d", &gpu); err != nil {
+		return nil
+	}
+	prefix := fmt.Sprintf(nvidiaCapabilitiesPath+"/gpu%d/mig/", gpu)
+	var paths []string
+	for capPath, devicePath := range capDevicePaths {
+		if strings.HasPrefix(capPath, prefix) {
+			paths = append(paths, devicePath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// migCapDevicePaths returns the nvidia-caps device nodes giving access to the GPU and compute
+// instances of the MIG device with the given UUID, looked up when called since recreating the
+// instances of a GPU changes their minors
+func migCapDevicePaths(uuid string) ([]string, error) {
+	parentUUID, gi, ci, err := nvml.ParseMigDeviceUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := nvml.NewDeviceLiteByUUID(parentUUID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the GPU of MIG device %s: %v", uuid, err)
+	}
+	var gpu int
+	if _, err := fmt.Sscanf(parent.Path, "/dev/nvidia%d", &gpu); err != nil {
+		return nil, fmt.Errorf("error getting GPU minor: %v", err)
+	}
+	capDevicePaths, err := GetMigCapabilityDevicePaths()
+	if err != nil {
+		return nil, fmt.Errorf("error getting MIG capability device paths: %v", err)
+	}
+	var paths []string
+	for _, capPath := range []string{
+		fmt.Sprintf(nvidiaCapabilitiesPath+"/gpu%d/mig/gi%d/access", gpu, gi),
+		fmt.Sprintf(nvidiaCapabilitiesPath+"/gpu%d/mig/gi%d/ci%d/access", gpu, gi, ci),
+	} {
+		devicePath, ok := capDevicePaths[capPath]
+		if !ok {
+			return nil, fmt.Errorf("missing MIG capability path of %s: %v", uuid, capPath)
+		}
+		paths = append(paths, devicePath)
+	}
+	return paths, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// modelResourcePrefix prefixes the model-qualified resource names, e.g. nvidia.com/gpu-t4
+const modelResourcePrefix = "nvidia.com/gpu-"
+
+// modelResourceMapping maps GPUs whose product name contains product to a resource name suffix
+type modelResourceMapping struct {
+	product string
+	suffix  string
+}
+
+// modelResourceMap is the parsed --model-resource-map
+var modelResourceMap []modelResourceMapping
+
+var (
+	modelVendorPrefix = regexp.MustCompile(`^(nvidia|tesla|geforce|quadro)[ -]+`)
+	modelInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+	modelSuffixFormat = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+)
+
+// parseModelResourceMap parses "<product>=<suffix>[,<product>=<suffix>...]"
+func parseModelResourceMap(s string) ([]modelResourceMapping, error) {
+	var mappings []modelResourceMapping
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected <product>=<suffix>", entry)
+		}
+		suffix := strings.TrimSpace(kv[1])
+		if !modelSuffixFormat.MatchString(suffix) {
+			return nil, fmt.Errorf("invalid resource name suffix %q", suffix)
+		}
+		mappings = append(mappings, modelResourceMapping{product: strings.ToLower(strings.TrimSpace(kv[0])), suffix: suffix})
+	}
+	return mappings, nil
+}
+
+// modelResourceSuffix returns the resource name suffix of a product name, using the first
+// matching mapping or else the lower-cased product name without vendor prefix
+func modelResourceSuffix(product string) string {
+	name := strings.ToLower(strings.TrimSpace(product))
+	for _, m := range modelResourceMap {
+		if strings.Contains(name, m.product) {
+			return m.suffix
+		}
+	}
+	for modelVendorPrefix.MatchString(name) {
+		name = modelVendorPrefix.ReplaceAllString(name, "")
+	}
+	return strings.Trim(modelInvalidChars.ReplaceAllString(name, "-"), "-")
+}
+
+// modelResourceName returns the model-qualified resource name of the GPU with the given UUID
+func modelResourceName(uuid string) (string, error) {
+	m, err := getGPUModel(uuid)
+	if err != nil {
+		return "", err
+	}
+	suffix := modelResourceSuffix(m.name)
+	if suffix == "" {
+		return "", fmt.Errorf("GPU %s has no usable product name %q", uuid, m.name)
+	}
+	return modelResourcePrefix + suffix, nil
+}
+
+// isGPUResource returns true for the full GPU resource and its model-qualified variants
+func isGPUResource(resource string) bool {
+	return resource == gpuResourceName() || strings.HasPrefix(resource, modelResourcePrefix)
+}
+
+// getModelResourcePlugins returns one plugin per GPU model of the node
+func getModelResourcePlugins() []*NvidiaDevicePlugin {
+	n, err := nvml.GetDeviceCount()
+	check(err)
+
+	resources := make(map[string]bool)
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		check(err)
+		r, err := modelResourceName(d.UUID)
+		check(err)
+		resources[r] = true
+	}
+	var names []string
+	for r := range resources {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+
+	var plugins []*NvidiaDevicePlugin
+	for _, r := range names {
+		log.Printf("Advertising GPUs as '%s'", r)
+		plugins = append(plugins, NewNvidiaDevicePlugin(
+			r,
+			NewModelGpuDeviceManager(r),
+			"NVIDIA_VISIBLE_DEVICES",
+			gpuallocator.NewBestEffortPolicy(),
+			devicePluginSocket("nvidia-gpu-"+strings.TrimPrefix(r, modelResourcePrefix)+".sock")))
+	}
+	return plugins
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	monitorapi "github.com/NVIDIA/k8s-device-plugin/api/monitor/v1alpha1"
+)
+
+// monitorTimeout bounds a call to the monitor in Allocate
+const monitorTimeout = 2 * time.Second
+
+// vgpuMonitor is non-nil when --monitor-socket is set
+var vgpuMonitor *VGPUMonitorClient
+
+// VGPUMonitorClient asks the vgpu-monitor for the shared cache directories of the containers,
+// so that Allocate does not need to look the pod up to name them
+type VGPUMonitorClient struct {
+	socket string
+	client *monitorapi.MonitorClient
+}
+
+// NewVGPUMonitorClient returns a client of the monitor serving on the unix socket. The
+// connection is established lazily.
+func NewVGPUMonitorClient(socket string) (*VGPUMonitorClient, error) {
+	conn, err := grpc.Dial(strings.TrimPrefix(socket, "unix://"), grpc.WithInsecure(), grpc.WithContextDialer(dialUnix))
+	if err != nil {
+		return nil, err
+	}
+	return &VGPUMonitorClient{
+		socket: socket,
+		client: monitorapi.NewMonitorClient(conn),
+	}, nil
+}
+
+// createCacheDir returns the host directory the monitor created for the container
+func (c *VGPUMonitorClient) createCacheDir(ctx context.Context, a *containerAllocation, numaNode int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, monitorTimeout)
+	defer cancel()
+	resp, err := c.client.CreateCacheDir(ctx, &monitorapi.CreateCacheDirRequest{
+		ResourceName: a.plugin.resourceName,
+		DeviceUUIDs:  a.uuids,
+		NUMANode:     numaNode,
+	})
+	if err != nil {
+		return "", fmt.Errorf("vgpu-monitor %s: %v", c.socket, err)
+	}
+	return resp.HostPath, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Modes of --monitor-mode
+const (
+	// monitorModeOff keeps the shared cache of libvgpu in the container /tmp
+	monitorModeOff = "off"
+	// monitorModeSharedCache keeps the shared cache of each container in a host directory, where
+	// a monitor can read the usage of the container
+	monitorModeSharedCache = "shared-cache"
+	// monitorModeFullMetrics also exports the GPU memory used by each pod on --metrics-address
+	monitorModeFullMetrics = "full-metrics"
+)
+
+// validMonitorMode returns true if mode is one of the modes of --monitor-mode
+func validMonitorMode(mode string) bool {
+	switch mode {
+	case monitorModeOff, monitorModeSharedCache, monitorModeFullMetrics:
+		return true
+	}
+	return false
+}
+
+// monitorModeFromEnv returns the mode set with the deprecated VGPU_MONITOR_MODE, which enabled
+// the shared cache whatever its value
+func monitorModeFromEnv() string {
+	value := os.Getenv("VGPU_MONITOR_MODE")
+	if value == "" {
+		return monitorModeOff
+	}
+	log.Printf("Warning: VGPU_MONITOR_MODE is deprecated, use --monitor-mode")
+	if validMonitorMode(value) {
+		return value
+	}
+	return monitorModeSharedCache
+}
+
+// sharedCacheEnabled returns true if the containers get a host directory for their shared cache
+func sharedCacheEnabled() bool {
+	return monitorModeFlag != monitorModeOff || vgpuMonitor != nil
+}
+
+// checkSharedCacheRoot fails if the plugin cannot create the shared cache directories of
+// --monitor-mode, typically because sharedCacheRoot is not mounted from the host
+func checkSharedCacheRoot() error {
+	if err := os.MkdirAll(sharedCacheRoot, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(sharedCacheRoot, ".check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// writePodUsageMetrics exports the GPU memory used by the processes of each pod
+func writePodUsageMetrics(w io.Writer) {
+	s, err := sampleUsage()
+	if err != nil {
+		log.Printf("Error: failed to sample the GPU usage of the pods: %v", err)
+		return
+	}
+	fmt.Fprintln(w, "# HELP vgpu_pod_memory_used Memory of the GPU in MiB used by the processes of the pod.")
+	fmt.Fprintln(w, "# TYPE vgpu_pod_memory_used gauge")
+	for _, u := range s.Pods {
+		fmt.Fprintf(w, "vgpu_pod_memory_used{pod=%q,uuid=%q} %d\n", u.Pod, u.GPU, u.MemoryUsed)
+	}
+}
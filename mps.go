@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	mpsRootDir           = "/usr/local/vgpu/mps"
+	mpsContainerPipeDir  = "/tmp/nvidia-mps"
+	mpsContainerLogDir   = "/tmp/nvidia-log"
+	mpsControlBinaryName = "nvidia-cuda-mps-control"
+	// mpsPidFile is written by the control daemon in its pipe directory
+	mpsPidFile = "nvidia-cuda-mps-control.pid"
+)
+
+// mpsReconcilePeriod is how often the daemons of the GPUs without allocated vDevices are stopped
+const mpsReconcilePeriod = 30 * time.Second
+
+// mpsAllocateGrace keeps the daemon of a container not in the kubelet checkpoint yet, which the
+// kubelet writes after Allocate returns
+const mpsAllocateGrace = time.Minute
+
+// mpsManager is non-nil when --enable-mps is set
+var mpsManager *MpsManager
+
+// mpsDaemon describes a running MPS control daemon bound to one physical GPU
+type mpsDaemon struct {
+	uuid    string
+	pipeDir string
+	logDir  string
+	// allocated is the last time a container was given the daemon
+	allocated time.Time
+}
+
+// MpsManager starts one MPS control daemon per shared physical GPU. The daemons outlive the
+// plugin, which adopts them again when it restarts, and are stopped once their GPU has no
+// allocated vDevices left.
+type MpsManager struct {
+	mux     sync.Mutex
+	root    string
+	daemons map[string]*mpsDaemon
+}
+
+// NewMpsManager returns a reference to a new MpsManager keeping its state under root, adopting
+// the daemons started there by a previous run of the plugin
+func NewMpsManager(root string) *MpsManager {
+	m := &MpsManager{
+		root:    root,
+		daemons: make(map[string]*mpsDaemon),
+	}
+	m.adopt()
+	return m
+}
+
+func (m *MpsManager) newDaemon(uuid string) *mpsDaemon {
+	return &mpsDaemon{
+		uuid:    uuid,
+		pipeDir: filepath.Join(m.root, uuid, "pipe"),
+		logDir:  filepath.Join(m.root, uuid, "log"),
+	}
+}
+
+// running returns true if the control daemon of the pid file of its pipe directory is alive
+func (d *mpsDaemon) running() bool {
+	data, err := ioutil.ReadFile(filepath.Join(d.pipeDir, mpsPidFile))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// adopt takes over the running daemons of the root directory and removes the directories of
+// the daemons that exited
+func (m *MpsManager) adopt() {
+	entries, err := ioutil.ReadDir(m.root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to adopt the MPS daemons of %s: %v", m.root, err)
+		}
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		d := m.newDaemon(e.Name())
+		if !d.running() {
+			os.RemoveAll(filepath.Join(m.root, d.uuid))
+			continue
+		}
+		d.allocated = time.Now()
+		m.daemons[d.uuid] = d
+		log.Printf("Adopted the MPS daemon of %s", d.uuid)
+	}
+}
+
+func (d *mpsDaemon) env() []string {
+	return append(os.Environ(),
+		"CUDA_VISIBLE_DEVICES="+d.uuid,
+		"CUDA_MPS_PIPE_DIRECTORY="+d.pipeDir,
+		"CUDA_MPS_LOG_DIRECTORY="+d.logDir,
+	)
+}
+
+// ensure starts the MPS control daemon for the GPU if it is not running yet
+func (m *MpsManager) ensure(uuid string) (*mpsDaemon, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if d, ok := m.daemons[uuid]; ok {
+		d.allocated = time.Now()
+		return d, nil
+	}
+	d := m.newDaemon(uuid)
+	for _, dir := range []string{d.pipeDir, d.logDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	cmd := exec.Command(mpsControlBinaryName, "-d")
+	cmd.Env = d.env()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to start MPS daemon on %s: %v: %s", uuid, err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("Started MPS daemon on %s", uuid)
+	d.allocated = time.Now()
+	m.daemons[uuid] = d
+	return d, nil
+}
+
+// stopLocked shuts down the MPS control daemon of the GPU, if any. The caller holds m.mux.
+func (m *MpsManager) stopLocked(uuid string) {
+	d, ok := m.daemons[uuid]
+	if !ok {
+		return
+	}
+	cmd := exec.Command(mpsControlBinaryName)
+	cmd.Env = d.env()
+	cmd.Stdin = strings.NewReader("quit\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Error: failed to stop MPS daemon on %s: %v: %s", uuid, err, strings.TrimSpace(string(out)))
+	} else {
+		log.Printf("Stopped MPS daemon on %s", uuid)
+	}
+	os.RemoveAll(filepath.Join(m.root, uuid))
+	delete(m.daemons, uuid)
+}
+
+// reconcile stops the daemons of the GPUs no pod has vDevices of, users being the pods using
+// each GPU according to the kubelet checkpoint
+func (m *MpsManager) reconcile(users map[string]map[string]bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for uuid, d := range m.daemons {
+		if len(users[uuid]) == 0 && time.Since(d.allocated) > mpsAllocateGrace {
+			log.Printf("GPU %s has no allocated vDevices left, stopping its MPS daemon", uuid)
+			m.stopLocked(uuid)
+		}
+	}
+}
+
+// run periodically stops the daemons of the drained GPUs
+func (m *MpsManager) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(mpsReconcilePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		users, err := gpuPods()
+		if err != nil {
+			log.Printf("Warning: failed to read the GPUs in use to stop the MPS daemons: %v", err)
+			continue
+		}
+		m.reconcile(users)
+	}
+}
+
+// allocate starts the MPS daemon backing a container and returns the envs and mounts it needs.
+// MPS clients can only talk to one control daemon, so multi-GPU containers are left alone.
+func (m *MpsManager) allocate(uuids []string) (map[string]string, []*pluginapi.Mount, error) {
+	if len(uuids) != 1 {
+		if len(uuids) > 1 {
+			log.Printf("Warning: MPS is not used for containers with %d GPUs", len(uuids))
+		}
+		return nil, nil, nil
+	}
+	d, err := m.ensure(uuids[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	envs := map[string]string{
+		"CUDA_MPS_PIPE_DIRECTORY": mpsContainerPipeDir,
+		"CUDA_MPS_LOG_DIRECTORY":  mpsContainerLogDir,
+	}
+	mounts := []*pluginapi.Mount{
+		&pluginapi.Mount{ContainerPath: mpsContainerPipeDir, HostPath: d.pipeDir, ReadOnly: false},
+		&pluginapi.Mount{ContainerPath: mpsContainerLogDir, HostPath: d.logDir, ReadOnly: false},
+	}
+	return envs, mounts, nil
+}
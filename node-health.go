@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const nodeConditionGPUHealthy v1.NodeConditionType = "GPUHealthy"
+
+// nodeHealthReporter is non-nil when --report-node-health is set
+var nodeHealthReporter *NodeHealthReporter
+
+// NodeHealthReporter publishes the aggregated GPU health of the node as a
+// node condition and, optionally, a taint
+type NodeHealthReporter struct {
+	mux      sync.Mutex
+	nodeName string
+	taint    *v1.Taint
+	healthy  *bool
+}
+
+// NewNodeHealthReporter returns a reference to a new NodeHealthReporter; taint may be nil
+func NewNodeHealthReporter(nodeName string, taint *v1.Taint) *NodeHealthReporter {
+	return &NodeHealthReporter{
+		nodeName: nodeName,
+		taint:    taint,
+	}
+}
+
+// parseTaint parses a taint in the "key[=value]:effect" form
+func parseTaint(s string) (*v1.Taint, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid taint %q, expected key[=value]:effect", s)
+	}
+	effect := v1.TaintEffect(parts[1])
+	if effect != v1.TaintEffectNoSchedule && effect != v1.TaintEffectPreferNoSchedule && effect != v1.TaintEffectNoExecute {
+		return nil, fmt.Errorf("invalid taint effect %q", parts[1])
+	}
+	kv := strings.SplitN(parts[0], "=", 2)
+	if kv[0] == "" {
+		return nil, fmt.Errorf("invalid taint %q, empty key", s)
+	}
+	taint := &v1.Taint{Key: kv[0], Effect: effect}
+	if len(kv) == 2 {
+		taint.Value = kv[1]
+	}
+	return taint, nil
+}
+
+// allDevicesUnhealthy returns true if devices is not empty and none of them is healthy
+func allDevicesUnhealthy(devices []*Device) bool {
+	for _, d := range devices {
+		if health, _ := d.health(); health != pluginapi.Unhealthy {
+			return false
+		}
+	}
+	return len(devices) > 0
+}
+
+// update sets the node condition and taint if the GPU health of the node changed
+func (r *NodeHealthReporter) update(healthy bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.healthy != nil && *r.healthy == healthy {
+		return
+	}
+	if err := r.apply(healthy); err != nil {
+		log.Printf("Error: failed to report node GPU health: %v", err)
+		return
+	}
+	r.healthy = &healthy
+}
+
+// apply sets the node condition and taint, reading the node again when another client
+// updated it in between
+func (r *NodeHealthReporter) apply(healthy bool) error {
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	nodes := client.CoreV1().Nodes()
+
+	condition := v1.NodeCondition{
+		Type:               nodeConditionGPUHealthy,
+		Status:             v1.ConditionTrue,
+		LastHeartbeatTime:  metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+		Reason:             "GPUsHealthy",
+		Message:            "at least one GPU is healthy",
+	}
+	if !healthy {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = "AllGPUsUnhealthy"
+		condition.Message = "all GPUs on the node are unhealthy"
+	}
+	err = retryOnConflict(func() error {
+		node, err := nodes.Get(ctx, r.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		found := false
+		for i, c := range node.Status.Conditions {
+			if c.Type == nodeConditionGPUHealthy {
+				node.Status.Conditions[i] = condition
+				found = true
+			}
+		}
+		if !found {
+			node.Status.Conditions = append(node.Status.Conditions, condition)
+		}
+		_, err = nodes.UpdateStatus(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil || r.taint == nil {
+		return err
+	}
+
+	return retryOnConflict(func() error {
+		node, err := nodes.Get(ctx, r.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var taints []v1.Taint
+		tainted := false
+		for _, t := range node.Spec.Taints {
+			if t.MatchTaint(r.taint) {
+				tainted = true
+				if healthy {
+					continue
+				}
+			}
+			taints = append(taints, t)
+		}
+		if healthy == !tainted {
+			return nil
+		}
+		if !healthy {
+			taints = append(taints, *r.taint)
+		}
+		node.Spec.Taints = taints
+		_, err = nodes.Update(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// newNodeHealthReporterFromFlags builds the reporter from the command line flags
+func newNodeHealthReporterFromFlags() (*NodeHealthReporter, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME must be set to report node GPU health")
+	}
+	var taint *v1.Taint
+	if unhealthyTaintFlag != "" {
+		var err error
+		taint, err = parseTaint(unhealthyTaintFlag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewNodeHealthReporter(nodeName, taint), nil
+}
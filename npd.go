@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Reasons written to the node-problem-detector log, matched by deployments/npd/vgpu-monitor.json
+const (
+	npdReasonXid         = "GPUXidError"
+	npdReasonFellOffBus  = "GPUFellOffBus"
+	npdReasonECC         = "GPUECCError"
+	npdReasonNVLink      = "GPUNVLinkError"
+	npdReasonUnsupported = "GPUHealthCheckUnsupported"
+	npdReasonStatusQuery = "GPUStatusQueryFailed"
+)
+
+const npdTimestampFormat = "2006-01-02T15:04:05Z"
+
+// npdLogger is non-nil when --npd-log-file is set
+var npdLogger *NpdLogger
+
+// NpdLogger appends GPU faults to a log file watched by the node-problem-detector filelog plugin,
+// rotating the file when it grows past maxSize
+type NpdLogger struct {
+	mux        sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+}
+
+// NewNpdLogger returns a reference to a new NpdLogger writing to path; maxSizeMB of 0 disables rotation
+func NewNpdLogger(path string, maxSizeMB int, maxBackups int) (*NpdLogger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &NpdLogger{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}, nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest backup. The filelog plugin follows the
+// new file at path.
+func (l *NpdLogger) rotate() {
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxBackups > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+}
+
+func (l *NpdLogger) report(reason string, uuid string, message string) {
+	line := fmt.Sprintf("%s vgpu-device-plugin: %s: device=%s %s\n", time.Now().UTC().Format(npdTimestampFormat), reason, uuid, message)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if info, err := os.Stat(l.path); err == nil && l.maxSize > 0 && info.Size()+int64(len(line)) > l.maxSize {
+		l.rotate()
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error: failed to open NPD log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line); err != nil {
+		log.Printf("Error: failed to write NPD log: %v", err)
+	}
+}
+
+// reportGPUFault forwards a GPU fault to node-problem-detector if enabled
+func reportGPUFault(reason string, uuid string, format string, args ...interface{}) {
+	if npdLogger == nil {
+		return
+	}
+	npdLogger.report(reason, uuid, fmt.Sprintf(format, args...))
+}
+
+// xidReason maps an Xid to the reason reported to node-problem-detector
+func xidReason(xid uint64) string {
+	switch xid {
+	case 79:
+		return npdReasonFellOffBus
+	case 48, 63, 64, 94, 95:
+		return npdReasonECC
+	case 74:
+		return npdReasonNVLink
+	}
+	return npdReasonXid
+}
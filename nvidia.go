@@ -21,6 +21,8 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 
@@ -35,19 +37,66 @@ const (
 // Device couples an underlying pluginapi.Device type with its device node paths
 type Device struct {
 	pluginapi.Device
-	Paths []string
-	Index string
+	Paths        []string
+	Index        string
+	HealthReason string
+	// healthMux guards Health and HealthReason, which ListAndWatch changes while the status,
+	// VGPUNode and node health goroutines read them
+	healthMux sync.RWMutex
+}
+
+// setHealth records a health change of the device
+func (d *Device) setHealth(health, reason string) {
+	d.healthMux.Lock()
+	defer d.healthMux.Unlock()
+	d.Health = health
+	d.HealthReason = reason
+}
+
+// health returns the health of the device and its cause
+func (d *Device) health() (string, string) {
+	d.healthMux.RLock()
+	defer d.healthMux.RUnlock()
+	return d.Health, d.HealthReason
+}
+
+// apiDevice returns a copy of the device as advertised to the kubelet
+func (d *Device) apiDevice() *pluginapi.Device {
+	d.healthMux.RLock()
+	defer d.healthMux.RUnlock()
+	dev := d.Device
+	return &dev
+}
+
+// DeviceHealth is a health change of a device along with its cause
+type DeviceHealth struct {
+	Device *Device
+	Health string
+	Reason string
+}
+
+// unhealthyEvent returns a DeviceHealth marking d unhealthy for the given reason
+func unhealthyEvent(d *Device, format string, args ...interface{}) *DeviceHealth {
+	return &DeviceHealth{
+		Device: d,
+		Health: pluginapi.Unhealthy,
+		Reason: fmt.Sprintf(format, args...),
+	}
 }
 
 // ResourceManager provides an interface for listing a set of Devices and checking health on them
 type ResourceManager interface {
 	Devices() []*Device
-	CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device)
+	CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth)
 }
 
 // GpuDeviceManager implements the ResourceManager interface for full GPU devices
 type GpuDeviceManager struct {
 	skipMigEnabledGPUs bool
+	// modelResource restricts the devices to the GPUs with this model-qualified resource name
+	modelResource string
+	// confidential selects the GPUs in confidential computing mode instead of the others
+	confidential bool
 }
 
 // MigDeviceManager implements the ResourceManager interface for MIG devices
@@ -69,6 +118,13 @@ func NewGpuDeviceManager(skipMigEnabledGPUs bool) *GpuDeviceManager {
 	}
 }
 
+// NewModelGpuDeviceManager returns a reference to a new GpuDeviceManager for the GPUs of one model
+func NewModelGpuDeviceManager(resource string) *GpuDeviceManager {
+	return &GpuDeviceManager{
+		modelResource: resource,
+	}
+}
+
 // NewMigDeviceManager returns a reference to a new MigDeviceManager
 func NewMigDeviceManager(strategy MigStrategy, resource string) *MigDeviceManager {
 	return &MigDeviceManager{
@@ -79,25 +135,64 @@ func NewMigDeviceManager(strategy MigStrategy, resource string) *MigDeviceManage
 
 // Devices returns a list of devices from the GpuDeviceManager
 func (g *GpuDeviceManager) Devices() []*Device {
-	n, err := nvml.GetDeviceCount()
+	n, err := gpuLibrary.deviceCount()
 	check(err)
 
-	var devs []*Device
+	// Query the GPUs concurrently, NVML calls on different devices do not serialize
+	found := make([]*Device, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
 	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDeviceLite(i)
-		check(err)
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			found[i], errs[i] = g.device(i)
+		}(i)
+	}
+	wg.Wait()
 
-		migEnabled, err := d.IsMigEnabled()
-		check(err)
+	var devs []*Device
+	for i := range found {
+		check(errs[i])
+		if found[i] != nil {
+			devs = append(devs, found[i])
+		}
+	}
 
-		if migEnabled && g.skipMigEnabledGPUs {
-			continue
+	return devs
+}
+
+// device returns the GPU at index i, or nil if the GpuDeviceManager does not serve it
+func (g *GpuDeviceManager) device(i uint) (*Device, error) {
+	d, migEnabled, err := gpuLibrary.deviceAt(i)
+	if err != nil {
+		return nil, err
+	}
+
+	if migEnabled && g.skipMigEnabledGPUs {
+		return nil, nil
+	}
+
+	if g.modelResource != "" {
+		r, err := modelResourceName(d.UUID)
+		if err != nil {
+			return nil, err
 		}
+		if r != g.modelResource {
+			return nil, nil
+		}
+	}
 
-		devs = append(devs, buildDevice(d, []string{d.Path}, fmt.Sprintf("%v", i)))
+	if isExcludedDevice(d.UUID, i) {
+		log.Printf("Excluding GPU %v (%s) by VGPUConfig", i, d.UUID)
+		return nil, nil
 	}
 
-	return devs
+	if isConfidentialGPU(d.UUID) != g.confidential {
+		return nil, nil
+	}
+
+	return buildDevice(d, []string{d.Path}, fmt.Sprintf("%v", i)), nil
 }
 
 // Devices returns a list of devices from the MigDeviceManager
@@ -136,12 +231,12 @@ func (m *MigDeviceManager) Devices() []*Device {
 }
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
-func (g *GpuDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+func (g *GpuDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth) {
 	checkHealth(stop, devices, unhealthy)
 }
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
-func (m *MigDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+func (m *MigDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth) {
 	checkHealth(stop, devices, unhealthy)
 }
 
@@ -163,13 +258,24 @@ func buildDevice(d *nvml.Device, paths []string, index string) *Device {
 	return &dev
 }
 
-func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth) {
 	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
 	if disableHealthChecks == "all" {
 		disableHealthChecks = allHealthChecks
 	}
+	status := newStatusChecker(devices)
 	if strings.Contains(disableHealthChecks, "xids") {
-		return
+		if healthCheckDepthFlag != healthCheckFull {
+			return
+		}
+		for {
+			status.check(unhealthy)
+			select {
+			case <-stop:
+				return
+			case <-time.After(healthCheckIntervalFlag):
+			}
+		}
 	}
 
 	eventSet := nvml.NewEventSet()
@@ -184,7 +290,8 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		err = nvml.RegisterEventForDevice(eventSet, nvml.XidCriticalError, gpu)
 		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
 			log.Printf("Warning: %s is too old to support healthchecking: %s. Marking it unhealthy.", d.ID, err)
-			unhealthy <- d
+			reportGPUFault(npdReasonUnsupported, d.ID, "health checking not supported: %s", err)
+			unhealthy <- unhealthyEvent(d, "health checking not supported: %s", err)
 			continue
 		}
 		check(err)
@@ -197,7 +304,14 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		default:
 		}
 
-		e, err := nvml.WaitForEvent(eventSet, 5000)
+		status.check(unhealthy)
+		e, err := nvml.WaitForEvent(eventSet, uint(healthCheckIntervalFlag/time.Millisecond))
+		if isNVMLStale(err) {
+			// Waiting again would fail immediately, let the main loop re-initialize NVML
+			log.Printf("Warning: NVML handles went stale: %v", err)
+			reportNVMLLost(err)
+			return
+		}
 		if err != nil && e.Etype != nvml.XidCriticalError {
 			continue
 		}
@@ -213,7 +327,8 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 			// All devices are unhealthy
 			log.Printf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Edata)
 			for _, d := range devices {
-				unhealthy <- d
+				reportGPUFault(xidReason(e.Edata), d.ID, "Xid=%d", e.Edata)
+				unhealthy <- unhealthyEvent(d, "XidCriticalError: Xid=%d on all devices", e.Edata)
 			}
 			continue
 		}
@@ -230,7 +345,8 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 
 			if gpu == *e.UUID && gi == *e.GpuInstanceId && ci == *e.ComputeInstanceId {
 				log.Printf("XidCriticalError: Xid=%d on Device=%s, the device will go unhealthy.", e.Edata, d.ID)
-				unhealthy <- d
+				reportGPUFault(xidReason(e.Edata), d.ID, "Xid=%d", e.Edata)
+				unhealthy <- unhealthyEvent(d, "XidCriticalError: Xid=%d", e.Edata)
 			}
 		}
 	}
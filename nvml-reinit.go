@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+const (
+	nvmlReinitInterval = 5 * time.Second
+	nvmlReinitTimeout  = 5 * time.Minute
+)
+
+// nvmlLost is signaled when NVML handles went stale, e.g. the driver was reloaded underneath the plugin
+var nvmlLost = make(chan string, 1)
+
+// isNVMLStale returns true if an NVML error means its handles are no longer usable
+func isNVMLStale(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, s := range []string{"GPU is lost", "Driver Not Loaded", "Uninitialized", "Unknown Error"} {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportNVMLLost asks the main loop to re-initialize NVML, at most once until it does
+func reportNVMLLost(err error) {
+	select {
+	case nvmlLost <- err.Error():
+	default:
+	}
+}
+
+// reinitNVML shuts NVML down and initializes it again, waiting for the driver to come back
+func reinitNVML() error {
+	log.Println("Shutdown of NVML returned:", nvml.Shutdown())
+	deadline := time.Now().Add(nvmlReinitTimeout)
+	for {
+		err := nvml.Init()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("failed to re-initialize NVML: %v", err)
+		}
+		log.Printf("Warning: failed to re-initialize NVML, retrying: %v", err)
+		time.Sleep(nvmlReinitInterval)
+	}
+
+	// A new driver may report other attributes, query the GPUs again
+	gpuModelsMux.Lock()
+	gpuModels = make(map[string]*gpuModel)
+	gpuModelsMux.Unlock()
+	if deviceCacheFileFlag != "" {
+		loadDeviceCache(deviceCacheFileFlag)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// Eviction policies of libvgpu for the memory of oversubscribing containers
+const (
+	// evictPolicyLRU moves the least recently used allocations to host memory first
+	evictPolicyLRU = "lru"
+	// evictPolicyFIFO moves the oldest allocations to host memory first
+	evictPolicyFIFO = "fifo"
+	// evictPolicyNone leaves the page migration to the unified memory driver
+	evictPolicyNone = "none"
+)
+
+// validEvictPolicy returns true if libvgpu knows the eviction policy
+func validEvictPolicy(policy string) bool {
+	switch policy {
+	case evictPolicyLRU, evictPolicyFIFO, evictPolicyNone:
+		return true
+	}
+	return false
+}
+
+// oversubscriptionEnvs returns the environment tuning how libvgpu evicts the memory of a
+// container opted into oversubscription
+func oversubscriptionEnvs() map[string]string {
+	return map[string]string{
+		"CUDA_OVERSUBSCRIBE":                 "true",
+		"CUDA_OVERSUBSCRIBE_EVICT_WATERMARK": strconv.Itoa(oversubscribeEvictWatermarkFlag),
+		"CUDA_OVERSUBSCRIBE_EVICT_POLICY":    oversubscribeEvictPolicyFlag,
+	}
+}
+
+// writeOversubscriptionMetrics exports the physical, granted and used memory of each GPU, to
+// tune --device-memory-scaling from the actual usage
+func writeOversubscriptionMetrics(w io.Writer) {
+	used := make(map[string]uint64)
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		log.Printf("Error: failed to count GPUs: %v", err)
+		return
+	}
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		if err != nil {
+			if isNVMLStale(err) {
+				reportNVMLLost(err)
+			}
+			return
+		}
+		status, err := d.Status()
+		if err != nil || status.Memory.Global.Used == nil {
+			continue
+		}
+		used[d.UUID] = *status.Memory.Global.Used
+	}
+
+	var devices []deviceStatus
+	for _, p := range getAdminPlugins() {
+		devices = append(devices, p.deviceStatuses(nil)...)
+	}
+	fmt.Fprintln(w, "# HELP vgpu_device_memory_physical Physical memory of the GPU in MiB.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_memory_physical gauge")
+	for _, d := range devices {
+		if d.MemoryTotal > 0 {
+			writeGauge(w, "vgpu_device_memory_physical", d.UUID, d.MemoryTotal)
+		}
+	}
+	fmt.Fprintln(w, "# HELP vgpu_device_memory_granted Memory in MiB of the vDevices of the GPU assigned to containers, scaled by --device-memory-scaling.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_memory_granted gauge")
+	for _, d := range devices {
+		if d.MemoryTotal > 0 {
+			writeGauge(w, "vgpu_device_memory_granted", d.UUID, d.MemoryGranted)
+		}
+	}
+	fmt.Fprintln(w, "# HELP vgpu_device_memory_used Memory of the GPU in MiB actually used, as reported by NVML.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_memory_used gauge")
+	for _, d := range devices {
+		if memory, ok := used[d.UUID]; ok {
+			writeGauge(w, "vgpu_device_memory_used", d.UUID, memory)
+		}
+	}
+}
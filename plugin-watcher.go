@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// The types below mirror k8s.io/kubelet/pkg/apis/pluginregistration/v1, which
+// is not part of the vendored kubelet module. They are wire compatible with the
+// kubelet plugin watcher.
+
+const pluginTypeDevicePlug = "DevicePlugin"
+
+// pluginInfo is the message sent to kubelet as a response to GetInfo
+type pluginInfo struct {
+	Type              string   `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Name              string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Endpoint          string   `protobuf:"bytes,3,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
+	SupportedVersions []string `protobuf:"bytes,4,rep,name=supported_versions,json=supportedVersions,proto3" json:"supported_versions,omitempty"`
+}
+
+func (m *pluginInfo) Reset()         { *m = pluginInfo{} }
+func (m *pluginInfo) String() string { return proto.CompactTextString(m) }
+func (*pluginInfo) ProtoMessage()    {}
+
+// registrationStatus is the message sent by kubelet once the plugin is (un)registered
+type registrationStatus struct {
+	PluginRegistered bool   `protobuf:"varint,1,opt,name=plugin_registered,json=pluginRegistered,proto3" json:"plugin_registered,omitempty"`
+	Error            string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (m *registrationStatus) Reset()         { *m = registrationStatus{} }
+func (m *registrationStatus) String() string { return proto.CompactTextString(m) }
+func (*registrationStatus) ProtoMessage()    {}
+
+type registrationStatusResponse struct{}
+
+func (m *registrationStatusResponse) Reset()         { *m = registrationStatusResponse{} }
+func (m *registrationStatusResponse) String() string { return proto.CompactTextString(m) }
+func (*registrationStatusResponse) ProtoMessage()    {}
+
+type infoRequest struct{}
+
+func (m *infoRequest) Reset()         { *m = infoRequest{} }
+func (m *infoRequest) String() string { return proto.CompactTextString(m) }
+func (*infoRequest) ProtoMessage()    {}
+
+type pluginRegistrationServer interface {
+	GetInfo(context.Context, *infoRequest) (*pluginInfo, error)
+	NotifyRegistrationStatus(context.Context, *registrationStatus) (*registrationStatusResponse, error)
+}
+
+var pluginRegistrationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pluginregistration.Registration",
+	HandlerType: (*pluginRegistrationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetInfo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(infoRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(pluginRegistrationServer).GetInfo(ctx, in)
+			},
+		},
+		{
+			MethodName: "NotifyRegistrationStatus",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(registrationStatus)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(pluginRegistrationServer).NotifyRegistrationStatus(ctx, in)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// pluginWatcherRegistration answers the kubelet plugin watcher on behalf of a device plugin
+type pluginWatcherRegistration struct {
+	plugin *NvidiaDevicePlugin
+	socket string
+	server *grpc.Server
+}
+
+// GetInfo returns the device plugin endpoint and the API versions it serves
+func (r *pluginWatcherRegistration) GetInfo(context.Context, *infoRequest) (*pluginInfo, error) {
+	var versions []string
+	for _, api := range devicePluginAPIs {
+		versions = append(versions, api.version)
+	}
+	return &pluginInfo{
+		Type:              pluginTypeDevicePlug,
+		Name:              r.plugin.resourceName,
+		Endpoint:          r.plugin.socket,
+		SupportedVersions: versions,
+	}, nil
+}
+
+// NotifyRegistrationStatus logs the registration outcome reported by kubelet
+func (r *pluginWatcherRegistration) NotifyRegistrationStatus(ctx context.Context, status *registrationStatus) (*registrationStatusResponse, error) {
+	setProbeRegistered(r.plugin.resourceName, status.PluginRegistered)
+	if status.PluginRegistered {
+		log.Printf("Registered device plugin for '%s' through the plugin watcher", r.plugin.resourceName)
+	} else {
+		log.Printf("Error: plugin watcher registration for '%s' failed: %s", r.plugin.resourceName, status.Error)
+	}
+	return &registrationStatusResponse{}, nil
+}
+
+// pluginWatcherSocket returns the registration socket path for a resource name
+func pluginWatcherSocket(resourceName string) string {
+	name := strings.NewReplacer("/", "-", ".", "-").Replace(resourceName)
+	// The plugin registry is next to the device plugin directory in the kubelet root
+	return filepath.Join(filepath.Dir(filepath.Clean(devicePluginDir)), "plugins_registry", name+"-reg.sock")
+}
+
+// startPluginWatcherRegistration serves the registration service in the kubelet plugin registry
+func startPluginWatcherRegistration(m *NvidiaDevicePlugin) (*pluginWatcherRegistration, error) {
+	r := &pluginWatcherRegistration{
+		plugin: m,
+		socket: pluginWatcherSocket(m.resourceName),
+		server: grpc.NewServer(),
+	}
+	os.Remove(r.socket)
+	sock, err := net.Listen("unix", r.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", r.socket, err)
+	}
+	r.server.RegisterService(&pluginRegistrationServiceDesc, r)
+	go func() {
+		if err := r.server.Serve(sock); err != nil {
+			log.Printf("Plugin watcher registration server for '%s' stopped: %v", m.resourceName, err)
+		}
+	}()
+	return r, nil
+}
+
+// stop stops the registration server, which makes kubelet deregister the plugin
+func (r *pluginWatcherRegistration) stop() {
+	r.server.Stop()
+	os.Remove(r.socket)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Pod annotations overriding the per vGPU limits, set by users or by the vgpu-webhook defaults
+const (
+	annMemoryLimit = "4paradigm.com/vgpu-memory"
+	annCoresLimit  = "4paradigm.com/vgpu-cores"
+)
+
+// annMemoryPercentage requests the memory limit of each vGPU in percent of the physical memory of its GPU
+const annMemoryPercentage = "nvidia.com/gpumem-percentage"
+
+// annMemoryGranted records the memory limits in MiB applied to the containers of a pod
+const annMemoryGranted = "4paradigm.com/vgpu-memory-granted"
+
+// annOversubscribe opts a pod into memory oversubscription on nodes with --device-memory-scaling
+// above 1: its vGPUs may exceed their share of the physical memory, backed by unified memory
+const annOversubscribe = "4paradigm.com/vgpu-oversubscribe"
+
+// defaultDeviceMemory is the parsed --default-device-memory, either in MiB or in percent of the card
+type defaultDeviceMemory struct {
+	mib     uint64
+	percent uint64
+}
+
+var defaultMemory defaultDeviceMemory
+
+// parseDefaultDeviceMemory parses a memory size (see parseMemoryMiB) or "<percent>%"
+func parseDefaultDeviceMemory(s string) (defaultDeviceMemory, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(s, "%"), 10, 64)
+		if err != nil || percent == 0 || percent > 100 {
+			return defaultDeviceMemory{}, fmt.Errorf("percentage must be between 1%% and 100%%: %q", s)
+		}
+		return defaultDeviceMemory{percent: percent}, nil
+	}
+	mib, err := parseMemoryMiB(s)
+	if err != nil || mib == 0 {
+		return defaultDeviceMemory{}, fmt.Errorf("expected a positive memory size or a percentage: %q", s)
+	}
+	return defaultDeviceMemory{mib: mib}, nil
+}
+
+// podLookupEnabled returns true if Allocate needs to resolve the pod it allocates for
+func podLookupEnabled() bool {
+	return (monitorModeFlag != monitorModeOff && vgpuMonitor == nil) || gpuTuner != nil || podAnnotationsFlag || deviceMemoryScalingFlag > 1 || namespaceQuotaFlag || rdmaResourcesFlag != "" || externalAllocator != nil || constraints != nil || reservations != nil || len(vmRuntimeClasses) > 0 || len(gvisorRuntimeClasses) > 0 || allocationWebhookFlag != "" || exclusive != nil
+}
+
+// podMemoryLimit returns the per vGPU memory limit in MiB requested by the pod annotations,
+// a plain number in MiB or a size with unit such as 8Gi
+func podMemoryLimit(pod *v1.Pod) (uint64, bool, error) {
+	value, ok := pod.Annotations[annMemoryLimit]
+	if !ok {
+		return 0, false, nil
+	}
+	memory, err := parseMemoryMiB(value)
+	if err != nil || memory == 0 {
+		return 0, false, fmt.Errorf("invalid %s annotation on pod %s: %q", annMemoryLimit, pod.Name, value)
+	}
+	return memory, true, nil
+}
+
+// podMemoryPercentage returns the per vGPU memory percentage requested by the pod annotations
+func podMemoryPercentage(pod *v1.Pod) (uint64, bool, error) {
+	value, ok := pod.Annotations[annMemoryPercentage]
+	if !ok {
+		return 0, false, nil
+	}
+	percent, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if err != nil || percent == 0 || percent > 100 {
+		return 0, false, fmt.Errorf("invalid %s annotation on pod %s: %q", annMemoryPercentage, pod.Name, value)
+	}
+	return percent, true, nil
+}
+
+// podCoresLimit returns the per vGPU SM percentage requested by the pod annotations
+func podCoresLimit(pod *v1.Pod) (int, bool, error) {
+	value, ok := pod.Annotations[annCoresLimit]
+	if !ok {
+		return 0, false, nil
+	}
+	cores, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || cores <= 0 || cores > 100 {
+		return 0, false, fmt.Errorf("invalid %s annotation on pod %s: %q", annCoresLimit, pod.Name, value)
+	}
+	return cores, true, nil
+}
+
+// podOversubscribes returns true if the pod opted into memory oversubscription and the node
+// oversubscribes its GPUs
+func podOversubscribes(pod *v1.Pod) (bool, error) {
+	if deviceMemoryScalingFlag <= 1 || len(pod.UID) == 0 {
+		return false, nil
+	}
+	value, ok := pod.Annotations[annOversubscribe]
+	if !ok {
+		return false, nil
+	}
+	oversubscribe, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation on pod %s: %q", annOversubscribe, pod.Name, value)
+	}
+	return oversubscribe, nil
+}
+
+// vdeviceMemory returns the memory in MiB the pod may get from vd: the scaled vDevice memory if
+// the pod oversubscribes, else its share of the physical memory, less the CUDA context overhead
+func vdeviceMemory(pod *v1.Pod, vd *VDevice) (uint64, error) {
+	oversubscribe, err := podOversubscribes(pod)
+	if err != nil {
+		return 0, err
+	}
+	if oversubscribe || deviceMemoryScalingFlag <= 1 {
+		return usableMemory(vd.memory), nil
+	}
+	return usableMemory(uint64(float64(vd.memory) / deviceMemoryScalingFlag)), nil
+}
+
+// usableMemory deducts --context-overhead from the memory of a vDevice: every container
+// sharing the GPU creates a CUDA context outside of its limit. The memory of the vDevices
+// without a limit, such as MIG devices, is left as is.
+func usableMemory(memory uint64) uint64 {
+	if memory <= contextOverheadMiB {
+		return memory
+	}
+	return memory - contextOverheadMiB
+}
+
+// effectiveMemory returns the memory limit in MiB of a vDevice allocated to the pod: the pod
+// annotations if honored, else the --default-device-memory capped to the vDevice, else the vDevice
+// memory. Pods not opted into oversubscription are capped to the physical memory share.
+func effectiveMemory(pod *v1.Pod, vd *VDevice) (uint64, error) {
+	limit, err := vdeviceMemory(pod, vd)
+	if err != nil {
+		return 0, err
+	}
+	if podAnnotationsFlag && len(pod.UID) > 0 {
+		memory, ok, err := podMemoryLimit(pod)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			memory, ok, err = podPercentageMemory(pod, vd)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if ok {
+			if memory > limit && limit < usableMemory(vd.memory) && memory <= usableMemory(vd.memory) {
+				return 0, fmt.Errorf("pod %s requests %vMiB, more than the %vMiB of physical memory of vDevice %s, set the %s annotation to oversubscribe", pod.Name, memory, limit, vd.ID, annOversubscribe)
+			}
+			if memory > limit {
+				return 0, fmt.Errorf("pod %s requests %vMiB, more than the %vMiB of vDevice %s", pod.Name, memory, limit, vd.ID)
+			}
+			return memory, nil
+		}
+	}
+	memory := limit
+	if defaultMemory.mib > 0 {
+		memory = defaultMemory.mib
+	}
+	if defaultMemory.percent > 0 {
+		// vd.memory times the split count is the memory of the card advertised as vDevices
+		memory = vd.memory * uint64(vd.split) * defaultMemory.percent / 100
+	}
+	if memory > limit {
+		memory = limit
+	}
+	return memory, nil
+}
+
+// podPercentageMemory translates the memory percentage requested by the pod into MiB of the GPU of vd
+func podPercentageMemory(pod *v1.Pod, vd *VDevice) (uint64, bool, error) {
+	percent, ok, err := podMemoryPercentage(pod)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	m, err := getGPUModel(vd.dev.ID)
+	if err != nil {
+		return 0, false, err
+	}
+	return m.memory * percent / 100, true, nil
+}
+
+// applyPodLimits sets the memory and SM limits of a container response, returning the memory
+// limit in MiB of each vDevice
+func applyPodLimits(pod *v1.Pod, envs map[string]string, vdevices []*VDevice) ([]uint64, error) {
+	var granted []uint64
+	for i, vd := range vdevices {
+		memory, err := effectiveMemory(pod, vd)
+		if err != nil {
+			return nil, err
+		}
+		envs[fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)] = formatMemoryLimit(memory)
+		granted = append(granted, memory)
+	}
+	if !podAnnotationsFlag || len(pod.UID) == 0 {
+		return granted, nil
+	}
+	cores, ok, err := podCoresLimit(pod)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		envs["CUDA_DEVICE_SM_LIMIT"] = strconv.Itoa(cores)
+	}
+	return granted, nil
+}
+
+// formatGranted formats the memory limits of a container for the annMemoryGranted annotation
+func formatGranted(container string, granted []uint64) string {
+	var limits []string
+	for _, m := range granted {
+		limits = append(limits, strconv.FormatUint(m, 10))
+	}
+	return container + "=" + strings.Join(limits, ",")
+}
+
+// recordGrantedMemory annotates the pod with the memory limits applied to its containers
+func recordGrantedMemory(pod *v1.Pod, entries []string) {
+	if len(pod.UID) == 0 || len(entries) == 0 {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annMemoryGranted: strings.Join(entries, ";")},
+		},
+	})
+	if err != nil {
+		return
+	}
+	client, err := newKubeClient()
+	if err != nil {
+		log.Printf("Warning: failed to record granted memory of pod %s: %v", pod.Name, err)
+		return
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	_, err = client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		log.Printf("Warning: failed to record granted memory of pod %s: %v", pod.Name, err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+)
+
+// gpuLoad is the occupancy of a physical GPU by the vDevices of a resource; memory is in MiB
+type gpuLoad struct {
+	total   uint64
+	granted uint64
+	used    int
+	// utilization is the recent SM utilization in percent with --busy-gpu-threshold
+	utilization uint64
+	busy        bool
+}
+
+// remaining returns the memory of the GPU not granted to a container yet
+func (l *gpuLoad) remaining() uint64 {
+	return l.total - l.granted
+}
+
+// gpuLoads returns the load of the GPUs of vdevices keyed by UUID, counting every vDevice the
+// kubelet does not list as available as granted
+func gpuLoads(vdevices []*VDevice, available []string) map[string]*gpuLoad {
+	free := make(map[string]bool, len(available))
+	for _, id := range available {
+		free[id] = true
+	}
+	loads := make(map[string]*gpuLoad)
+	for _, vd := range vdevices {
+		l, ok := loads[vd.dev.ID]
+		if !ok {
+			l = &gpuLoad{}
+			loads[vd.dev.ID] = l
+		}
+		l.total += vd.memory
+		if !free[vd.ID] {
+			l.granted += vd.memory
+			l.used++
+		}
+	}
+	return loads
+}
+
+// sortByLoad orders the GPUs least loaded first: the busy GPUs last, least utilized first, then
+// the most memory remaining, then the fewest vDevices in use. The allocation policy breaks its
+// topology ties in this order, so new vDevices land on the least loaded compatible GPUs.
+func sortByLoad(uuids []string, loads map[string]*gpuLoad) {
+	sort.SliceStable(uuids, func(i, j int) bool {
+		li, lj := loads[uuids[i]], loads[uuids[j]]
+		if li.busy != lj.busy {
+			return lj.busy
+		}
+		if li.busy && li.utilization != lj.utilization {
+			return li.utilization < lj.utilization
+		}
+		if li.remaining() != lj.remaining() {
+			return li.remaining() > lj.remaining()
+		}
+		return li.used < lj.used
+	})
+}
+
+// preferredVDevices translates the GPUs picked by the allocation policy back to exactly size
+// vDevices: the required ones first, then one vDevice on each picked GPU not covered yet, then
+// one on each of the other GPUs in the order of gpus and finally, unless --spread-vdevices is
+// set, more vDevices on the same GPUs. It returns nil if there are not enough vDevices.
+func preferredVDevices(picked []string, gpus []string, available, required []*VDevice, size int) []string {
+	if len(required) > size {
+		return nil
+	}
+	var ids []string
+	chosen := make(map[string]bool)
+	covered := make(map[string]bool)
+	add := func(vd *VDevice) {
+		ids = append(ids, vd.ID)
+		chosen[vd.ID] = true
+		covered[vd.dev.ID] = true
+	}
+	for _, vd := range required {
+		if !chosen[vd.ID] {
+			add(vd)
+		}
+	}
+	// Distinct GPUs first
+	for _, gpu := range append(append([]string{}, picked...), gpus...) {
+		if covered[gpu] {
+			continue
+		}
+		for _, vd := range available {
+			if len(ids) < size && vd.dev.ID == gpu {
+				add(vd)
+				break
+			}
+		}
+	}
+	for _, gpu := range gpus {
+		for _, vd := range available {
+			if len(ids) < size && vd.dev.ID == gpu && !chosen[vd.ID] && !spreadVDevicesFlag {
+				add(vd)
+			}
+		}
+	}
+	if len(ids) != size {
+		return nil
+	}
+	return ids
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// testVDevices returns count vDevices on each of the GPUs
+func testVDevices(count int, gpus ...string) []*VDevice {
+	var vdevices []*VDevice
+	for _, gpu := range gpus {
+		dev := &Device{Device: pluginapi.Device{ID: gpu}}
+		for i := 0; i < count; i++ {
+			vd := &VDevice{Device: dev.Device, dev: dev, split: uint(count)}
+			vd.ID = fmt.Sprintf("%s-%d", gpu, i)
+			vdevices = append(vdevices, vd)
+		}
+	}
+	return vdevices
+}
+
+func TestPreferredVDevices(t *testing.T) {
+	tests := []struct {
+		name      string
+		picked    []string
+		gpus      []string
+		available []*VDevice
+		required  []string
+		size      int
+		spread    bool
+		want      []string
+	}{
+		{
+			name:      "must-include on a shared GPU",
+			picked:    []string{"GPU-0"},
+			gpus:      []string{"GPU-0", "GPU-1"},
+			available: testVDevices(2, "GPU-0", "GPU-1"),
+			required:  []string{"GPU-0-1"},
+			size:      2,
+			want:      []string{"GPU-0-1", "GPU-1-0"},
+		},
+		{
+			name:      "size above the number of distinct GPUs",
+			picked:    []string{"GPU-0", "GPU-1"},
+			gpus:      []string{"GPU-0", "GPU-1"},
+			available: testVDevices(2, "GPU-0", "GPU-1"),
+			size:      3,
+			want:      []string{"GPU-0-0", "GPU-1-0", "GPU-0-1"},
+		},
+		{
+			name:      "size above the number of distinct GPUs with --spread-vdevices",
+			picked:    []string{"GPU-0", "GPU-1"},
+			gpus:      []string{"GPU-0", "GPU-1"},
+			available: testVDevices(2, "GPU-0", "GPU-1"),
+			size:      3,
+			spread:    true,
+			want:      nil,
+		},
+		{
+			name:      "more required vDevices than the size",
+			picked:    []string{"GPU-0", "GPU-1"},
+			gpus:      []string{"GPU-0", "GPU-1"},
+			available: testVDevices(2, "GPU-0", "GPU-1"),
+			required:  []string{"GPU-0-0", "GPU-1-0"},
+			size:      1,
+			want:      nil,
+		},
+		{
+			name:      "not enough vDevices",
+			picked:    []string{"GPU-0"},
+			gpus:      []string{"GPU-0"},
+			available: testVDevices(1, "GPU-0"),
+			size:      2,
+			want:      nil,
+		},
+	}
+	defer func(spread bool) { spreadVDevicesFlag = spread }(spreadVDevicesFlag)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spreadVDevicesFlag = tt.spread
+			required, err := VDevicesByIDs(tt.available, tt.required)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := preferredVDevices(tt.picked, tt.gpus, tt.available, required, tt.size)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("preferredVDevices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
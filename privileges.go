@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capSysAdmin is the CAP_SYS_ADMIN capability number, needed to change GPU clocks and power limits
+const capSysAdmin = 21
+
+// effectiveCapabilities returns the effective capability set of the plugin process
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "CapEff:") {
+			return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+// hasCapability returns true if the plugin holds the capability, or if it cannot tell
+func hasCapability(capability uint) bool {
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		return true
+	}
+	return caps&(1<<capability) != 0
+}
+
+// sysfsWritable returns an error if sysfs is mounted read-only or not writable by the plugin, as
+// in unprivileged containers
+func sysfsWritable() error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs("/sys", &st); err != nil {
+		return err
+	}
+	if st.Flags&0x1 != 0 { // ST_RDONLY
+		return fmt.Errorf("/sys is mounted read-only")
+	}
+	return syscall.Access(pciDriversProbe, 0x2) // W_OK
+}
+
+// hostPIDNamespace returns true if the plugin sees the processes of the host, which is needed
+// to attribute GPU processes to pods
+func hostPIDNamespace() bool {
+	data, err := ioutil.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	return !strings.Contains(string(data), "kubepods")
+}
+
+// explainPrivilegeError adds how to fix a write to sysfs failing for lack of privilege
+func explainPrivilegeError(err error) error {
+	if os.IsPermission(err) || strings.Contains(err.Error(), syscall.EROFS.Error()) {
+		return fmt.Errorf("%v (sysfs is not writable, run the plugin with a privileged securityContext)", err)
+	}
+	return err
+}
+
+// adaptToPrivileges turns off or warns about the features the plugin lacks the privileges for,
+// so that the plugin can run with a restricted securityContext
+func adaptToPrivileges() error {
+	if enableGPUTuningFlag && !hasCapability(capSysAdmin) {
+		log.Printf("Warning: GPU tuning needs CAP_SYS_ADMIN, disabling --enable-gpu-tuning")
+		enableGPUTuningFlag = false
+	}
+	if mdevTypeFlag != "" {
+		if err := sysfsWritable(); err != nil {
+			return fmt.Errorf("--mdev-type needs write access to sysfs to create mdevs, run the plugin with a privileged securityContext: %v", err)
+		}
+	}
+	if enableVfioFlag {
+		if err := sysfsWritable(); err != nil {
+			log.Printf("Warning: sysfs is not writable (%v), GPUs already bound to vfio-pci are served but the %s annotation cannot move GPUs", err, annPassthrough)
+		}
+	}
+	if historyDirFlag != "" && !hostPIDNamespace() {
+		log.Printf("Warning: the plugin does not run in the host PID namespace, the usage history only records GPUs, set hostPID: true to record pods")
+	}
+	return nil
+}
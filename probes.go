@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// probeDialTimeout bounds the check that a plugin gRPC server still accepts connections
+const probeDialTimeout = time.Second
+
+// pluginProbe is the state of a started plugin as seen by the probes
+type pluginProbe struct {
+	socket     string
+	registered bool
+	// selfTest is the error of the startup self-test, if enabled
+	selfTest error
+}
+
+var (
+	probeMux     sync.Mutex
+	probePlugins = make(map[string]*pluginProbe)
+	// probeStarted is true once the plugins have been started, until they are restarted
+	probeStarted bool
+)
+
+// setProbeServing records that the gRPC server of a plugin listens on socket
+func setProbeServing(resourceName, socket string) {
+	probeMux.Lock()
+	defer probeMux.Unlock()
+	probePlugins[resourceName] = &pluginProbe{socket: socket}
+}
+
+// setProbeRegistered records whether the kubelet accepted the registration of a plugin
+func setProbeRegistered(resourceName string, registered bool) {
+	probeMux.Lock()
+	defer probeMux.Unlock()
+	if p, ok := probePlugins[resourceName]; ok {
+		p.registered = registered
+	}
+}
+
+// setProbeSelfTest records the outcome of the self-test of a plugin
+func setProbeSelfTest(resourceName string, err error) {
+	probeMux.Lock()
+	defer probeMux.Unlock()
+	if p, ok := probePlugins[resourceName]; ok {
+		p.selfTest = err
+	}
+}
+
+// clearProbe forgets a stopped plugin
+func clearProbe(resourceName string) {
+	probeMux.Lock()
+	defer probeMux.Unlock()
+	delete(probePlugins, resourceName)
+}
+
+// setProbeStarted records whether all the plugins with devices have been started
+func setProbeStarted(started bool) {
+	probeMux.Lock()
+	defer probeMux.Unlock()
+	probeStarted = started
+}
+
+// probeSnapshot returns a copy of the plugin states, sorted by resource name
+func probeSnapshot() ([]string, map[string]pluginProbe, bool) {
+	probeMux.Lock()
+	defer probeMux.Unlock()
+	plugins := make(map[string]pluginProbe, len(probePlugins))
+	var names []string
+	for name, p := range probePlugins {
+		plugins[name] = *p
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, plugins, probeStarted
+}
+
+// checkServing returns an error if the gRPC server behind socket does not accept connections
+func checkServing(socket string) error {
+	conn, err := net.DialTimeout("unix", socket, probeDialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// livenessProblems returns why the plugin is not alive: a started gRPC server that stopped serving
+func livenessProblems() []string {
+	names, plugins, _ := probeSnapshot()
+	var problems []string
+	for _, name := range names {
+		if err := checkServing(plugins[name].socket); err != nil {
+			problems = append(problems, fmt.Sprintf("gRPC server for '%s' is not serving: %v", name, err))
+		}
+	}
+	return problems
+}
+
+// readinessProblems returns why the plugin is not ready: plugins not yet started, servers not
+// serving, registrations not accepted by the kubelet, failed self-tests, or NVML unavailable
+func readinessProblems() []string {
+	names, plugins, started := probeSnapshot()
+	var problems []string
+	if !started {
+		problems = append(problems, "plugins are not started")
+	}
+	for _, name := range names {
+		p := plugins[name]
+		if err := checkServing(p.socket); err != nil {
+			problems = append(problems, fmt.Sprintf("gRPC server for '%s' is not serving: %v", name, err))
+		}
+		if !p.registered {
+			problems = append(problems, fmt.Sprintf("'%s' is not registered with the kubelet", name))
+		}
+		if p.selfTest != nil {
+			problems = append(problems, fmt.Sprintf("self-test of '%s' failed: %v", name, p.selfTest))
+		}
+	}
+	if _, err := nvml.GetDeviceCount(); err != nil {
+		problems = append(problems, fmt.Sprintf("NVML is unavailable: %v", err))
+	}
+	return problems
+}
+
+func serveProbe(check func() []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if problems := check(); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// registerProbeHandlers adds /healthz and /readyz to mux
+func registerProbeHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", serveProbe(livenessProblems))
+	mux.HandleFunc("/readyz", serveProbe(readinessProblems))
+}
+
+// startProbeServer serves only the probes on addr in the background
+func startProbeServer(addr string) {
+	mux := http.NewServeMux()
+	registerProbeHandlers(mux)
+	go func() {
+		log.Printf("Serving probes on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Error: probe server stopped: %v", err)
+		}
+	}()
+}
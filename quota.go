@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annMemoryQuota is the namespace annotation limiting the vGPU memory its pods are granted on each node, in MiB or with a unit
+const annMemoryQuota = "4paradigm.com/vgpu-memory-quota"
+
+// namespaceQuota is the vGPU memory budget of the namespace of a pod being allocated
+type namespaceQuota struct {
+	namespace string
+	// limit is the budget in MiB, 0 means unlimited
+	limit uint64
+	// used is the memory in MiB already granted to the namespace on this node
+	used uint64
+}
+
+// newNamespaceQuota returns the quota of the namespace of the pod, or nil if it has none
+func newNamespaceQuota(ctx context.Context, pod *v1.Pod) (*namespaceQuota, error) {
+	if !namespaceQuotaFlag || len(pod.UID) == 0 {
+		return nil, nil
+	}
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	var ns *v1.Namespace
+	err = retryKube(ctx, func(ctx context.Context) error {
+		ns, err = client.CoreV1().Namespaces().Get(ctx, pod.Namespace, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := ns.Annotations[annMemoryQuota]
+	if !ok {
+		return nil, nil
+	}
+	limit, err := parseMemoryMiB(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on namespace %s: %q", annMemoryQuota, pod.Namespace, value)
+	}
+
+	opts := nodePodsListOptions()
+	var pods *v1.PodList
+	err = retryKube(ctx, func(ctx context.Context) error {
+		pods, err = client.CoreV1().Pods(pod.Namespace).List(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]*v1.Pod)
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		if p.UID == pod.UID || p.Status.Phase == v1.PodSucceeded || p.Status.Phase == v1.PodFailed {
+			continue
+		}
+		members[string(p.UID)] = p
+	}
+
+	q := &namespaceQuota{namespace: pod.Namespace, limit: limit}
+	for _, plugin := range getAdminPlugins() {
+		assignments, err := readCheckpointAssignments(plugin.resourceName)
+		if err != nil {
+			return nil, err
+		}
+		for _, vd := range plugin.getVDevices() {
+			a, ok := assignments[vd.ID]
+			if !ok {
+				continue
+			}
+			if p, ok := members[a.podUID]; ok {
+				q.used += grantedMemory(p, vd)
+			}
+		}
+	}
+	return q, nil
+}
+
+// grantedMemory returns the memory in MiB a pod is granted on a vDevice
+func grantedMemory(pod *v1.Pod, vd *VDevice) uint64 {
+	memory, err := effectiveMemory(pod, vd)
+	if err != nil {
+		return vd.memory
+	}
+	return memory
+}
+
+// charge adds the memory of the vDevices allocated to a container of the pod,
+// failing if it exceeds the budget of the namespace
+func (q *namespaceQuota) charge(pod *v1.Pod, vdevices []*VDevice) error {
+	if q == nil {
+		return nil
+	}
+	var memory uint64
+	for _, vd := range vdevices {
+		memory += grantedMemory(pod, vd)
+	}
+	if q.limit != 0 && q.used+memory > q.limit {
+		log.Printf("Warning: denied %vMiB to pod %s/%s, namespace quota %vMiB with %vMiB in use", memory, pod.Namespace, pod.Name, q.limit, q.used)
+		return fmt.Errorf("vGPU memory quota of namespace %s exceeded: %vMiB requested, %vMiB of %vMiB in use on this node", q.namespace, memory, q.used, q.limit)
+	}
+	q.used += memory
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// infinibandClassPath lists the RDMA devices of the node, including RoCE NICs
+const infinibandClassPath = "/sys/class/infiniband"
+
+// PCIe locality of a GPU to the closest RDMA NIC, higher is closer
+const (
+	rdmaLocalityNone   = 0
+	rdmaLocalityNUMA   = 1
+	rdmaLocalitySwitch = 2
+)
+
+// podRequestsRDMA returns true if a container of the pod requests a resource matching --rdma-resources
+func podRequestsRDMA(pod *v1.Pod) bool {
+	if rdmaResourcesFlag == "" {
+		return false
+	}
+	for _, ctr := range pod.Spec.Containers {
+		for name := range ctr.Resources.Limits {
+			for _, prefix := range strings.Split(rdmaResourcesFlag, ",") {
+				if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(string(name), prefix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// rdmaNICPaths returns the resolved sysfs PCI paths of the RDMA NICs
+func rdmaNICPaths() []string {
+	entries, err := ioutil.ReadDir(infinibandClassPath)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, e := range entries {
+		p, err := filepath.EvalSymlinks(filepath.Join(infinibandClassPath, e.Name(), "device"))
+		if err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// gpuPCIPath returns the resolved sysfs PCI path of a GPU
+func gpuPCIPath(uuid string) (string, error) {
+	m, err := getGPUModel(uuid)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(filepath.Join(pciDevicesPath, m.busID))
+}
+
+// pciLocality returns how close two PCI devices are: below the same PCIe switch, on the same NUMA node, or neither
+func pciLocality(a, b string) int {
+	// The paths are /sys/devices/pci<root>/<root port>/<switch ports>.../<device>;
+	// sharing more than the root port means sharing a switch.
+	pa := strings.Split(a, "/")
+	pb := strings.Split(b, "/")
+	common := 0
+	for common < len(pa)-1 && common < len(pb)-1 && pa[common] == pb[common] {
+		common++
+	}
+	if common > 5 {
+		return rdmaLocalitySwitch
+	}
+	na := readSysfs(filepath.Join(a, "numa_node"))
+	if na != "" && na != "-1" && na == readSysfs(filepath.Join(b, "numa_node")) {
+		return rdmaLocalityNUMA
+	}
+	return rdmaLocalityNone
+}
+
+// rdmaLocality returns the locality of a GPU to its closest RDMA NIC
+func rdmaLocality(uuid string, nics []string) int {
+	gpu, err := gpuPCIPath(uuid)
+	if err != nil {
+		if verboseFlag > 5 {
+			log.Printf("Debug: no PCI path for %s: %v", uuid, err)
+		}
+		return rdmaLocalityNone
+	}
+	best := rdmaLocalityNone
+	for _, nic := range nics {
+		if l := pciLocality(gpu, nic); l > best {
+			best = l
+		}
+	}
+	return best
+}
+
+// preferRDMALocal returns the candidate vDevice IDs closest to an RDMA NIC, widening to the
+// next locality tier until there are at least n of them
+func preferRDMALocal(vdevices []*VDevice, ids []string, n int) []string {
+	nics := rdmaNICPaths()
+	if len(nics) == 0 {
+		return ids
+	}
+	locality := make(map[string]int)
+	scores := make(map[string]float64)
+	for _, id := range ids {
+		for _, vd := range vdevices {
+			if vd.ID != id {
+				continue
+			}
+			l, ok := locality[vd.dev.ID]
+			if !ok {
+				l = rdmaLocality(vd.dev.ID, nics)
+				locality[vd.dev.ID] = l
+			}
+			scores[id] = float64(l)
+		}
+	}
+	return preferHighestScores(ids, scores, n)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// annRebalance is the node annotation listing the pods to move to free fragmented GPUs
+const annRebalance = "4paradigm.com/vgpu-rebalance"
+
+// annCompaction is the node annotation reporting the fill ratio of each GPU and the compaction
+// score of the node as JSON
+const annCompaction = "4paradigm.com/vgpu-compaction"
+
+// annCompactionScore is the node annotation holding only the compaction score, for consumers
+// that do not parse JSON
+const annCompactionScore = "4paradigm.com/vgpu-compaction-score"
+
+// rebalanceAnalyzer is non-nil when --rebalance-interval is set
+var rebalanceAnalyzer *RebalanceAnalyzer
+
+// rebalanceRecommendation frees a GPU by moving its pods to the free capacity of other busy GPUs
+type rebalanceRecommendation struct {
+	GPU string `json:"gpu"`
+	// Pods are the "namespace/name" of the pods to evict so that they are rescheduled
+	Pods []string `json:"pods"`
+	// Memory is the memory in MiB granted on the GPU
+	Memory uint64 `json:"memory"`
+}
+
+// compactionReport tells how fragmented the vGPU workloads of the node are
+type compactionReport struct {
+	// Score is the share of the memory of the GPUs in use left ungranted, from 0 when every GPU
+	// in use is full to 1, so that the nodes to re-pack first have the highest score
+	Score float64 `json:"score"`
+	// GPUsInUse is the number of GPUs with vDevices assigned
+	GPUsInUse int `json:"gpusInUse"`
+	// GPUsNeeded is the number of GPUs the granted memory would fill if it were packed
+	GPUsNeeded int `json:"gpusNeeded"`
+	// Fill is the granted memory of each GPU over its memory, above 1 when oversubscribed
+	Fill map[string]float64 `json:"fill"`
+}
+
+// analyzeCompaction returns the compaction report of the node
+func analyzeCompaction(status *nodeStatus) *compactionReport {
+	report := &compactionReport{Fill: make(map[string]float64)}
+	var total, granted, largest uint64
+	for _, d := range status.Devices {
+		if d.MemoryTotal == 0 || strings.Contains(d.UUID, "MIG") || d.Confidential {
+			continue
+		}
+		var memory uint64
+		inUse := false
+		for _, vd := range d.VDevices {
+			if vd.PodUID != "" {
+				memory += vd.Memory
+				inUse = true
+			}
+		}
+		report.Fill[d.UUID] = roundRatio(float64(memory) / float64(d.MemoryTotal))
+		if d.MemoryTotal > largest {
+			largest = d.MemoryTotal
+		}
+		if !inUse {
+			continue
+		}
+		report.GPUsInUse++
+		total += d.MemoryTotal
+		if memory > d.MemoryTotal {
+			memory = d.MemoryTotal
+		}
+		granted += memory
+	}
+	if total > 0 {
+		report.Score = roundRatio(float64(total-granted) / float64(total))
+		report.GPUsNeeded = int((granted + largest - 1) / largest)
+	}
+	return report
+}
+
+// roundRatio rounds a ratio to 3 decimals so that the annotations only change with the load
+func roundRatio(ratio float64) float64 {
+	return float64(int64(ratio*1000+0.5)) / 1000
+}
+
+// RebalanceAnalyzer periodically looks for GPUs pinned by a few small vDevices whose pods
+// would fit on the other busy GPUs, and publishes them as metrics and a node annotation
+// for a descheduler to act on
+type RebalanceAnalyzer struct {
+	mux             sync.Mutex
+	nodeName        string
+	interval        time.Duration
+	recommendations []rebalanceRecommendation
+	fragmentation   map[string]uint64
+	compaction      *compactionReport
+	published       string
+}
+
+// NewRebalanceAnalyzer returns a reference to a new RebalanceAnalyzer
+func NewRebalanceAnalyzer(nodeName string, interval time.Duration) *RebalanceAnalyzer {
+	return &RebalanceAnalyzer{
+		nodeName: nodeName,
+		interval: interval,
+	}
+}
+
+// rebalanceGPU is the occupancy of a GPU during the analysis
+type rebalanceGPU struct {
+	uuid      string
+	total     uint64
+	granted   uint64
+	slots     int
+	usedSlots int
+	// vdevices are the memory of the assigned vDevices keyed by the pod they are assigned to
+	vdevices map[string][]uint64
+}
+
+// analyzeRebalance returns the GPUs that could be freed, least used first, along with the
+// memory stranded on each busy GPU
+func analyzeRebalance(status *nodeStatus) ([]rebalanceRecommendation, map[string]uint64) {
+	var busy []*rebalanceGPU
+	fragmentation := make(map[string]uint64)
+	for _, d := range status.Devices {
+		if d.MemoryTotal == 0 || strings.Contains(d.UUID, "MIG") {
+			continue
+		}
+		g := &rebalanceGPU{uuid: d.UUID, total: d.MemoryTotal, slots: len(d.VDevices), vdevices: make(map[string][]uint64)}
+		for _, vd := range d.VDevices {
+			if vd.PodUID == "" {
+				continue
+			}
+			pod := vd.Pod
+			if pod == "" {
+				pod = vd.PodUID
+			}
+			g.vdevices[pod] = append(g.vdevices[pod], vd.Memory)
+			g.granted += vd.Memory
+			g.usedSlots++
+		}
+		if g.usedSlots > 0 {
+			busy = append(busy, g)
+			if g.total > g.granted {
+				fragmentation[g.uuid] = g.total - g.granted
+			}
+		}
+	}
+
+	// Try to empty the least used GPUs into the most used ones
+	sort.SliceStable(busy, func(i, j int) bool { return busy[i].granted < busy[j].granted })
+	freed := make(map[string]bool)
+	var recommendations []rebalanceRecommendation
+	for i, src := range busy {
+		targets := make([]*rebalanceGPU, 0, len(busy))
+		for j := len(busy) - 1; j > i; j-- {
+			if !freed[busy[j].uuid] {
+				targets = append(targets, busy[j])
+			}
+		}
+		plan, ok := planMoves(src, targets)
+		if !ok {
+			continue
+		}
+		for _, m := range plan {
+			m.target.granted += m.memory
+			m.target.usedSlots++
+		}
+		freed[src.uuid] = true
+		r := rebalanceRecommendation{GPU: src.uuid, Memory: src.granted}
+		for pod := range src.vdevices {
+			r.Pods = append(r.Pods, pod)
+		}
+		sort.Strings(r.Pods)
+		recommendations = append(recommendations, r)
+	}
+	return recommendations, fragmentation
+}
+
+type rebalanceMove struct {
+	target *rebalanceGPU
+	memory uint64
+}
+
+// planMoves places the vDevices of src on the targets, first fit, without modifying them
+func planMoves(src *rebalanceGPU, targets []*rebalanceGPU) ([]rebalanceMove, bool) {
+	if len(targets) == 0 {
+		return nil, false
+	}
+	granted := make(map[*rebalanceGPU]uint64)
+	slots := make(map[*rebalanceGPU]int)
+	var plan []rebalanceMove
+	for _, memories := range src.vdevices {
+		for _, memory := range memories {
+			placed := false
+			for _, t := range targets {
+				if t.usedSlots+slots[t] < t.slots && t.granted+granted[t]+memory <= t.total {
+					granted[t] += memory
+					slots[t]++
+					plan = append(plan, rebalanceMove{target: t, memory: memory})
+					placed = true
+					break
+				}
+			}
+			if !placed {
+				return nil, false
+			}
+		}
+	}
+	return plan, true
+}
+
+// run analyzes the node every interval until stop is closed
+func (r *RebalanceAnalyzer) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(r.interval):
+		}
+		status := collectNodeStatus()
+		recommendations, fragmentation := analyzeRebalance(status)
+		compaction := analyzeCompaction(status)
+		r.mux.Lock()
+		r.recommendations = recommendations
+		r.fragmentation = fragmentation
+		r.compaction = compaction
+		r.mux.Unlock()
+		if err := r.publish(recommendations, compaction); err != nil {
+			log.Printf("Warning: failed to publish rebalancing recommendations: %v", err)
+		}
+	}
+}
+
+// publish sets the node annotations to the recommendations, removing it when there are none,
+// and to the compaction report
+func (r *RebalanceAnalyzer) publish(recommendations []rebalanceRecommendation, compaction *compactionReport) error {
+	var value interface{}
+	if len(recommendations) > 0 {
+		data, err := json.Marshal(recommendations)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	}
+	report, err := json.Marshal(compaction)
+	if err != nil {
+		return err
+	}
+	current := fmt.Sprint(value)
+	if current+string(report) == r.published {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				annRebalance:       value,
+				annCompaction:      string(report),
+				annCompactionScore: fmt.Sprint(compaction.Score),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	_, err = client.CoreV1().Nodes().Patch(ctx, r.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+	if len(recommendations) > 0 {
+		log.Printf("Rebalancing would free %d GPUs: %s", len(recommendations), current)
+	}
+	r.published = current + string(report)
+	return nil
+}
+
+func (r *RebalanceAnalyzer) writeMetrics(w io.Writer) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	fmt.Fprintln(w, "# HELP vgpu_rebalance_freeable_gpus GPUs that moving their pods to other busy GPUs would free.")
+	fmt.Fprintln(w, "# TYPE vgpu_rebalance_freeable_gpus gauge")
+	fmt.Fprintf(w, "vgpu_rebalance_freeable_gpus %d\n", len(r.recommendations))
+	fmt.Fprintln(w, "# HELP vgpu_device_stranded_memory Memory in MiB left ungranted on a GPU in use.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_stranded_memory gauge")
+	for uuid, memory := range r.fragmentation {
+		writeGauge(w, "vgpu_device_stranded_memory", uuid, memory)
+	}
+	fmt.Fprintln(w, "# HELP vgpu_device_rebalance_candidate 1 if the GPU could be freed by moving its pods.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_rebalance_candidate gauge")
+	for _, rec := range r.recommendations {
+		writeGauge(w, "vgpu_device_rebalance_candidate", rec.GPU, 1)
+	}
+	if r.compaction == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP vgpu_compaction_score Share of the memory of the GPUs in use left ungranted, the higher the more re-packing would free.")
+	fmt.Fprintln(w, "# TYPE vgpu_compaction_score gauge")
+	fmt.Fprintf(w, "vgpu_compaction_score %v\n", r.compaction.Score)
+	fmt.Fprintln(w, "# HELP vgpu_compaction_gpus_needed GPUs the granted memory would fill if it were packed.")
+	fmt.Fprintln(w, "# TYPE vgpu_compaction_gpus_needed gauge")
+	fmt.Fprintf(w, "vgpu_compaction_gpus_needed %d\n", r.compaction.GPUsNeeded)
+	fmt.Fprintln(w, "# HELP vgpu_device_fill_ratio Memory granted on a GPU over its memory.")
+	fmt.Fprintln(w, "# TYPE vgpu_device_fill_ratio gauge")
+	for uuid, fill := range r.compaction.Fill {
+		writeGauge(w, "vgpu_device_fill_ratio", uuid, fill)
+	}
+}
+
+// newRebalanceAnalyzerFromFlags returns a RebalanceAnalyzer for the node of the plugin
+func newRebalanceAnalyzerFromFlags() (*RebalanceAnalyzer, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME must be set to publish rebalancing recommendations")
+	}
+	return NewRebalanceAnalyzer(nodeName, rebalanceIntervalFlag), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// selfTestHostRoot is the host directory of the files mounted into the containers, which the
+// plugin sees at the same path
+const selfTestHostRoot = "/usr/local/vgpu"
+
+// selfTest allocates a vDevice to a synthetic container without the kubelet and checks the
+// response, returning a descriptive error if the plugin could not serve real requests
+func (m *NvidiaDevicePlugin) selfTest() error {
+	vdevices := m.getVDevices()
+	if len(vdevices) == 0 {
+		return nil
+	}
+	r := &allocateRequest{
+		ctx:    context.Background(),
+		plugin: m,
+		requests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{vdevices[0].ID}},
+		},
+		dryRun: true,
+	}
+	resp, err := r.allocate()
+	if err != nil {
+		return fmt.Errorf("allocation failed: %v", err)
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return fmt.Errorf("expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	return checkSelfTestResponse(m, resp.ContainerResponses[0])
+}
+
+// checkSelfTestResponse checks that the response selects a device and a memory limit and that
+// the libraries it mounts exist
+func checkSelfTestResponse(m *NvidiaDevicePlugin, resp *pluginapi.ContainerAllocateResponse) error {
+	var problems []string
+	if deviceListStrategyFlag == DeviceListStrategyEnvvar && resp.Envs[m.deviceListEnvvar] == "" {
+		problems = append(problems, fmt.Sprintf("%s is not set", m.deviceListEnvvar))
+	}
+	if deviceListStrategyFlag == DeviceListStrategyCDIAnnotations && len(resp.Annotations) == 0 {
+		problems = append(problems, "no CDI device annotation is set")
+	}
+	for _, name := range []string{controlEnvName("CUDA_DEVICE_MEMORY_LIMIT_0"), controlEnvName("NVIDIA_DEVICE_MAP")} {
+		// libvgpu is not used in gVisor sandboxes
+		if resp.Envs[name] == "" && !gvisorNVProxyFlag {
+			problems = append(problems, fmt.Sprintf("%s is not set", name))
+		}
+	}
+	for _, mount := range resp.Mounts {
+		if !strings.HasPrefix(mount.HostPath, selfTestHostRoot+"/") {
+			continue
+		}
+		// Directories created per container do not exist yet
+		if strings.HasPrefix(mount.HostPath, sharedCacheRoot+"/") || strings.HasPrefix(mount.HostPath, deviceConfigRoot+"/") {
+			continue
+		}
+		if _, err := os.Stat(mount.HostPath); err != nil {
+			problems = append(problems, fmt.Sprintf("%s mounted at %s is missing: %v", mount.HostPath, mount.ContainerPath, err))
+		}
+	}
+	if pciBusFile := os.Getenv("PCIBUSFILE"); pciBusFile != "" {
+		if _, err := os.Stat(pciBusFile); err != nil {
+			problems = append(problems, fmt.Sprintf("PCIBUSFILE %s is missing: %v", pciBusFile, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// runSelfTest runs the self-test of a started plugin and reports its outcome to the readiness probe
+func (m *NvidiaDevicePlugin) runSelfTest() {
+	if m.migStrategy != "none" {
+		return
+	}
+	err := m.selfTest()
+	if err != nil {
+		log.Printf("Error: self-test of '%s' failed: %v", m.resourceName, err)
+	} else {
+		log.Printf("Self-test of '%s' passed", m.resourceName)
+	}
+	setProbeSelfTest(m.resourceName, err)
+}
@@ -23,29 +23,30 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
-	"github.com/google/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	v1 "k8s.io/api/core/v1"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
 	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // Constants to represent the various device list strategies
 const (
-	DeviceListStrategyEnvvar       = "envvar"
-	DeviceListStrategyVolumeMounts = "volume-mounts"
+	DeviceListStrategyEnvvar         = "envvar"
+	DeviceListStrategyVolumeMounts   = "volume-mounts"
+	DeviceListStrategyCDIAnnotations = "cdi-annotations"
 )
 
+// cdiAnnotationPrefix is the prefix of the container annotations requesting CDI devices from the runtime
+const cdiAnnotationPrefix = "cdi.k8s.io/"
+
 // Constants to represent the various device id strategies
 const (
 	DeviceIDStrategyUUID  = "uuid"
@@ -58,6 +59,9 @@ const (
 	deviceListAsVolumeMountsContainerPathRoot = "/var/run/nvidia-container-devices"
 )
 
+// healthUpdateWindow is the time health events are collected before ListAndWatch sends an update
+const healthUpdateWindow = 200 * time.Millisecond
+
 // NvidiaDevicePlugin implements the Kubernetes device plugin API
 type NvidiaDevicePlugin struct {
 	ResourceManager
@@ -66,13 +70,23 @@ type NvidiaDevicePlugin struct {
 	allocatePolicy   gpuallocator.Policy
 	socket           string
 	migStrategy      string
+	apiVersion       string
 
 	server            *grpc.Server
 	cachedDevices     []*Device
-	health            chan *Device
+	health            chan *DeviceHealth
 	stop              chan interface{}
 	vDevices          []*VDevice
+	vDevicesMux       sync.RWMutex
 	vDeviceController *VDeviceController
+	registration      *pluginWatcherRegistration
+	// allocations are the recent Allocate responses, returned again when the kubelet retries
+	allocations allocateCache
+	// kubeletConnected is closed when the kubelet first calls ListAndWatch
+	kubeletConnected     chan struct{}
+	kubeletConnectedOnce *sync.Once
+	// devicesChanged makes ListAndWatch send the vDevices again after they were resized
+	devicesChanged chan struct{}
 }
 
 // NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
@@ -99,32 +113,48 @@ func (m *NvidiaDevicePlugin) initialize() {
 	m.cachedDevices = m.Devices()
 	log.Println("migstrategy=", m.migStrategy)
 	if strings.Compare(m.migStrategy, "none") == 0 {
-		m.vDevices = Device2VDevice(m.cachedDevices)
-	}
-	if enableLegacyPreferredFlag && m.allocatePolicy != nil {
-		deviceIDs := make([]string, len(m.vDevices))
-		for i, v := range m.vDevices {
-			deviceIDs[i] = v.ID
-		}
-		m.vDeviceController = newVDeviceController(deviceIDs)
-		m.vDeviceController.initialize()
-	}
-	m.server = grpc.NewServer([]grpc.ServerOption{}...)
-	m.health = make(chan *Device)
+		// Plugins serving the same GPUs under other resource names share their state
+		m.cachedDevices = sharedDevices.devicesOf(m.cachedDevices)
+		m.setVDevices(sharedDevices.vDevicesOf(m.cachedDevices))
+	}
+	allocationTracer.traceInventoryOf(m.resourceName, m.vDevices)
+	m.allocations.reset()
+	log.Printf("'%s' uses the %s allocation mode", m.resourceName, m.allocationMode())
+	if m.allocationMode() == allocationModePluginManaged {
+		m.vDeviceController = sharedDevices.acquireController(m.resourceName, m.vDevices)
+	}
+	m.server = grpc.NewServer(grpcServerOptions()...)
+	m.health = make(chan *DeviceHealth, len(m.cachedDevices)+1)
+	m.devicesChanged = make(chan struct{}, 1)
 	m.stop = make(chan interface{})
+	m.kubeletConnected = make(chan struct{})
+	m.kubeletConnectedOnce = &sync.Once{}
 }
 
 func (m *NvidiaDevicePlugin) cleanup() {
 	if m.vDeviceController != nil {
-		m.vDeviceController.cleanup()
+		sharedDevices.releaseController(m.vDeviceController)
 		m.vDeviceController = nil
 	}
 	close(m.stop)
-	m.vDevices = nil
+	m.setVDevices(nil)
 	m.cachedDevices = nil
+	// m.stop and m.health are kept: a ListAndWatch stream still being torn down
+	// by the gRPC server reads them, the next initialize replaces them
 	m.server = nil
-	m.health = nil
-	m.stop = nil
+}
+
+// getVDevices returns the vDevices of the plugin, which are replaced when the split count changes
+func (m *NvidiaDevicePlugin) getVDevices() []*VDevice {
+	m.vDevicesMux.RLock()
+	defer m.vDevicesMux.RUnlock()
+	return m.vDevices
+}
+
+func (m *NvidiaDevicePlugin) setVDevices(vdevices []*VDevice) {
+	m.vDevicesMux.Lock()
+	defer m.vDevicesMux.Unlock()
+	m.vDevices = vdevices
 }
 
 // Start starts the gRPC server, registers the device plugin with the Kubelet,
@@ -139,6 +169,7 @@ func (m *NvidiaDevicePlugin) Start() error {
 		return err
 	}
 	log.Printf("Starting to serve '%s' on %s", m.resourceName, m.socket)
+	setProbeServing(m.resourceName, m.socket)
 
 	err = m.Register()
 	if err != nil {
@@ -146,9 +177,27 @@ func (m *NvidiaDevicePlugin) Start() error {
 		m.Stop()
 		return err
 	}
-	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
+	if m.registration != nil {
+		log.Printf("Waiting for the kubelet plugin watcher to register '%s' from %s", m.resourceName, m.registration.socket)
+	} else {
+		log.Printf("Registered device plugin for '%s' with Kubelet using API %s", m.resourceName, m.apiVersion)
+	}
 
+	go m.verifyKubeletConnects(m.stop, m.kubeletConnected, m.socket)
 	go m.CheckHealth(m.stop, m.cachedDevices, m.health)
+	if dcgmClient != nil {
+		go checkDcgmHealth(m.stop, m.cachedDevices, m.health)
+	}
+	if fabricManaged && fabricManagerAddressFlag != "" && m.migStrategy != vfioAllocStrategy && m.migStrategy != canaryAllocStrategy {
+		go checkFabricHealth(m.stop, m.cachedDevices, m.health)
+	}
+	if m.migStrategy == mdevAllocStrategy {
+		go m.reconcileMdevs(m.stop, m.cachedDevices)
+	}
+	if coexistFlag && isGPUResource(m.resourceName) {
+		go m.watchUpstreamClaims(m.stop, m.cachedDevices, m.health)
+	}
+	m.reportNodeHealth()
 
 	return nil
 }
@@ -159,6 +208,11 @@ func (m *NvidiaDevicePlugin) Stop() error {
 		return nil
 	}
 	log.Printf("Stopping to serve '%s' on %s", m.resourceName, m.socket)
+	clearProbe(m.resourceName)
+	if m.registration != nil {
+		m.registration.stop()
+		m.registration = nil
+	}
 	m.server.Stop()
 	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
 		return err
@@ -169,13 +223,21 @@ func (m *NvidiaDevicePlugin) Stop() error {
 
 // Serve starts the gRPC server of the device plugin.
 func (m *NvidiaDevicePlugin) Serve() error {
-	os.Remove(m.socket)
+	if err := takeOverSocket(m.socket); err != nil {
+		return err
+	}
 	sock, err := net.Listen("unix", m.socket)
 	if err != nil {
 		return err
 	}
+	if err := applySocketPermissions(m.socket); err != nil {
+		sock.Close()
+		return err
+	}
 
-	pluginapi.RegisterDevicePluginServer(m.server, m)
+	for _, api := range devicePluginAPIs {
+		api.registerServer(m.server, m)
+	}
 
 	go func() {
 		lastCrashTime := time.Now()
@@ -208,7 +270,7 @@ func (m *NvidiaDevicePlugin) Serve() error {
 	}()
 
 	// Wait for server to start by launching a blocking connexion
-	conn, err := m.dial(m.socket, 5*time.Second)
+	conn, err := defaultConnManager.dial(m.socket)
 	if err != nil {
 		return err
 	}
@@ -219,94 +281,164 @@ func (m *NvidiaDevicePlugin) Serve() error {
 
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (m *NvidiaDevicePlugin) Register() error {
-	conn, err := m.dial(pluginapi.KubeletSocket, 5*time.Second)
-	if err != nil {
+	if err := takeFault(faultRegister); err != nil {
 		return err
 	}
-	defer conn.Close()
+	if usePluginWatcherFlag {
+		r, err := startPluginWatcherRegistration(m)
+		if err != nil {
+			return err
+		}
+		m.registration = r
+		return nil
+	}
 
-	client := pluginapi.NewRegistrationClient(conn)
-	reqt := &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     path.Base(m.socket),
-		ResourceName: m.resourceName,
-		Options: &pluginapi.DevicePluginOptions{
-			GetPreferredAllocationAvailable: m.allocatePolicy != nil && m.vDeviceController == nil,
-		},
+	conn, err := defaultConnManager.dial(kubeletSocket())
+	if err != nil {
+		return err
 	}
+	defer conn.Close()
 
-	_, err = client.Register(context.Background(), reqt)
+	version, err := negotiateRegistration(conn, m, path.Base(m.socket))
 	if err != nil {
 		return err
 	}
+	m.apiVersion = version
+	setProbeRegistered(m.resourceName, true)
+	recordEvent(eventRegister, m.resourceName, nil, "registered with kubelet using API %s", version)
 	return nil
 }
 
 // GetDevicePluginOptions returns the values of the optional settings for this plugin
 func (m *NvidiaDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	options := &pluginapi.DevicePluginOptions{
-		GetPreferredAllocationAvailable: m.allocatePolicy != nil,
+		GetPreferredAllocationAvailable: m.preferredAllocationAvailable(),
+		PreStartRequired:                m.preStartRequired(),
 	}
 	return options, nil
 }
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	m.kubeletConnectedOnce.Do(func() { close(m.kubeletConnected) })
 	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
 
 	for {
 		select {
 		case <-m.stop:
 			return nil
-		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			d.Health = pluginapi.Unhealthy
-			log.Printf("'%s' device marked unhealthy: %s", m.resourceName, d.ID)
+		case <-m.devicesChanged:
+			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
+		case h := <-m.health:
+			// Coalesce the burst of events raised when a whole GPU fails
+			// into a single response.
+			m.updateHealth(h)
+			timeout := time.After(healthUpdateWindow)
+		coalesce:
+			for {
+				select {
+				case <-m.stop:
+					return nil
+				case h := <-m.health:
+					m.updateHealth(h)
+				case <-timeout:
+					break coalesce
+				}
+			}
+			m.reportNodeHealth()
 			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
 		}
 	}
 }
 
+// updateHealth records a health change of a physical device. Only the vDevices
+// derived from it are affected, the rest of the capacity stays schedulable.
+func (m *NvidiaDevicePlugin) updateHealth(h *DeviceHealth) {
+	d := h.Device
+	d.setHealth(h.Health, h.Reason)
+	recordEvent(eventHealth, m.resourceName, []string{d.ID}, "%s: %s", h.Health, h.Reason)
+	if h.Health == pluginapi.Healthy {
+		log.Printf("'%s' device marked healthy: %s", m.resourceName, d.ID)
+		return
+	}
+	log.Printf("'%s' device marked unhealthy: %s (%s)", m.resourceName, d.ID, h.Reason)
+}
+
+// reportNodeHealth publishes the GPU health of the node; only the full GPU resources are considered
+func (m *NvidiaDevicePlugin) reportNodeHealth() {
+	if nodeHealthReporter == nil || !isGPUResource(m.resourceName) {
+		return
+	}
+	var devices []*Device
+	for _, p := range getAdminPlugins() {
+		if isGPUResource(p.resourceName) {
+			devices = append(devices, p.cachedDevices...)
+		}
+	}
+	nodeHealthReporter.update(!allDevicesUnhealthy(devices))
+}
+
 // GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
 func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	_, end := startSpan(ctx, spanGetPreferredAllocation, spanAttributes{"vgpu.resource": m.resourceName})
+	defer end()
 
 	response := &pluginapi.PreferredAllocationResponse{}
 	if strings.Compare(m.migStrategy, "mixed") == 0 {
-		return nil, nil
+		return m.migPreferredAllocation(r)
 	}
+	if m.migStrategy == vfioAllocStrategy || m.migStrategy == mdevAllocStrategy || m.migStrategy == canaryAllocStrategy || m.migStrategy == ccAllocStrategy {
+		return noPreferredAllocation(r), nil
+	}
+	vdevices := m.getVDevices()
 	// get device
 	for _, req := range r.ContainerRequests {
-		availableVDev, err := VDevicesByIDs(m.vDevices, req.AvailableDeviceIDs)
+		availableVDev, err := VDevicesByIDs(vdevices, req.AvailableDeviceIDs)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to retrieve list of available vdevices: %v", err)
 		}
-		available, err := gpuallocator.NewDevicesFrom(UniqueDeviceIDs(availableVDev))
+		requiredVDev, err := VDevicesByIDs(vdevices, req.MustIncludeDeviceIDs)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to retrieve list of available devices: %v", err)
+			return nil, fmt.Errorf("Unable to retrieve list of available vdevices: %v", err)
 		}
-
-		requiredVDev, err := VDevicesByIDs(m.vDevices, req.MustIncludeDeviceIDs)
+		rejected := make(map[string]string)
+		filter := func(reason string, filtered []*VDevice) {
+			if decisions.enabled() {
+				for _, uuid := range droppedGPUs(availableVDev, filtered) {
+					rejected[uuid] = reason
+				}
+			}
+			availableVDev = filtered
+		}
+		// Multi-GPU allocations of NVSwitch systems must stay within a fabric partition
+		filter("outside the fabric partition", fabricPartitionVDevices(availableVDev, requiredVDev, int(req.AllocationSize)))
+		// Reserved GPUs are left to the pods of their reservation, checked in Allocate
+		filter("reserved", reservations.withoutReserved(availableVDev, requiredVDev, int(req.AllocationSize)))
+		// So are the GPUs held by pods with exclusive GPUs
+		filter("held by a pod with exclusive GPUs", exclusive.withoutClaimed(availableVDev, requiredVDev, int(req.AllocationSize)))
+
+		// Offer the least loaded GPUs first, the policy keeps that order among equal topologies
+		availableGPUs := UniqueDeviceIDs(availableVDev)
+		loads := gpuLoads(vdevices, req.AvailableDeviceIDs)
+		utilizationMonitor.markBusy(loads)
+		sortByLoad(availableGPUs, loads)
+		available, err := gpuallocator.NewDevicesFrom(availableGPUs)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to retrieve list of available vdevices: %v", err)
+			return nil, fmt.Errorf("Unable to retrieve list of available devices: %v", err)
 		}
 		required, err := gpuallocator.NewDevicesFrom(UniqueDeviceIDs(requiredVDev))
 		if err != nil {
 			return nil, fmt.Errorf("Unable to retrieve list of required devices: %v", err)
 		}
 
-		allocated := m.allocatePolicy.Allocate(available, required, int(req.AllocationSize))
-		if len(allocated) == 0 && len(available) >= int(req.AllocationSize) {
-			allocated = available[0:req.AllocationSize]
+		var picked []string
+		for _, device := range m.allocatePolicy.Allocate(available, required, int(req.AllocationSize)) {
+			picked = append(picked, device.UUID)
 		}
-
-		var deviceIds []string
-		for _, device := range allocated {
-			for _, vd := range availableVDev {
-				if vd.dev.ID == device.UUID {
-					deviceIds = append(deviceIds, vd.ID)
-					break
-				}
-			}
+		deviceIds := preferredVDevices(picked, availableGPUs, availableVDev, requiredVDev, int(req.AllocationSize))
+		if deviceIds == nil {
+			// The kubelet then picks the vDevices itself
+			log.Printf("Warning: no preferred allocation of %d vDevices including %v for '%s'", req.AllocationSize, req.MustIncludeDeviceIDs, m.resourceName)
 		}
 
 		resp := &pluginapi.ContainerPreferredAllocationResponse{
@@ -314,12 +446,16 @@ func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r *plug
 		}
 
 		response.ContainerResponses = append(response.ContainerResponses, resp)
-		//if verboseFlag > 5 {
-		log.Printf("Debug: preferred allocation %d: [%s] -> [%s]\n",
-			req.AllocationSize,
-			strings.Join(req.AvailableDeviceIDs, ","),
-			strings.Join(deviceIds, ","))
-		//}
+		allocationTracer.write(&traceRecord{
+			Type:      tracePreferred,
+			Resource:  m.resourceName,
+			Size:      int(req.AllocationSize),
+			Available: len(req.AvailableDeviceIDs),
+			Devices:   deviceIds,
+		})
+		if decisions.enabled() {
+			decisions.write(preferredDecision(m.resourceName, int(req.AllocationSize), vdevices, deviceIds, picked, availableGPUs, loads, rejected))
+		}
 	}
 	//return nil, fmt.Errorf("Not implemented")
 	return response, nil
@@ -347,8 +483,17 @@ func (m *NvidiaDevicePlugin) MIGAllocate(ctx context.Context, reqs *pluginapi.Al
 			response.Envs = m.apiEnvs(m.deviceListEnvvar, []string{deviceListAsVolumeMountsContainerPathRoot})
 			response.Mounts = m.apiMounts(deviceIDs)
 		}
+		if deviceListStrategyFlag == DeviceListStrategyCDIAnnotations {
+			response.Annotations = m.apiCDIAnnotations(uuids)
+		}
 		if passDeviceSpecsFlag {
 			response.Devices = m.apiDeviceSpecs(nvidiaDriverRootFlag, uuids)
+		} else if passMigCapsFlag {
+			specs, err := migCapDeviceSpecs(nvidiaDriverRootFlag, uuids)
+			if err != nil {
+				return nil, err
+			}
+			response.Devices = specs
 		}
 
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
@@ -359,198 +504,123 @@ func (m *NvidiaDevicePlugin) MIGAllocate(ctx context.Context, reqs *pluginapi.Al
 
 // Allocate which return list of devices.
 func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	ctx, end := startSpan(ctx, spanAllocate, spanAttributes{
+		"vgpu.resource":   m.resourceName,
+		"vgpu.containers": len(reqs.ContainerRequests),
+	})
+	defer end()
 	if strings.Compare(m.migStrategy, "mixed") == 0 {
 		return m.MIGAllocate(ctx, reqs)
 	}
-	monitorMode := os.Getenv("VGPU_MONITOR_MODE")
-	targetpod := v1.Pod{}
-	if len(monitorMode) > 0 {
-		config, err := rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
-		}
-		clientset, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			panic(err.Error())
-		}
-		pods, err := clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
+	if m.migStrategy == vfioAllocStrategy {
+		return m.VfioAllocate(ctx, reqs)
+	}
+	if m.migStrategy == mdevAllocStrategy {
+		return m.MdevAllocate(ctx, reqs)
+	}
+	if m.migStrategy == ccAllocStrategy {
+		// Whole GPUs, like the MIG devices
+		return m.MIGAllocate(ctx, reqs)
+	}
+	injectAllocateLatency()
+	if m.migStrategy == canaryAllocStrategy {
+		return m.CanaryAllocate(ctx, reqs)
+	}
+	// The pod tells a retried request from a new pod getting the same devices
+	var pod *v1.Pod
+	var podUID types.UID
+	if podLookupEnabled() {
+		p, err := resolvePod(ctx, m.resourceName, reqs)
 		if err != nil {
-			panic(err.Error())
-		}
-		fmt.Println("[Allocate]")
-		for _, cursor := range pods.Items {
-			//fmt.Println("pod name", cursor.Name)
-			if cursor.Status.Phase == v1.PodPending {
-				match := true
-				minus := 0
-				for ctridx, ctr := range cursor.Spec.Containers {
-					nvcount, ok := ctr.Resources.Limits["nvidia.com/gpu"]
-					if !ok {
-						minus++
-						continue
-					}
-					reqv := reqs.ContainerRequests[ctridx-minus]
-					tmpstr := fmt.Sprint(len(reqv.DevicesIDs))
-					fmt.Println("pod", cursor.Name, "ctr", ctr.Name, "requires gpu", tmpstr, "nvcount=", nvcount.String())
-					if !nvcount.Equal(resource.MustParse(tmpstr)) {
-						match = false
-						break
-					}
-				}
-				if match {
-					fmt.Println("pod matched name=", cursor.Name)
-					targetpod = cursor
-				}
-			}
+			return nil, err
 		}
+		pod, podUID = &p, p.UID
+	}
+	checkpoint := func() (map[string]deviceAssignment, error) { return readCheckpointAssignments(m.resourceName) }
+	if response := m.allocations.get(reqs, podUID, checkpoint); response != nil {
+		log.Printf("Allocate of %s retried for %s, returning the previous response", m.resourceName, allocateKey(reqs))
+		return response, nil
 	}
-	responses := pluginapi.AllocateResponse{}
 	if m.vDeviceController != nil {
 		// release devices from kubelet checkpoint
-		if err := m.vDeviceController.updateFromCheckpoint(); err != nil {
+		if err := m.vDeviceController.updateFromCheckpoint(ctx); err != nil {
 			return nil, err
 		}
 	}
-	addnum := 0
-	for reqidx, req := range reqs.ContainerRequests {
-		ctrname := ""
-		if len(monitorMode) > 0 {
-			for {
-				ctrs := targetpod.Spec.Containers[reqidx+addnum]
-				_, ok := ctrs.Resources.Limits["nvidia.com/gpu"]
-				if !ok {
-					addnum++
-					continue
-				} else {
-					ctrname = ctrs.Name
-					break
-				}
-			}
-		}
-		reqDeviceIDs := req.DevicesIDs
-
-		if m.vDeviceController != nil {
-			// fix kubelet shutdown after Allocate
-			m.vDeviceController.releaseByRequest(req.DevicesIDs)
+	response, err := m.runAllocateStages(ctx, reqs, pod)
+	if err != nil {
+		return nil, err
+	}
+	m.allocations.put(reqs, podUID, response)
+	return response, nil
+}
 
-			availableIds := m.vDeviceController.available()
-			if len(availableIds) < len(req.DevicesIDs) {
-				return nil, fmt.Errorf("no enough devices")
+// findPendingPod returns the pending pod whose GPU requests match the allocate request
+func findPendingPod(ctx context.Context, resourceName string, reqs *pluginapi.AllocateRequest) (v1.Pod, error) {
+	ctx, end := startSpan(ctx, spanKubeAPI, spanAttributes{"k8s.operation": "list pods", "vgpu.resource": resourceName})
+	defer end()
+	targetpod := v1.Pod{}
+	clientset, err := newKubeClient()
+	if err != nil {
+		return targetpod, err
+	}
+	var pods *v1.PodList
+	err = retryKube(ctx, func(ctx context.Context) error {
+		pods, err = clientset.CoreV1().Pods("").List(ctx, nodePodsListOptions())
+		return err
+	})
+	if err != nil {
+		return targetpod, err
+	}
+	decision := &decisionRecord{Type: decisionPodMatch, Resource: resourceName}
+	for _, cursor := range pods.Items {
+		if cursor.Status.Phase == v1.PodPending {
+			match := true
+			reason := "matched"
+			var counts []*resource.Quantity
+			for _, ctr := range cursor.Spec.Containers {
+				if nvcount, ok := ctr.Resources.Limits[v1.ResourceName(resourceName)]; ok {
+					counts = append(counts, &nvcount)
+				}
 			}
-			preferReq := pluginapi.PreferredAllocationRequest{}
-			preferReq.ContainerRequests = make([]*pluginapi.ContainerPreferredAllocationRequest, 1)
-			preferReq.ContainerRequests[0] = &pluginapi.ContainerPreferredAllocationRequest{
-				AllocationSize:     int32(len(reqDeviceIDs)),
-				AvailableDeviceIDs: availableIds,
+			if len(counts) != len(reqs.ContainerRequests) {
+				match = false
+				reason = fmt.Sprintf("%d containers request %s, the allocation is for %d", len(counts), resourceName, len(reqs.ContainerRequests))
 			}
-			preferResp, err := m.GetPreferredAllocation(ctx, &preferReq)
-			if err != nil {
-				return nil, err
+			for i := 0; match && i < len(counts); i++ {
+				requested := resource.NewQuantity(int64(len(reqs.ContainerRequests[i].DevicesIDs)), resource.DecimalSI)
+				if !counts[i].Equal(*requested) {
+					match = false
+					reason = fmt.Sprintf("container %d requests %s, the allocation is for %s", i, counts[i].String(), requested.String())
+				}
 			}
-			if int32(len(preferResp.ContainerResponses[0].DeviceIDs)) == preferReq.ContainerRequests[0].AllocationSize {
-				reqDeviceIDs = preferResp.ContainerResponses[0].DeviceIDs
-			} else {
-				reqDeviceIDs = availableIds[0:len(req.DevicesIDs)]
-				log.Printf("Warn: get preferred failed")
+			if match {
+				targetpod = cursor
 			}
-			m.vDeviceController.acquire(req.DevicesIDs, reqDeviceIDs)
-		}
-
-		vdevices, err := VDevicesByIDs(m.vDevices, reqDeviceIDs)
-		if err != nil {
-			return nil, err
-		}
-
-		response := pluginapi.ContainerAllocateResponse{}
-
-		uuids := UniqueDeviceIDs(vdevices)
-		deviceIDs := m.deviceIDsFromUUIDs(uuids)
-
-		if deviceListStrategyFlag == DeviceListStrategyEnvvar {
-			response.Envs = m.apiEnvs(m.deviceListEnvvar, deviceIDs)
-		}
-		if deviceListStrategyFlag == DeviceListStrategyVolumeMounts {
-			response.Envs = m.apiEnvs(m.deviceListEnvvar, []string{deviceListAsVolumeMountsContainerPathRoot})
-			response.Mounts = m.apiMounts(deviceIDs)
-		}
-		if passDeviceSpecsFlag {
-			response.Devices = m.apiDeviceSpecs(nvidiaDriverRootFlag, uuids)
-		}
-
-		if m.vDeviceController != nil {
-			response.Annotations = make(map[string]string)
-			response.Annotations[annRequest] = strings.Join(req.DevicesIDs, annSep)
-			response.Annotations[annUsing] = strings.Join(reqDeviceIDs, annSep)
-			m.vDeviceController.acquire(req.DevicesIDs, reqDeviceIDs)
-		}
-		var mapEnvs []string
-		for i, vd := range vdevices {
-			limitKey := fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)
-			response.Envs[limitKey] = fmt.Sprintf("%vm", vd.memory)
-			mapEnvs = append(mapEnvs, fmt.Sprintf("%v:%v", i, vd.dev.ID))
-		}
-		response.Envs["CUDA_DEVICE_SM_LIMIT"] = strconv.Itoa(int(100 * deviceCoresScalingFlag / float64(deviceSplitCountFlag)))
-		response.Envs["NVIDIA_DEVICE_MAP"] = strings.Join(mapEnvs, " ")
-		if len(monitorMode) > 0 {
-			timestr := targetpod.Name + "_" + ctrname
-			os.MkdirAll("/usr/local/vgpu/shared/"+timestr, os.ModePerm)
-			response.Mounts = append(response.Mounts,
-				&pluginapi.Mount{ContainerPath: "/" + timestr,
-					HostPath: "/usr/local/vgpu/shared/" + timestr, ReadOnly: false})
-			fmt.Println("shared_path=", timestr)
-			response.Envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"] = fmt.Sprintf("/"+timestr+"/%v.cache", uuid.NewString())
-		} else {
-			response.Envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"] = fmt.Sprintf("/tmp/%v.cache", uuid.NewString())
-		}
-		if deviceMemoryScalingFlag > 1 {
-			response.Envs["CUDA_OVERSUBSCRIBE"] = "true"
-		}
-		
-		//response.Annotations = make(map[string]string)
-		//response.Annotations["CUDA-DEVICE-MEMORY-SHARED-CACHE"] = timestr
-		response.Mounts = append(response.Mounts,
-			&pluginapi.Mount{ContainerPath: "/usr/local/vgpu/libvgpu.so",
-				HostPath: "/usr/local/vgpu/libvgpu.so", ReadOnly: true},
-			&pluginapi.Mount{ContainerPath: "/etc/ld.so.preload",
-				HostPath: "/usr/local/vgpu/ld.so.preload", ReadOnly: true},
-			&pluginapi.Mount{ContainerPath: "/usr/local/vgpu/pciinfo.vgpu",
-				HostPath: os.Getenv("PCIBUSFILE"), ReadOnly: true},
-			&pluginapi.Mount{ContainerPath: "/usr/bin/vgpuvalidator",
-				HostPath: "/usr/local/vgpu/vgpuvalidator",ReadOnly:true},
-			&pluginapi.Mount{ContainerPath: "/vgpu",
-				HostPath: "/usr/local/vgpu/license",ReadOnly:true},
-			)
-		fmt.Println("mounts=",response.Mounts)
-		responses.ContainerResponses = append(responses.ContainerResponses, &response)
-
-		if verboseFlag > 5 {
-			log.Printf("Debug: allocate request %v, response %v\n",
-				req.DevicesIDs, reqDeviceIDs)
+			decision.Pods = append(decision.Pods, podDecision{Pod: cursor.Namespace + "/" + cursor.Name, Reason: reason})
 		}
 	}
-
-	return &responses, nil
+	if len(targetpod.UID) > 0 {
+		decision.Pod = targetpod.Namespace + "/" + targetpod.Name
+	}
+	decisions.write(decision)
+	return targetpod, nil
 }
 
-// PreStartContainer is unimplemented for this plugin
-func (m *NvidiaDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+// PreStartContainer publishes the device config of the container with --device-config-file
+func (m *NvidiaDevicePlugin) PreStartContainer(ctx context.Context, r *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if m.preStartRequired() {
+		if err := publishDeviceConfig(r.DevicesIDs); err != nil {
+			return nil, fmt.Errorf("failed to publish the device config of %v: %v", r.DevicesIDs, err)
+		}
+	}
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
-// dial establishes the gRPC communication with the registered device plugin.
-func (m *NvidiaDevicePlugin) dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
-	c, err := grpc.Dial(unixSocketPath, grpc.WithInsecure(), grpc.WithBlock(),
-		grpc.WithTimeout(timeout),
-		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
-			return net.DialTimeout("unix", addr, timeout)
-		}),
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return c, nil
+// preStartRequired returns true if the kubelet must call PreStartContainer before starting the
+// containers of the resource
+func (m *NvidiaDevicePlugin) preStartRequired() bool {
+	return deviceConfigFileFlag && m.migStrategy == MigStrategyNone
 }
 
 func (m *NvidiaDevicePlugin) deviceExists(id string) bool {
@@ -583,13 +653,18 @@ func (m *NvidiaDevicePlugin) deviceIDsFromUUIDs(uuids []string) []string {
 func (m *NvidiaDevicePlugin) apiDevices() []*pluginapi.Device {
 	var pdevs []*pluginapi.Device
 	if strings.Compare(m.migStrategy, "none") == 0 {
-		for _, d := range m.vDevices {
-			d.Health = d.dev.Health
-			pdevs = append(pdevs, &d.Device)
+		for _, d := range m.getVDevices() {
+			dev := d.Device
+			health, reason := d.dev.health()
+			dev.Health = health
+			if health != pluginapi.Healthy && verboseFlag > 5 {
+				log.Printf("Debug: vdevice %s unhealthy: %s", d.ID, reason)
+			}
+			pdevs = append(pdevs, &dev)
 		}
 	} else {
 		for _, d := range m.cachedDevices {
-			pdevs = append(pdevs, &d.Device)
+			pdevs = append(pdevs, d.apiDevice())
 		}
 	}
 	return pdevs
@@ -601,6 +676,17 @@ func (m *NvidiaDevicePlugin) apiEnvs(envvar string, deviceIDs []string) map[stri
 	}
 }
 
+// apiCDIAnnotations returns the annotation asking a CDI enabled runtime to inject the devices of
+// the given UUIDs, as named by nvidia-ctk cdi generate --device-name-strategy=uuid
+func (m *NvidiaDevicePlugin) apiCDIAnnotations(uuids []string) map[string]string {
+	var devices []string
+	for _, id := range uuids {
+		devices = append(devices, cdiKindFlag+"="+id)
+	}
+	key := cdiAnnotationPrefix + strings.NewReplacer("/", "_", ".", "-").Replace(m.resourceName)
+	return map[string]string{key: strings.Join(devices, ",")}
+}
+
 func (m *NvidiaDevicePlugin) apiMounts(deviceIDs []string) []*pluginapi.Mount {
 	var mounts []*pluginapi.Mount
 
@@ -615,6 +701,29 @@ func (m *NvidiaDevicePlugin) apiMounts(deviceIDs []string) []*pluginapi.Mount {
 	return mounts
 }
 
+// migCapDeviceSpecs returns the device specs of the nvidia-caps nodes of the MIG devices of
+// uuids, for container runtimes that do not inject them from the device list
+func migCapDeviceSpecs(driverRoot string, uuids []string) ([]*pluginapi.DeviceSpec, error) {
+	var specs []*pluginapi.DeviceSpec
+	for _, uuid := range uuids {
+		if !strings.HasPrefix(uuid, "MIG-") {
+			continue
+		}
+		paths, err := migCapDevicePaths(uuid)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			specs = append(specs, &pluginapi.DeviceSpec{
+				ContainerPath: p,
+				HostPath:      filepath.Join(driverRoot, p),
+				Permissions:   "rw",
+			})
+		}
+	}
+	return specs, nil
+}
+
 func (m *NvidiaDevicePlugin) apiDeviceSpecs(driverRoot string, uuids []string) []*pluginapi.DeviceSpec {
 	var specs []*pluginapi.DeviceSpec
 
@@ -636,17 +745,33 @@ func (m *NvidiaDevicePlugin) apiDeviceSpecs(driverRoot string, uuids []string) [
 		}
 	}
 
+	// The MIG devices of a GPU share its device node, and the MIG enabled GPUs given whole need
+	// the nvidia-caps nodes of their instances under strict device cgroup policies
+	capDevicePaths, err := GetMigCapabilityDevicePaths()
+	if err != nil {
+		log.Printf("Warning: failed to read the MIG capability devices: %v", err)
+	}
+	added := make(map[string]bool)
 	for _, d := range m.cachedDevices {
 		for _, id := range uuids {
-			if d.ID == id {
-				for _, p := range d.Paths {
-					spec := &pluginapi.DeviceSpec{
-						ContainerPath: p,
-						HostPath:      filepath.Join(driverRoot, p),
-						Permissions:   "rw",
-					}
-					specs = append(specs, spec)
+			if d.ID != id {
+				continue
+			}
+			paths := append([]string{}, d.Paths...)
+			if !strings.Contains(d.ID, "MIG") && len(d.Paths) > 0 {
+				paths = append(paths, migInstanceCapabilityPaths(capDevicePaths, d.Paths[0])...)
+			}
+			for _, p := range paths {
+				if added[p] {
+					continue
+				}
+				added[p] = true
+				spec := &pluginapi.DeviceSpec{
+					ContainerPath: p,
+					HostPath:      filepath.Join(driverRoot, p),
+					Permissions:   "rw",
 				}
+				specs = append(specs, spec)
 			}
 		}
 	}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"golang.org/x/net/context"
+
+	"github.com/NVIDIA/k8s-device-plugin/tests/fakekubelet"
+)
+
+// fakeGPULib is a gpuLib of GPUs that do not exist, for the tests running without NVML
+type fakeGPULib struct {
+	gpus []*nvml.Device
+}
+
+// newFakeGPULib returns count fake GPUs of the model with the memory in MiB
+func newFakeGPULib(count int, model string, memory uint64) *fakeGPULib {
+	l := &fakeGPULib{}
+	for i := 0; i < count; i++ {
+		name, mem, major, minor := model, memory, 7, 0
+		l.gpus = append(l.gpus, &nvml.Device{
+			UUID:                  fmt.Sprintf("GPU-fake-%d", i),
+			Path:                  fmt.Sprintf("/dev/nvidia%d", i),
+			Model:                 &name,
+			Memory:                &mem,
+			PCI:                   nvml.PCIInfo{BusID: fmt.Sprintf("00000000:%02x:00.0", i+1)},
+			CudaComputeCapability: nvml.CudaComputeCapabilityInfo{Major: &major, Minor: &minor},
+		})
+	}
+	return l
+}
+
+func (l *fakeGPULib) deviceCount() (uint, error) {
+	return uint(len(l.gpus)), nil
+}
+
+func (l *fakeGPULib) deviceAt(i uint) (*nvml.Device, bool, error) {
+	if i >= uint(len(l.gpus)) {
+		return nil, false, fmt.Errorf("no GPU %d", i)
+	}
+	return l.gpus[i], false, nil
+}
+
+func (l *fakeGPULib) deviceByUUID(uuid string) (*nvml.Device, error) {
+	for _, d := range l.gpus {
+		if d.UUID == uuid {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("no GPU %s", uuid)
+}
+
+// useFakeGPUs replaces the GPUs of the node with the fake ones and returns the function
+// restoring them
+func useFakeGPUs(l *fakeGPULib) func() {
+	previous := gpuLibrary
+	gpuLibrary = l
+	gpuModelsMux.Lock()
+	gpuModels = make(map[string]*gpuModel)
+	gpuModelsMux.Unlock()
+	return func() { gpuLibrary = previous }
+}
+
+// parseTestFlags sets the flag variables from their defaults and args, as the plugin does at
+// startup
+func parseTestFlags(t *testing.T, args ...string) {
+	app := newApp()
+	app.Commands = nil
+	app.Action = loadFlags
+	if err := app.Run(append([]string{"nvidia-device-plugin"}, args...)); err != nil {
+		t.Fatalf("invalid flags %v: %v", args, err)
+	}
+}
+
+// startTestPlugin starts the plugin of nvidia.com/gpu with the flags on 2 fake T4 GPUs of
+// 16384 MiB, registered to a fake kubelet, and returns it with the function stopping them
+func startTestPlugin(t *testing.T, args ...string) (*NvidiaDevicePlugin, *fakekubelet.Plugin, func()) {
+	var cleanup []func()
+	stop := func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+	defer func() {
+		if t.Failed() {
+			stop()
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "vgpu-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = append(cleanup, func() { os.RemoveAll(dir) })
+	cleanup = append(cleanup, useFakeGPUs(newFakeGPULib(2, "Tesla T4", 16384)))
+	os.Setenv(envDisableHealthChecks, "all")
+	cleanup = append(cleanup, func() { os.Unsetenv(envDisableHealthChecks) })
+	parseTestFlags(t, append([]string{"--device-plugin-dir=" + dir}, args...)...)
+	previousDir := devicePluginDir
+	devicePluginDir = dir
+	cleanup = append(cleanup, func() { devicePluginDir = previousDir })
+	// Any shared library of the architecture passes for a libvgpu.so of protocol version 1
+	previousLibrary := vgpuLibraryPath
+	if vgpuLibraryPath, err = os.Executable(); err != nil {
+		t.Fatal(err)
+	}
+	cleanup = append(cleanup, func() { vgpuLibraryPath = previousLibrary })
+
+	k, err := fakekubelet.Start(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = append(cleanup, k.Stop)
+
+	plugin := NewNvidiaDevicePlugin("nvidia.com/gpu", NewGpuDeviceManager(false), "NVIDIA_VISIBLE_DEVICES",
+		nil, devicePluginSocket("nvidia-gpu.sock"))
+	if err := plugin.Start(); err != nil {
+		t.Fatal(err)
+	}
+	cleanup = append(cleanup, func() { plugin.Stop() })
+
+	p, err := k.WaitForPlugin("nvidia.com/gpu", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plugin, p, stop
+}
+
+// TestStartRegisterAllocate runs the plugin against a fake kubelet on fake GPUs: it must
+// register, advertise the vDevices of the GPUs and allocate them with their memory limit
+func TestStartRegisterAllocate(t *testing.T) {
+	_, p, stop := startTestPlugin(t, "--device-split-count=2")
+	defer stop()
+
+	devices, err := p.WaitForDevices(4, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 4 {
+		t.Fatalf("advertised %d vDevices, expected 2 for each of the 2 GPUs", len(devices))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := p.Allocate(ctx, []string{devices[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs := resp.ContainerResponses[0].Envs
+	gpu := devices[0].ID[:strings.LastIndex(devices[0].ID, "-")]
+	if envs["NVIDIA_VISIBLE_DEVICES"] != gpu {
+		t.Errorf("NVIDIA_VISIBLE_DEVICES is %q, expected %q", envs["NVIDIA_VISIBLE_DEVICES"], gpu)
+	}
+	if limit := envs["CUDA_DEVICE_MEMORY_LIMIT_0"]; limit != formatMemoryLimit(8192) {
+		t.Errorf("CUDA_DEVICE_MEMORY_LIMIT_0 is %q, expected half of the GPU: %q", limit, formatMemoryLimit(8192))
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sharedCacheQuotaInterval is the interval at which the size of the shared cache is measured
+const sharedCacheQuotaInterval = 30 * time.Second
+
+// eventSharedCacheQuota is the device lifecycle event type of the shared cache quota changes
+const eventSharedCacheQuota = "shared-cache-quota"
+
+// sharedCacheQuota is non-nil when --shared-cache-quota or --shared-cache-dir-limit is set
+var sharedCacheQuota *SharedCacheQuota
+
+// sharedCacheQuotaMiB and sharedCacheDirLimitMiB are the parsed --shared-cache-quota and
+// --shared-cache-dir-limit
+var sharedCacheQuotaMiB, sharedCacheDirLimitMiB uint64
+
+// SharedCacheQuota periodically measures the disk used by the shared cache directories of the
+// containers, reporting the directories above the per container limit and refusing new shared
+// cache allocations while the total is above the quota
+type SharedCacheQuota struct {
+	mux sync.Mutex
+	// quota and dirLimit are in MiB, 0 when not set
+	quota    uint64
+	dirLimit uint64
+	nodeName string
+	// used is the disk used by all the directories in bytes, dirs the one of each directory
+	used     uint64
+	dirs     map[string]uint64
+	exceeded bool
+	oversize map[string]bool
+}
+
+// NewSharedCacheQuota returns a reference to a new SharedCacheQuota, sizes are in MiB
+func NewSharedCacheQuota(quota, dirLimit uint64, nodeName string) *SharedCacheQuota {
+	return &SharedCacheQuota{
+		quota:    quota,
+		dirLimit: dirLimit,
+		nodeName: nodeName,
+		dirs:     make(map[string]uint64),
+		oversize: make(map[string]bool),
+	}
+}
+
+// diskUsage returns the bytes of disk or memory allocated to the files under dir, which is less
+// than their size for the sparse cache files
+func diskUsage(dir string) uint64 {
+	var used uint64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			used += uint64(st.Blocks) * 512
+		}
+		return nil
+	})
+	return used
+}
+
+// check measures the directories and reports the quota and limits being exceeded
+func (q *SharedCacheQuota) check() {
+	dirs := make(map[string]uint64)
+	var used uint64
+	for _, root := range cacheDirRoots() {
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			dir := filepath.Join(root, e.Name())
+			dirs[dir] = diskUsage(dir)
+			used += dirs[dir]
+		}
+	}
+	oversize := make(map[string]bool)
+	if q.dirLimit > 0 {
+		for dir, size := range dirs {
+			if size > q.dirLimit<<20 {
+				oversize[dir] = true
+			}
+		}
+	}
+	exceeded := q.quota > 0 && used > q.quota<<20
+
+	q.mux.Lock()
+	wasExceeded, previous := q.exceeded, q.oversize
+	q.used, q.dirs, q.exceeded, q.oversize = used, dirs, exceeded, oversize
+	q.mux.Unlock()
+
+	if exceeded && !wasExceeded {
+		q.report("SharedCacheQuotaExceeded", fmt.Sprintf("The shared cache directories use %vMiB, more than the quota of %vMiB, new containers are refused a shared cache", used>>20, q.quota))
+	} else if !exceeded && wasExceeded {
+		log.Printf("The shared cache directories use %vMiB, within the quota of %vMiB again", used>>20, q.quota)
+		recordEvent(eventSharedCacheQuota, "", nil, "shared cache back within quota")
+	}
+	var newOversize []string
+	for dir := range oversize {
+		if !previous[dir] {
+			newOversize = append(newOversize, dir)
+		}
+	}
+	sort.Strings(newOversize)
+	for _, dir := range newOversize {
+		q.report("SharedCacheDirTooLarge", fmt.Sprintf("The shared cache directory %s uses %vMiB, more than the limit of %vMiB per container", dir, dirs[dir]>>20, q.dirLimit))
+	}
+}
+
+// report logs a limit being exceeded and creates a node event for it
+func (q *SharedCacheQuota) report(reason, message string) {
+	log.Printf("Warning: %s", message)
+	recordEvent(eventSharedCacheQuota, "", nil, "%s", message)
+	if q.nodeName == "" {
+		return
+	}
+	if err := createNodeEvent(q.nodeName, reason, message); err != nil {
+		log.Printf("Warning: failed to create the %s node event: %v", reason, err)
+	}
+}
+
+// admit fails while the shared cache is above the quota
+func (q *SharedCacheQuota) admit() error {
+	if q == nil {
+		return nil
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.exceeded {
+		return fmt.Errorf("the shared cache directories use %vMiB, more than --shared-cache-quota of %vMiB", q.used>>20, q.quota)
+	}
+	return nil
+}
+
+// run checks the directories every sharedCacheQuotaInterval until stop is closed
+func (q *SharedCacheQuota) run(stop <-chan struct{}) {
+	for {
+		q.check()
+		select {
+		case <-stop:
+			return
+		case <-time.After(sharedCacheQuotaInterval):
+		}
+	}
+}
+
+func (q *SharedCacheQuota) writeMetrics(w io.Writer) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	fmt.Fprintln(w, "# HELP vgpu_shared_cache_bytes Disk used by the shared cache directories of the containers.")
+	fmt.Fprintln(w, "# TYPE vgpu_shared_cache_bytes gauge")
+	fmt.Fprintf(w, "vgpu_shared_cache_bytes %d\n", q.used)
+	fmt.Fprintln(w, "# HELP vgpu_shared_cache_quota_exceeded 1 while the shared cache uses more than --shared-cache-quota.")
+	fmt.Fprintln(w, "# TYPE vgpu_shared_cache_quota_exceeded gauge")
+	value := 0
+	if q.exceeded {
+		value = 1
+	}
+	fmt.Fprintf(w, "vgpu_shared_cache_quota_exceeded %d\n", value)
+	fmt.Fprintln(w, "# HELP vgpu_shared_cache_oversize_dirs Shared cache directories above --shared-cache-dir-limit.")
+	fmt.Fprintln(w, "# TYPE vgpu_shared_cache_oversize_dirs gauge")
+	fmt.Fprintf(w, "vgpu_shared_cache_oversize_dirs %d\n", len(q.oversize))
+}
+
+// newSharedCacheQuotaFromFlags returns a SharedCacheQuota for the node of the plugin
+func newSharedCacheQuotaFromFlags() *SharedCacheQuota {
+	return NewSharedCacheQuota(sharedCacheQuotaMiB, sharedCacheDirLimitMiB, os.Getenv("NODE_NAME"))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// sharedCacheRoot is the host directory of the per container shared cache directories when
+// --numa-shared-cache-dir is not set
+const sharedCacheRoot = "/usr/local/vgpu/shared"
+
+// writableContainerDir is where containers get their writable files with --read-only-rootfs
+const writableContainerDir = "/run/vgpu"
+
+// tmpfsMagic is the statfs type of tmpfs
+const tmpfsMagic = 0x01021994
+
+// gpuNUMANode returns the NUMA node of the first GPU of the allocation, or -1 if unknown
+func gpuNUMANode(vdevices []*VDevice) int64 {
+	if len(vdevices) == 0 || vdevices[0].dev.Topology == nil || len(vdevices[0].dev.Topology.Nodes) == 0 {
+		return -1
+	}
+	return vdevices[0].dev.Topology.Nodes[0].ID
+}
+
+// sharedCacheDir returns the host directory holding the shared cache directories of the
+// containers using GPUs of a NUMA node, sharedCacheRoot if there is no NUMA local directory
+func sharedCacheDir(numaNode int64) string {
+	if numaSharedCacheDirFlag == "" || numaNode < 0 {
+		return sharedCacheRoot
+	}
+	return fmt.Sprintf(numaSharedCacheDirFlag, numaNode)
+}
+
+// checkSharedCacheDirs warns about the NUMA local directories of the GPUs of the node that are
+// not tmpfs mounts, whose cache would live on disk instead of in the memory of the node
+func checkSharedCacheDirs() {
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		if err != nil || d.CPUAffinity == nil {
+			continue
+		}
+		dir := sharedCacheDir(int64(*d.CPUAffinity))
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			log.Printf("Warning: shared cache directory %s of NUMA node %d is not usable: %v", dir, *d.CPUAffinity, err)
+			continue
+		}
+		if st.Type != tmpfsMagic {
+			log.Printf("Warning: shared cache directory %s of NUMA node %d is not a tmpfs mount, mount one with mpol=bind:%d", dir, *d.CPUAffinity, *d.CPUAffinity)
+		}
+	}
+}
+
+// validNUMASharedCacheDir returns an error if the template does not give one absolute directory
+// per NUMA node
+func validNUMASharedCacheDir(template string) error {
+	if strings.Count(template, "%d") != 1 || strings.Count(template, "%") != 1 {
+		return fmt.Errorf("%q must contain %%d once for the NUMA node", template)
+	}
+	if !filepath.IsAbs(template) {
+		return fmt.Errorf("%q is not an absolute path", template)
+	}
+	return nil
+}
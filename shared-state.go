@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// deviceState is the device state shared by the plugins of the process. The plugins serving the
+// same GPUs under several resource names, each on its own socket, see the same Device health and
+// the same vDevices, and acquire these through the same vDevice controller. NVML is initialized
+// once for the process and shared as well.
+type deviceState struct {
+	mux     sync.Mutex
+	devices map[string]*Device
+	// vdevices are the vDevices of each GPU by device ID
+	vdevices map[string][]*VDevice
+	// controllers are the vDevice controllers by vDevice set, see controllerKey
+	controllers map[string]*sharedController
+}
+
+// sharedController is a vDevice controller and the number of plugins using it
+type sharedController struct {
+	controller *VDeviceController
+	users      int
+}
+
+// sharedDevices is the device state of the running plugins, reset when they restart
+var sharedDevices = newDeviceState()
+
+func newDeviceState() *deviceState {
+	return &deviceState{
+		devices:     make(map[string]*Device),
+		vdevices:    make(map[string][]*VDevice),
+		controllers: make(map[string]*sharedController),
+	}
+}
+
+// reset forgets the devices once all the plugins are stopped, so that they are enumerated again
+func (s *deviceState) reset() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.devices = make(map[string]*Device)
+	s.vdevices = make(map[string][]*VDevice)
+	s.controllers = make(map[string]*sharedController)
+}
+
+// devicesOf returns the shared Device of each device enumerated by a plugin
+func (s *deviceState) devicesOf(devices []*Device) []*Device {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	shared := make([]*Device, len(devices))
+	for i, d := range devices {
+		if known, ok := s.devices[d.ID]; ok {
+			shared[i] = known
+			continue
+		}
+		s.devices[d.ID] = d
+		shared[i] = d
+	}
+	return shared
+}
+
+// vDevicesOf returns the vDevices of shared devices, splitting the devices seen for the first time
+func (s *deviceState) vDevicesOf(devices []*Device) []*VDevice {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var unknown []*Device
+	for _, d := range devices {
+		if _, ok := s.vdevices[d.ID]; !ok {
+			unknown = append(unknown, d)
+		}
+	}
+	for _, vd := range Device2VDevice(unknown) {
+		s.vdevices[vd.dev.ID] = append(s.vdevices[vd.dev.ID], vd)
+	}
+	var vdevices []*VDevice
+	for _, d := range devices {
+		vdevices = append(vdevices, s.vdevices[d.ID]...)
+	}
+	return vdevices
+}
+
+// controllerKey identifies a set of vDevices
+func controllerKey(vdevices []*VDevice) string {
+	ids := make([]string, len(vdevices))
+	for i, vd := range vdevices {
+		ids[i] = vd.ID
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, annSep)
+}
+
+// acquireController returns the vDevice controller of the vDevices of a plugin, creating it for
+// the first plugin serving them
+func (s *deviceState) acquireController(resourceName string, vdevices []*VDevice) *VDeviceController {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	key := controllerKey(vdevices)
+	if c, ok := s.controllers[key]; ok {
+		c.users++
+		c.controller.addResource(resourceName)
+		return c.controller
+	}
+	ids := make([]string, len(vdevices))
+	for i, vd := range vdevices {
+		ids[i] = vd.ID
+	}
+	controller := newVDeviceController(resourceName, ids)
+	controller.initialize()
+	s.controllers[key] = &sharedController{controller: controller, users: 1}
+	return controller
+}
+
+// releaseController cleans a vDevice controller up once no plugin uses it anymore
+func (s *deviceState) releaseController(controller *VDeviceController) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for key, c := range s.controllers {
+		if c.controller != controller {
+			continue
+		}
+		c.users--
+		if c.users == 0 {
+			controller.cleanup()
+			delete(s.controllers, key)
+		}
+		return
+	}
+	controller.cleanup()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// Placement policies of the simulate command
+const (
+	simPolicyFirst  = "first"
+	simPolicyPack   = "pack"
+	simPolicySpread = "spread"
+)
+
+// simGPU is a physical GPU of the simulation
+type simGPU struct {
+	uuid       string
+	memory     uint64
+	slots      int
+	usedSlots  int
+	usedMemory uint64
+}
+
+// simAllocation is the placement of the vDevices of a traced allocation
+type simAllocation struct {
+	gpus   []int
+	memory []uint64
+}
+
+// simResult summarizes the replay of a trace with one configuration
+type simResult struct {
+	policy        string
+	splitCount    uint
+	memoryScaling float64
+	allocated     int
+	failed        int
+	samples       int
+	packing       float64
+	fragmentation float64
+	busyGPUs      float64
+}
+
+// simulateTrace is the action of the simulate command
+func simulateTrace(c *cli.Context) error {
+	records, err := readTrace(c.String("trace"))
+	if err != nil {
+		return err
+	}
+	var inventory []traceGPU
+	seen := make(map[string]bool)
+	var splitCount uint
+	var memoryScaling float64
+	for _, r := range records {
+		if r.Type != traceInventory {
+			continue
+		}
+		if splitCount == 0 {
+			splitCount, memoryScaling = r.SplitCount, r.MemoryScaling
+		}
+		for _, g := range r.GPUs {
+			if !seen[g.UUID] {
+				seen[g.UUID] = true
+				inventory = append(inventory, g)
+			}
+		}
+	}
+	if len(inventory) == 0 {
+		return fmt.Errorf("no inventory record in %s, was it recorded with --record-file?", c.String("trace"))
+	}
+
+	splitCounts := []uint{splitCount}
+	if s := c.String("split-counts"); s != "" {
+		splitCounts = nil
+		for _, v := range strings.Split(s, ",") {
+			n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+			if err != nil || n == 0 {
+				return fmt.Errorf("invalid --split-counts option: %v", s)
+			}
+			splitCounts = append(splitCounts, uint(n))
+		}
+	}
+	scalings := []float64{memoryScaling}
+	if s := c.String("memory-scalings"); s != "" {
+		scalings = nil
+		for _, v := range strings.Split(s, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || f <= 0 {
+				return fmt.Errorf("invalid --memory-scalings option: %v", s)
+			}
+			scalings = append(scalings, f)
+		}
+	}
+	var policies []string
+	for _, p := range strings.Split(c.String("policies"), ",") {
+		p = strings.TrimSpace(p)
+		if p != simPolicyFirst && p != simPolicyPack && p != simPolicySpread {
+			return fmt.Errorf("invalid --policies option: %v", p)
+		}
+		policies = append(policies, p)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POLICY\tSPLIT\tSCALING\tALLOCATED\tFAILED\tPACKING\tFRAGMENTATION\tBUSY GPUS")
+	for _, policy := range policies {
+		for _, split := range splitCounts {
+			for _, scaling := range scalings {
+				r := replayTrace(records, inventory, policy, split, scaling)
+				fmt.Fprintf(w, "%s\t%d\t%.2f\t%d\t%d\t%.1f%%\t%.1f%%\t%.2f\n", r.policy, r.splitCount, r.memoryScaling,
+					r.allocated, r.failed, r.packing*100, r.fragmentation*100, r.busyGPUs)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// readTrace reads the records of an allocation trace
+func readTrace(path string) ([]*traceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*traceRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		r := &traceRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// replayTrace places the traced allocations on the inventory with the given configuration.
+// Packing is the memory granted over the memory of the GPUs in use, fragmentation the free
+// memory stranded on GPUs in use over all free memory, both averaged after each event.
+func replayTrace(records []*traceRecord, inventory []traceGPU, policy string, split uint, scaling float64) simResult {
+	res := simResult{policy: policy, splitCount: split, memoryScaling: scaling}
+	gpus := make([]*simGPU, len(inventory))
+	for i, g := range inventory {
+		gpus[i] = &simGPU{uuid: g.UUID, memory: uint64(float64(g.Memory) * scaling), slots: int(split)}
+	}
+	// placed maps the traced vDevice IDs to the simulated allocation replacing them
+	placed := make(map[string]*simAllocation)
+
+	for _, r := range records {
+		switch r.Type {
+		case traceAllocate:
+			a := placeAllocation(gpus, r, policy, split)
+			if a == nil {
+				res.failed++
+				continue
+			}
+			res.allocated++
+			for _, id := range r.Devices {
+				placed[id] = a
+			}
+		case traceRelease:
+			for _, id := range r.Devices {
+				a, ok := placed[id]
+				if !ok {
+					continue
+				}
+				for i, g := range a.gpus {
+					gpus[g].usedSlots--
+					gpus[g].usedMemory -= a.memory[i]
+				}
+				for k, v := range placed {
+					if v == a {
+						delete(placed, k)
+					}
+				}
+			}
+		default:
+			continue
+		}
+
+		var busyCapacity, used, free, stranded uint64
+		busy := 0
+		for _, g := range gpus {
+			free += g.memory - g.usedMemory
+			if g.usedSlots == 0 {
+				continue
+			}
+			busy++
+			busyCapacity += g.memory
+			used += g.usedMemory
+			stranded += g.memory - g.usedMemory
+		}
+		res.samples++
+		res.busyGPUs += float64(busy)
+		if busyCapacity > 0 {
+			res.packing += float64(used) / float64(busyCapacity)
+		}
+		if free > 0 {
+			res.fragmentation += float64(stranded) / float64(free)
+		}
+	}
+	if res.samples > 0 {
+		res.packing /= float64(res.samples)
+		res.fragmentation /= float64(res.samples)
+		res.busyGPUs /= float64(res.samples)
+	}
+	return res
+}
+
+// placeAllocation places the vDevices of an allocate record on distinct GPUs, or returns nil
+func placeAllocation(gpus []*simGPU, r *traceRecord, policy string, split uint) *simAllocation {
+	order := make([]int, len(gpus))
+	for i := range order {
+		order[i] = i
+	}
+	switch policy {
+	case simPolicyPack:
+		sort.SliceStable(order, func(i, j int) bool { return gpus[order[i]].usedMemory > gpus[order[j]].usedMemory })
+	case simPolicySpread:
+		sort.SliceStable(order, func(i, j int) bool { return gpus[order[i]].usedMemory < gpus[order[j]].usedMemory })
+	}
+
+	a := &simAllocation{}
+	used := make(map[int]bool)
+	for i := 0; i < r.Size; i++ {
+		var memory uint64
+		if i < len(r.Memory) {
+			memory = r.Memory[i]
+		}
+		found := false
+		for _, g := range order {
+			need := memory
+			if need == 0 {
+				need = gpus[g].memory / uint64(split)
+			}
+			if used[g] || gpus[g].usedSlots >= gpus[g].slots || gpus[g].memory-gpus[g].usedMemory < need {
+				continue
+			}
+			used[g] = true
+			a.gpus = append(a.gpus, g)
+			a.memory = append(a.memory, need)
+			found = true
+			break
+		}
+		if !found {
+			return nil
+		}
+	}
+	for i, g := range a.gpus {
+		gpus[g].usedSlots++
+		gpus[g].usedMemory += a.memory[i]
+	}
+	return a
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// annSpread overrides --spread-vdevices for a pod: "true" gives each vDevice of a container its
+// own GPU, "false" lets them share one
+const annSpread = "nvidia.com/vgpu-spread"
+
+// stageSpread is the allocation stage checking the vDevices of spread containers
+const stageSpread = "spread"
+
+func init() {
+	registerAllocateStage(stageSpread, stageSelectVDevices, spreadStage)
+}
+
+// podSpreads returns true if each vDevice of the containers of the pod must be on its own GPU
+func podSpreads(pod *v1.Pod) (bool, error) {
+	value, ok := pod.Annotations[annSpread]
+	if !podAnnotationsFlag || len(pod.UID) == 0 || !ok {
+		return spreadVDevicesFlag, nil
+	}
+	spread, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation on pod %s: %q", annSpread, pod.Name, value)
+	}
+	return spread, nil
+}
+
+// spreadStage refuses several vDevices of one GPU for a container of a spread pod. The preferred
+// allocation already puts the vDevices on distinct GPUs whenever there are enough of them.
+func spreadStage(a *containerAllocation) error {
+	if len(a.uuids) == len(a.vdevices) {
+		return nil
+	}
+	spread, err := podSpreads(&a.pod)
+	if err != nil || !spread {
+		return err
+	}
+	return fmt.Errorf("%d vDevices requested on distinct GPUs for pod %s, got %d GPUs", len(a.vdevices), a.pod.Name, len(a.uuids))
+}
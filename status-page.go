@@ -0,0 +1,112 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// statusPageEvents is the number of recent events shown on the status page
+const statusPageEvents = 50
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(part, total uint64) uint64 {
+		if total == 0 {
+			return 0
+		}
+		if part > total {
+			return 100
+		}
+		return part * 100 / total
+	},
+	"occupancy": func(vds []vDeviceStatus) int {
+		if len(vds) == 0 {
+			return 0
+		}
+		n := 0
+		for _, vd := range vds {
+			if vd.PodUID != "" {
+				n++
+			}
+		}
+		return n * 100 / len(vds)
+	},
+	"assigned": func(vds []vDeviceStatus) int {
+		n := 0
+		for _, vd := range vds {
+			if vd.PodUID != "" {
+				n++
+			}
+		}
+		return n
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>vGPU status {{.Status.Node}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.bar { width: 200px; height: 12px; background: #eee; }
+.fill { height: 12px; background: #4a8; }
+.over { background: #d54; }
+.Unhealthy { color: #d54; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>vGPU status {{.Status.Node}}</h1>
+<table>
+<tr><th>GPU</th><th>Resource</th><th>Health</th><th>vDevices in use</th><th>Memory granted / physical (MiB)</th></tr>
+{{range .Status.Devices}}
+<tr>
+<td>{{.UUID}}</td>
+<td>{{.Resource}}</td>
+<td class="{{.Health}}">{{.Health}} {{.HealthReason}}</td>
+<td><div class="bar"><div class="fill" style="width: {{occupancy .VDevices}}%"></div></div>{{assigned .VDevices}} / {{len .VDevices}}</td>
+<td><div class="bar"><div class="fill{{if gt .MemoryGranted .MemoryTotal}} over{{end}}" style="width: {{percent .MemoryGranted .MemoryTotal}}%"></div></div>{{.MemoryGranted}} / {{.MemoryTotal}}</td>
+</tr>
+{{range .VDevices}}
+<tr><td colspan="2">&nbsp;&nbsp;{{.ID}}</td><td class="{{.Health}}">{{.Health}}</td><td>{{if .Pod}}{{.Pod}}{{else}}{{.PodUID}}{{end}} {{.Container}}</td><td>{{.Memory}}</td></tr>
+{{end}}
+{{end}}
+</table>
+<h2>Recent events</h2>
+<table>
+<tr><th>Time</th><th>Type</th><th>Resource</th><th>Devices</th><th>Message</th></tr>
+{{range .Events}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Type}}</td><td>{{.Resource}}</td><td>{{range .Devices}}{{.}} {{end}}</td><td>{{.Message}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// serveStatusPage renders a read-only HTML overview of the GPUs and recent events of the node
+func serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	events := deviceEvents.list()
+	if len(events) > statusPageEvents {
+		events = events[len(events)-statusPageEvents:]
+	}
+	// Show the most recent events first
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	data := struct {
+		Status *nodeStatus
+		Events []deviceEvent
+	}{
+		Status: collectNodeStatus(),
+		Events: events,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, data); err != nil {
+		log.Printf("Error: failed to render status page: %v", err)
+	}
+}
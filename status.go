@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"golang.org/x/net/context"
+)
+
+// nodeStatus is the state of the GPUs of the node served on /debug/devices
+type nodeStatus struct {
+	Node    string         `json:"node"`
+	Devices []deviceStatus `json:"devices"`
+}
+
+// deviceStatus is the state of one physical GPU; memory is in MiB
+type deviceStatus struct {
+	UUID          string `json:"uuid"`
+	Resource      string `json:"resource"`
+	Health        string `json:"health"`
+	HealthReason  string `json:"healthReason,omitempty"`
+	MemoryTotal   uint64 `json:"memoryTotal"`
+	MemoryGranted uint64 `json:"memoryGranted"`
+	// Confidential is set for the GPUs in confidential computing mode, advertised whole
+	Confidential bool            `json:"confidential,omitempty"`
+	VDevices     []vDeviceStatus `json:"vdevices"`
+}
+
+// vDeviceStatus is the state of one vDevice and the container it is assigned to, if any
+type vDeviceStatus struct {
+	ID        string `json:"id"`
+	Memory    uint64 `json:"memory"`
+	Health    string `json:"health"`
+	Pod       string `json:"pod,omitempty"`
+	PodUID    string `json:"podUID,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+// deviceAssignment is the container a device was allocated to according to the kubelet
+type deviceAssignment struct {
+	podUID    string
+	container string
+}
+
+// readCheckpointAssignments returns the kubelet device assignments of a resource keyed by device ID
+func readCheckpointAssignments(resourceName string) (map[string]deviceAssignment, error) {
+	cp, err := readKubeletCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	podDevices, _ := cp.GetData()
+	assignments := make(map[string]deviceAssignment)
+	for _, pde := range podDevices {
+		if pde.ResourceName != resourceName {
+			continue
+		}
+		for _, id := range pde.DeviceIDs {
+			assignments[id] = deviceAssignment{podUID: pde.PodUID, container: pde.ContainerName}
+		}
+	}
+	return assignments, nil
+}
+
+// podNamesByUID returns "namespace/name" of the pods on this node keyed by UID
+func podNamesByUID() map[string]string {
+	names := make(map[string]string)
+	client, err := newKubeClient()
+	if err != nil {
+		return names
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	opts := nodePodsListOptions()
+	pods, err := client.CoreV1().Pods("").List(ctx, opts)
+	if err != nil {
+		log.Printf("Warning: failed to list pods for status: %v", err)
+		return names
+	}
+	for _, p := range pods.Items {
+		names[string(p.UID)] = p.Namespace + "/" + p.Name
+	}
+	return names
+}
+
+// deviceStatuses returns the state of the physical GPUs served by the plugin
+func (m *NvidiaDevicePlugin) deviceStatuses(podNames map[string]string) []deviceStatus {
+	assignments, err := readCheckpointAssignments(m.resourceName)
+	if err != nil {
+		log.Printf("Warning: failed to read kubelet checkpoint: %v", err)
+	}
+	vdevices := m.getVDevices()
+	var statuses []deviceStatus
+	for _, d := range m.cachedDevices {
+		health, reason := d.health()
+		s := deviceStatus{
+			UUID:         d.ID,
+			Resource:     m.resourceName,
+			Health:       health,
+			HealthReason: reason,
+			Confidential: m.migStrategy == ccAllocStrategy,
+		}
+		if !strings.Contains(d.ID, "MIG") {
+			if dev, err := nvml.NewDeviceByUUID(d.ID); err == nil && dev.Memory != nil {
+				s.MemoryTotal = *dev.Memory
+			}
+		}
+		for _, vd := range vdevices {
+			if vd.dev != d {
+				continue
+			}
+			vs := vDeviceStatus{ID: vd.ID, Memory: vd.memory, Health: health}
+			if a, ok := assignments[vd.ID]; ok {
+				vs.PodUID = a.podUID
+				vs.Pod = podNames[a.podUID]
+				vs.Container = a.container
+				s.MemoryGranted += vd.memory
+			}
+			s.VDevices = append(s.VDevices, vs)
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// collectNodeStatus returns the state of all the GPUs served by the running plugins
+func collectNodeStatus() *nodeStatus {
+	status := &nodeStatus{Node: os.Getenv("NODE_NAME")}
+	podNames := podNamesByUID()
+	for _, p := range getAdminPlugins() {
+		status.Devices = append(status.Devices, p.deviceStatuses(podNames)...)
+	}
+	return status
+}
+
+func serveDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collectNodeStatus())
+}
@@ -0,0 +1,260 @@
+// Package fakekubelet implements the kubelet side of the device plugin API, so that the
+// registration, ListAndWatch and Allocate flow of the plugin can be exercised without a kubelet.
+//
+// A test starts a Kubelet in a temporary directory, starts the plugin with
+// --device-plugin-dir pointing at the same directory, waits for the registration of the
+// resource and then allocates its devices:
+//
+//	k, err := fakekubelet.Start(dir)
+//	...
+//	defer k.Stop()
+//	p, err := k.WaitForPlugin("nvidia.com/gpu", time.Minute)
+//	...
+//	devices, err := p.WaitForDevices(1, time.Minute)
+//	...
+//	resp, err := p.Allocate(ctx, []string{devices[0].ID})
+package fakekubelet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// KubeletSocket is the name of the registration socket in the device plugin directory
+const KubeletSocket = "kubelet.sock"
+
+// Kubelet serves the registration service and connects to the plugins registering with it
+type Kubelet struct {
+	dir    string
+	server *grpc.Server
+
+	mux     sync.Mutex
+	cond    *sync.Cond
+	plugins map[string]*Plugin
+	stopped bool
+}
+
+// Plugin is a plugin registered with the Kubelet
+type Plugin struct {
+	// Request is the registration request of the plugin
+	Request *pluginapi.RegisterRequest
+
+	conn   *grpc.ClientConn
+	client pluginapi.DevicePluginClient
+	cancel context.CancelFunc
+
+	mux     sync.Mutex
+	cond    *sync.Cond
+	devices []*pluginapi.Device
+	updates int
+	err     error
+}
+
+// Start serves the registration service on the kubelet socket of dir
+func Start(dir string) (*Kubelet, error) {
+	socket := filepath.Join(dir, KubeletSocket)
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sock, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	k := &Kubelet{
+		dir:     dir,
+		server:  grpc.NewServer(),
+		plugins: make(map[string]*Plugin),
+	}
+	k.cond = sync.NewCond(&k.mux)
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(sock)
+	return k, nil
+}
+
+// Stop stops serving and disconnects from the plugins
+func (k *Kubelet) Stop() {
+	k.server.Stop()
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.stopped = true
+	for _, p := range k.plugins {
+		p.close()
+	}
+	k.cond.Broadcast()
+}
+
+// Register connects to the plugin and starts consuming its ListAndWatch stream, replacing a
+// previous registration of the same resource like the kubelet does
+func (k *Kubelet) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if r.Version != pluginapi.Version {
+		return nil, fmt.Errorf("unsupported API version %s", r.Version)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, filepath.Join(k.dir, r.Endpoint),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", r.Endpoint, err)
+	}
+	p := &Plugin{
+		Request: r,
+		conn:    conn,
+		client:  pluginapi.NewDevicePluginClient(conn),
+	}
+	p.cond = sync.NewCond(&p.mux)
+	streamCtx, streamCancel := context.WithCancel(context.Background())
+	p.cancel = streamCancel
+	go p.listAndWatch(streamCtx)
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if previous, ok := k.plugins[r.ResourceName]; ok {
+		previous.close()
+	}
+	k.plugins[r.ResourceName] = p
+	k.cond.Broadcast()
+	return &pluginapi.Empty{}, nil
+}
+
+// WaitForPlugin waits until a plugin registers the resource
+func (k *Kubelet) WaitForPlugin(resourceName string, timeout time.Duration) (*Plugin, error) {
+	timer := time.AfterFunc(timeout, func() {
+		k.mux.Lock()
+		defer k.mux.Unlock()
+		k.cond.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	for {
+		if p, ok := k.plugins[resourceName]; ok {
+			return p, nil
+		}
+		if k.stopped || !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s was not registered within %v", resourceName, timeout)
+		}
+		k.cond.Wait()
+	}
+}
+
+// listAndWatch records the devices sent by the plugin until the stream ends
+func (p *Plugin) listAndWatch(ctx context.Context) {
+	stream, err := p.client.ListAndWatch(ctx, &pluginapi.Empty{})
+	for err == nil {
+		var resp *pluginapi.ListAndWatchResponse
+		if resp, err = stream.Recv(); err == nil {
+			p.mux.Lock()
+			p.devices = resp.Devices
+			p.updates++
+			p.cond.Broadcast()
+			p.mux.Unlock()
+		}
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.err = err
+	p.cond.Broadcast()
+}
+
+func (p *Plugin) close() {
+	p.cancel()
+	p.conn.Close()
+}
+
+// Devices returns the devices of the last ListAndWatch response and the number of responses
+func (p *Plugin) Devices() ([]*pluginapi.Device, int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.devices, p.updates
+}
+
+// WaitForDevices waits until the plugin advertises at least n healthy devices and returns them
+func (p *Plugin) WaitForDevices(n int, timeout time.Duration) ([]*pluginapi.Device, error) {
+	timer := time.AfterFunc(timeout, func() {
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		p.cond.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for {
+		var healthy []*pluginapi.Device
+		for _, d := range p.devices {
+			if d.Health == pluginapi.Healthy {
+				healthy = append(healthy, d)
+			}
+		}
+		if len(healthy) >= n {
+			return healthy, nil
+		}
+		if p.err != nil {
+			return nil, fmt.Errorf("ListAndWatch of %s ended: %v", p.Request.ResourceName, p.err)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s advertised %d healthy devices within %v, expected %d", p.Request.ResourceName, len(healthy), timeout, n)
+		}
+		p.cond.Wait()
+	}
+}
+
+// GetPreferredAllocation asks the plugin for its preferred devices among available
+func (p *Plugin) GetPreferredAllocation(ctx context.Context, available, mustInclude []string, size int) ([]string, error) {
+	resp, err := p.client.GetPreferredAllocation(ctx, &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs:   available,
+			MustIncludeDeviceIDs: mustInclude,
+			AllocationSize:       int32(size),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return nil, fmt.Errorf("expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	return resp.ContainerResponses[0].DeviceIDs, nil
+}
+
+// Allocate allocates the devices of each container, as the kubelet does when it admits a pod
+func (p *Plugin) Allocate(ctx context.Context, containers ...[]string) (*pluginapi.AllocateResponse, error) {
+	req := &pluginapi.AllocateRequest{}
+	for _, ids := range containers {
+		req.ContainerRequests = append(req.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: ids})
+	}
+	resp, err := p.client.Allocate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != len(containers) {
+		return nil, fmt.Errorf("expected %d container responses, got %d", len(containers), len(resp.ContainerResponses))
+	}
+	return resp, nil
+}
+
+// PreStartContainer calls PreStartContainer if the plugin asked for it at registration
+func (p *Plugin) PreStartContainer(ctx context.Context, ids []string) error {
+	if p.Request.Options == nil || !p.Request.Options.PreStartRequired {
+		return nil
+	}
+	_, err := p.client.PreStartContainer(ctx, &pluginapi.PreStartContainerRequest{DevicesIDs: ids})
+	return err
+}
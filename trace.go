@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Span names of the allocation pipeline
+const (
+	spanAllocate               = "Allocate"
+	spanGetPreferredAllocation = "GetPreferredAllocation"
+	spanCheckpoint             = "UpdateFromCheckpoint"
+	spanKubeAPI                = "KubernetesAPI"
+)
+
+// slowSpanThreshold is the duration above which a span is always logged
+const slowSpanThreshold = time.Second
+
+const (
+	// spanExportInterval is how often the finished spans are sent to --otlp-endpoint
+	spanExportInterval = 5 * time.Second
+	// spanExportBatch is the number of finished spans sent at once, and spanQueueSize how many
+	// wait to be sent before new ones are dropped
+	spanExportBatch = 512
+	spanQueueSize   = 4096
+)
+
+// spanAttributes are the attributes of a span, of type string, bool, int or float64
+type spanAttributes map[string]interface{}
+
+// span is a step of the allocation pipeline, in the terms of the OTLP trace data model
+type span struct {
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    spanAttributes
+}
+
+// spanStats accumulates the durations of finished spans with the same name
+type spanStats struct {
+	count uint64
+	sum   time.Duration
+	max   time.Duration
+}
+
+var (
+	spanMux   sync.Mutex
+	spanTotal = make(map[string]*spanStats)
+	// spanQueue holds the finished spans until they are exported, nil without --otlp-endpoint
+	spanQueue   chan *span
+	spanDropped uint64
+)
+
+// spanContextKey is the context key of the current span
+type spanContextKey struct{}
+
+// randomID returns n random bytes in hex, the encoding of trace and span IDs in OTLP/JSON
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a step of the allocation pipeline, a child of the span of ctx if any; call
+// the returned func to end it. Durations are exported on the metrics endpoint, slow spans are
+// logged and spans are sent to --otlp-endpoint when it is set.
+func startSpan(ctx context.Context, name string, attrs spanAttributes) (context.Context, func()) {
+	s := &span{spanID: randomID(8), name: name, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomID(16)
+	}
+	return context.WithValue(ctx, spanContextKey{}, s), func() {
+		s.end = time.Now()
+		d := s.end.Sub(s.start)
+		spanMux.Lock()
+		st, ok := spanTotal[name]
+		if !ok {
+			st = &spanStats{}
+			spanTotal[name] = st
+		}
+		st.count++
+		st.sum += d
+		if d > st.max {
+			st.max = d
+		}
+		spanMux.Unlock()
+		if d > slowSpanThreshold || verboseFlag > 5 {
+			log.Printf("Trace: %s %s took %v (trace %s)", name, formatSpanAttributes(attrs), d, s.traceID)
+		}
+		if spanQueue != nil {
+			select {
+			case spanQueue <- s:
+			default:
+				spanMux.Lock()
+				spanDropped++
+				spanMux.Unlock()
+			}
+		}
+	}
+}
+
+// formatSpanAttributes returns the attributes sorted by key for the logs
+func formatSpanAttributes(attrs spanAttributes) string {
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, attrs[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// validateOTLPEndpoint checks the base URL of --otlp-endpoint, the spans are sent to its
+// /v1/traces path
+func validateOTLPEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid --otlp-endpoint option: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --otlp-endpoint option: %q, expected the http(s) URL of an OTLP/HTTP collector such as http://otel-collector:4318", endpoint)
+	}
+	return nil
+}
+
+// startSpanExporter sends the finished spans in batches to the OTLP/HTTP collector at the
+// endpoint, encoded as OTLP/JSON. Spans that cannot be sent are dropped, tracing never blocks
+// an allocation.
+func startSpanExporter(endpoint string) {
+	spanQueue = make(chan *span, spanQueueSize)
+	tracesURL := strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	client := &http.Client{Timeout: 10 * time.Second}
+	log.Printf("Exporting the spans of the allocation pipeline to %s", tracesURL)
+	go func() {
+		ticker := time.NewTicker(spanExportInterval)
+		defer ticker.Stop()
+		var batch []*span
+		for {
+			select {
+			case s := <-spanQueue:
+				batch = append(batch, s)
+				if len(batch) < spanExportBatch {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			if err := exportSpans(client, tracesURL, batch); err != nil {
+				log.Printf("Warning: failed to export %d spans: %v", len(batch), err)
+				spanMux.Lock()
+				spanDropped += uint64(len(batch))
+				spanMux.Unlock()
+			}
+			batch = nil
+		}
+	}()
+}
+
+// OTLP/JSON encoding of ExportTraceServiceRequest, see opentelemetry-proto
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+// Span kinds of OTLP
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+)
+
+// otlpSpanKinds are the kinds of the spans that are not internal steps: the gRPC calls of the
+// kubelet and the calls to the Kubernetes API
+var otlpSpanKinds = map[string]int{
+	spanAllocate:               otlpSpanKindServer,
+	spanGetPreferredAllocation: otlpSpanKindServer,
+	spanKubeAPI:                otlpSpanKindClient,
+}
+
+// otlpAttributes returns the attributes sorted by key in OTLP/JSON
+func otlpAttributes(attrs spanAttributes) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// encodeSpans returns the spans as an OTLP/JSON ExportTraceServiceRequest
+func encodeSpans(spans []*span) ([]byte, error) {
+	resource := spanAttributes{"service.name": "nvidia-device-plugin"}
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		resource["host.name"] = node
+	}
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/NVIDIA/k8s-device-plugin"}}
+	for _, s := range spans {
+		kind, ok := otlpSpanKinds[s.name]
+		if !ok {
+			kind = otlpSpanKindInternal
+		}
+		scope.Spans = append(scope.Spans, otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		})
+	}
+	return json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(resource)},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+}
+
+// exportSpans posts the spans to the /v1/traces URL of the collector
+func exportSpans(client *http.Client, tracesURL string, spans []*span) error {
+	data, err := encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(tracesURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func writeSpanMetrics(w io.Writer) {
+	spanMux.Lock()
+	defer spanMux.Unlock()
+	var names []string
+	for name := range spanTotal {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP vgpu_span_duration_seconds Duration of the steps of the allocation pipeline.")
+	fmt.Fprintln(w, "# TYPE vgpu_span_duration_seconds summary")
+	for _, name := range names {
+		s := spanTotal[name]
+		fmt.Fprintf(w, "vgpu_span_duration_seconds_sum{span=%q} %v\n", name, s.sum.Seconds())
+		fmt.Fprintf(w, "vgpu_span_duration_seconds_count{span=%q} %v\n", name, s.count)
+	}
+	fmt.Fprintln(w, "# HELP vgpu_span_duration_max_seconds Longest duration of the steps of the allocation pipeline.")
+	fmt.Fprintln(w, "# TYPE vgpu_span_duration_max_seconds gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "vgpu_span_duration_max_seconds{span=%q} %v\n", name, spanTotal[name].max.Seconds())
+	}
+	if spanQueue != nil {
+		fmt.Fprintln(w, "# HELP vgpu_spans_dropped_total Spans that could not be exported to the OTLP endpoint.")
+		fmt.Fprintln(w, "# TYPE vgpu_spans_dropped_total counter")
+		fmt.Fprintf(w, "vgpu_spans_dropped_total %v\n", spanDropped)
+	}
+}
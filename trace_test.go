@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestExportSpans checks that the spans reach the collector in OTLP/JSON, the child span in the
+// trace of its parent
+func TestExportSpans(t *testing.T) {
+	var got otlpTraces
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s %s of %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	ctx, endAllocate := startSpan(context.Background(), spanAllocate, spanAttributes{"vgpu.containers": 1})
+	listCtx, endList := startSpan(ctx, spanKubeAPI, spanAttributes{"k8s.operation": "list pods"})
+	endList()
+	endAllocate()
+	spans := []*span{ctx.Value(spanContextKey{}).(*span), listCtx.Value(spanContextKey{}).(*span)}
+
+	if err := exportSpans(collector.Client(), collector.URL+"/v1/traces", spans); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export %+v", got)
+	}
+	exported := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(exported) != 2 {
+		t.Fatalf("exported %d spans, expected 2", len(exported))
+	}
+	parent, child := exported[0], exported[1]
+	if len(parent.TraceID) != 32 || len(parent.SpanID) != 16 || parent.ParentSpanID != "" {
+		t.Errorf("invalid root span %+v", parent)
+	}
+	if child.TraceID != parent.TraceID || child.ParentSpanID != parent.SpanID {
+		t.Errorf("span %+v is not a child of %+v", child, parent)
+	}
+	if parent.Kind != otlpSpanKindServer || child.Kind != otlpSpanKindClient {
+		t.Errorf("kinds are %d and %d, expected server and client", parent.Kind, child.Kind)
+	}
+	if len(parent.Attributes) != 1 || parent.Attributes[0].Value["intValue"] != "1" {
+		t.Errorf("attributes are %+v, expected vgpu.containers=1", parent.Attributes)
+	}
+}
@@ -3,23 +3,18 @@ package main
 import (
 	"k8s.io/apimachinery/pkg/labels"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
-	"k8s.io/kubernetes/pkg/kubelet/cm/devicemanager/checkpoint"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/net/context"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/informers"
-	"k8s.io/client-go/kubernetes"
 	listerscorev1 "k8s.io/client-go/listers/core/v1"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/kubernetes/pkg/kubelet/checkpointmanager"
 )
 
 const (
@@ -31,45 +26,52 @@ const kubeletDeviceManagerCheckpoint = "kubelet_internal_checkpoint"
 
 // VDeviceController vdevice id manager
 type VDeviceController struct {
-	nodeName string
-	mux      sync.Mutex
-	stopCh   chan struct{}
-	idMap    map[string]string
+	resourceName string
+	// resourceNames are all the resources advertising the vDevices, see deviceState
+	resourceNames map[string]bool
+	nodeName      string
+	mux           sync.Mutex
+	stopCh        chan struct{}
+	idMap         map[string]string
+	// acquiredAt is when each vDevice in use was acquired
+	acquiredAt map[string]time.Time
+	// journaled is set once the vDevices in use are kept in the allocation journal
+	journaled bool
 
-	podLister         listerscorev1.PodLister
-	checkpointManager checkpointmanager.CheckpointManager
+	podLister listerscorev1.PodLister
 }
 
 // newVDeviceController new VDeviceController
-func newVDeviceController(deviceIDs []string) *VDeviceController {
+func newVDeviceController(resourceName string, deviceIDs []string) *VDeviceController {
 	m := &VDeviceController{
-		nodeName: "",
-		stopCh:   make(chan struct{}),
-		idMap:    make(map[string]string),
+		resourceName:  resourceName,
+		resourceNames: map[string]bool{resourceName: true},
+		nodeName:      "",
+		stopCh:        make(chan struct{}),
+		idMap:         make(map[string]string),
+		acquiredAt:    make(map[string]time.Time),
 	}
 	for _, v := range deviceIDs {
 		m.idMap[v] = ""
 	}
-	var err error
-	m.checkpointManager, err = checkpointmanager.NewCheckpointManager(pluginapi.DevicePluginPath)
-	check(err)
 	return m
 }
 
 // updateFromCheckpoint update devices from kubelet device checkpoint
-func (m *VDeviceController) updateFromCheckpoint() error {
-	registeredDevs := make(map[string][]string)
-	devEntries := make([]checkpoint.PodDevicesEntry, 0)
-	cp := checkpoint.New(devEntries, registeredDevs)
-	err := m.checkpointManager.GetCheckpoint(kubeletDeviceManagerCheckpoint, cp)
+func (m *VDeviceController) updateFromCheckpoint(ctx context.Context) error {
+	_, end := startSpan(ctx, spanCheckpoint, spanAttributes{"vgpu.resource": m.resourceName})
+	defer end()
+	cp, err := readKubeletCheckpoint()
 	if err != nil {
 		log.Printf("Error: read checkpoint error, %v\n", err)
+		countVDevices(m.resourceName, func(c *vdeviceCounts) { c.checkpointFailures++ })
 		return err
 	}
+	countVDevices(m.resourceName, func(c *vdeviceCounts) { c.checkpointSyncs++ })
 	pods, err := m.podLister.Pods("").List(labels.Everything())
 	podDevices, _ := cp.GetData()
 	for _, pde := range podDevices {
-		if pde.ResourceName != "nvidia.com/gpu" {
+		if !m.serves(pde.ResourceName) {
 			continue
 		}
 		allocResp := &pluginapi.ContainerAllocateResponse{}
@@ -107,6 +109,7 @@ func (m *VDeviceController) updateFromCheckpoint() error {
 			m.release(using)
 		}
 	}
+	recordEvent(eventCheckpoint, m.resourceName, nil, "reconciled %d %s checkpoint entries", len(podDevices), cp.version)
 	return nil
 }
 
@@ -164,16 +167,7 @@ func (m *VDeviceController) initialize() {
 	if m.nodeName == "" {
 		log.Panicln("Fatal: must set NODE_NAME")
 	}
-	kubeConfig := os.Getenv("KUBECONFIG")
-	if kubeConfig == "" {
-		kubeConfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
-	}
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
-		check(err)
-	}
-	client, err := kubernetes.NewForConfig(config)
+	client, err := newKubeClient()
 	check(err)
 	selector := fields.SelectorFromSet(fields.Set{"spec.nodeName": m.nodeName})
 	informerFactory := informers.NewSharedInformerFactoryWithOptions(
@@ -220,6 +214,10 @@ func (m *VDeviceController) initialize() {
 	m.stopCh = make(chan struct{})
 	informerFactory.Start(m.stopCh)
 	informerFactory.WaitForCacheSync(m.stopCh)
+	m.restore()
+	if vdeviceReconcileIntervalFlag > 0 {
+		go m.runReconcile(vdeviceReconcileIntervalFlag)
+	}
 }
 
 // cleanup finalize vdevice manager
@@ -240,15 +238,82 @@ func (m *VDeviceController) available() []string {
 	return ids
 }
 
+// addResource makes the controller track the allocations of another resource advertising its
+// vDevices
+func (m *VDeviceController) addResource(resourceName string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.resourceNames[resourceName] = true
+}
+
+// serves returns true if the vDevices of the controller are advertised as resourceName
+func (m *VDeviceController) serves(resourceName string) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.resourceNames[resourceName]
+}
+
+// resize tracks the vDevices of deviceIDs, dropping the free vDevices not among them
+func (m *VDeviceController) resize(deviceIDs []string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	keep := make(map[string]bool)
+	for _, id := range deviceIDs {
+		keep[id] = true
+		if _, ok := m.idMap[id]; !ok {
+			m.idMap[id] = ""
+		}
+	}
+	for id, owner := range m.idMap {
+		if !keep[id] && owner == "" {
+			delete(m.idMap, id)
+		}
+	}
+}
+
+// inUse returns the vDevices acquired by the controller
+func (m *VDeviceController) inUse() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var ids []string
+	for id, owner := range m.idMap {
+		if owner != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// counts returns the number of free and used vDevices
+func (m *VDeviceController) counts() (free, used int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, v := range m.idMap {
+		if v == "" {
+			free++
+		} else {
+			used++
+		}
+	}
+	return free, used
+}
+
 // acquire acquire device ids
 func (m *VDeviceController) acquire(request, using []string) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	defer m.persist()
+	acquired := 0
+	defer countVDevices(m.resourceName, func(c *vdeviceCounts) { c.acquired += uint64(acquired) })
 	for i, v := range using {
 		if _, ok := m.idMap[v]; !ok {
 			log.Printf("Error: device %s unknown\n", v)
 			continue
 		}
+		if m.idMap[v] == "" {
+			m.acquiredAt[v] = time.Now()
+			acquired++
+		}
 		if i < len(request) {
 			m.idMap[v] = request[i]
 		} else {
@@ -262,24 +327,37 @@ func (m *VDeviceController) acquire(request, using []string) {
 func (m *VDeviceController) release(using []string) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	defer m.persist()
+	recordEvent(eventRelease, m.resourceName, using, "released")
+	var freed []string
 	for _, v := range using {
-		if _, ok := m.idMap[v]; ok {
+		if owner, ok := m.idMap[v]; ok {
+			if owner != "" {
+				freed = append(freed, v)
+			}
 			m.idMap[v] = ""
+			delete(m.acquiredAt, v)
 		} else {
 			log.Printf("Error: device %s unknown\n", v)
 		}
 	}
+	countVDevices(m.resourceName, func(c *vdeviceCounts) { c.released += uint64(len(freed)) })
+	if len(freed) > 0 {
+		allocationTracer.write(&traceRecord{Type: traceRelease, Resource: m.resourceName, Devices: freed})
+	}
 }
 
 // releaseByRequest release device ids by request ids
 func (m *VDeviceController) releaseByRequest(request []string) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	defer m.persist()
 	for k, v := range m.idMap {
 		for _, r := range request {
 			if v == r {
 				log.Printf("Error: device %s[%s] loss.\n", k, v)
 				m.idMap[k] = ""
+				delete(m.acquiredAt, k)
 			}
 		}
 	}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// vdeviceCounts are the operations of the vDevice controllers of a resource
+type vdeviceCounts struct {
+	acquired           uint64
+	released           uint64
+	checkpointSyncs    uint64
+	checkpointFailures uint64
+	reconciliations    uint64
+	reconcileFailures  uint64
+	leaked             uint64
+	missing            uint64
+	preferredFallbacks uint64
+}
+
+// vdeviceStats outlive the controllers, which are recreated when the plugin restarts
+var vdeviceStats = struct {
+	sync.Mutex
+	byResource map[string]*vdeviceCounts
+}{byResource: make(map[string]*vdeviceCounts)}
+
+// countVDevices updates the counts of the controllers of a resource
+func countVDevices(resourceName string, update func(c *vdeviceCounts)) {
+	vdeviceStats.Lock()
+	defer vdeviceStats.Unlock()
+	c, ok := vdeviceStats.byResource[resourceName]
+	if !ok {
+		c = &vdeviceCounts{}
+		vdeviceStats.byResource[resourceName] = c
+	}
+	update(c)
+}
+
+// vdeviceCounters are the exported counters of vdeviceCounts
+var vdeviceCounters = []struct {
+	name, help string
+	value      func(c *vdeviceCounts) uint64
+}{
+	{"vgpu_vdevice_acquired_total", "vDevices acquired by the vDevice controller.", func(c *vdeviceCounts) uint64 { return c.acquired }},
+	{"vgpu_vdevice_released_total", "vDevices released by the vDevice controller.", func(c *vdeviceCounts) uint64 { return c.released }},
+	{"vgpu_vdevice_checkpoint_syncs_total", "Updates of the vDevices in use from the kubelet checkpoint in Allocate.", func(c *vdeviceCounts) uint64 { return c.checkpointSyncs }},
+	{"vgpu_vdevice_checkpoint_sync_failures_total", "Updates from the kubelet checkpoint in Allocate that failed.", func(c *vdeviceCounts) uint64 { return c.checkpointFailures }},
+	{"vgpu_vdevice_reconciliations_total", "Periodic reconciliations of the vDevices in use with the kubelet checkpoint.", func(c *vdeviceCounts) uint64 { return c.reconciliations }},
+	{"vgpu_vdevice_reconcile_failures_total", "Reconciliations that could not read the kubelet checkpoint or the pods.", func(c *vdeviceCounts) uint64 { return c.reconcileFailures }},
+	{"vgpu_vdevice_reconcile_leaked_total", "vDevices released by reconciliations because no running pod held them.", func(c *vdeviceCounts) uint64 { return c.leaked }},
+	{"vgpu_vdevice_reconcile_missing_total", "vDevices acquired by reconciliations because a running pod held them.", func(c *vdeviceCounts) uint64 { return c.missing }},
+	{"vgpu_vdevice_preferred_fallbacks_total", "Allocations that took the first available vDevices because no preferred allocation was found.", func(c *vdeviceCounts) uint64 { return c.preferredFallbacks }},
+}
+
+// writeVDeviceMetrics exports the operations of the vDevice controllers and the vDevices they
+// see free and in use, to catch their state drifting from the kubelet one
+func writeVDeviceMetrics(w io.Writer) {
+	vdeviceStats.Lock()
+	var resources []string
+	for r := range vdeviceStats.byResource {
+		resources = append(resources, r)
+	}
+	sort.Strings(resources)
+	for _, counter := range vdeviceCounters {
+		fmt.Fprintf(w, "# HELP %s %s\n", counter.name, counter.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", counter.name)
+		for _, r := range resources {
+			fmt.Fprintf(w, "%s{resource=%q} %d\n", counter.name, r, counter.value(vdeviceStats.byResource[r]))
+		}
+	}
+	vdeviceStats.Unlock()
+
+	fmt.Fprintln(w, "# HELP vgpu_vdevices Number of vDevices known to the vDevice controller by state.")
+	fmt.Fprintln(w, "# TYPE vgpu_vdevices gauge")
+	for _, p := range getAdminPlugins() {
+		c := p.vDeviceController
+		if c == nil {
+			continue
+		}
+		free, used := c.counts()
+		fmt.Fprintf(w, "vgpu_vdevices{resource=%q,state=\"free\"} %d\n", p.resourceName, free)
+		fmt.Fprintf(w, "vgpu_vdevices{resource=%q,state=\"used\"} %d\n", p.resourceName, used)
+	}
+}
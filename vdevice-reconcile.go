@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// reconcileGracePeriod keeps the vDevices acquired recently from being released by a
+// reconciliation, the kubelet checkpoints an allocation only once Allocate returned
+const reconcileGracePeriod = time.Minute
+
+// eventReconcile is the device lifecycle event type of the reconciliation discrepancies
+const eventReconcile = "reconcile"
+
+// checkpointClaims returns the request ID each vDevice of the resource is held for by the
+// running and pending pods according to the kubelet checkpoint
+func (m *VDeviceController) checkpointClaims() (map[string]string, error) {
+	cp, err := readKubeletCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := m.podLister.Pods("").List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool)
+	for _, p := range pods {
+		if p.Status.Phase == v1.PodPending || p.Status.Phase == v1.PodRunning {
+			live[string(p.UID)] = true
+		}
+	}
+	claims := make(map[string]string)
+	podDevices, _ := cp.GetData()
+	for _, pde := range podDevices {
+		if !m.serves(pde.ResourceName) || !live[pde.PodUID] {
+			continue
+		}
+		allocResp := &pluginapi.ContainerAllocateResponse{}
+		if err := allocResp.Unmarshal(pde.AllocResp); err != nil {
+			continue
+		}
+		usingStr := allocResp.Annotations[annUsing]
+		if usingStr == "" {
+			continue
+		}
+		request := strings.Split(allocResp.Annotations[annRequest], annSep)
+		for i, id := range strings.Split(usingStr, annSep) {
+			if i < len(request) {
+				claims[id] = request[i]
+			} else {
+				claims[id] = "mismatched"
+			}
+		}
+	}
+	return claims, nil
+}
+
+// reconcile compares the vDevices in use with the checkpoint of the kubelet and the pods of the
+// node, releasing the vDevices of deleted pods and acquiring the ones the controller missed
+func (m *VDeviceController) reconcile() error {
+	claims, err := m.checkpointClaims()
+	if err != nil {
+		countVDevices(m.resourceName, func(c *vdeviceCounts) { c.reconcileFailures++ })
+		return err
+	}
+
+	var leaked, missing, missingRequest []string
+	m.mux.Lock()
+	for id, owner := range m.idMap {
+		request, claimed := claims[id]
+		switch {
+		case owner != "" && !claimed && time.Since(m.acquiredAt[id]) > reconcileGracePeriod:
+			leaked = append(leaked, id)
+		case owner == "" && claimed:
+			missing = append(missing, id)
+			missingRequest = append(missingRequest, request)
+		}
+	}
+	m.mux.Unlock()
+
+	if len(leaked) > 0 {
+		sort.Strings(leaked)
+		log.Printf("Warning: releasing %d leaked vDevices of %s: %v", len(leaked), m.resourceName, leaked)
+		recordEvent(eventReconcile, m.resourceName, leaked, "released leaked vDevices")
+		m.release(leaked)
+	}
+	if len(missing) > 0 {
+		log.Printf("Warning: acquiring %d vDevices of %s held by pods: %v", len(missing), m.resourceName, missing)
+		recordEvent(eventReconcile, m.resourceName, missing, "acquired vDevices held by pods")
+		m.acquire(missingRequest, missing)
+	}
+	countVDevices(m.resourceName, func(c *vdeviceCounts) {
+		c.reconciliations++
+		c.leaked += uint64(len(leaked))
+		c.missing += uint64(len(missing))
+	})
+	return nil
+}
+
+// runReconcile reconciles every interval until the controller is cleaned up
+func (m *VDeviceController) runReconcile(interval time.Duration) {
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-time.After(interval):
+		}
+		if err := m.reconcile(); err != nil {
+			log.Printf("Warning: failed to reconcile the vDevices of %s: %v", m.resourceName, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// eventResize is the device lifecycle event type of the split count changes applied live
+const eventResize = "resize"
+
+// shrinkRetryInterval is the interval at which a deferred shrink of the vDevices is retried
+const shrinkRetryInterval = time.Minute
+
+// splitCountOnly returns true if c differs from the running options by the split count alone,
+// which is applied to the running plugins without restarting them
+func (c *pluginConfig) splitCountOnly() bool {
+	current := currentPluginConfig()
+	if c.deviceSplitCount == current.deviceSplitCount ||
+		c.deviceMemoryScaling != current.deviceMemoryScaling ||
+		c.deviceCoresScaling != current.deviceCoresScaling ||
+		len(c.excludeDevices) != len(current.excludeDevices) {
+		return false
+	}
+	for id := range c.excludeDevices {
+		if !current.excludeDevices[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// deferredShrink is the last deferred shrink reported, so that retries do not repeat the event
+var deferredShrink string
+
+// vDevicesInUse returns the vDevices allocated according to the kubelet checkpoint or acquired
+// through the vDevice controllers of the plugins
+func vDevicesInUse(plugins []*NvidiaDevicePlugin) (map[string]bool, error) {
+	cp, err := readKubeletCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	podDevices, _ := cp.GetData()
+	for _, pde := range podDevices {
+		for _, id := range pde.DeviceIDs {
+			inUse[id] = true
+		}
+	}
+	for _, p := range plugins {
+		if p.vDeviceController == nil {
+			continue
+		}
+		for _, id := range p.vDeviceController.inUse() {
+			inUse[id] = true
+		}
+	}
+	return inUse, nil
+}
+
+// resize splits each GPU into the vDevices of the current split count. The vDevices in use are
+// kept with their memory, so a GPU keeps more vDevices than wanted, or fewer or smaller new ones
+// than wanted, until enough of them are released; resize returns a description of each such GPU.
+func (s *deviceState) resize(inUse map[string]bool) []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var deferred []string
+	for id, current := range s.vdevices {
+		if len(current) == 0 || strings.Contains(id, "MIG") {
+			continue
+		}
+		d := current[0].dev
+		model, err := getGPUModel(id)
+		if err != nil {
+			log.Printf("Warning: failed to query GPU %s, keeping its vDevices: %v", id, err)
+			continue
+		}
+		scaled := uint64(float64(model.memory) * deviceMemoryScalingFlag)
+		target, memory := vdeviceSplit(scaled)
+
+		// The vDevices in use keep the memory granted to their pods, the new ones share the rest
+		var indexes []int
+		used := make(map[int]bool)
+		usedMemory := make(map[int]uint64)
+		var granted uint64
+		for _, vd := range current {
+			var i int
+			if _, err := fmt.Sscanf(strings.TrimPrefix(vd.ID, id+"-"), "%d", &i); err == nil && inUse[vd.ID] {
+				used[i] = true
+				usedMemory[i] = vd.memory
+				granted += vd.memory
+				indexes = append(indexes, i)
+			}
+		}
+		count := int(target)
+		if len(indexes) > count {
+			count = len(indexes)
+			deferred = append(deferred, fmt.Sprintf("GPU %s keeps %d vDevices in use, %d wanted", id, count, target))
+		}
+		free := count - len(indexes)
+		var remaining uint64
+		if scaled > granted {
+			remaining = scaled - granted
+		}
+		if free > 0 && memory*uint64(free) > remaining {
+			if vdeviceMemoryQuantumMiB > 0 {
+				free = int(remaining / vdeviceMemoryQuantumMiB)
+			} else {
+				memory = remaining / uint64(free)
+			}
+			if memory == 0 {
+				free = 0
+			}
+			deferred = append(deferred, fmt.Sprintf("GPU %s grows to %d vDevices of %d MiB while %d MiB are in use, %d vDevices wanted",
+				id, len(indexes)+free, memory, granted, target))
+		}
+		count = len(indexes) + free
+		for i := 0; len(indexes) < count; i++ {
+			if !used[i] {
+				indexes = append(indexes, i)
+			}
+		}
+		sort.Ints(indexes)
+
+		vdevices := make([]*VDevice, 0, count)
+		for _, i := range indexes {
+			vd := &VDevice{Device: d.Device, dev: d, memory: memory, split: uint(count)}
+			if used[i] {
+				vd.memory = usedMemory[i]
+			}
+			vd.ID = fmt.Sprintf("%v-%v", id, i)
+			vdevices = append(vdevices, vd)
+		}
+		s.vdevices[id] = vdevices
+	}
+	sort.Strings(deferred)
+	return deferred
+}
+
+// resizeVDevices applies the current split count to the vDevices of the running plugins and
+// sends them to the kubelet. It returns true if some GPUs could not shrink yet, resizeVDevices
+// must then be called again later.
+func resizeVDevices(plugins []*NvidiaDevicePlugin) bool {
+	inUse, err := vDevicesInUse(plugins)
+	if err != nil {
+		log.Printf("Error: failed to read the vDevices in use, deferring the new split count: %v", err)
+		return true
+	}
+	deferred := sharedDevices.resize(inUse)
+	for _, p := range plugins {
+		if p.migStrategy != MigStrategyNone || p.getVDevices() == nil {
+			continue
+		}
+		vdevices := sharedDevices.vDevicesOf(p.cachedDevices)
+		p.setVDevices(vdevices)
+		p.allocations.reset()
+		ids := make([]string, len(vdevices))
+		for i, vd := range vdevices {
+			ids[i] = vd.ID
+		}
+		if p.vDeviceController != nil {
+			p.vDeviceController.resize(ids)
+		}
+		allocationTracer.traceInventoryOf(p.resourceName, vdevices)
+		recordEvent(eventResize, p.resourceName, nil, "split into %d vDevices", len(vdevices))
+		log.Printf("'%s' now advertises %d vDevices", p.resourceName, len(vdevices))
+		select {
+		case p.devicesChanged <- struct{}{}:
+		default:
+		}
+	}
+	if len(deferred) == 0 {
+		deferredShrink = ""
+		return false
+	}
+
+	message := fmt.Sprintf("Shrinking the vDevices to the split count of %d is deferred until they are released: %s",
+		deviceSplitCountFlag, strings.Join(deferred, ", "))
+	if message == deferredShrink {
+		return true
+	}
+	deferredShrink = message
+	log.Printf("Warning: %s", message)
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		if err := createNodeEvent(nodeName, "VDeviceShrinkDeferred", message); err != nil {
+			log.Printf("Warning: failed to create the VDeviceShrinkDeferred node event: %v", err)
+		}
+	}
+	return true
+}
@@ -21,34 +21,74 @@ import (
 	"log"
 	"strings"
 
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+// vdeviceMemoryQuantumMiB is the parsed --vdevice-memory-quantum, 0 when not set
+var vdeviceMemoryQuantumMiB uint64
+
+// minVDeviceMemoryMiB and maxVDeviceMemoryMiB are the parsed --min-vdevice-memory and
+// --max-vdevice-memory, 0 when not set
+var minVDeviceMemoryMiB, maxVDeviceMemoryMiB uint64
+
+// contextOverheadMiB is the parsed --context-overhead, 0 when not set
+var contextOverheadMiB uint64
+
 // VDevice virtual device
 type VDevice struct {
 	pluginapi.Device
 	dev    *Device
 	memory uint64
+	// split is the number of vDevices of the GPU of the vDevice
+	split uint
+}
+
+// vdeviceSplit returns the number of vDevices of a GPU with the given scaled memory and the
+// memory of each. The memory is split --device-split-count ways, or with --vdevice-memory-quantum
+// into as many vDevices of the quantum as fit, at most --device-split-count, so that the vDevices
+// of GPU models with different memory sizes are interchangeable.
+func vdeviceSplit(memory uint64) (uint, uint64) {
+	if vdeviceMemoryQuantumMiB == 0 {
+		return deviceSplitCountFlag, memory / uint64(deviceSplitCountFlag)
+	}
+	count := memory / vdeviceMemoryQuantumMiB
+	if count == 0 {
+		return 1, memory
+	}
+	if count > uint64(deviceSplitCountFlag) {
+		count = uint64(deviceSplitCountFlag)
+	}
+	return uint(count), vdeviceMemoryQuantumMiB
 }
 
 // Device2VDevice device to virtual device
 func Device2VDevice(devices []*Device) []*VDevice {
+	var uuids []string
+	for _, d := range devices {
+		if !strings.Contains(d.ID, "MIG") {
+			uuids = append(uuids, d.ID)
+		}
+	}
+	warmGPUModels(uuids)
+
 	var vdevices []*VDevice
 	for _, d := range devices {
 		log.Println("uuid=", d.ID)
 		if strings.Contains(d.ID, "MIG") {
-			vd := &VDevice{Device: d.Device, dev: d, memory: 0}
+			vd := &VDevice{Device: d.Device, dev: d, memory: 0, split: 1}
 			vd.ID = fmt.Sprintf("%v-%v", d.ID, 0)
 			vd.memory = 0
 			vdevices = append(vdevices, vd)
 			continue
 		}
-		dev, err := nvml.NewDeviceByUUID(d.ID)
+		model, err := getGPUModel(d.ID)
 		check(err)
-		memory := uint64(float64(*dev.Memory) * deviceMemoryScalingFlag / float64(deviceSplitCountFlag))
-		for i := uint(0); i < deviceSplitCountFlag; i++ {
-			vd := &VDevice{Device: d.Device, dev: d, memory: memory}
+		split, memory := vdeviceSplit(uint64(float64(model.memory) * deviceMemoryScalingFlag))
+		if vdeviceMemoryQuantumMiB > 0 && memory < vdeviceMemoryQuantumMiB {
+			log.Printf("Warning: GPU %s has %vMiB, less than --vdevice-memory-quantum, advertising a single vDevice", d.ID, memory)
+		}
+		for i := uint(0); i < split; i++ {
+			vd := &VDevice{Device: d.Device, dev: d, memory: memory, split: split}
 			vd.ID = fmt.Sprintf("%v-%v", d.ID, i)
 			vd.memory = memory
 			vdevices = append(vdevices, vd)
@@ -57,6 +97,46 @@ func Device2VDevice(devices []*Device) []*VDevice {
 	return vdevices
 }
 
+// checkVDeviceMemory returns an error if the GPUs of the node would be split into vDevices
+// with less memory than --min-vdevice-memory or more than --max-vdevice-memory, or with no
+// memory left after --context-overhead
+func checkVDeviceMemory() error {
+	if minVDeviceMemoryMiB == 0 && maxVDeviceMemoryMiB == 0 && contextOverheadMiB == 0 || migStrategyFlag != MigStrategyNone {
+		return nil
+	}
+	n, err := gpuLibrary.deviceCount()
+	if err != nil {
+		return err
+	}
+	for i := uint(0); i < n; i++ {
+		d, _, err := gpuLibrary.deviceAt(i)
+		if err != nil {
+			return err
+		}
+		if isExcludedDevice(d.UUID, i) || isConfidentialGPU(d.UUID) {
+			continue
+		}
+		model, err := getGPUModel(d.UUID)
+		if err != nil {
+			return err
+		}
+		split, memory := vdeviceSplit(uint64(float64(model.memory) * deviceMemoryScalingFlag))
+		if minVDeviceMemoryMiB > 0 && memory < minVDeviceMemoryMiB {
+			return fmt.Errorf("GPU %s (%s, %vMiB) would be split into %d vDevices of %vMiB, less than the minimum of %vMiB: lower the split count or raise the memory scaling",
+				d.UUID, model.name, model.memory, split, memory, minVDeviceMemoryMiB)
+		}
+		if maxVDeviceMemoryMiB > 0 && memory > maxVDeviceMemoryMiB {
+			return fmt.Errorf("GPU %s (%s, %vMiB) would be split into %d vDevices of %vMiB, more than the maximum of %vMiB: raise the split count or lower the memory scaling",
+				d.UUID, model.name, model.memory, split, memory, maxVDeviceMemoryMiB)
+		}
+		if memory <= contextOverheadMiB {
+			return fmt.Errorf("GPU %s (%s, %vMiB) would be split into %d vDevices of %vMiB, no more than the context overhead of %vMiB: lower the split count or the overhead",
+				d.UUID, model.name, model.memory, split, memory, contextOverheadMiB)
+		}
+	}
+	return nil
+}
+
 // VDevicesByIDs filter vdevices by uuids
 func VDevicesByIDs(vdevices []*VDevice, ids []string) ([]*VDevice, error) {
 	//var vds []*VDevice
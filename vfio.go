@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// PCI sysfs layout and drivers used to move GPUs between sharing and passthrough
+const (
+	pciDevicesPath    = "/sys/bus/pci/devices"
+	pciDriversProbe   = "/sys/bus/pci/drivers_probe"
+	nvidiaPCIVendor   = "0x10de"
+	vfioPCIDriver     = "vfio-pci"
+	vfioDevicePath    = "/dev/vfio"
+	vfioAllocStrategy = "vfio"
+)
+
+// annPassthrough is the node annotation listing the PCI addresses of the GPUs to pass through
+// to VMs, or "all"; the other GPUs are shared between containers
+const annPassthrough = "4paradigm.com/vgpu-passthrough"
+
+// passthroughResync is the interval at which the passthrough annotation is polled
+const passthroughResync = 30 * time.Second
+
+// VfioDeviceManager implements the ResourceManager interface for GPUs bound to vfio-pci
+type VfioDeviceManager struct{}
+
+// pciDevice is an NVIDIA PCI function found in sysfs
+type pciDevice struct {
+	address string
+	class   string
+	driver  string
+}
+
+// isGPU returns true for display controllers, leaving out the audio and USB functions of a card
+func (d *pciDevice) isGPU() bool {
+	return strings.HasPrefix(d.class, "0x03")
+}
+
+// slot returns the PCI address without its function, shared by all the functions of a card
+func (d *pciDevice) slot() string {
+	return strings.SplitN(d.address, ".", 2)[0]
+}
+
+func readSysfs(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func writeSysfs(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0200); err != nil {
+		return explainPrivilegeError(err)
+	}
+	return nil
+}
+
+// nvidiaPCIDevices returns the NVIDIA PCI functions of the node
+func nvidiaPCIDevices() ([]*pciDevice, error) {
+	entries, err := ioutil.ReadDir(pciDevicesPath)
+	if err != nil {
+		return nil, err
+	}
+	var devices []*pciDevice
+	for _, e := range entries {
+		path := filepath.Join(pciDevicesPath, e.Name())
+		if readSysfs(filepath.Join(path, "vendor")) != nvidiaPCIVendor {
+			continue
+		}
+		d := &pciDevice{address: e.Name(), class: readSysfs(filepath.Join(path, "class"))}
+		if driver, err := os.Readlink(filepath.Join(path, "driver")); err == nil {
+			d.driver = filepath.Base(driver)
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// iommuGroup returns the IOMMU group of a PCI function
+func iommuGroup(address string) (string, error) {
+	group, err := os.Readlink(filepath.Join(pciDevicesPath, address, "iommu_group"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(group), nil
+}
+
+// Devices returns the GPUs bound to vfio-pci, identified by their PCI address
+func (v *VfioDeviceManager) Devices() []*Device {
+	pcis, err := nvidiaPCIDevices()
+	if err != nil {
+		log.Printf("Error: failed to list PCI devices: %v", err)
+		return nil
+	}
+	var devs []*Device
+	for _, p := range pcis {
+		if !p.isGPU() || p.driver != vfioPCIDriver {
+			continue
+		}
+		group, err := iommuGroup(p.address)
+		if err != nil {
+			log.Printf("Error: GPU %s has no IOMMU group: %v", p.address, err)
+			continue
+		}
+		dev := &Device{Paths: []string{filepath.Join(vfioDevicePath, group)}, Index: p.address}
+		dev.ID = p.address
+		dev.Health = pluginapi.Healthy
+		devs = append(devs, dev)
+	}
+	return devs
+}
+
+// CheckHealth is a no-op for passthrough GPUs, which the host driver does not monitor
+func (v *VfioDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *DeviceHealth) {
+	<-stop
+}
+
+// getVfioPlugin returns the plugin advertising the passthrough GPUs
+func getVfioPlugin() *NvidiaDevicePlugin {
+	plugin := NewNvidiaDevicePlugin(
+		vfioResourceNameFlag,
+		&VfioDeviceManager{},
+		"",
+		nil,
+		devicePluginSocket("vgpu-vfio.sock"))
+	plugin.migStrategy = vfioAllocStrategy
+	return plugin
+}
+
+// kubevirtResourceEnv returns the env KubeVirt reads the PCI addresses of a host device resource from
+func kubevirtResourceEnv(resourceName string) string {
+	r := strings.NewReplacer(".", "_", "/", "_", "-", "_")
+	return "PCI_RESOURCE_" + strings.ToUpper(r.Replace(resourceName))
+}
+
+// VfioAllocate passes the vfio groups of the requested GPUs to the virt-launcher pod
+func (m *NvidiaDevicePlugin) VfioAllocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		response := pluginapi.ContainerAllocateResponse{
+			Devices: []*pluginapi.DeviceSpec{{
+				ContainerPath: filepath.Join(vfioDevicePath, "vfio"),
+				HostPath:      filepath.Join(vfioDevicePath, "vfio"),
+				Permissions:   "mrw",
+			}},
+		}
+		for _, id := range req.DevicesIDs {
+			if !m.deviceExists(id) {
+				return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", m.resourceName, id)
+			}
+			for _, d := range m.cachedDevices {
+				if d.ID != id {
+					continue
+				}
+				for _, p := range d.Paths {
+					response.Devices = append(response.Devices, &pluginapi.DeviceSpec{ContainerPath: p, HostPath: p, Permissions: "mrw"})
+				}
+			}
+		}
+		response.Envs = map[string]string{kubevirtResourceEnv(m.resourceName): strings.Join(req.DevicesIDs, ",")}
+		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+		recordEvent(eventAllocate, m.resourceName, req.DevicesIDs, "passthrough")
+	}
+	return &responses, nil
+}
+
+// rebindPassthrough binds the cards of the listed GPU addresses (or all cards for "all") to
+// vfio-pci and the other cards back to their default driver. NVML must not hold the GPUs.
+func rebindPassthrough(addresses []string) error {
+	pcis, err := nvidiaPCIDevices()
+	if err != nil {
+		return err
+	}
+	all := len(addresses) == 1 && addresses[0] == "all"
+	wanted := make(map[string]bool)
+	for _, p := range pcis {
+		if !p.isGPU() {
+			continue
+		}
+		for _, a := range addresses {
+			if all || strings.EqualFold(a, p.address) {
+				wanted[p.slot()] = true
+			}
+		}
+	}
+	for _, p := range pcis {
+		passthrough := wanted[p.slot()]
+		if passthrough == (p.driver == vfioPCIDriver) {
+			continue
+		}
+		override := "\n"
+		if passthrough {
+			override = vfioPCIDriver
+		}
+		log.Printf("Moving PCI device %s from '%s' to %s", p.address, p.driver, map[bool]string{true: "passthrough", false: "sharing"}[passthrough])
+		path := filepath.Join(pciDevicesPath, p.address)
+		if err := writeSysfs(filepath.Join(path, "driver_override"), override); err != nil {
+			return fmt.Errorf("failed to set driver override of %s: %v", p.address, err)
+		}
+		if p.driver != "" {
+			if err := writeSysfs(filepath.Join(path, "driver", "unbind"), p.address); err != nil {
+				return fmt.Errorf("failed to unbind %s from %s: %v", p.address, p.driver, err)
+			}
+		}
+		if err := writeSysfs(pciDriversProbe, p.address); err != nil {
+			return fmt.Errorf("failed to probe driver of %s: %v", p.address, err)
+		}
+	}
+	return nil
+}
+
+// PassthroughWatcher polls the passthrough annotation of the node and reports changes
+type PassthroughWatcher struct {
+	nodeName string
+	changes  chan []string
+}
+
+// newPassthroughWatcherFromFlags builds the watcher from the environment
+func newPassthroughWatcherFromFlags() (*PassthroughWatcher, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME must be set to watch the %s annotation", annPassthrough)
+	}
+	return &PassthroughWatcher{nodeName: nodeName, changes: make(chan []string)}, nil
+}
+
+// run polls the annotation until stop is closed, sending the sorted addresses when they change
+func (w *PassthroughWatcher) run(stop chan struct{}) {
+	var current []string
+	first := true
+	for {
+		addresses, ok, err := w.read()
+		if err != nil {
+			log.Printf("Error: failed to read the %s annotation: %v", annPassthrough, err)
+		} else if ok && (first || !reflect.DeepEqual(addresses, current)) {
+			select {
+			case w.changes <- addresses:
+				current = addresses
+				first = false
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(passthroughResync):
+		}
+	}
+}
+
+// read returns the addresses of the annotation, and false if the node is not annotated so
+// that GPUs bound to vfio-pci by other means are left alone
+func (w *PassthroughWatcher) read() ([]string, bool, error) {
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	node, err := client.CoreV1().Nodes().Get(ctx, w.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := node.Annotations[annPassthrough]
+	if !ok {
+		return nil, false, nil
+	}
+	addresses := []string{}
+	for _, a := range strings.Split(value, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addresses = append(addresses, strings.ToLower(a))
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, true, nil
+}
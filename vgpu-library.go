@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vgpuProtocolVersion is the version of the contract between the plugin and libvgpu.so: the
+// CUDA_DEVICE_* environment variables and the files mounted into the containers
+const vgpuProtocolVersion = 1
+
+// vgpuLibraryPath is the host path of the library preloaded into the containers, a variable for
+// the tests
+var vgpuLibraryPath = "/usr/local/vgpu/libvgpu.so"
+
+// stageCheckLibrary is the allocation stage checking that libvgpu.so speaks the protocol of the plugin
+const stageCheckLibrary = "check-library"
+
+// vgpuProtocolSymbol matches the symbols libvgpu.so exports for each protocol version it supports
+var vgpuProtocolSymbol = regexp.MustCompile(`^vgpu_protocol_v([0-9]+)$`)
+
+// vgpuProtocolString is the marker libvgpu.so may embed instead, e.g. "VGPU_PROTOCOL_VERSIONS=1,2"
+var vgpuProtocolString = []byte("VGPU_PROTOCOL_VERSIONS=")
+
+// vgpuLibraryCheck caches the outcome of the last check of libvgpu.so until the file changes
+var vgpuLibraryCheck struct {
+	sync.Mutex
+	modTime time.Time
+	size    int64
+	err     error
+}
+
+// vgpuLibraryMachines are the ELF machines of the libvgpu.so builds for each architecture of
+// the plugin, the library installed on the node must be the one of the node
+var vgpuLibraryMachines = map[string]elf.Machine{
+	"amd64": elf.EM_X86_64,
+	"arm64": elf.EM_AARCH64,
+}
+
+func init() {
+	registerAllocateStage(stageCheckLibrary, stageComputeLimits, checkLibraryStage)
+}
+
+// vgpuLibraryVersions returns the protocol versions declared by the library, or nil if it
+// predates the handshake
+func vgpuLibraryVersions(path string) ([]int, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if machine, ok := vgpuLibraryMachines[runtime.GOARCH]; ok && f.Machine != machine {
+		return nil, fmt.Errorf("built for %v, not for the %s node", f.Machine, runtime.GOARCH)
+	}
+
+	var versions []int
+	symbols, _ := f.DynamicSymbols()
+	for _, s := range symbols {
+		if m := vgpuProtocolSymbol.FindStringSubmatch(s.Name); m != nil {
+			v, _ := strconv.Atoi(m[1])
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) > 0 {
+		return versions, nil
+	}
+
+	if section := f.Section(".rodata"); section != nil {
+		data, err := section.Data()
+		if err == nil {
+			if i := bytes.Index(data, vgpuProtocolString); i >= 0 {
+				rest := data[i+len(vgpuProtocolString):]
+				if end := bytes.IndexByte(rest, 0); end >= 0 {
+					rest = rest[:end]
+				}
+				for _, field := range strings.Split(string(rest), ",") {
+					if v, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+						versions = append(versions, v)
+					}
+				}
+			}
+		}
+	}
+	return versions, nil
+}
+
+// checkVGPULibrary returns an error if libvgpu.so is missing, unreadable or does not support
+// vgpuProtocolVersion. A library declaring no version is assumed to support version 1.
+func checkVGPULibrary() error {
+	info, err := os.Stat(vgpuLibraryPath)
+	if err != nil {
+		return fmt.Errorf("%s is missing, containers would fail to preload it: %v", vgpuLibraryPath, err)
+	}
+
+	vgpuLibraryCheck.Lock()
+	defer vgpuLibraryCheck.Unlock()
+	if info.ModTime().Equal(vgpuLibraryCheck.modTime) && info.Size() == vgpuLibraryCheck.size {
+		return vgpuLibraryCheck.err
+	}
+	vgpuLibraryCheck.modTime = info.ModTime()
+	vgpuLibraryCheck.size = info.Size()
+
+	versions, err := vgpuLibraryVersions(vgpuLibraryPath)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%s is not a valid shared library, containers would fail to preload it: %v", vgpuLibraryPath, err)
+	case len(versions) == 0 && vgpuProtocolVersion > 1:
+		err = fmt.Errorf("%s predates protocol version %d required by this plugin, upgrade the library", vgpuLibraryPath, vgpuProtocolVersion)
+	case len(versions) > 0 && !containsInt(versions, vgpuProtocolVersion):
+		err = fmt.Errorf("%s supports protocol versions %v but this plugin requires version %d, upgrade the library or the plugin", vgpuLibraryPath, versions, vgpuProtocolVersion)
+	}
+	vgpuLibraryCheck.err = err
+	if err == nil && verboseFlag > 0 {
+		log.Printf("%s supports protocol versions %v", vgpuLibraryPath, versions)
+	}
+	return err
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLibraryStage fails the allocation if libvgpu.so cannot serve the container and tells the
+// library the protocol version the environment was built for
+func checkLibraryStage(a *containerAllocation) error {
+	if podUsesVMRuntime(&a.pod) || podUsesGVisor(&a.pod) {
+		return nil
+	}
+	if err := checkVGPULibrary(); err != nil {
+		return fmt.Errorf("cannot allocate vGPUs to pod %s: %v", a.pod.Name, err)
+	}
+	a.response.Envs["VGPU_PROTOCOL_VERSION"] = strconv.Itoa(vgpuProtocolVersion)
+	return nil
+}
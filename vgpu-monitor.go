@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"github.com/google/uuid"
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	monitorapi "github.com/NVIDIA/k8s-device-plugin/api/monitor/v1alpha1"
+)
+
+// defaultMonitorSocket is where the monitor serves the plugin by default
+const defaultMonitorSocket = "/var/lib/vgpu/monitor.sock"
+
+// monitorCacheDirGracePeriod keeps the directories created recently, whose allocation the
+// kubelet may not have checkpointed yet
+const monitorCacheDirGracePeriod = 2 * time.Minute
+
+// VGPUMonitor owns the shared cache directories of the containers: it creates them for the
+// plugin, finds their pods from the kubelet checkpoint, removes them once their pods are gone
+// and exports the GPU memory used by the pods
+type VGPUMonitor struct {
+	mux       sync.Mutex
+	nodeName  string
+	podLister listerscorev1.PodLister
+	// owners maps the shared cache directories in use to the "namespace/name" of their pod
+	owners  map[string]string
+	usage   []podUsageSample
+	removed uint64
+	// scrapeUsage is false when NVML is unavailable
+	scrapeUsage bool
+}
+
+// CreateCacheDir creates a shared cache directory for a container being allocated
+func (m *VGPUMonitor) CreateCacheDir(ctx context.Context, req *monitorapi.CreateCacheDirRequest) (*monitorapi.CreateCacheDirResponse, error) {
+	dir := filepath.Join(sharedCacheDir(req.NUMANode), uuid.NewString())
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &monitorapi.CreateCacheDirResponse{HostPath: dir}, nil
+}
+
+// cacheDirRoots returns the directories holding the shared cache directories
+func cacheDirRoots() []string {
+	roots := []string{sharedCacheRoot}
+	if numaSharedCacheDirFlag != "" {
+		numaRoots, _ := filepath.Glob(strings.Replace(numaSharedCacheDirFlag, "%d", "*", 1))
+		roots = append(roots, numaRoots...)
+	}
+	return roots
+}
+
+// sync finds the pods of the shared cache and device config directories from the mounts of the
+// allocations in the kubelet checkpoint, removes the directories of the pods that are gone and
+// samples usage
+func (m *VGPUMonitor) sync() error {
+	cp, err := readKubeletCheckpoint()
+	if err != nil {
+		return err
+	}
+	pods, err := m.podLister.Pods("").List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	live := make(map[string]*v1.Pod)
+	for _, p := range pods {
+		if p.Status.Phase != v1.PodSucceeded && p.Status.Phase != v1.PodFailed {
+			live[string(p.UID)] = p
+		}
+	}
+	owners := make(map[string]string)
+	podDevices, _ := cp.GetData()
+	for _, pde := range podDevices {
+		pod, ok := live[pde.PodUID]
+		if !ok {
+			continue
+		}
+		allocResp := &pluginapi.ContainerAllocateResponse{}
+		if err := allocResp.Unmarshal(pde.AllocResp); err != nil {
+			continue
+		}
+		for _, mount := range allocResp.Mounts {
+			owners[filepath.Clean(mount.HostPath)] = pod.Namespace + "/" + pod.Name
+		}
+	}
+
+	var removed uint64
+	for _, root := range append(cacheDirRoots(), deviceConfigRoot) {
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			dir := filepath.Join(root, e.Name())
+			if !e.IsDir() || owners[dir] != "" || time.Since(e.ModTime()) < monitorCacheDirGracePeriod {
+				continue
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("Warning: failed to remove the directory %s: %v", dir, err)
+				continue
+			}
+			if verboseFlag > 5 {
+				log.Printf("Debug: removed the directory %s of a deleted pod", dir)
+			}
+			removed++
+		}
+	}
+
+	var usage []podUsageSample
+	if m.scrapeUsage {
+		if s, err := sampleUsage(); err == nil {
+			usage = s.Pods
+		} else {
+			log.Printf("Warning: failed to sample the GPU usage of the pods: %v", err)
+		}
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.owners = owners
+	m.usage = usage
+	m.removed += removed
+	return nil
+}
+
+// run syncs every interval until stop is closed
+func (m *VGPUMonitor) run(interval time.Duration, stop <-chan struct{}) {
+	for {
+		if err := m.sync(); err != nil {
+			log.Printf("Warning: failed to sync the shared cache directories: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (m *VGPUMonitor) writeMetrics(w io.Writer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	fmt.Fprintln(w, "# HELP vgpu_monitor_cache_dirs Shared cache directories of running pods.")
+	fmt.Fprintln(w, "# TYPE vgpu_monitor_cache_dirs gauge")
+	fmt.Fprintf(w, "vgpu_monitor_cache_dirs %d\n", len(m.owners))
+	fmt.Fprintln(w, "# HELP vgpu_monitor_cache_dirs_removed_total Shared cache directories removed after their pod was deleted.")
+	fmt.Fprintln(w, "# TYPE vgpu_monitor_cache_dirs_removed_total counter")
+	fmt.Fprintf(w, "vgpu_monitor_cache_dirs_removed_total %d\n", m.removed)
+	fmt.Fprintln(w, "# HELP vgpu_pod_memory_used Memory of the GPU in MiB used by the processes of the pod.")
+	fmt.Fprintln(w, "# TYPE vgpu_pod_memory_used gauge")
+	for _, u := range m.usage {
+		fmt.Fprintf(w, "vgpu_pod_memory_used{pod=%q,uuid=%q} %d\n", u.Pod, u.GPU, u.MemoryUsed)
+	}
+}
+
+// watchPods starts the informer of the pods of the node
+func (m *VGPUMonitor) watchPods(stop <-chan struct{}) error {
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	selector := fields.SelectorFromSet(fields.Set{"spec.nodeName": m.nodeName})
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(
+		client,
+		time.Hour*1,
+		informers.WithTweakListOptions(
+			func(options *metav1.ListOptions) {
+				options.FieldSelector = selector.String()
+			},
+		),
+	)
+	m.podLister = informerFactory.Core().V1().Pods().Lister()
+	informerFactory.Start(stop)
+	informerFactory.WaitForCacheSync(stop)
+	return nil
+}
+
+// runMonitor runs the vgpu-monitor until it is killed
+func runMonitor(c *cli.Context) error {
+	resolveDevicePluginDir()
+	m := &VGPUMonitor{nodeName: os.Getenv("NODE_NAME")}
+	if m.nodeName == "" {
+		return fmt.Errorf("NODE_NAME must be set")
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := m.watchPods(stop); err != nil {
+		return fmt.Errorf("failed to watch the pods: %v", err)
+	}
+	if err := nvml.Init(); err != nil {
+		log.Printf("Warning: failed to initialize NVML, the pod usage is not exported: %v", err)
+	} else {
+		m.scrapeUsage = true
+		defer nvml.Shutdown()
+	}
+
+	socket := c.String("socket")
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sock, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	monitorapi.RegisterMonitorServer(server, m)
+	go server.Serve(sock)
+	defer server.Stop()
+	log.Printf("Serving the vgpu-monitor on %s", socket)
+
+	if address := c.String("metrics-address"); address != "" {
+		registerMetrics(m.writeMetrics)
+		startHTTPServer(address)
+	}
+	go m.run(c.Duration("interval"), stop)
+
+	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	s := <-sigs
+	log.Printf("Received signal \"%v\", shutting down.", s)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// VGPUConfig custom resource, see deployments/crd/vgpuconfigs.yml
+const vgpuConfigPath = "/apis/" + vgpuNodeGroupVersion + "/vgpuconfigs"
+
+// vgpuConfigResync is the interval at which the VGPUConfigs are polled
+const vgpuConfigResync = 30 * time.Second
+
+// vgpuConfigList is a list of VGPUConfig objects
+type vgpuConfigList struct {
+	Items []vgpuConfig `json:"items"`
+}
+
+// vgpuConfig is a cluster-scoped set of plugin options for the nodes matching its selector
+type vgpuConfig struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              vgpuConfigSpec `json:"spec"`
+}
+
+// vgpuConfigSpec holds the options overriding the command line; unset fields are left unchanged
+type vgpuConfigSpec struct {
+	NodeSelector        map[string]string `json:"nodeSelector,omitempty"`
+	DeviceSplitCount    *uint             `json:"deviceSplitCount,omitempty"`
+	DeviceMemoryScaling *float64          `json:"deviceMemoryScaling,omitempty"`
+	DeviceCoresScaling  *float64          `json:"deviceCoresScaling,omitempty"`
+	// ExcludeDevices lists the UUIDs or indexes of GPUs the plugin does not advertise
+	ExcludeDevices []string `json:"excludeDevices,omitempty"`
+}
+
+// pluginConfig is the effective value of the options a VGPUConfig can override
+type pluginConfig struct {
+	deviceSplitCount    uint
+	deviceMemoryScaling float64
+	deviceCoresScaling  float64
+	excludeDevices      map[string]bool
+}
+
+// excludedDevices holds the UUIDs and indexes of the GPUs excluded by the VGPUConfigs
+var excludedDevices map[string]bool
+
+// isExcludedDevice returns true if the GPU with the given UUID or index must not be advertised
+func isExcludedDevice(uuid string, index uint) bool {
+	return excludedDevices[uuid] || excludedDevices[strconv.Itoa(int(index))]
+}
+
+// currentPluginConfig returns the options the plugins currently run with
+func currentPluginConfig() *pluginConfig {
+	return &pluginConfig{
+		deviceSplitCount:    deviceSplitCountFlag,
+		deviceMemoryScaling: deviceMemoryScalingFlag,
+		deviceCoresScaling:  deviceCoresScalingFlag,
+		excludeDevices:      excludedDevices,
+	}
+}
+
+// apply sets the options; the plugins must be restarted for them to take effect
+func (c *pluginConfig) apply() {
+	deviceSplitCountFlag = c.deviceSplitCount
+	deviceMemoryScalingFlag = c.deviceMemoryScaling
+	deviceCoresScalingFlag = c.deviceCoresScaling
+	excludedDevices = c.excludeDevices
+}
+
+// merge overrides the options set in spec, ignoring the spec if it is invalid
+func (c *pluginConfig) merge(name string, spec *vgpuConfigSpec) {
+	if spec.DeviceSplitCount != nil && *spec.DeviceSplitCount < 1 ||
+		spec.DeviceMemoryScaling != nil && *spec.DeviceMemoryScaling <= 0 ||
+		spec.DeviceCoresScaling != nil && *spec.DeviceCoresScaling <= 0 {
+		log.Printf("Error: ignoring VGPUConfig %s with invalid options", name)
+		return
+	}
+	if spec.DeviceSplitCount != nil {
+		c.deviceSplitCount = *spec.DeviceSplitCount
+	}
+	if spec.DeviceMemoryScaling != nil {
+		c.deviceMemoryScaling = *spec.DeviceMemoryScaling
+	}
+	if spec.DeviceCoresScaling != nil {
+		c.deviceCoresScaling = *spec.DeviceCoresScaling
+	}
+	if spec.ExcludeDevices != nil {
+		c.excludeDevices = make(map[string]bool)
+		for _, d := range spec.ExcludeDevices {
+			c.excludeDevices[d] = true
+		}
+	}
+}
+
+// VGPUConfigWatcher polls the VGPUConfigs matching the node and reports changes of the effective options
+type VGPUConfigWatcher struct {
+	nodeName string
+	base     *pluginConfig
+	changes  chan *pluginConfig
+}
+
+// NewVGPUConfigWatcher returns a reference to a new VGPUConfigWatcher, using the
+// current options as the base the VGPUConfigs are applied on
+func NewVGPUConfigWatcher(nodeName string) *VGPUConfigWatcher {
+	return &VGPUConfigWatcher{
+		nodeName: nodeName,
+		base:     currentPluginConfig(),
+		changes:  make(chan *pluginConfig),
+	}
+}
+
+// newVGPUConfigWatcherFromFlags builds the watcher from the environment
+func newVGPUConfigWatcherFromFlags() (*VGPUConfigWatcher, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME must be set to watch VGPUConfigs")
+	}
+	return NewVGPUConfigWatcher(nodeName), nil
+}
+
+// run polls the VGPUConfigs until stop is closed, sending the effective options on changes
+func (w *VGPUConfigWatcher) run(stop chan struct{}) {
+	current := w.base
+	for {
+		config, err := w.resolve()
+		if err != nil {
+			log.Printf("Error: failed to read VGPUConfigs: %v", err)
+		} else if !reflect.DeepEqual(config, current) {
+			select {
+			case w.changes <- config:
+				current = config
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(vgpuConfigResync):
+		}
+	}
+}
+
+// resolve returns the base options overridden by the VGPUConfigs matching the node, in name order
+func (w *VGPUConfigWatcher) resolve() (*pluginConfig, error) {
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	node, err := client.CoreV1().Nodes().Get(ctx, w.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := client.Discovery().RESTClient().Get().AbsPath(vgpuConfigPath).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := &vgpuConfigList{}
+	if err := json.Unmarshal(raw, list); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	config := *w.base
+	for i := range list.Items {
+		c := &list.Items[i]
+		if !labels.SelectorFromSet(c.Spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		config.merge(c.Name, &c.Spec)
+	}
+	return &config, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VGPUNode custom resource, see deployments/crd/vgpunodes.yml
+const (
+	vgpuNodeGroupVersion = "vgpu.4paradigm.com/v1alpha1"
+	vgpuNodeKind         = "VGPUNode"
+	vgpuNodePath         = "/apis/" + vgpuNodeGroupVersion + "/vgpunodes"
+)
+
+// vgpuNodeResync is the interval at which the VGPUNode is refreshed without events
+const vgpuNodeResync = time.Minute
+
+// vgpuNodeDebounce delays syncs so that bursts of events result in a single update
+const vgpuNodeDebounce = 2 * time.Second
+
+// vgpuNodeReporter is non-nil when --vgpu-node-crd is set
+var vgpuNodeReporter *VGPUNodeReporter
+
+// vgpuNode is the VGPUNode object of a node, named after it
+type vgpuNode struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Status            vgpuNodeStatus `json:"status"`
+}
+
+type vgpuNodeStatus struct {
+	Limits     vgpuNodeLimits `json:"limits"`
+	GPUs       int            `json:"gpus"`
+	VDevices   int            `json:"vdevices"`
+	Allocated  int            `json:"allocated"`
+	Healthy    int            `json:"healthy"`
+	Devices    []deviceStatus `json:"devices"`
+	UpdateTime metav1.Time    `json:"updateTime"`
+}
+
+// vgpuNodeLimits are the splitting options the plugin runs with
+type vgpuNodeLimits struct {
+	SplitCount    uint    `json:"splitCount"`
+	MemoryScaling float64 `json:"memoryScaling"`
+	CoresScaling  float64 `json:"coresScaling"`
+}
+
+// VGPUNodeReporter keeps the VGPUNode of the node up to date with the device inventory
+type VGPUNodeReporter struct {
+	nodeName string
+	trigger  chan struct{}
+}
+
+// NewVGPUNodeReporter returns a reference to a new VGPUNodeReporter
+func NewVGPUNodeReporter(nodeName string) *VGPUNodeReporter {
+	return &VGPUNodeReporter{
+		nodeName: nodeName,
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// newVGPUNodeReporterFromFlags builds the reporter from the environment
+func newVGPUNodeReporterFromFlags() (*VGPUNodeReporter, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME must be set to report the VGPUNode")
+	}
+	return NewVGPUNodeReporter(nodeName), nil
+}
+
+// notify schedules a sync of the VGPUNode without blocking
+func (r *VGPUNodeReporter) notify() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run syncs the VGPUNode on notifications and periodically until stop is closed
+func (r *VGPUNodeReporter) run(stop chan struct{}) {
+	ticker := time.NewTicker(vgpuNodeResync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+			time.Sleep(vgpuNodeDebounce)
+		}
+		if err := r.sync(); err != nil {
+			log.Printf("Error: failed to update VGPUNode %s: %v", r.nodeName, err)
+		}
+	}
+}
+
+// sync creates or replaces the VGPUNode of the node with the current device status
+func (r *VGPUNodeReporter) sync() error {
+	status := collectNodeStatus()
+	obj := &vgpuNode{
+		TypeMeta:   metav1.TypeMeta{APIVersion: vgpuNodeGroupVersion, Kind: vgpuNodeKind},
+		ObjectMeta: metav1.ObjectMeta{Name: r.nodeName},
+		Status: vgpuNodeStatus{
+			Limits: vgpuNodeLimits{
+				SplitCount:    deviceSplitCountFlag,
+				MemoryScaling: deviceMemoryScalingFlag,
+				CoresScaling:  deviceCoresScalingFlag,
+			},
+			GPUs:       len(status.Devices),
+			Devices:    status.Devices,
+			UpdateTime: metav1.Now(),
+		},
+	}
+	for _, d := range status.Devices {
+		obj.Status.VDevices += len(d.VDevices)
+		for _, vd := range d.VDevices {
+			if vd.PodUID != "" {
+				obj.Status.Allocated++
+			}
+			if vd.Health == "Healthy" {
+				obj.Status.Healthy++
+			}
+		}
+	}
+
+	client, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := kubeContext(context.Background())
+	defer cancel()
+	rc := client.Discovery().RESTClient()
+	raw, err := rc.Get().AbsPath(vgpuNodePath, r.nodeName).DoRaw(ctx)
+	if apierrors.IsNotFound(err) {
+		body, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		return rc.Post().AbsPath(vgpuNodePath).Body(body).Do(ctx).Error()
+	}
+	if err != nil {
+		return err
+	}
+	current := &vgpuNode{}
+	if err := json.Unmarshal(raw, current); err != nil {
+		return err
+	}
+	obj.ResourceVersion = current.ResourceVersion
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return rc.Put().AbsPath(vgpuNodePath, r.nodeName).Body(body).Do(ctx).Error()
+}
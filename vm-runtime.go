@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// vmRuntimeClasses is the parsed --vm-runtime-classes
+var vmRuntimeClasses []string
+
+// parseRuntimeClasses parses a comma separated list of RuntimeClass names
+func parseRuntimeClasses(s string) []string {
+	var classes []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			classes = append(classes, c)
+		}
+	}
+	return classes
+}
+
+// podUsesVMRuntime returns true if the pod runs in a VM, such as with Kata Containers, where
+// the host libraries and the files shared with the plugin are out of reach
+func podUsesVMRuntime(pod *v1.Pod) bool {
+	if len(vmRuntimeClasses) == 0 || pod.Spec.RuntimeClassName == nil {
+		return false
+	}
+	return containsString(vmRuntimeClasses, *pod.Spec.RuntimeClassName)
+}
+
+// injectVMStage passes the devices of the allocated GPUs through to the VM of the pod, without
+// libvgpu: its mounts and environment are meaningless inside the guest, where memory and cores
+// cannot be limited
+func injectVMStage(a *containerAllocation) error {
+	m := a.plugin
+	response := a.response
+	if maxSplit(a.vdevices) > 1 {
+		log.Printf("Warning: pod %s runs in a VM with runtime class %s, it gets the whole GPUs %v without vGPU limits", a.pod.Name, *a.pod.Spec.RuntimeClassName, a.uuids)
+	}
+	response.Envs = m.apiEnvs(m.deviceListEnvvar, m.deviceIDsFromUUIDs(a.uuids))
+	response.Mounts = nil
+	response.Devices = m.apiDeviceSpecs(nvidiaDriverRootFlag, a.uuids)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// annProfile selects a workload profile of --workload-profiles for the vGPUs of a pod
+const annProfile = "4paradigm.com/vgpu-profile"
+
+// stageProfile is the allocation stage applying the workload profile of the pod
+const stageProfile = "profile"
+
+// workloadProfile bundles the limits and driver capabilities of a kind of workload, e.g.
+//
+//	{"name": "inference-small", "memory": "4Gi", "cores": 25}
+//	{"name": "training-half", "memory": "50%", "cores": 50}
+//	{"name": "transcode", "memory": "2Gi", "cores": 20, "driverCapabilities": "video,compute,utility"}
+//
+// Memory is a memory size or a percentage of the GPU, like --default-device-memory.
+type workloadProfile struct {
+	Name               string `json:"name"`
+	Memory             string `json:"memory"`
+	Cores              int    `json:"cores"`
+	DriverCapabilities string `json:"driverCapabilities"`
+
+	memory defaultDeviceMemory
+}
+
+// workloadProfiles is non-nil when --workload-profiles is set
+var workloadProfiles map[string]*workloadProfile
+
+func init() {
+	registerAllocateStage(stageProfile, stageIdentifyPod, profileStage)
+}
+
+// loadWorkloadProfiles reads and checks the profiles of a file
+func loadWorkloadProfiles(path string) (map[string]*workloadProfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*workloadProfile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]*workloadProfile)
+	for _, p := range list {
+		if p.Name == "" {
+			return nil, fmt.Errorf("profile without a name")
+		}
+		if _, ok := profiles[p.Name]; ok {
+			return nil, fmt.Errorf("profile %q defined twice", p.Name)
+		}
+		if p.Memory != "" {
+			if p.memory, err = parseDefaultDeviceMemory(p.Memory); err != nil {
+				return nil, fmt.Errorf("invalid memory of profile %q: %v", p.Name, err)
+			}
+		}
+		if p.Cores < 0 || p.Cores > 100 {
+			return nil, fmt.Errorf("invalid cores of profile %q: %d", p.Name, p.Cores)
+		}
+		profiles[p.Name] = p
+	}
+	return profiles, nil
+}
+
+// annotations returns the limit annotations the profile stands for
+func (p *workloadProfile) annotations() map[string]string {
+	annotations := make(map[string]string)
+	if p.memory.mib > 0 {
+		annotations[annMemoryLimit] = strconv.FormatUint(p.memory.mib, 10)
+	}
+	if p.memory.percent > 0 {
+		annotations[annMemoryPercentage] = strconv.FormatUint(p.memory.percent, 10)
+	}
+	if p.Cores > 0 {
+		annotations[annCoresLimit] = strconv.Itoa(p.Cores)
+	}
+	return annotations
+}
+
+// profileStage applies the profile selected by annProfile: its limits stand for the limit
+// annotations the pod does not set itself, and its driver capabilities are passed to the
+// container toolkit
+func profileStage(a *containerAllocation) error {
+	name, ok := a.pod.Annotations[annProfile]
+	if workloadProfiles == nil || !podAnnotationsFlag || len(a.pod.UID) == 0 || !ok {
+		return nil
+	}
+	p, ok := workloadProfiles[strings.TrimSpace(name)]
+	if !ok {
+		return fmt.Errorf("invalid %s annotation on pod %s: no profile %q", annProfile, a.pod.Name, name)
+	}
+	if a.first() {
+		// An explicit memory limit or percentage of the pod replaces both of the profile
+		_, hasMemory := a.pod.Annotations[annMemoryLimit]
+		_, hasPercentage := a.pod.Annotations[annMemoryPercentage]
+		annotations := make(map[string]string, len(a.pod.Annotations))
+		for k, v := range p.annotations() {
+			if (k == annMemoryLimit || k == annMemoryPercentage) && (hasMemory || hasPercentage) {
+				continue
+			}
+			annotations[k] = v
+		}
+		for k, v := range a.pod.Annotations {
+			annotations[k] = v
+		}
+		a.pod.Annotations = annotations
+	}
+	if p.DriverCapabilities != "" {
+		a.response.Envs["NVIDIA_DRIVER_CAPABILITIES"] = p.DriverCapabilities
+	}
+	return nil
+}